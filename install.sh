@@ -13,7 +13,7 @@ fi
 
 DEST="${HOME}/.please"
 mkdir -p ${DEST}
-rm -f ${DEST}/please ${DEST}/please_pex ${DEST}/junit_runner.jar ${DEST}/jarcat ${DEST}/please_maven ${DEST}/cache_cleaner ${DEST}/*.so
+rm -f ${DEST}/please ${DEST}/please_pex ${DEST}/junit_runner.jar ${DEST}/jarcat ${DEST}/javac_worker ${DEST}/please_maven ${DEST}/cache_cleaner ${DEST}/*.so
 cp -f plz-out/bin/src/please ${DEST}/please
 chmod 0775 ${DEST}/please
 ln -sf ${DEST}/please ${DEST}/plz
@@ -25,6 +25,8 @@ cp -f plz-out/bin/src/build/java/junit_runner.jar ${DEST}/junit_runner.jar
 chmod 0664 ${DEST}/junit_runner.jar
 cp -f plz-out/bin/src/build/java/jarcat ${DEST}/jarcat
 chmod 0775 ${DEST}/jarcat
+cp -f plz-out/bin/src/build/java/javac_worker.jar ${DEST}/javac_worker
+chmod 0775 ${DEST}/javac_worker
 cp -f plz-out/bin/src/build/java/please_maven ${DEST}/please_maven
 chmod 0775 ${DEST}/please_maven
 cp -f plz-out/bin/src/cache/main/cache_cleaner ${DEST}/cache_cleaner
@@ -3,7 +3,6 @@ package build
 
 import (
 	"bytes"
-	"crypto/sha1"
 	"encoding/hex"
 	"fmt"
 	"os"
@@ -50,6 +49,13 @@ func Build(tid int, state *core.BuildState, label core.BuildLabel) {
 		return
 	}
 	metrics.Record(target, time.Since(start))
+	if state.CheckDeterminism && state.IsOriginalTarget(label) && !target.IsFilegroup() && target.SharedWith() == nil {
+		if err := checkDeterminism(tid, state, target); err != nil {
+			state.LogBuildError(tid, label, core.TargetBuildFailed, err, "Nondeterministic build")
+			target.SetState(core.Failed)
+			return
+		}
+	}
 
 	// Add any of the reverse deps that are now fully built to the queue.
 	for _, reverseDep := range state.Graph.ReverseDependencies(target) {
@@ -83,6 +89,19 @@ func buildTarget(tid int, state *core.BuildState, target *core.BuildTarget) (err
 	if err := target.CheckDuplicateOutputs(); err != nil {
 		return err
 	}
+	// Stamped targets' hashes depend on the workspace status, so check it's available before calculating them.
+	if target.Stamp {
+		if _, err := state.WorkspaceStatus(); err != nil {
+			return err
+		}
+	}
+	// Targets in other configurations don't need building if they'd be the same as the primary one.
+	if state.Graph.ShareOutputs(target) {
+		log.Debug("%s is the same as %s, sharing its outputs", target.Label, target.SharedWith().Label)
+		target.SetState(core.Reused)
+		state.LogBuildResult(tid, target.Label, core.TargetCached, "Same as "+state.Config.Build.Config)
+		return nil
+	}
 	// This must run before we can leave this function successfully by any path.
 	if target.PreBuildFunction != 0 {
 		log.Debug("Running pre-build function for %s", target.Label)
@@ -100,7 +119,8 @@ func buildTarget(tid int, state *core.BuildState, target *core.BuildTarget) (err
 		if err := prepareDirectories(target); err != nil {
 			return err
 		}
-		if err := prepareSources(state.Graph, target); err != nil {
+		action := core.NewBuildAction(state, target, replaceSequences(target), core.BuildEnvironment(state, target, false))
+		if err := prepareSources(action); err != nil {
 			return err
 		}
 		return stopTarget
@@ -165,15 +185,27 @@ func buildTarget(tid int, state *core.BuildState, target *core.BuildTarget) (err
 			return nil
 		}
 	}
-	if err := prepareSources(state.Graph, target); err != nil {
+	worker, workerArgs, replacedCmd := workerCommandAndArgs(target)
+	env, err := core.StampedBuildEnvironment(state, target, false, cacheKey)
+	if err != nil {
+		return err
+	}
+	action := core.NewBuildAction(state, target, replacedCmd, env)
+	if err := prepareSources(action); err != nil {
 		return fmt.Errorf("Error preparing sources for %s: %s", target.Label, err)
 	}
 
 	state.LogBuildResult(tid, target.Label, core.TargetBuilding, target.BuildingDescription)
-	replacedCmd := replaceSequences(target)
-	env := core.StampedBuildEnvironment(state, target, false, cacheKey)
 	log.Debug("Building target %s\nENVIRONMENT:\n%s\n%s", target.Label, strings.Join(env, "\n"), replacedCmd)
-	out, combined, err := core.ExecWithTimeoutShell(target.TmpDir(), env, target.BuildTimeout, state.Config.Build.Timeout, state.ShowAllOutput, replacedCmd)
+	logCommand := replacedCmd
+	if worker != "" {
+		// Part of the command goes to the worker rather than the shell, so record it as it was written.
+		logCommand = target.GetCommand()
+	}
+	actionLog := core.NewActionLog(target.Label, "build", logCommand, action.Dir, env)
+	start := time.Now()
+	out, combined, err := runBuildAction(state, action, worker, workerArgs)
+	actionLog.Finish(state, combined, err)
 	if err != nil {
 		if state.Verbosity >= 4 {
 			return fmt.Errorf("Error building target %s: %s\nENVIRONMENT:\n%s\n%s\n%s",
@@ -181,6 +213,7 @@ func buildTarget(tid int, state *core.BuildState, target *core.BuildTarget) (err
 		}
 		return fmt.Errorf("Error building target %s: %s\n%s", target.Label, err, combined)
 	}
+	core.Timings.RecordBuild(target.Label, time.Since(start))
 	if target.PostBuildFunction != 0 {
 		out = bytes.TrimSpace(out)
 		sout := string(out)
@@ -208,7 +241,8 @@ func buildTarget(tid int, state *core.BuildState, target *core.BuildTarget) (err
 	if err != nil {
 		return fmt.Errorf("Error moving outputs for target %s: %s", target.Label, err)
 	}
-	if _, err = calculateAndCheckRuleHash(state, target); err != nil {
+	outputHash, err := calculateAndCheckRuleHash(state, target)
+	if err != nil {
 		return err
 	}
 	if outputsChanged {
@@ -228,6 +262,12 @@ func buildTarget(tid int, state *core.BuildState, target *core.BuildTarget) (err
 		for _, out := range extraOuts {
 			(*state.Cache).StoreExtra(target, newCacheKey, out)
 		}
+		// Stored so 'plz cache verify' can check the artifacts haven't been corrupted since.
+		if err := storeOutputHash(target, outputHash); err != nil {
+			log.Warning("Failed to write output hash for %s: %s", target.Label, err)
+		} else {
+			(*state.Cache).StoreExtra(target, newCacheKey, core.OutputHashFileName(target))
+		}
 	}
 	// Clean up the temporary directory once it's done.
 	if state.CleanWorkdirs {
@@ -276,8 +316,8 @@ func prepareDirectory(directory string, remove bool) error {
 }
 
 // Symlinks the source files of this rule into its temp directory.
-func prepareSources(graph *core.BuildGraph, target *core.BuildTarget) error {
-	for source := range core.IterSources(graph, target) {
+func prepareSources(action *core.BuildAction) error {
+	for _, source := range action.Sources {
 		if err := core.PrepareSourcePair(source); err != nil {
 			return err
 		}
@@ -393,6 +433,9 @@ func RemoveOutputs(target *core.BuildTarget) error {
 	if err := os.Remove(ruleHashFileName(target)); err != nil && !os.IsNotExist(err) {
 		return err
 	}
+	if err := os.Remove(hashComponentsFileName(target)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
 	for _, output := range target.Outputs() {
 		if err := os.RemoveAll(path.Join(target.OutDir(), output)); err != nil {
 			return err
@@ -424,7 +467,7 @@ func calculateAndCheckRuleHash(state *core.BuildState, target *core.BuildTarget)
 
 // OutputHash calculates the hash of a target's outputs.
 func OutputHash(target *core.BuildTarget) ([]byte, error) {
-	h := sha1.New()
+	h := core.NewHash()
 	for _, output := range target.Outputs() {
 		// NB. Always force a recalculation of the output hashes here. Memoisation is not
 		//     useful because by definition we are rebuilding a target, and can actively hurt
@@ -444,6 +487,7 @@ func checkRuleHashes(target *core.BuildTarget, hash []byte) error {
 		return nil // nothing to check
 	}
 	hashStr := hex.EncodeToString(hash)
+	sameLength := false
 	for _, okHash := range target.Hashes {
 		// Hashes can have an arbitrary label prefix. Strip it off if present.
 		if index := strings.LastIndexByte(okHash, ':'); index != -1 {
@@ -452,8 +496,13 @@ func checkRuleHashes(target *core.BuildTarget, hash []byte) error {
 		if okHash == hashStr {
 			return nil
 		}
+		sameLength = sameLength || len(okHash) == len(hashStr)
 	}
-	if len(target.Hashes) == 1 {
+	if !sameLength {
+		// Most likely the hashes were calculated with a different hash function.
+		return fmt.Errorf("Bad output hash for rule %s: was %s (%s) but expected %s; hashes must be given using the configured hashfunction",
+			target.Label, hashStr, core.HashFunctionName(), strings.Join(target.Hashes, ", "))
+	} else if len(target.Hashes) == 1 {
 		return fmt.Errorf("Bad output hash for rule %s: was %s but expected %s",
 			target.Label, hashStr, target.Hashes[0])
 	}
@@ -73,6 +73,102 @@ func TestModifiedBuildTargetStillNeedsRebuilding(t *testing.T) {
 	assert.Equal(t, core.Built, target.State())
 }
 
+func TestExplainRuleChange(t *testing.T) {
+	state, target := newState("//package1:target11")
+	target.AddOutput("file11")
+	state.Explain = true
+	assert.NoError(t, writeRuleHashFile(state, target))
+	target.Command = "echo 'wibble wibble wibble' > $OUT"
+	target.RuleHash = nil // Have to force a reset of this
+	assert.NoError(t, buildTarget(1, state, target))
+	assert.Contains(t, state.Explanations()[target.Label], "rule definition has changed")
+}
+
+func TestExplainSourceChange(t *testing.T) {
+	state, target := newState("//package1:target12")
+	target.AddOutput("file12")
+	target.AddSource(core.FileLabel{File: "src12", Package: "package1"})
+	state.Explain = true
+	assert.NoError(t, ioutil.WriteFile("package1/src12", []byte("original"), 0644))
+	defer os.Remove("package1/src12")
+	assert.NoError(t, writeRuleHashFile(state, target))
+	assert.NoError(t, ioutil.WriteFile("package1/src12", []byte("modified"), 0644))
+	_, err := pathHash("package1/src12", true)
+	assert.NoError(t, err)
+	assert.NoError(t, buildTarget(1, state, target))
+	assert.Equal(t, "sources have changed: package1/src12 (modified)", state.Explanations()[target.Label])
+}
+
+func TestCheckDeterminism(t *testing.T) {
+	state, target := newState("//package1:target13")
+	target.AddOutput("file13")
+	assert.NoError(t, checkDeterminism(1, state, target))
+}
+
+func TestCheckDeterminismFails(t *testing.T) {
+	state, target := newState("//package1:target14")
+	target.AddOutput("file14")
+	target.Command = "echo $RANDOM$RANDOM$RANDOM > $OUT"
+	err := checkDeterminism(1, state, target)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "file14: differs at byte")
+}
+
+func TestCheckDeterminismEmbeddedPaths(t *testing.T) {
+	state, target := newState("//package1:target13a")
+	target.AddOutput("file13a")
+	target.Command = "echo $TMP_DIR > $OUT"
+	assert.NoError(t, checkDeterminism(1, state, target))
+}
+
+func TestCheckDeterminismLeavesTmpDir(t *testing.T) {
+	state, target := newState("//package1:target13b")
+	target.AddOutput("file13b")
+	assert.NoError(t, os.MkdirAll(target.TmpDir(), core.DirPermissions))
+	marker := path.Join(target.TmpDir(), "marker")
+	assert.NoError(t, ioutil.WriteFile(marker, []byte("marker"), 0644))
+	assert.NoError(t, checkDeterminism(1, state, target))
+	assert.True(t, core.FileExists(marker))
+}
+
+func TestWorkspaceStatus(t *testing.T) {
+	state, target := newState("//package1:target15")
+	state.Config.Build.WorkspaceStatusCommand = "echo STABLE_REVISION 1234 && echo BUILD_USER someone"
+	target.AddOutput("file15")
+	target.Command = "echo $STABLE_REVISION $BUILD_USER > $OUT"
+	target.Stamp = true
+	assert.NoError(t, buildTarget(1, state, target))
+	assert.True(t, core.FileExists("plz-out/gen/package1/file15"))
+	contents, err := ioutil.ReadFile("plz-out/gen/package1/file15")
+	assert.NoError(t, err)
+	assert.Equal(t, "1234 someone\n", string(contents))
+}
+
+func TestWorkspaceStatusFails(t *testing.T) {
+	state, target := newState("//package1:target17")
+	state.Config.Build.WorkspaceStatusCommand = "echo STABLE_REVISION 1234 && false"
+	target.AddOutput("file17")
+	target.Command = "echo $STABLE_REVISION > $OUT"
+	target.Stamp = true
+	err := buildTarget(1, state, target)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "workspace status command")
+}
+
+func TestWorkspaceStatusHash(t *testing.T) {
+	hash := func(command string) []byte {
+		state, target := newState("//package1:target16")
+		state.Config.Build.WorkspaceStatusCommand = command
+		target.Stamp = true
+		return ruleHash(target, false)
+	}
+	hash1 := hash("echo STABLE_REVISION 1234 && echo BUILD_TIMESTAMP 1")
+	hash2 := hash("echo STABLE_REVISION 1234 && echo BUILD_TIMESTAMP 2")
+	hash3 := hash("echo STABLE_REVISION 5678 && echo BUILD_TIMESTAMP 1")
+	assert.Equal(t, hash1, hash2, "Volatile keys shouldn't affect the hash")
+	assert.NotEqual(t, hash1, hash3, "Stable keys should affect the hash")
+}
+
 func TestSymlinkedOutputs(t *testing.T) {
 	// Test behaviour when the output is a symlink.
 	state, target := newState("//package1:target5")
@@ -269,8 +365,11 @@ func (*mockCache) RetrieveExtra(target *core.BuildTarget, key []byte, file strin
 	return false
 }
 
-func (*mockCache) Clean(target *core.BuildTarget) {}
-func (*mockCache) Shutdown()                      {}
+func (*mockCache) Clean(target *core.BuildTarget)                  {}
+func (*mockCache) List(target *core.BuildTarget) []core.CacheEntry { return nil }
+func (*mockCache) Evict(target *core.BuildTarget, key []byte)      {}
+func (*mockCache) Stats() []core.CacheStats                        { return nil }
+func (*mockCache) Shutdown()                                       {}
 
 func TestMain(m *testing.M) {
 	cache = &mockCache{}
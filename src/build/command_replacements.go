@@ -124,6 +124,14 @@ func replaceSequencesInternal(target *core.BuildTarget, command string, test boo
 func replaceSequence(target *core.BuildTarget, in string, runnable, multiple, dir, outPrefix, hash, test bool) string {
 	if core.LooksLikeABuildLabel(in) {
 		label := core.ParseBuildLabel(in, target.Label.PackageName)
+		if !target.IsTool(label) {
+			// Tools are built for the host in the primary configuration, but anything else is built
+			// for the same platform and configuration as the target.
+			if label.Arch == "" {
+				label.Arch = target.Label.Arch
+			}
+			label.Config = target.Label.Config
+		}
 		return replaceSequenceLabel(target, label, in, runnable, multiple, dir, outPrefix, hash, test, true)
 	}
 	for _, src := range target.AllSources() {
@@ -0,0 +1,259 @@
+// Support for checking that targets build deterministically.
+//
+// Nondeterministic outputs quietly undermine caching (a target that's rebuilt produces
+// a different output, so everything depending on it has to be rebuilt too) so it's useful
+// to be able to find them. We do that by building the target twice more and comparing
+// the outputs of the two builds; if their hashes differ, we diff them to explain why.
+
+package build
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"core"
+)
+
+// checkDeterminism builds the given target twice and returns an error describing
+// any differences between the outputs of the two builds.
+func checkDeterminism(tid int, state *core.BuildState, target *core.BuildTarget) error {
+	state.LogBuildResult(tid, target.Label, core.TargetBuilding, "Checking determinism...")
+	dirs := []string{determinismDir(target, 1), determinismDir(target, 2)}
+	for _, dir := range dirs {
+		if err := buildInto(state, target, dir); err != nil {
+			return err
+		}
+	}
+	if differences := diffOutputs(target, dirs[0], dirs[1]); len(differences) > 0 {
+		return fmt.Errorf("Outputs of %s are nondeterministic; the builds are in %s and %s:\n  %s",
+			target.Label, dirs[0], dirs[1], strings.Join(differences, "\n  "))
+	}
+	if state.CleanWorkdirs {
+		for _, dir := range dirs {
+			if err := os.RemoveAll(dir); err != nil {
+				log.Warning("Failed to remove temporary directory for %s: %s", target.Label, err)
+			}
+		}
+	}
+	state.LogBuildResult(tid, target.Label, core.TargetBuilding, "Outputs are deterministic")
+	return nil
+}
+
+// determinismDir returns the directory we keep the results of the given build of a target in.
+// Build 0 is the one in progress.
+func determinismDir(target *core.BuildTarget, n int) string {
+	if n == 0 {
+		return target.TmpDir() + "_determinism"
+	}
+	return fmt.Sprintf("%s_determinism%d", target.TmpDir(), n)
+}
+
+// buildInto builds the target and moves the directory it was built in to the given location.
+// The builds run in a directory of their own so the target's usual temporary directory is left
+// alone, but it's the same one each time so any paths that end up embedded in the outputs
+// don't count as differences.
+func buildInto(state *core.BuildState, target *core.BuildTarget, dir string) error {
+	buildDir := determinismDir(target, 0)
+	if err := prepareDirectory(buildDir, true); err != nil {
+		return err
+	}
+	for _, out := range target.Outputs() {
+		if d := path.Dir(out); d != "." {
+			if err := os.MkdirAll(path.Join(buildDir, d), core.DirPermissions); err != nil {
+				return err
+			}
+		}
+	}
+	worker, workerArgs, command := workerCommandAndArgs(target)
+	env, err := core.StampedBuildEnvironment(state, target, false, mustShortTargetHash(state, target))
+	if err != nil {
+		return err
+	}
+	action := core.NewBuildAction(state, target, command, env)
+	relocateAction(action, buildDir)
+	if err := prepareSources(action); err != nil {
+		return fmt.Errorf("Error preparing sources for %s: %s", target.Label, err)
+	}
+	if _, combined, err := runBuildAction(state, action, worker, workerArgs); err != nil {
+		return fmt.Errorf("Error rebuilding target %s to check determinism: %s\n%s", target.Label, err, combined)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	return os.Rename(buildDir, dir)
+}
+
+// relocateAction changes an action to run in the given directory instead of its target's
+// temporary directory, moving its sources and any variables referring to it to match.
+func relocateAction(action *core.BuildAction, dir string) {
+	from := action.Dir
+	action.Dir = dir
+	for i, source := range action.Sources {
+		if strings.HasPrefix(source.Tmp, from+"/") {
+			action.Sources[i].Tmp = dir + source.Tmp[len(from):]
+		}
+	}
+	absFrom := path.Join(core.RepoRoot, from)
+	absDir := path.Join(core.RepoRoot, dir)
+	for i, v := range action.Env {
+		if index := strings.IndexByte(v, '='); index != -1 {
+			if value := v[index+1:]; value == absFrom || strings.HasPrefix(value, absFrom+"/") {
+				action.Env[i] = v[:index+1] + absDir + value[len(absFrom):]
+			}
+		}
+	}
+}
+
+// diffOutputs returns a description of each difference between the outputs of two builds
+// of a target in the given directories. Their hashes are compared first; the outputs are
+// only diffed if those don't match, to explain why.
+func diffOutputs(target *core.BuildTarget, a, b string) []string {
+	hashA, errA := outputHashIn(target, a)
+	hashB, errB := outputHashIn(target, b)
+	if errA == nil && errB == nil && bytes.Equal(hashA, hashB) {
+		return nil
+	}
+	differences := []string{}
+	for _, out := range target.Outputs() {
+		differences = append(differences, diffPaths(path.Join(a, out), path.Join(b, out), out)...)
+	}
+	if len(differences) == 0 {
+		// Must be something the diff doesn't look at, e.g. a symlink pointing somewhere else.
+		return []string{"outputs have different hashes but no differences were found in their contents"}
+	}
+	return differences
+}
+
+// outputHashIn calculates the hash of a target's outputs in the given directory, in the same
+// way as OutputHash but without memoising it.
+func outputHashIn(target *core.BuildTarget, dir string) ([]byte, error) {
+	h := core.NewHash()
+	for _, output := range target.Outputs() {
+		h2, err := pathHashImpl(path.Join(dir, output))
+		if err != nil {
+			return nil, err
+		}
+		h.Write(h2)
+	}
+	return h.Sum(nil), nil
+}
+
+// diffPaths returns a description of each difference between two copies of an output,
+// which might be files or directories.
+func diffPaths(a, b, name string) []string {
+	infoA, errA := os.Stat(a)
+	infoB, errB := os.Stat(b)
+	if errA != nil && errB != nil {
+		return []string{fmt.Sprintf("%s: missing from both builds", name)}
+	} else if errA != nil {
+		return []string{fmt.Sprintf("%s: only created by the second build", name)}
+	} else if errB != nil {
+		return []string{fmt.Sprintf("%s: only created by the first build", name)}
+	} else if infoA.IsDir() != infoB.IsDir() {
+		return []string{fmt.Sprintf("%s: is a directory in only one build", name)}
+	} else if infoA.IsDir() {
+		return diffDirs(a, b, name)
+	}
+	contentsA, err := ioutil.ReadFile(a)
+	if err != nil {
+		return []string{fmt.Sprintf("%s: %s", name, err)}
+	}
+	contentsB, err := ioutil.ReadFile(b)
+	if err != nil {
+		return []string{fmt.Sprintf("%s: %s", name, err)}
+	}
+	return diffFiles(contentsA, contentsB, name)
+}
+
+// diffDirs returns a description of the differences between two directories.
+func diffDirs(a, b, name string) []string {
+	files := map[string]bool{}
+	for _, dir := range []string{a, b} {
+		filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				files[strings.TrimPrefix(p, dir+"/")] = true
+			}
+			return nil
+		})
+	}
+	names := make([]string, 0, len(files))
+	for file := range files {
+		names = append(names, file)
+	}
+	sort.Strings(names)
+	differences := []string{}
+	for _, file := range names {
+		differences = append(differences, diffPaths(path.Join(a, file), path.Join(b, file), path.Join(name, file))...)
+	}
+	return differences
+}
+
+// diffFiles returns a description of the differences between two versions of a file.
+// For zip files (which includes the .jar and .pex files produced by jarcat) it compares
+// the individual entries, otherwise it just reports where they first differ.
+func diffFiles(a, b []byte, name string) []string {
+	if bytes.Equal(a, b) {
+		return nil
+	}
+	zipA, errA := zip.NewReader(bytes.NewReader(a), int64(len(a)))
+	zipB, errB := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if errA == nil && errB == nil {
+		if differences := diffZips(zipA, zipB, name); len(differences) > 0 {
+			return differences
+		}
+	}
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return []string{fmt.Sprintf("%s: differs at byte %d", name, i)}
+		}
+	}
+	return []string{fmt.Sprintf("%s: differs in length (%d bytes vs. %d bytes)", name, len(a), len(b))}
+}
+
+// diffZips returns a description of the differences between the entries of two zip files.
+// It returns nothing if the entries are all the same, in which case the difference must be
+// in metadata we don't look at.
+func diffZips(a, b *zip.Reader, name string) []string {
+	entriesA := zipEntries(a)
+	entriesB := zipEntries(b)
+	differences := []string{}
+	for _, f := range a.File {
+		if g, present := entriesB[f.Name]; !present {
+			differences = append(differences, fmt.Sprintf("%s: entry %s only exists in the first build", name, f.Name))
+		} else if f.CRC32 != g.CRC32 || f.UncompressedSize64 != g.UncompressedSize64 {
+			differences = append(differences, fmt.Sprintf("%s: contents of entry %s differ", name, f.Name))
+		} else if !f.ModTime().Equal(g.ModTime()) {
+			differences = append(differences, fmt.Sprintf("%s: timestamps of entry %s differ (%s vs. %s)", name, f.Name, f.ModTime(), g.ModTime()))
+		} else if f.Mode() != g.Mode() {
+			differences = append(differences, fmt.Sprintf("%s: permissions of entry %s differ (%s vs. %s)", name, f.Name, f.Mode(), g.Mode()))
+		}
+	}
+	for _, f := range b.File {
+		if _, present := entriesA[f.Name]; !present {
+			differences = append(differences, fmt.Sprintf("%s: entry %s only exists in the second build", name, f.Name))
+		}
+	}
+	if len(differences) == 0 && len(a.File) == len(b.File) {
+		for i, f := range a.File {
+			if f.Name != b.File[i].Name {
+				return []string{fmt.Sprintf("%s: entries are in a different order (%s vs. %s at position %d)", name, f.Name, b.File[i].Name, i)}
+			}
+		}
+	}
+	return differences
+}
+
+func zipEntries(r *zip.Reader) map[string]*zip.File {
+	entries := make(map[string]*zip.File, len(r.File))
+	for _, f := range r.File {
+		entries[f.Name] = f
+	}
+	return entries
+}
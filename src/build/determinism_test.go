@@ -0,0 +1,114 @@
+package build
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"core"
+)
+
+func TestDiffFilesIdentical(t *testing.T) {
+	assert.Nil(t, diffFiles([]byte("hello"), []byte("hello"), "out.txt"))
+}
+
+func TestDiffFilesOffset(t *testing.T) {
+	assert.Equal(t, []string{"out.txt: differs at byte 3"}, diffFiles([]byte("hello"), []byte("help!"), "out.txt"))
+}
+
+func TestDiffFilesLength(t *testing.T) {
+	assert.Equal(t, []string{"out.txt: differs in length (5 bytes vs. 7 bytes)"}, diffFiles([]byte("hello"), []byte("hello!!"), "out.txt"))
+}
+
+func TestDiffOutputsSameHash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "determinism_test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	target := core.NewBuildTarget(core.ParseBuildLabel("//pkg:target", ""))
+	target.AddOutput("out.txt")
+	target.AddOutput("out")
+	a := path.Join(dir, "a")
+	b := path.Join(dir, "b")
+	for _, d := range []string{a, b} {
+		writeTestFile(t, path.Join(d, "out.txt"), "same")
+		writeTestFile(t, path.Join(d, "out", "nested.txt"), "same")
+	}
+	assert.Nil(t, diffOutputs(target, a, b))
+	writeTestFile(t, path.Join(b, "out", "nested.txt"), "different")
+	assert.Equal(t, []string{"out/nested.txt: differs at byte 0"}, diffOutputs(target, a, b))
+}
+
+func TestDiffZips(t *testing.T) {
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	a := makeZip(t, []zipEntry{{"a.txt", "a", now}, {"b.txt", "b", now}, {"c.txt", "c", now}})
+	b := makeZip(t, []zipEntry{{"a.txt", "a", now}, {"b.txt", "B", now}, {"d.txt", "d", now}})
+	assert.Equal(t, []string{
+		"out.jar: contents of entry b.txt differ",
+		"out.jar: entry c.txt only exists in the first build",
+		"out.jar: entry d.txt only exists in the second build",
+	}, diffFiles(a, b, "out.jar"))
+}
+
+func TestDiffZipsTimestamps(t *testing.T) {
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	a := makeZip(t, []zipEntry{{"a.txt", "a", now}})
+	b := makeZip(t, []zipEntry{{"a.txt", "a", now.Add(time.Hour)}})
+	differences := diffFiles(a, b, "out.jar")
+	assert.Equal(t, 1, len(differences))
+	assert.Contains(t, differences[0], "out.jar: timestamps of entry a.txt differ")
+}
+
+func TestDiffZipsOrder(t *testing.T) {
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	a := makeZip(t, []zipEntry{{"a.txt", "a", now}, {"b.txt", "b", now}})
+	b := makeZip(t, []zipEntry{{"b.txt", "b", now}, {"a.txt", "a", now}})
+	assert.Equal(t, []string{"out.jar: entries are in a different order (a.txt vs. b.txt at position 0)"}, diffFiles(a, b, "out.jar"))
+}
+
+func TestDiffDirs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "determinism_test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	a := path.Join(dir, "a")
+	b := path.Join(dir, "b")
+	writeTestFile(t, path.Join(a, "out", "same.txt"), "same")
+	writeTestFile(t, path.Join(b, "out", "same.txt"), "same")
+	writeTestFile(t, path.Join(a, "out", "different.txt"), "abc")
+	writeTestFile(t, path.Join(b, "out", "different.txt"), "abd")
+	writeTestFile(t, path.Join(b, "out", "extra.txt"), "extra")
+	assert.Equal(t, []string{
+		"out/different.txt: differs at byte 2",
+		"out/extra.txt: only created by the second build",
+	}, diffPaths(path.Join(a, "out"), path.Join(b, "out"), "out"))
+}
+
+type zipEntry struct {
+	name, contents string
+	modified       time.Time
+}
+
+func makeZip(t *testing.T, entries []zipEntry) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, entry := range entries {
+		fh := &zip.FileHeader{Name: entry.name}
+		fh.SetModTime(entry.modified)
+		f, err := w.CreateHeader(fh)
+		assert.NoError(t, err)
+		_, err = f.Write([]byte(entry.contents))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func writeTestFile(t *testing.T, filename, contents string) {
+	assert.NoError(t, os.MkdirAll(path.Dir(filename), 0755))
+	assert.NoError(t, ioutil.WriteFile(filename, []byte(contents), 0644))
+}
@@ -0,0 +1,140 @@
+// Support for explaining why targets needed rebuilding.
+//
+// The rule hash file only records a single hash of all the sources of a target, which is enough
+// to tell that one of them changed but not which. Alongside it we record the hashes of each
+// individual source and tool so we can compare them against the current ones later.
+
+package build
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"core"
+)
+
+// maxExplainedChanges is the most changed sources we'll list in a single explanation.
+const maxExplainedChanges = 10
+
+// hashComponentsFileName returns the filename we store the individual source hashes for this target in.
+func hashComponentsFileName(target *core.BuildTarget) string {
+	return path.Join(target.OutDir(), ".rule_hash_components_"+target.Label.Name)
+}
+
+// sourceHashComponents returns the hashes of each of the target's sources and tools, keyed by
+// a description of each one. Note that the logic here mimics sourceHash.
+func sourceHashComponents(graph *core.BuildGraph, target *core.BuildTarget) (map[string][]byte, error) {
+	components := map[string][]byte{}
+	for source := range core.IterSources(graph, target) {
+		result, err := pathHash(source.Src, false)
+		if err != nil {
+			return nil, err
+		}
+		components[source.Src] = result
+	}
+	for _, tool := range target.Tools {
+		if label := tool.Label(); label != nil {
+			components["tool "+label.String()] = mustTargetHash(core.State, graph.TargetOrDie(*label))
+		} else {
+			filename := tool.FullPaths(graph)[0]
+			result, err := pathHash(filename, false)
+			if err != nil {
+				return nil, err
+			}
+			components["tool "+filename] = result
+		}
+	}
+	return components, nil
+}
+
+// writeHashComponents writes the individual source hashes of a target.
+// Each line is the base64 encoded hash followed by a description of the source.
+func writeHashComponents(state *core.BuildState, target *core.BuildTarget) error {
+	components, err := sourceHashComponents(state.Graph, target)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	for _, name := range sortedComponentNames(components) {
+		fmt.Fprintf(&buf, "%s %s\n", base64.RawStdEncoding.EncodeToString(components[name]), name)
+	}
+	return core.WriteFile(&buf, hashComponentsFileName(target), 0644)
+}
+
+// readHashComponents reads a file previously written by writeHashComponents.
+func readHashComponents(filename string) (map[string][]byte, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	components := map[string][]byte{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), " ", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid line in %s: %s", filename, scanner.Text())
+		}
+		hash, err := base64.RawStdEncoding.DecodeString(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		components[parts[1]] = hash
+	}
+	return components, scanner.Err()
+}
+
+// explainSourceChanges returns a description of which sources of a target have changed
+// since it was last built.
+func explainSourceChanges(state *core.BuildState, target *core.BuildTarget) string {
+	old, err := readHashComponents(hashComponentsFileName(target))
+	if err != nil {
+		log.Debug("Can't read previous source hashes for %s: %s", target.Label, err)
+		return "no record of which"
+	}
+	current, err := sourceHashComponents(state.Graph, target)
+	if err != nil {
+		return err.Error()
+	}
+	changes := diffHashComponents(old, current)
+	if len(changes) == 0 {
+		// The overall hash is sensitive to the order of the sources even though the set is the same.
+		return "their order has changed"
+	} else if len(changes) > maxExplainedChanges {
+		return fmt.Sprintf("%s and %d more", strings.Join(changes[:maxExplainedChanges], ", "), len(changes)-maxExplainedChanges)
+	}
+	return strings.Join(changes, ", ")
+}
+
+// diffHashComponents returns a description of each source that differs between the two sets of hashes.
+func diffHashComponents(old, current map[string][]byte) []string {
+	changes := []string{}
+	for _, name := range sortedComponentNames(current) {
+		if hash, present := old[name]; !present {
+			changes = append(changes, name+" (added)")
+		} else if !bytes.Equal(hash, current[name]) {
+			changes = append(changes, name+" (modified)")
+		}
+	}
+	for _, name := range sortedComponentNames(old) {
+		if _, present := current[name]; !present {
+			changes = append(changes, name+" (removed)")
+		}
+	}
+	return changes
+}
+
+func sortedComponentNames(components map[string][]byte) []string {
+	names := make([]string, 0, len(components))
+	for name := range components {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,33 @@
+package build
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffHashComponents(t *testing.T) {
+	old := map[string][]byte{
+		"src/a.go":       {1, 2, 3},
+		"src/b.go":       {4, 5, 6},
+		"src/c.go":       {7, 8, 9},
+		"tool //tools:x": {1, 1, 1},
+	}
+	current := map[string][]byte{
+		"src/a.go":       {1, 2, 3},
+		"src/b.go":       {4, 5, 7},
+		"src/d.go":       {7, 8, 9},
+		"tool //tools:x": {1, 1, 2},
+	}
+	assert.Equal(t, []string{
+		"src/b.go (modified)",
+		"src/d.go (added)",
+		"tool //tools:x (modified)",
+		"src/c.go (removed)",
+	}, diffHashComponents(old, current))
+}
+
+func TestDiffHashComponentsUnchanged(t *testing.T) {
+	components := map[string][]byte{"src/a.go": {1, 2, 3}}
+	assert.Equal(t, []string{}, diffHashComponents(components, components))
+}
@@ -130,6 +130,8 @@ package main
 
 import (
 	"os"
+	"strconv"
+	"strings"
 	"testing"
 
 {{range .Imports}}
@@ -184,6 +186,25 @@ func matchString(pat, str string) (bool, error) {
     return pat == str, nil
 }
 
+// shardTests returns the subset of tests to run if this is one shard of a sharded test.
+func shardTests(tests []testing.InternalTest) []testing.InternalTest {
+	index, err := strconv.Atoi(os.Getenv("TEST_SHARD_INDEX"))
+	if err != nil {
+		return tests
+	}
+	total, err := strconv.Atoi(os.Getenv("TEST_TOTAL_SHARDS"))
+	if err != nil || total <= 1 {
+		return tests
+	}
+	ret := []testing.InternalTest{}
+	for i, test := range tests {
+		if i%total == index {
+			ret = append(ret, test)
+		}
+	}
+	return ret
+}
+
 func main() {
 {{if .CoverVars}}
 	testing.RegisterCover(testing.Cover{
@@ -199,12 +220,14 @@ func main() {
 {{end}}
     testVar := os.Getenv("TESTS")
     if testVar != "" {
-        args = append(args, "-test.run", testVar)
+        // Multiple tests are separated by spaces; each must match an entire test name, so
+        // rerunning TestFoo doesn't also run TestFooBar.
+        args = append(args, "-test.run", "^(" + strings.Join(strings.Fields(testVar), "|") + ")$")
     }
     os.Args = append(args, os.Args[1:]...)
 	benchmarks := []testing.InternalBenchmark{}
 	var examples = []testing.InternalExample{}
-	m := testing.MainStart(matchString, tests, benchmarks, examples)
+	m := testing.MainStart(matchString, shardTests(tests), benchmarks, examples)
 {{if .Main}}
 	{{.Package}}.{{.Main}}(m)
 {{else}}
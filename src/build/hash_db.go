@@ -0,0 +1,182 @@
+// Persistent database of file hashes.
+//
+// Hashing every source file a build touches dominates the time of a no-op build on a large
+// repo, so we remember the hashes of files across invocations. Entries are keyed by path and
+// are only trusted while the file's mtime, size and inode are unchanged.
+
+package build
+
+import (
+	"bytes"
+	"encoding/gob"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"core"
+)
+
+// hashDBFile is the file we store the hash database in.
+const hashDBFile = "plz-out/.hash_db"
+
+// hashDBMaxAge is how long entries are kept without being used before they're dropped.
+const hashDBMaxAge = 7 * 24 * time.Hour
+
+// hashDBRacyInterval is how recently a file can have been modified and still have its hash stored.
+// Anything newer than this could be modified again without its mtime changing (depending on the
+// timestamp granularity of the filesystem) so we can't safely trust it later.
+const hashDBRacyInterval = 2 * time.Second
+
+// A fileHashEntry is a single entry in the hash database.
+type fileHashEntry struct {
+	ModTime  int64
+	Size     int64
+	Inode    uint64
+	Hash     []byte
+	LastUsed int64
+}
+
+// matches returns true if this entry is still valid for the given file.
+func (entry *fileHashEntry) matches(info os.FileInfo) bool {
+	return entry.ModTime == info.ModTime().UnixNano() && entry.Size == info.Size() && entry.Inode == inode(info)
+}
+
+// hashDBContents is the serialised form of the database.
+type hashDBContents struct {
+	// Hash function that the hashes were calculated with. If it's changed they're all invalid.
+	HashFunction string
+	Entries      map[string]*fileHashEntry
+}
+
+// A fileHashDB is the in-memory form of the hash database.
+type fileHashDB struct {
+	filename string
+	entries  map[string]*fileHashEntry
+	// Paths whose entries we've used or updated during this invocation.
+	dirty    map[string]bool
+	mutex    sync.Mutex
+	loadOnce sync.Once
+}
+
+// hashDB is the singleton instance of the hash database that pathHash uses.
+var hashDB = newFileHashDB(hashDBFile)
+
+func newFileHashDB(filename string) *fileHashDB {
+	return &fileHashDB{filename: filename, dirty: map[string]bool{}}
+}
+
+// Get returns the stored hash for the given file, or nil if we don't have a valid one.
+func (db *fileHashDB) Get(path string, info os.FileInfo) []byte {
+	db.loadOnce.Do(db.load)
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if entry, present := db.entries[path]; present && entry.matches(info) {
+		entry.LastUsed = time.Now().Unix()
+		db.dirty[path] = true
+		return entry.Hash
+	}
+	return nil
+}
+
+// Set stores the hash for the given file.
+func (db *fileHashDB) Set(path string, info os.FileInfo, hash []byte) {
+	if time.Since(info.ModTime()) < hashDBRacyInterval || strings.HasPrefix(path, core.TmpDir) {
+		return // Too recent to trust, or a temporary file that we won't see again.
+	}
+	db.loadOnce.Do(db.load)
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	db.entries[path] = &fileHashEntry{
+		ModTime:  info.ModTime().UnixNano(),
+		Size:     info.Size(),
+		Inode:    inode(info),
+		Hash:     hash,
+		LastUsed: time.Now().Unix(),
+	}
+	db.dirty[path] = true
+}
+
+// load loads the database from disk.
+func (db *fileHashDB) load() {
+	db.entries = db.read()
+}
+
+// read reads the current contents of the database on disk. It returns an empty map if it doesn't exist.
+func (db *fileHashDB) read() map[string]*fileHashEntry {
+	f, err := os.Open(db.filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warning("Failed to open file hash database: %s", err)
+		}
+		return map[string]*fileHashEntry{}
+	}
+	defer f.Close()
+	contents := hashDBContents{}
+	if err := gob.NewDecoder(f).Decode(&contents); err != nil {
+		log.Warning("Failed to read file hash database, will recreate it: %s", err)
+		return map[string]*fileHashEntry{}
+	} else if contents.HashFunction != core.HashFunctionName() || contents.Entries == nil {
+		log.Debug("Hash function has changed, discarding file hash database")
+		return map[string]*fileHashEntry{}
+	}
+	return contents.Entries
+}
+
+// Save writes any entries used or updated during this invocation back to disk.
+// It's safe to call from multiple concurrent plz processes (eg. under --nolock); each
+// merges its entries with whatever's on disk at the time, under an exclusive lock.
+func (db *fileHashDB) Save() error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if len(db.dirty) == 0 {
+		return nil
+	}
+	lock, err := os.OpenFile(db.filename+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+	// Re-read whatever's on disk now, in case another process has updated it since we started.
+	entries := db.read()
+	for path := range db.dirty {
+		entries[path] = db.entries[path]
+	}
+	threshold := time.Now().Add(-hashDBMaxAge).Unix()
+	for path, entry := range entries {
+		if entry.LastUsed < threshold {
+			delete(entries, path)
+		}
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&hashDBContents{HashFunction: core.HashFunctionName(), Entries: entries}); err != nil {
+		return err
+	}
+	// This writes to a temp file and renames it, so readers never see a partial database.
+	if err := core.WriteFile(&buf, db.filename, 0644); err != nil {
+		return err
+	}
+	db.entries = entries
+	db.dirty = map[string]bool{}
+	return nil
+}
+
+// SaveFileHashes writes the file hash database to disk. It should be called at the end of a build.
+func SaveFileHashes() {
+	if err := hashDB.Save(); err != nil {
+		log.Warning("Failed to save file hash database: %s", err)
+	}
+}
+
+// inode returns the inode number of a file.
+func inode(info os.FileInfo) uint64 {
+	if s, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(s.Ino)
+	}
+	return 0
+}
@@ -0,0 +1,69 @@
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const hashDBTestFile = "src/build/test_data/hash_db_test.txt"
+
+func writeOldFile(t *testing.T, filename, contents string) os.FileInfo {
+	assert.NoError(t, ioutil.WriteFile(filename, []byte(contents), 0644))
+	// Must be old enough that the database will trust it.
+	old := time.Now().Add(-time.Minute)
+	assert.NoError(t, os.Chtimes(filename, old, old))
+	info, err := os.Lstat(filename)
+	assert.NoError(t, err)
+	return info
+}
+
+func TestHashDBGetAndSet(t *testing.T) {
+	db := newFileHashDB("plz-out/hash_db_test_1")
+	info := writeOldFile(t, hashDBTestFile, "test")
+	assert.Nil(t, db.Get(hashDBTestFile, info))
+	db.Set(hashDBTestFile, info, []byte{1, 2, 3})
+	assert.Equal(t, []byte{1, 2, 3}, db.Get(hashDBTestFile, info))
+	// Changing the file should invalidate the entry.
+	info = writeOldFile(t, hashDBTestFile, "test2")
+	assert.Nil(t, db.Get(hashDBTestFile, info))
+}
+
+func TestHashDBIgnoresRecentFiles(t *testing.T) {
+	db := newFileHashDB("plz-out/hash_db_test_2")
+	assert.NoError(t, ioutil.WriteFile(hashDBTestFile, []byte("recent"), 0644))
+	info, err := os.Lstat(hashDBTestFile)
+	assert.NoError(t, err)
+	db.Set(hashDBTestFile, info, []byte{1, 2, 3})
+	assert.Nil(t, db.Get(hashDBTestFile, info))
+}
+
+func TestHashDBSaveAndLoad(t *testing.T) {
+	assert.NoError(t, os.MkdirAll("plz-out", 0755))
+	db := newFileHashDB("plz-out/hash_db_test_3")
+	info := writeOldFile(t, hashDBTestFile, "save")
+	db.Set(hashDBTestFile, info, []byte{4, 5, 6})
+	assert.NoError(t, db.Save())
+	db2 := newFileHashDB("plz-out/hash_db_test_3")
+	assert.Equal(t, []byte{4, 5, 6}, db2.Get(hashDBTestFile, info))
+}
+
+func TestHashDBSaveMergesConcurrentUpdates(t *testing.T) {
+	// Simulates two plz processes updating the database at once.
+	assert.NoError(t, os.MkdirAll("plz-out", 0755))
+	const file2 = "src/build/test_data/hash_db_test2.txt"
+	db1 := newFileHashDB("plz-out/hash_db_test_4")
+	db2 := newFileHashDB("plz-out/hash_db_test_4")
+	info1 := writeOldFile(t, hashDBTestFile, "one")
+	info2 := writeOldFile(t, file2, "two")
+	db1.Set(hashDBTestFile, info1, []byte{1})
+	db2.Set(file2, info2, []byte{2})
+	assert.NoError(t, db1.Save())
+	assert.NoError(t, db2.Save())
+	db3 := newFileHashDB("plz-out/hash_db_test_4")
+	assert.Equal(t, []byte{1}, db3.Get(hashDBTestFile, info1))
+	assert.Equal(t, []byte{2}, db3.Get(file2, info2))
+}
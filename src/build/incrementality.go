@@ -14,7 +14,6 @@ package build
 
 import (
 	"bytes"
-	"crypto/sha1"
 	"encoding/base64"
 	"encoding/gob"
 	"fmt"
@@ -25,17 +24,13 @@ import (
 	"path"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 
 	"core"
 )
 
-const hashLength = sha1.Size
-
-// Length of the hash file we write
-const hashFileLength = 4 * hashLength
-
 // Used to write something when we need to indicate a boolean in a hash. Can be essentially
 // any value as long as they're different from one another.
 var boolTrueHashValue = []byte{2}
@@ -43,16 +38,28 @@ var boolFalseHashValue = []byte{1}
 
 // Return true if the rule needs building, false if the existing outputs are OK.
 func needsBuilding(state *core.BuildState, target *core.BuildTarget, postBuild bool) bool {
+	reason := rebuildReason(state, target, postBuild)
+	if reason == "" {
+		return false
+	}
+	log.Debug("Need to rebuild %s, %s", target.Label, reason)
+	if state.Explain {
+		state.ExplainRebuild(target.Label, reason)
+	}
+	return true
+}
+
+// rebuildReason returns a description of why the rule needs building, or the empty string if it doesn't.
+func rebuildReason(state *core.BuildState, target *core.BuildTarget, postBuild bool) string {
 	// Check the dependencies first, because they don't need any disk I/O.
 	if target.NeedsTransitiveDependencies {
-		if anyDependencyHasChanged(target) {
-			return true // one of the transitive deps has changed, need to rebuild
+		if dep := changedDependency(target); dep != nil {
+			return fmt.Sprintf("dependency %s has changed", dep.Label) // one of the transitive deps has changed, need to rebuild
 		}
 	} else {
 		for _, dep := range target.Dependencies() {
 			if dep.State() < core.Unchanged {
-				log.Debug("Need to rebuild %s, %s has changed", target.Label, dep.Label)
-				return true // dependency has just been rebuilt, do this too.
+				return fmt.Sprintf("dependency %s has changed", dep.Label) // dependency has just been rebuilt, do this too.
 			}
 		}
 	}
@@ -60,21 +67,19 @@ func needsBuilding(state *core.BuildState, target *core.BuildTarget, postBuild b
 	if !bytes.Equal(oldConfigHash, state.Hashes.Config) {
 		if len(oldConfigHash) == 0 {
 			// Small nicety to make it a bit clearer what's going on.
-			log.Debug("Need to build %s, outputs aren't there", target.Label)
-		} else {
-			log.Debug("Need to rebuild %s, config has changed (was %s, need %s)", target.Label, b64(oldConfigHash), b64(state.Hashes.Config))
+			return "outputs aren't there"
 		}
-		return true
+		return fmt.Sprintf("config has changed (was %s, need %s)", b64(oldConfigHash), b64(state.Hashes.Config))
 	}
 	newRuleHash := RuleHash(target, false, postBuild)
 	if !bytes.Equal(oldRuleHash, newRuleHash) {
-		log.Debug("Need to rebuild %s, rule has changed (was %s, need %s)", target.Label, b64(oldRuleHash), b64(newRuleHash))
-		return true
+		return fmt.Sprintf("rule definition has changed (was %s, need %s)", b64(oldRuleHash), b64(newRuleHash))
 	}
 	newSourceHash, err := sourceHash(state.Graph, target)
-	if err != nil || !bytes.Equal(oldSourceHash, newSourceHash) {
-		log.Debug("Need to rebuild %s, sources have changed (was %s, need %s)", target.Label, b64(oldSourceHash), b64(newSourceHash))
-		return true
+	if err != nil {
+		return fmt.Sprintf("failed to calculate source hash: %s", err)
+	} else if !bytes.Equal(oldSourceHash, newSourceHash) {
+		return "sources have changed: " + explainSourceChanges(state, target)
 	}
 	// Check the outputs of this rule exist. This would only happen if the user had
 	// removed them but it's incredibly aggravating if you remove an output and the
@@ -82,12 +87,14 @@ func needsBuilding(state *core.BuildState, target *core.BuildTarget, postBuild b
 	for _, output := range target.Outputs() {
 		realOutput := path.Join(target.OutDir(), output)
 		if !core.PathExists(realOutput) {
-			log.Debug("Output %s doesn't exist for rule %s; will rebuild.", realOutput, target.Label)
-			return true
+			return fmt.Sprintf("output %s doesn't exist", realOutput)
 		}
 	}
 	// Maybe we've forced a rebuild. Do this last; might be interesting to see if it needed building anyway.
-	return state.ForceRebuild && (state.IsOriginalTarget(target.Label) || state.IsOriginalTarget(target.Label.Parent()))
+	if state.ForceRebuild && (state.IsOriginalTarget(target.Label) || state.IsOriginalTarget(target.Label.Parent())) {
+		return "a rebuild was forced"
+	}
+	return ""
 }
 
 // b64 base64 encodes a string of bytes for printing.
@@ -98,25 +105,24 @@ func b64(b []byte) string {
 	return base64.RawStdEncoding.EncodeToString(b)
 }
 
-// Returns true if any transitive dependency of this target has changed.
-func anyDependencyHasChanged(target *core.BuildTarget) bool {
+// changedDependency returns any transitive dependency of this target that has changed, or nil if none have.
+func changedDependency(target *core.BuildTarget) *core.BuildTarget {
 	done := map[core.BuildLabel]bool{}
-	var inner func(*core.BuildTarget) bool
-	inner = func(dependency *core.BuildTarget) bool {
+	var inner func(*core.BuildTarget) *core.BuildTarget
+	inner = func(dependency *core.BuildTarget) *core.BuildTarget {
 		done[dependency.Label] = true
 		if dependency != target && dependency.State() < core.Unchanged {
-			return true
+			return dependency
 		} else if !dependency.OutputIsComplete || dependency == target {
 			for _, dep := range dependency.Dependencies() {
 				if !done[dep.Label] {
-					if inner(dep) {
-						log.Debug("Need to rebuild %s, %s has changed", target.Label, dep.Label)
-						return true
+					if changed := inner(dep); changed != nil {
+						return changed
 					}
 				}
 			}
 		}
-		return false
+		return nil
 	}
 	return inner(target)
 }
@@ -131,7 +137,7 @@ func mustSourceHash(graph *core.BuildGraph, target *core.BuildTarget) []byte {
 
 // Calculate the hash of all sources of this rule
 func sourceHash(graph *core.BuildGraph, target *core.BuildTarget) ([]byte, error) {
-	h := sha1.New()
+	h := core.NewHash()
 	for source := range core.IterSources(graph, target) {
 		result, err := pathHash(source.Src, false)
 		if err != nil {
@@ -174,11 +180,26 @@ func pathHash(path string, recalc bool) ([]byte, error) {
 			return cached, nil
 		}
 	}
+	// Regular files can be looked up in the persistent database, which saves us reading them
+	// if they haven't changed since a previous invocation.
+	info, err := os.Lstat(path)
+	isFile := err == nil && info.Mode().IsRegular()
+	if isFile && !recalc {
+		if result := hashDB.Get(path, info); result != nil {
+			pathHashMutex.Lock()
+			pathHashMemoizer[path] = result
+			pathHashMutex.Unlock()
+			return result, nil
+		}
+	}
 	result, err := pathHashImpl(path)
 	if err == nil {
 		pathHashMutex.Lock()
 		pathHashMemoizer[path] = result
 		pathHashMutex.Unlock()
+		if isFile {
+			hashDB.Set(path, info, result)
+		}
 	}
 	return result, err
 }
@@ -192,7 +213,7 @@ func mustPathHash(path string) []byte {
 }
 
 func pathHashImpl(path string) ([]byte, error) {
-	h := sha1.New()
+	h := core.NewHash()
 	info, err := os.Lstat(path)
 	if err == nil && info.Mode()&os.ModeSymlink != 0 {
 		// Dereference symlink and try again
@@ -290,7 +311,7 @@ func RuleHash(target *core.BuildTarget, runtime, postBuild bool) []byte {
 }
 
 func ruleHash(target *core.BuildTarget, runtime bool) []byte {
-	h := sha1.New()
+	h := core.NewHash()
 	h.Write([]byte(target.Label.String()))
 	for _, dep := range target.DeclaredDependencies() {
 		h.Write([]byte(dep.String()))
@@ -339,6 +360,9 @@ func ruleHash(target *core.BuildTarget, runtime bool) []byte {
 				panic(err)
 			}
 		}
+		if target.Shards > 1 {
+			h.Write([]byte(strconv.Itoa(target.Shards)))
+		}
 		if target.Containerise {
 			h.Write(core.State.Hashes.Containerisation)
 		}
@@ -351,10 +375,25 @@ func ruleHash(target *core.BuildTarget, runtime bool) []byte {
 	// Might consider removing this the next time we peturb the hashing strategy.
 	if target.Stamp {
 		hashBool(h, target.Stamp)
+		// Only the stable keys count; volatile ones (e.g. timestamps) would otherwise force a rebuild every time.
+		// If the status command failed the target can't be built anyway; buildTarget reports the error.
+		if status, err := core.State.WorkspaceStatus(); err == nil {
+			for _, kv := range status.StableEnvironment() {
+				h.Write([]byte(kv))
+			}
+		}
+	}
+	if target.Sandbox {
+		hashBool(h, target.Sandbox)
 	}
 	for _, require := range target.Requires {
 		h.Write([]byte(require))
 	}
+	// These come from outside so the values have to be hashed, not just the names.
+	for _, env := range target.PassEnv {
+		h.Write([]byte(env))
+		h.Write([]byte(os.Getenv(env)))
+	}
 	// Indeterminate iteration order, yay...
 	languages := []string{}
 	for k := range target.Provides {
@@ -383,20 +422,18 @@ func hashBool(writer hash.Hash, b bool) {
 // Arrays will be empty if there's an error reading the file.
 // If postBuild is true then the rule hash will be the post-build one if present.
 func readRuleHashFile(filename string, postBuild bool) ([]byte, []byte, []byte) {
-	contents := make([]byte, hashFileLength, hashFileLength)
-	file, err := os.Open(filename)
+	contents, err := ioutil.ReadFile(filename)
 	if err != nil {
 		if !os.IsNotExist(err) {
 			log.Warning("Failed to read rule hash file %s: %s", filename, err)
 		}
 		return nil, nil, nil
 	}
-	defer file.Close()
-	if n, err := file.Read(contents); err != nil {
-		log.Warning("Error reading rule hash file %s: %s", filename, err)
-		return nil, nil, nil
-	} else if n != hashFileLength {
-		log.Warning("Unexpected rule hash file length: expected %d bytes, was %d", hashFileLength, n)
+	hashLength := core.HashSize()
+	hashFileLength := 4 * hashLength
+	if len(contents) != hashFileLength {
+		// This is expected if the hash function has been changed since it was written.
+		log.Debug("Unexpected rule hash file length for %s: expected %d bytes, was %d", filename, hashFileLength, len(contents))
 		return nil, nil, nil
 	}
 	if postBuild {
@@ -405,12 +442,16 @@ func readRuleHashFile(filename string, postBuild bool) ([]byte, []byte, []byte)
 	return contents[0:hashLength], contents[2*hashLength : 3*hashLength], contents[3*hashLength : hashFileLength]
 }
 
-// Writes the contents of the rule hash file
+// Writes the contents of the rule hash file, along with the individual source hashes that
+// we use to explain why a target has to be rebuilt.
 func writeRuleHashFile(state *core.BuildState, target *core.BuildTarget) error {
 	hash, err := targetHash(state, target)
 	if err != nil {
 		return err
 	}
+	if err := writeHashComponents(state, target); err != nil {
+		return err
+	}
 	file, err := os.Create(ruleHashFileName(target))
 	if err != nil {
 		return err
@@ -419,7 +460,7 @@ func writeRuleHashFile(state *core.BuildState, target *core.BuildTarget) error {
 	n, err := file.Write(hash)
 	if err != nil {
 		return err
-	} else if n != hashFileLength {
+	} else if hashFileLength := 4 * core.HashSize(); n != hashFileLength {
 		return fmt.Errorf("Wrote %d bytes to rule hash file; should be %d", n, hashFileLength)
 	}
 	return nil
@@ -458,6 +499,16 @@ func storePostBuildOutput(state *core.BuildState, target *core.BuildTarget, out
 	}
 }
 
+// storeOutputHash writes the hash of a target's outputs to a file so it can be stored in the
+// cache alongside them.
+func storeOutputHash(target *core.BuildTarget, hash []byte) error {
+	filename := path.Join(target.OutDir(), core.OutputHashFileName(target))
+	if err := os.RemoveAll(filename); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, hash, 0644)
+}
+
 // targetHash returns the hash for a target and any error encountered while calculating it.
 func targetHash(state *core.BuildState, target *core.BuildTarget) ([]byte, error) {
 	hash := append(RuleHash(target, false, false), RuleHash(target, false, true)...)
@@ -483,6 +534,16 @@ func mustShortTargetHash(state *core.BuildState, target *core.BuildTarget) []byt
 	return core.CollapseHash(mustTargetHash(state, target))
 }
 
+// ShortTargetHash returns the hash for a target that its artifacts are stored in the cache under.
+// It returns an error if it can't be calculated, for example because its dependencies haven't been built.
+func ShortTargetHash(state *core.BuildState, target *core.BuildTarget) ([]byte, error) {
+	hash, err := targetHash(state, target)
+	if err != nil {
+		return nil, err
+	}
+	return core.CollapseHash(hash), nil
+}
+
 // RuntimeHash returns the target hash, source hash, config hash & runtime file hash,
 // all rolled into one. Essentially this is one hash needed to determine if the runtime
 // state is consistent.
@@ -493,7 +554,7 @@ func RuntimeHash(state *core.BuildState, target *core.BuildTarget) ([]byte, erro
 	if err != nil {
 		return nil, err
 	}
-	h := sha1.New()
+	h := core.NewHash()
 	h.Write(sh)
 	for source := range core.IterRuntimeFiles(state.Graph, target, true) {
 		result, err := pathHash(source.Src, false)
@@ -40,10 +40,13 @@ var KnownFields = map[string]bool{
 	"Tools":                       true,
 	"TestOutputs":                 true,
 	"Stamp":                       true,
+	"Sandbox":                     true,
+	"PassEnv":                     true,
 
 	// These only contribute to the runtime hash, not at build time.
 	"Data":              true,
 	"Containerise":      true,
+	"Shards":            true,
 	"ContainerSettings": true,
 
 	// These would ideally not contribute to the hash, but we need that at present
@@ -59,7 +62,10 @@ var KnownFields = map[string]bool{
 	"SkipCache":           true,
 	"BuildTimeout":        true,
 	"TestTimeout":         true,
+	"Cpus":                true,
+	"Memory":              true,
 	"state":               true,
+	"sharedWith":          true, // Decided at build time, and the target isn't built at all if it's set.
 	"Results":             true, // Recall that unsuccessful test results aren't cached...
 	"BuildingDescription": true,
 
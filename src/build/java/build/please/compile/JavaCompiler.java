@@ -0,0 +1,265 @@
+package build.please.compile;
+
+import java.io.BufferedReader;
+import java.io.File;
+import java.io.FileDescriptor;
+import java.io.FileOutputStream;
+import java.io.IOException;
+import java.io.InputStream;
+import java.io.InputStreamReader;
+import java.io.PrintStream;
+import java.io.StringWriter;
+import java.nio.charset.Charset;
+import java.util.ArrayList;
+import java.util.List;
+
+import javax.tools.Diagnostic;
+import javax.tools.DiagnosticCollector;
+import javax.tools.JavaFileObject;
+import javax.tools.StandardJavaFileManager;
+import javax.tools.ToolProvider;
+
+
+public class JavaCompiler {
+  // Persistent worker that compiles Java code in-process, which saves the cost of starting a
+  // new JVM for every java_library. See src/build/workers.go for a description of the protocol.
+  private static final Charset UTF8 = Charset.forName("UTF-8");
+
+  // The compiler to use, which is given by --javac (and is just javac by default).
+  private final String javac;
+  // True if that's the compiler from the JDK we're running in, so we can compile in-process.
+  private final boolean inProcess;
+
+  public JavaCompiler(String javac) throws IOException {
+    this.javac = javac;
+    this.inProcess = isOwnCompiler(javac);
+  }
+
+  public static void main(String[] args) throws IOException {
+    String javac = "javac";
+    for (int i = 0; i < args.length; ++i) {
+      if (args[i].equals("--javac") && i + 1 < args.length) {
+        javac = args[++i];
+      }
+    }
+    BufferedReader reader = new BufferedReader(new InputStreamReader(System.in, UTF8));
+    PrintStream out = new PrintStream(new FileOutputStream(FileDescriptor.out), false, "UTF-8");
+    // Anything else writing to stdout would corrupt our responses, so send it to stderr instead.
+    System.setOut(System.err);
+    JavaCompiler compiler = new JavaCompiler(javac);
+    Request request;
+    while ((request = Request.read(reader)) != null) {
+      Response response;
+      try {
+        response = compiler.compile(request);
+      } catch (Exception ex) {
+        response = new Response(false);
+        response.addMessages("Failed to compile " + request.rule + ": " + ex);
+      }
+      response.write(out);
+    }
+  }
+
+  // Returns true if the given javac is the one from the JDK we're running in.
+  // A plain "javac" is assumed to be, since we're normally run by the java found on the same PATH.
+  private static boolean isOwnCompiler(String javac) throws IOException {
+    if (javac.equals("javac")) {
+      return true;
+    }
+    File tool = new File(javac).getCanonicalFile();
+    File home = new File(System.getProperty("java.home"));
+    // java.home is the jre directory inside the JDK for older versions.
+    return tool.equals(new File(home, "bin/javac").getCanonicalFile())
+        || tool.equals(new File(home.getParentFile(), "bin/javac").getCanonicalFile());
+  }
+
+  // Compiles a single request.
+  public Response compile(Request request) throws IOException, InterruptedException {
+    javax.tools.JavaCompiler compiler = null;
+    if (inProcess && (compiler = ToolProvider.getSystemJavaCompiler()) == null) {
+      Response response = new Response(false);
+      response.addMessages("No Java compiler available; the worker must be run by a JDK, not a JRE");
+      return response;
+    }
+    File dir = new File(request.dir);
+    File outputDir = dir;
+    List<String> options = new ArrayList<>();
+    String classpath = "";
+    for (int i = 0; i < request.args.size(); ++i) {
+      String arg = request.args.get(i);
+      if (arg.equals("-d") && i + 1 < request.args.size()) {
+        // Relative paths are relative to the rule's directory, not wherever we happen to be.
+        outputDir = new File(dir, request.args.get(++i));
+        outputDir.mkdirs();
+        options.add(arg);
+        options.add(outputDir.getPath());
+      } else if ((arg.equals("-classpath") || arg.equals("-cp")) && i + 1 < request.args.size()) {
+        for (String entry : request.args.get(++i).split(File.pathSeparator)) {
+          if (!entry.isEmpty()) {
+            classpath += new File(dir, entry).getPath() + File.pathSeparator;
+          }
+        }
+      } else {
+        options.add(arg);
+      }
+    }
+    // Any jars in the rule's directory are dependencies, which is what the javac command would
+    // find with `find . -name "*.jar"`.
+    List<File> jars = new ArrayList<>();
+    findFiles(dir, ".jar", outputDir, jars);
+    for (File jar : jars) {
+      classpath += jar.getPath() + File.pathSeparator;
+    }
+    options.add("-classpath");
+    options.add(classpath + dir.getPath());
+
+    List<File> srcs = new ArrayList<>();
+    for (String src : request.srcs) {
+      File file = new File(dir, src);
+      if (file.isDirectory()) {
+        findFiles(file, ".java", outputDir, srcs);
+      } else if (src.endsWith(".java")) {
+        srcs.add(file);
+      }
+    }
+    if (!inProcess) {
+      return compileExternally(dir, options, srcs);
+    }
+    DiagnosticCollector<JavaFileObject> diagnostics = new DiagnosticCollector<>();
+    StandardJavaFileManager fileManager = compiler.getStandardFileManager(diagnostics, null, UTF8);
+    StringWriter writer = new StringWriter();
+    try {
+      Iterable<? extends JavaFileObject> units = fileManager.getJavaFileObjectsFromFiles(srcs);
+      boolean success = compiler.getTask(writer, fileManager, diagnostics, options, null, units).call();
+      Response response = new Response(success);
+      response.addMessages(writer.toString());
+      for (Diagnostic<? extends JavaFileObject> diagnostic : diagnostics.getDiagnostics()) {
+        response.addMessages(formatDiagnostic(dir, diagnostic));
+      }
+      return response;
+    } finally {
+      fileManager.close();
+    }
+  }
+
+  // Compiles by running the configured javac, for when it's not one we can run in-process.
+  private Response compileExternally(File dir, List<String> options, List<File> srcs) throws IOException, InterruptedException {
+    List<String> command = new ArrayList<>();
+    // Relative paths are relative to the repo root, which is where we're started, not the rule's directory.
+    command.add(javac.contains(File.separator) ? new File(javac).getAbsolutePath() : javac);
+    command.addAll(options);
+    for (File src : srcs) {
+      command.add(src.getPath());
+    }
+    Process process = new ProcessBuilder(command).directory(dir).redirectErrorStream(true).start();
+    process.getOutputStream().close();
+    String output = readAll(process.getInputStream());
+    Response response = new Response(process.waitFor() == 0);
+    response.addMessages(output);
+    return response;
+  }
+
+  // Reads everything from the given stream.
+  private static String readAll(InputStream in) throws IOException {
+    StringWriter writer = new StringWriter();
+    BufferedReader reader = new BufferedReader(new InputStreamReader(in, UTF8));
+    char[] buf = new char[4096];
+    for (int n = reader.read(buf); n != -1; n = reader.read(buf)) {
+      writer.write(buf, 0, n);
+    }
+    return writer.toString();
+  }
+
+  // Formats a diagnostic in the same way javac would print it.
+  private static String formatDiagnostic(File dir, Diagnostic<? extends JavaFileObject> diagnostic) {
+    String kind = diagnostic.getKind().toString().toLowerCase().replace('_', ' ');
+    if (diagnostic.getSource() == null) {
+      return kind + ": " + diagnostic.getMessage(null);
+    }
+    String name = diagnostic.getSource().getName();
+    String prefix = dir.getPath() + File.separator;
+    if (name.startsWith(prefix)) {
+      name = name.substring(prefix.length());
+    }
+    return name + ":" + diagnostic.getLineNumber() + ": " + kind + ": " + diagnostic.getMessage(null);
+  }
+
+  // Recursively finds all files under dir with the given suffix, skipping the excluded directory.
+  private static void findFiles(File dir, String suffix, File exclude, List<File> files) {
+    File[] children = dir.listFiles();
+    if (children == null) {
+      return;
+    }
+    for (File child : children) {
+      if (child.isDirectory()) {
+        if (!child.equals(exclude)) {
+          findFiles(child, suffix, exclude, files);
+        }
+      } else if (child.getName().endsWith(suffix)) {
+        files.add(child);
+      }
+    }
+  }
+
+  // A single request to compile some code.
+  public static class Request {
+    public String rule = "";
+    public String dir = "";
+    public List<String> srcs = new ArrayList<>();
+    public List<String> args = new ArrayList<>();
+
+    // Reads a request. Returns null if there are no more.
+    public static Request read(BufferedReader reader) throws IOException {
+      Request request = new Request();
+      boolean any = false;
+      String line;
+      while ((line = reader.readLine()) != null) {
+        if (line.isEmpty()) {
+          return request;
+        }
+        any = true;
+        int index = line.indexOf(' ');
+        String key = index == -1 ? line : line.substring(0, index);
+        String value = index == -1 ? "" : line.substring(index + 1);
+        if (key.equals("rule")) {
+          request.rule = value;
+        } else if (key.equals("dir")) {
+          request.dir = value;
+        } else if (key.equals("src")) {
+          request.srcs.add(value);
+        } else if (key.equals("arg")) {
+          request.args.add(value);
+        }
+      }
+      return any ? request : null;
+    }
+  }
+
+  // The response to a request.
+  public static class Response {
+    public final boolean success;
+    public final List<String> messages = new ArrayList<>();
+
+    public Response(boolean success) {
+      this.success = success;
+    }
+
+    // Adds some messages. Each line is added separately.
+    public void addMessages(String messages) {
+      for (String line : messages.split("\n")) {
+        if (!line.isEmpty()) {
+          this.messages.add(line);
+        }
+      }
+    }
+
+    public void write(PrintStream out) {
+      out.print("success " + success + "\n");
+      for (String message : messages) {
+        out.print("message " + message + "\n");
+      }
+      out.print("\n");
+      out.flush();
+    }
+  }
+}
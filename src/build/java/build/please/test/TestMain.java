@@ -5,6 +5,9 @@ import java.lang.reflect.Method;
 import java.util.HashSet;
 import java.util.Set;
 import java.util.ArrayList;
+import java.util.Arrays;
+import java.util.Collections;
+import java.util.Comparator;
 import java.util.List;
 
 import java.io.BufferedOutputStream;
@@ -67,6 +70,7 @@ public class TestMain {
         }
       }
     }
+    classes = shardClasses(classes);
     if (System.getenv("COVERAGE") != null) {
       TestCoverage.RunTestClasses(classes, allClasses);
     } else {
@@ -82,13 +86,40 @@ public class TestMain {
     System.exit(exitCode);
   }
 
+  /**
+   *  Reduces the given test classes to the ones this shard should run, if the test is sharded.
+   */
+  static Set<Class> shardClasses(Set<Class> classes) {
+    String index = System.getenv("TEST_SHARD_INDEX");
+    String total = System.getenv("TEST_TOTAL_SHARDS");
+    if (index == null || total == null) {
+      return classes;
+    }
+    int shard = Integer.parseInt(index);
+    int numShards = Integer.parseInt(total);
+    // Must sort them so every shard agrees on the order.
+    List<Class> sorted = new ArrayList<>(classes);
+    Collections.sort(sorted, new Comparator<Class>() {
+      public int compare(Class a, Class b) {
+        return a.getName().compareTo(b.getName());
+      }
+    });
+    Set<Class> ret = new HashSet<>();
+    for (int i = 0; i < sorted.size(); ++i) {
+      if (i % numShards == shard) {
+        ret.add(sorted.get(i));
+      }
+    }
+    return ret;
+  }
+
   public static void runClass(Class testClass) throws Exception {
     List<TestResult> results = new ArrayList<>();
     JUnitCore core = new JUnitCore();
     core.addListener(new TestListener(results));
     Request request = Request.aClass(testClass);
-    for (int i = 0; i < program_args.length; ++i) {
-      request = request.filterWith(Filter.matchMethodDescription(testDescription(testClass, program_args[i])));
+    if (program_args.length > 0) {
+      request = request.filterWith(anyOf(testClass, program_args));
     }
     core.run(request);
     writeResults(testClass.getName(), results);
@@ -190,8 +221,35 @@ public class TestMain {
     int index = s.lastIndexOf('.');
     if (index == -1) {
       return Description.createTestDescription(testClass, s);
+    } else if (s.substring(0, index).equals(testClass.getSimpleName())) {
+      // This is how we name tests in the results, so it's what comes back when rerunning them.
+      return Description.createTestDescription(testClass, s.substring(index + 1));
     } else {
       return Description.createTestDescription(s.substring(0, index), s.substring(index + 1));
     }
   }
+
+  // Returns a filter that matches tests matching any of the given names.
+  static Filter anyOf(Class testClass, final String[] names) {
+    final List<Filter> filters = new ArrayList<>();
+    for (String name : names) {
+      filters.add(Filter.matchMethodDescription(testDescription(testClass, name)));
+    }
+    return new Filter() {
+      @Override
+      public boolean shouldRun(Description description) {
+        for (Filter filter : filters) {
+          if (filter.shouldRun(description)) {
+            return true;
+          }
+        }
+        return false;
+      }
+
+      @Override
+      public String describe() {
+        return "any of " + Arrays.toString(names);
+      }
+    };
+  }
 }
@@ -29,6 +29,12 @@ def list_classes(suite):
             yield test, test.__class__.__module__ + '.' + test.id()
 
 
+def shard_suite(suite, index, total):
+    """Reduces a test suite to just the tests that this shard should run."""
+    tests = sorted(list_classes(suite), key=lambda x: x[1])
+    return unittest.suite.TestSuite(test for i, (test, _) in enumerate(tests) if i % total == index)
+
+
 def filter_suite(suite, test_names):
     """Reduces a test suite to just the tests matching the given names."""
     new_suite = unittest.suite.TestSuite()
@@ -63,6 +69,8 @@ def run_tests(test_names):
         suite = filter_suite(suite, test_names)
         if suite.countTestCases() == 0:
             raise Exception('No matching tests found')
+    if os.getenv('TEST_TOTAL_SHARDS'):
+        suite = shard_suite(suite, int(os.getenv('TEST_SHARD_INDEX')), int(os.getenv('TEST_TOTAL_SHARDS')))
     runner = xmlrunner.XMLTestRunner(output='test.results', outsuffix='')
     results = runner.run(suite)
     return len(results.errors) + len(results.failures)
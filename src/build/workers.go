@@ -0,0 +1,420 @@
+// Support for persistent workers.
+//
+// Some tools (notably javac) take much longer to start up than to do the work for a single
+// rule. Rules can mark a tool as a worker by starting their command with
+// $(worker //path/to:tool); we keep a pool of long-lived instances of the tool for the duration
+// of the build and send the rest of the command up to the first && to one of them instead of
+// running it through the shell. Anything after that is run as usual once the worker has finished.
+// The arguments are split and quoted as the shell would, but only environment variables are expanded.
+// Actions that are sandboxed or run by a remote executor can't use our workers, so they start a new
+// instance of the tool for just that request instead.
+//
+// The protocol is line-based over the worker's stdin and stdout. Each request looks like:
+//   rule //path/to:target
+//   dir /abs/path/to/plz-out/tmp/path/to/target._build
+//   src path/to/source.java       (one per source, relative to dir)
+//   arg -encoding                 (one per argument)
+//   <blank line>
+// and the worker replies with:
+//   success true                  (or false)
+//   message Something went wrong  (any number of these)
+//   <blank line>
+// Workers handle one request at a time and should exit when their stdin is closed.
+
+package build
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/shlex"
+
+	"core"
+)
+
+var workerReplacement = regexp.MustCompile("^\\$\\(worker ([^\\)]+)\\)")
+
+// A workerRequest is a single request sent to a worker.
+type workerRequest struct {
+	Rule string
+	Dir  string
+	Srcs []string
+	Args []string
+}
+
+// A workerResponse is a worker's reply to a request.
+type workerResponse struct {
+	Success  bool
+	Messages []string
+}
+
+// workerCommandAndArgs returns the command to start a target's worker, the arguments to send to
+// it and the remainder of the command. The first two are empty if it doesn't use a worker.
+func workerCommandAndArgs(target *core.BuildTarget) (string, string, string) {
+	command := target.GetCommand()
+	match := workerReplacement.FindStringSubmatch(command)
+	if match == nil {
+		return "", "", ReplaceSequences(target, command)
+	}
+	// The worker can be given arguments of its own after the tool itself.
+	worker := strings.TrimSpace(match[1])
+	workerArgs := ""
+	if index := strings.IndexByte(worker, ' '); index != -1 {
+		worker, workerArgs = worker[:index], worker[index:]
+	}
+	if core.LooksLikeABuildLabel(worker) {
+		worker = ReplaceSequences(target, "$(exe "+worker+")")
+	}
+	worker += workerArgs
+	args := strings.TrimSpace(command[len(match[0]):])
+	rest := ""
+	if index := strings.Index(args, " && "); index != -1 {
+		args, rest = args[:index], args[index+4:]
+	}
+	return worker, ReplaceSequences(target, args), ReplaceSequences(target, rest)
+}
+
+// runBuildAction runs the action for a target, sending the first part of it to a worker if needed.
+func runBuildAction(state *core.BuildState, action *core.BuildAction, worker, workerArgs string) ([]byte, []byte, error) {
+	if worker == "" {
+		return state.Executor.Execute(action)
+	}
+	request, err := newWorkerRequest(action, workerArgs)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error preparing request for worker %s: %s", worker, err)
+	}
+	if _, local := state.Executor.(*core.LocalExecutor); action.Sandbox || !local {
+		// Our workers run on this machine outside any sandbox, so they can't do this one.
+		// Instead we start a new instance of the tool just for this request as part of the action.
+		return runOneShotWorker(state, action, worker, request)
+	}
+	request.Dir = path.Join(core.RepoRoot, action.Dir)
+	timeout := action.Timeout
+	if timeout == 0 {
+		timeout = time.Duration(action.DefaultTimeout)
+	}
+	response, err := getWorkerPool(worker, core.WorkerEnvironment(state, action.Target), state.Config.Build.MaxWorkers).run(request, timeout)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error running worker %s: %s", worker, err)
+	}
+	msgs := []byte(strings.Join(response.Messages, "\n"))
+	if len(msgs) > 0 {
+		msgs = append(msgs, '\n')
+	}
+	if !response.Success {
+		return msgs, msgs, fmt.Errorf("Worker %s failed", worker)
+	} else if strings.TrimSpace(action.Command) == "" {
+		return msgs, msgs, nil
+	}
+	// The rest of the command uses whatever the worker produced, so it has to run here too.
+	out, combined, err := state.Executor.Execute(action)
+	return append(msgs, out...), append(msgs, combined...), err
+}
+
+// newWorkerRequest creates the request to send to a worker for an action.
+// The arguments are split as the shell would, but variables are the only thing expanded in them.
+func newWorkerRequest(action *core.BuildAction, workerArgs string) (*workerRequest, error) {
+	expand := core.ReplaceEnvironment(action.Env)
+	args, err := shlex.Split(os.Expand(workerArgs, expand))
+	if err != nil {
+		return nil, err
+	}
+	return &workerRequest{
+		Rule: action.Target.Label.String(),
+		Srcs: strings.Fields(expand("SRCS")),
+		Args: args,
+	}, nil
+}
+
+// runOneShotWorker runs an action by starting a new instance of the worker through the executor,
+// sending it the single request and then running the rest of the command as usual.
+func runOneShotWorker(state *core.BuildState, action *core.BuildAction, worker string, request *workerRequest) ([]byte, []byte, error) {
+	command, err := oneShotWorkerCommand(worker, request)
+	if err != nil {
+		return nil, nil, err
+	}
+	oneShot := *action
+	oneShot.Command = command
+	if strings.TrimSpace(action.Command) != "" {
+		oneShot.Command += " && " + action.Command
+	}
+	return state.Executor.Execute(&oneShot)
+}
+
+// oneShotWorkerCommand returns a shell command that sends the given request to a new instance of
+// the worker, prints its messages and fails if it does. The shell fills in the directory so it's
+// correct wherever the command ends up running.
+func oneShotWorkerCommand(worker string, request *workerRequest) (string, error) {
+	msg, err := encodeWorkerRequest(request)
+	if err != nil {
+		return "", err
+	}
+	lines := strings.Split(msg, "\n")
+	lines = lines[:len(lines)-1] // The last one is empty since the message ends in a newline.
+	for i, line := range lines {
+		if strings.HasPrefix(line, "dir ") {
+			lines[i] = `"dir $PWD"`
+		} else {
+			lines[i] = "'" + strings.Replace(line, "'", `'\''`, -1) + "'"
+		}
+	}
+	return fmt.Sprintf(`_WORKER_OUT=$(printf '%%s\n' %s | %s) && printf '%%s\n' "$_WORKER_OUT" | sed -n 's/^message //p' && printf '%%s\n' "$_WORKER_OUT" | grep -x 'success true' > /dev/null`,
+		strings.Join(lines, " "), worker), nil
+}
+
+// A workerPool manages the processes for a single worker tool.
+type workerPool struct {
+	command string
+	env     []string
+	// Processes that are alive and waiting for work.
+	idle chan *workerProcess
+	// Has a value in it for each running process; limits the number of them.
+	slots chan struct{}
+	// Set once the pool's been stopped; busy workers are stopped when they finish rather than
+	// being returned to idle. Protected by mutex, which is also held while returning them.
+	stopped bool
+	mutex   sync.Mutex
+}
+
+var workerPools = map[string]*workerPool{}
+var workerPoolMutex sync.Mutex
+
+// getWorkerPool returns the pool of workers for the given command and environment, creating it if needed.
+// Targets that need a different environment (e.g. because they pass through different variables)
+// get separate pools.
+func getWorkerPool(command string, env []string, max int) *workerPool {
+	workerPoolMutex.Lock()
+	defer workerPoolMutex.Unlock()
+	key := command + "\x00" + strings.Join(env, "\x00")
+	pool, present := workerPools[key]
+	if !present {
+		if max <= 0 {
+			max = 1
+		}
+		pool = newWorkerPool(command, env, max)
+		workerPools[key] = pool
+	}
+	return pool
+}
+
+// newWorkerPool creates a new pool of up to max workers.
+func newWorkerPool(command string, env []string, max int) *workerPool {
+	return &workerPool{
+		command: command,
+		env:     env,
+		idle:    make(chan *workerProcess, max),
+		slots:   make(chan struct{}, max),
+	}
+}
+
+// run sends a single request to one of the pool's workers, starting a new one if there isn't one free.
+func (pool *workerPool) run(request *workerRequest, timeout time.Duration) (*workerResponse, error) {
+	worker, err := pool.get()
+	if err != nil {
+		return nil, err
+	}
+	response, err := worker.send(request, timeout)
+	if err != nil {
+		// Don't try to reuse it, we can't know what state it's in.
+		worker.kill()
+		<-pool.slots
+		return nil, err
+	}
+	pool.release(worker)
+	return response, nil
+}
+
+// release returns a worker to the pool once it's finished a request, or stops it if the pool has been stopped.
+func (pool *workerPool) release(worker *workerProcess) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if pool.stopped {
+		worker.stop()
+		<-pool.slots
+		return
+	}
+	pool.idle <- worker // Never blocks, it has room for every worker.
+}
+
+// get returns an idle worker, starting one if there aren't any and we're under the limit.
+func (pool *workerPool) get() (*workerProcess, error) {
+	select {
+	case worker := <-pool.idle:
+		return worker, nil
+	default:
+	}
+	select {
+	case worker := <-pool.idle:
+		return worker, nil
+	case pool.slots <- struct{}{}:
+		worker, err := startWorker(pool.command, pool.env)
+		if err != nil {
+			<-pool.slots
+		}
+		return worker, err
+	}
+}
+
+// stop stops all the idle workers in the pool. Any that are busy are stopped when they finish.
+func (pool *workerPool) stop() {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	pool.stopped = true
+	for {
+		select {
+		case worker := <-pool.idle:
+			worker.stop()
+			<-pool.slots
+		default:
+			return
+		}
+	}
+}
+
+// StopWorkers stops all the worker processes. It should be called at the end of the build.
+func StopWorkers() {
+	workerPoolMutex.Lock()
+	defer workerPoolMutex.Unlock()
+	for _, pool := range workerPools {
+		pool.stop()
+	}
+}
+
+// A workerProcess is a single running worker.
+type workerProcess struct {
+	command string
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	stdout  *bufio.Reader
+}
+
+// startWorker starts a new worker process.
+func startWorker(command string, env []string) (*workerProcess, error) {
+	log.Debug("Starting worker %s", command)
+	cmd := exec.Command("bash", "-c", "exec "+command)
+	cmd.Dir = core.RepoRoot
+	cmd.Env = env
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	go func() {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			log.Debug("Worker %s: %s", command, scanner.Text())
+		}
+	}()
+	return &workerProcess{command: command, cmd: cmd, stdin: stdin, stdout: bufio.NewReader(stdout)}, nil
+}
+
+// send sends a request to the worker and waits for its response.
+func (worker *workerProcess) send(request *workerRequest, timeout time.Duration) (*workerResponse, error) {
+	msg, err := encodeWorkerRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(worker.stdin, msg); err != nil {
+		return nil, err
+	}
+	type result struct {
+		response *workerResponse
+		err      error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		response, err := readWorkerResponse(worker.stdout)
+		ch <- result{response: response, err: err}
+	}()
+	select {
+	case r := <-ch:
+		return r.response, r.err
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("Timed out after %s", timeout)
+	}
+}
+
+// stop asks the worker to exit by closing its stdin, and waits for it to do so.
+func (worker *workerProcess) stop() {
+	worker.stdin.Close()
+	done := make(chan error, 1)
+	go func() { done <- worker.cmd.Wait() }()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		log.Warning("Worker %s didn't exit after closing stdin, killing it", worker.command)
+		if err := worker.cmd.Process.Kill(); err != nil {
+			log.Warning("Failed to kill worker %s: %s", worker.command, err)
+		}
+		<-done
+	}
+}
+
+// kill kills the worker process and waits for it to exit. Waiting also closes its stdout, so
+// anything still reading a response from it gets an error.
+func (worker *workerProcess) kill() {
+	worker.stdin.Close()
+	if err := worker.cmd.Process.Kill(); err != nil {
+		log.Warning("Failed to kill worker %s: %s", worker.command, err)
+	}
+	worker.cmd.Wait()
+}
+
+// encodeWorkerRequest returns the serialised form of a request.
+func encodeWorkerRequest(request *workerRequest) (string, error) {
+	lines := []string{"rule " + request.Rule, "dir " + request.Dir}
+	for _, src := range request.Srcs {
+		lines = append(lines, "src "+src)
+	}
+	for _, arg := range request.Args {
+		lines = append(lines, "arg "+arg)
+	}
+	for _, line := range lines {
+		if strings.ContainsAny(line, "\r\n") {
+			return "", fmt.Errorf("Can't send %q to a worker, it contains a newline", line)
+		}
+	}
+	return strings.Join(lines, "\n") + "\n\n", nil
+}
+
+// readWorkerResponse reads a single response from a worker.
+func readWorkerResponse(r *bufio.Reader) (*workerResponse, error) {
+	response := &workerResponse{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				return nil, fmt.Errorf("Worker exited unexpectedly")
+			}
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			return response, nil
+		} else if strings.HasPrefix(line, "success ") {
+			response.Success = line == "success true"
+		} else if strings.HasPrefix(line, "message ") {
+			response.Messages = append(response.Messages, strings.TrimPrefix(line, "message "))
+		} else {
+			return nil, fmt.Errorf("Unexpected line in worker response: %s", line)
+		}
+	}
+}
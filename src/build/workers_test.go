@@ -0,0 +1,213 @@
+// Tests for persistent workers.
+
+package build
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"core"
+)
+
+// A trivial worker that echoes back the rule and arguments it was given, and fails if one of them is "fail".
+const testWorkerScript = `
+success=true
+messages=()
+while read -r line; do
+    if [ -z "$line" ]; then
+        echo "success $success"
+        for msg in "${messages[@]}"; do echo "message $msg"; done
+        echo ""
+        success=true
+        messages=()
+    elif [ "$line" == "arg fail" ]; then
+        success=false
+    else
+        messages+=("$line")
+    fi
+done
+`
+
+func init() {
+	core.NewBuildState(1, nil, 1, core.DefaultConfiguration())
+}
+
+func TestWorkerCommandAndArgsNoWorker(t *testing.T) {
+	target := makeWorkerTarget("javac -d _tmp $SRCS && jar cf $OUT _tmp")
+	worker, args, rest := workerCommandAndArgs(target)
+	assert.Equal(t, "", worker)
+	assert.Equal(t, "", args)
+	assert.Equal(t, "javac -d _tmp $SRCS && jar cf $OUT _tmp", rest)
+}
+
+func TestWorkerCommandAndArgs(t *testing.T) {
+	target := makeWorkerTarget("$(worker /usr/bin/javac_worker) -d _tmp -g && mkdir -p _tmp/META-INF && jar cf $OUT _tmp")
+	worker, args, rest := workerCommandAndArgs(target)
+	assert.Equal(t, "/usr/bin/javac_worker", worker)
+	assert.Equal(t, "-d _tmp -g", args)
+	assert.Equal(t, "mkdir -p _tmp/META-INF && jar cf $OUT _tmp", rest)
+}
+
+func TestWorkerCommandAndArgsOnlyWorker(t *testing.T) {
+	target := makeWorkerTarget("$(worker /usr/bin/javac_worker) -d _tmp")
+	worker, args, rest := workerCommandAndArgs(target)
+	assert.Equal(t, "/usr/bin/javac_worker", worker)
+	assert.Equal(t, "-d _tmp", args)
+	assert.Equal(t, "", rest)
+}
+
+func TestWorkerCommandAndArgsWorkerFlags(t *testing.T) {
+	target := makeWorkerTarget("$(worker /usr/bin/javac_worker --javac /opt/jdk/bin/javac) -d _tmp")
+	worker, args, rest := workerCommandAndArgs(target)
+	assert.Equal(t, "/usr/bin/javac_worker --javac /opt/jdk/bin/javac", worker)
+	assert.Equal(t, "-d _tmp", args)
+	assert.Equal(t, "", rest)
+}
+
+func TestEncodeWorkerRequest(t *testing.T) {
+	msg, err := encodeWorkerRequest(&workerRequest{
+		Rule: "//src/core:core",
+		Dir:  "/tmp/core",
+		Srcs: []string{"src/core/a.java", "src/core/b.java"},
+		Args: []string{"-d", "_tmp"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "rule //src/core:core\ndir /tmp/core\nsrc src/core/a.java\nsrc src/core/b.java\narg -d\narg _tmp\n\n", msg)
+}
+
+func TestEncodeWorkerRequestNewline(t *testing.T) {
+	_, err := encodeWorkerRequest(&workerRequest{Rule: "//src/core:core", Args: []string{"a\nb"}})
+	assert.Error(t, err)
+}
+
+func TestReadWorkerResponse(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("success false\nmessage a.java:1: error\nmessage 1 error\n\nsuccess true\n\n"))
+	response, err := readWorkerResponse(r)
+	assert.NoError(t, err)
+	assert.False(t, response.Success)
+	assert.Equal(t, []string{"a.java:1: error", "1 error"}, response.Messages)
+	response, err = readWorkerResponse(r)
+	assert.NoError(t, err)
+	assert.True(t, response.Success)
+	assert.Equal(t, 0, len(response.Messages))
+	_, err = readWorkerResponse(r)
+	assert.Error(t, err)
+}
+
+func TestReadWorkerResponseInvalid(t *testing.T) {
+	_, err := readWorkerResponse(bufio.NewReader(strings.NewReader("wibble\n\n")))
+	assert.Error(t, err)
+}
+
+func TestWorkerPool(t *testing.T) {
+	pool := newTestWorkerPool(t, 2)
+	defer pool.stop()
+	response, err := pool.run(&workerRequest{Rule: "//src:a", Dir: "/tmp", Args: []string{"-g"}}, 10*time.Second)
+	assert.NoError(t, err)
+	assert.True(t, response.Success)
+	assert.Equal(t, []string{"rule //src:a", "dir /tmp", "arg -g"}, response.Messages)
+	// The same process should be reused for the next request.
+	response, err = pool.run(&workerRequest{Rule: "//src:b", Dir: "/tmp", Args: []string{"fail"}}, 10*time.Second)
+	assert.NoError(t, err)
+	assert.False(t, response.Success)
+	assert.Equal(t, []string{"rule //src:b", "dir /tmp"}, response.Messages)
+	assert.Equal(t, 1, len(pool.slots))
+}
+
+func TestWorkerPoolLimit(t *testing.T) {
+	pool := newTestWorkerPool(t, 2)
+	defer pool.stop()
+	done := make(chan struct{})
+	for i := 0; i < 10; i++ {
+		go func() {
+			response, err := pool.run(&workerRequest{Rule: "//src:a", Dir: "/tmp"}, 10*time.Second)
+			assert.NoError(t, err)
+			assert.True(t, response.Success)
+			done <- struct{}{}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		<-done
+	}
+	assert.True(t, len(pool.slots) <= 2)
+}
+
+func TestWorkerPoolDeadWorker(t *testing.T) {
+	pool := newWorkerPool("true", []string{"PATH=/usr/local/bin:/usr/bin:/bin"}, 1)
+	_, err := pool.run(&workerRequest{Rule: "//src:a", Dir: "/tmp"}, 10*time.Second)
+	assert.Error(t, err)
+	// It shouldn't be counted any more.
+	assert.Equal(t, 0, len(pool.slots))
+}
+
+func TestWorkerTimeout(t *testing.T) {
+	// This one never replies, so the request should time out and the process be cleaned up.
+	pool := newWorkerPool("cat > /dev/null", []string{"PATH=/usr/local/bin:/usr/bin:/bin"}, 1)
+	worker, err := pool.get()
+	assert.NoError(t, err)
+	_, err = worker.send(&workerRequest{Rule: "//src:a", Dir: "/tmp"}, 50*time.Millisecond)
+	assert.Error(t, err)
+	worker.kill()
+	assert.NotNil(t, worker.cmd.ProcessState, "Process wasn't waited for")
+}
+
+func TestWorkerPoolStopBusy(t *testing.T) {
+	pool := newTestWorkerPool(t, 1)
+	worker, err := pool.get()
+	assert.NoError(t, err)
+	pool.stop()
+	// It was busy when the pool was stopped, so it should be stopped once it's finished.
+	pool.release(worker)
+	assert.NotNil(t, worker.cmd.ProcessState, "Worker wasn't stopped")
+	assert.Equal(t, 0, len(pool.slots))
+	assert.Equal(t, 0, len(pool.idle))
+}
+
+func TestNewWorkerRequestQuotedArgs(t *testing.T) {
+	action := &core.BuildAction{
+		Target: makeWorkerTarget(""),
+		Env:    []string{"SRCS=src/a.java src/b.java", "OUT=lib.jar"},
+	}
+	request, err := newWorkerRequest(action, `-d _tmp -Xlint:"all,-serial" '-Akey=a b' $OUT`)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"src/a.java", "src/b.java"}, request.Srcs)
+	assert.Equal(t, []string{"-d", "_tmp", "-Xlint:all,-serial", "-Akey=a b", "lib.jar"}, request.Args)
+}
+
+func TestOneShotWorkerCommand(t *testing.T) {
+	pool := newTestWorkerPool(t, 1)
+	dir, err := ioutil.TempDir("", "worker")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	cmd, err := oneShotWorkerCommand(pool.command, &workerRequest{Rule: "//src:a", Args: []string{"it's", "-g"}})
+	assert.NoError(t, err)
+	out, _, err := core.ExecWithTimeoutShell(dir, pool.env, 10*time.Second, 0, false, false, cmd)
+	assert.NoError(t, err)
+	assert.Equal(t, "rule //src:a\ndir "+dir+"\narg it's\narg -g\n", string(out))
+	cmd, err = oneShotWorkerCommand(pool.command, &workerRequest{Rule: "//src:a", Args: []string{"fail"}})
+	assert.NoError(t, err)
+	_, _, err = core.ExecWithTimeoutShell(dir, pool.env, 10*time.Second, 0, false, false, cmd)
+	assert.Error(t, err)
+}
+
+func makeWorkerTarget(command string) *core.BuildTarget {
+	target := core.NewBuildTarget(core.ParseBuildLabel("//src/build:worker_target", ""))
+	target.Command = command
+	return target
+}
+
+func newTestWorkerPool(t *testing.T, max int) *workerPool {
+	f, err := ioutil.TempFile("", "worker")
+	assert.NoError(t, err)
+	defer f.Close()
+	_, err = f.WriteString(testWorkerScript)
+	assert.NoError(t, err)
+	assert.NoError(t, os.Chmod(f.Name(), 0755))
+	return newWorkerPool("bash "+f.Name(), []string{"PATH=/usr/local/bin:/usr/bin:/bin"}, max)
+}
@@ -1,25 +1,38 @@
 package cache
 
 import (
+	"bytes"
 	"sync"
+	"time"
 
 	"core"
 )
 
 // An asyncCache is a wrapper around a Cache interface that handles incoming
-// store requests asynchronously and attempts to return immediately.
-// The requests are handled on an internal queue, if that fills up then
-// incoming requests will start to block again until it empties.
+// store requests asynchronously and returns immediately.
+// The requests are journaled to disk and handled on an internal queue by a set of
+// background workers; anything that hasn't been stored by the time we shut down is
+// picked up again by the next invocation.
 // Retrieval requests are still handled synchronously.
 type asyncCache struct {
-	requests  chan cacheRequest
 	realCache core.Cache
+	journal   *journal
 	wg        sync.WaitGroup
 	mutex     sync.Mutex
-	// queuedRequests handles the awkward case of storing multiple things for one
-	// build target, which isn't necessarily safe to do in parallel. This blocks
-	// further requests from handling that target and queues them here until it's ready.
-	queuedRequests map[*core.BuildTarget][]cacheRequest
+	cond      *sync.Cond
+	// Requests that haven't been started yet, in the order they arrived.
+	pending []*cacheRequest
+	// active handles the awkward case of storing multiple things for one
+	// build target, which isn't necessarily safe to do in parallel. Requests for
+	// a target aren't started while another one for it is in progress.
+	active map[core.BuildLabel]bool
+	// Number of requests that are pending or in progress.
+	outstanding int
+	// Set when we're shutting down; workers exit once the queue is empty.
+	closed bool
+	// Set if we gave up waiting for the queue to empty. Anything left remains in the journal.
+	abandoned    bool
+	flushTimeout time.Duration
 }
 
 // A cacheRequest models an incoming cache request on our queue.
@@ -27,13 +40,29 @@ type cacheRequest struct {
 	target *core.BuildTarget
 	key    []byte
 	file   string
+	// The state of the files to store when the request was made.
+	stamps map[string]stamp
+	// The file in the journal recording this request.
+	filename string
 }
 
-func newAsyncCache(realCache core.Cache, config *core.Configuration) core.Cache {
+// newAsyncCache creates a new asyncCache wrapping the given cache.
+// If resume is true it also picks up any uploads left in the journal by previous runs.
+func newAsyncCache(realCache core.Cache, config *core.Configuration, resume bool) core.Cache {
 	c := &asyncCache{
-		requests:       make(chan cacheRequest),
-		realCache:      realCache,
-		queuedRequests: make(map[*core.BuildTarget][]cacheRequest),
+		realCache:    realCache,
+		active:       map[core.BuildLabel]bool{},
+		flushTimeout: time.Duration(config.Cache.FlushTimeout),
+	}
+	c.cond = sync.NewCond(&c.mutex)
+	if j, err := openJournal(journalDir, resume); err != nil {
+		log.Warning("Failed to open upload queue, cache uploads won't be resumed if interrupted: %s", err)
+	} else {
+		c.journal = j
+		if c.pending = j.Pending(); len(c.pending) > 0 {
+			log.Notice("Resuming %d cache uploads from a previous run", len(c.pending))
+			c.outstanding = len(c.pending)
+		}
 	}
 	c.wg.Add(config.Cache.Workers)
 	for i := 0; i < config.Cache.Workers; i++ {
@@ -43,18 +72,18 @@ func newAsyncCache(realCache core.Cache, config *core.Configuration) core.Cache
 }
 
 func (c *asyncCache) Store(target *core.BuildTarget, key []byte) {
-	c.requests <- cacheRequest{
+	c.enqueue(&cacheRequest{
 		target: target,
 		key:    key,
-	}
+	})
 }
 
 func (c *asyncCache) StoreExtra(target *core.BuildTarget, key []byte, file string) {
-	c.requests <- cacheRequest{
+	c.enqueue(&cacheRequest{
 		target: target,
 		key:    key,
 		file:   file,
-	}
+	})
 }
 
 func (c *asyncCache) Retrieve(target *core.BuildTarget, key []byte) bool {
@@ -66,47 +95,161 @@ func (c *asyncCache) RetrieveExtra(target *core.BuildTarget, key []byte, file st
 }
 
 func (c *asyncCache) Clean(target *core.BuildTarget) {
+	c.discard(target, nil)
 	c.realCache.Clean(target)
 }
 
+func (c *asyncCache) List(target *core.BuildTarget) []core.CacheEntry {
+	return c.realCache.List(target)
+}
+
+func (c *asyncCache) Evict(target *core.BuildTarget, key []byte) {
+	c.discard(target, key)
+	c.realCache.Evict(target, key)
+}
+
+func (c *asyncCache) Stats() []core.CacheStats {
+	return c.realCache.Stats()
+}
+
+// PendingUploads returns the number of store requests that haven't finished yet.
+func (c *asyncCache) PendingUploads() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.outstanding
+}
+
 func (c *asyncCache) Shutdown() {
-	log.Notice("Shutting down cache workers...")
-	close(c.requests)
-	c.wg.Wait()
+	c.mutex.Lock()
+	c.closed = true
+	n := c.outstanding
+	c.cond.Broadcast()
+	c.mutex.Unlock()
+	if n > 0 {
+		log.Notice("Waiting for %d cache uploads to finish...", n)
+	}
+	done := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		log.Debug("Cache workers finished")
+	case <-time.After(c.flushTimeout):
+		c.mutex.Lock()
+		c.abandoned = true
+		n = c.outstanding
+		c.cond.Broadcast()
+		c.mutex.Unlock()
+		log.Warning("Timed out waiting for cache uploads; %d remaining will be resumed next time", n)
+		// The workers won't start anything else now, but give the ones in progress a chance to
+		// finish; the underlying cache can't be shut down while they're still using it.
+		select {
+		case <-done:
+		case <-time.After(c.flushTimeout):
+			log.Warning("Cache uploads still in progress, not shutting down cache")
+			if c.journal != nil {
+				c.journal.Close()
+			}
+			return
+		}
+	}
+	if c.journal != nil {
+		c.journal.Close()
+	}
+	c.realCache.Shutdown()
+}
+
+// enqueue records a new request in the journal and adds it to the queue.
+func (c *asyncCache) enqueue(r *cacheRequest) {
+	r.stamps = stampFiles(r.target, r.file)
+	if c.journal != nil {
+		if err := c.journal.Add(r); err != nil {
+			log.Warning("Failed to add %s to upload queue: %s", r.target.Label, err)
+		}
+	}
+	c.mutex.Lock()
+	c.pending = append(c.pending, r)
+	c.outstanding++
+	c.cond.Signal()
+	c.mutex.Unlock()
+}
+
+// discard drops any queued requests to store the given target, so they can't put back
+// artifacts that have been evicted. A nil key matches requests for any key.
+func (c *asyncCache) discard(target *core.BuildTarget, key []byte) {
+	c.mutex.Lock()
+	pending := c.pending[:0]
+	for _, r := range c.pending {
+		if r.target.Label == target.Label && (key == nil || bytes.Equal(r.key, key)) {
+			c.outstanding--
+		} else {
+			pending = append(pending, r)
+		}
+	}
+	c.pending = pending
+	c.cond.Broadcast()
+	c.mutex.Unlock()
+	if c.journal != nil {
+		c.journal.Discard(target.Label, key)
+	}
+}
+
+// next returns the next request that can be started, blocking until there is one.
+// It returns nil once there's nothing more to do.
+func (c *asyncCache) next() *cacheRequest {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for !c.abandoned {
+		for i, r := range c.pending {
+			if !c.active[r.target.Label] {
+				c.active[r.target.Label] = true
+				c.pending = append(c.pending[:i], c.pending[i+1:]...)
+				return r
+			}
+		}
+		if c.closed && len(c.pending) == 0 {
+			break
+		}
+		c.cond.Wait()
+	}
+	return nil
 }
 
 // run implements the actual async logic.
 func (c *asyncCache) run() {
-	for r := range c.requests {
-		// Ensure only one goroutine handles each target at a time.
-		c.mutex.Lock()
-		q, present := c.queuedRequests[r.target]
-		if present {
-			c.queuedRequests[r.target] = append(q, r)
-			c.mutex.Unlock()
-			continue
-		}
-		c.queuedRequests[r.target] = nil
-		c.mutex.Unlock()
+	defer c.wg.Done()
+	for r := c.next(); r != nil; r = c.next() {
 		c.runOne(r)
-		// Now handle any queued requests that happened while we were dealing with it.
+		// It's complete now even if we've been abandoned in the meantime, so it mustn't be resumed.
+		if c.journal != nil {
+			c.journal.Remove(r)
+		}
 		c.mutex.Lock()
-		q = c.queuedRequests[r.target]
-		delete(c.queuedRequests, r.target)
+		delete(c.active, r.target.Label)
+		c.outstanding--
+		c.cond.Broadcast()
 		c.mutex.Unlock()
-		for _, r := range q {
-			c.runOne(r)
-		}
 	}
-	log.Debug("Cache worker finished")
-	c.wg.Done()
 }
 
 // runOne runs a single cache request.
-func (c *asyncCache) runOne(r cacheRequest) {
+func (c *asyncCache) runOne(r *cacheRequest) {
+	// Check the files haven't been changed since the request was made, which is most likely
+	// for requests left over from a previous run; if they've been rebuilt since then they
+	// no longer correspond to the key we'd be storing them under.
+	if !stampsMatch(r.target, r.file, r.stamps) {
+		log.Info("Outputs of %s have changed since they were queued for upload, not storing", r.target.Label)
+		return
+	}
 	if r.file != "" {
 		c.realCache.StoreExtra(r.target, r.key, r.file)
 	} else {
 		c.realCache.Store(r.target, r.key)
 	}
+	if !stampsMatch(r.target, r.file, r.stamps) {
+		log.Warning("Outputs of %s changed while they were being uploaded, evicting them", r.target.Label)
+		c.realCache.Evict(r.target, r.key)
+	}
 }
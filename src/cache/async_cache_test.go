@@ -2,6 +2,9 @@ package cache
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
 	"sort"
 	"sync"
 	"testing"
@@ -9,6 +12,7 @@ import (
 
 	"github.com/stretchr/testify/assert"
 
+	"cli"
 	"core"
 )
 
@@ -78,6 +82,163 @@ func TestConcurrentStores(t *testing.T) {
 	assert.Equal(t, expected, stored)
 }
 
+func TestResume(t *testing.T) {
+	// Nothing runs the requests with no workers, so they should be left in the journal.
+	mCache := newMockCache()
+	config := core.DefaultConfiguration()
+	config.Cache.Workers = 0
+	aCache := newAsyncCache(mCache, config, true)
+	aCache.Store(makeTarget("//pkg1:test_resume"), []byte("abc"))
+	aCache.StoreExtra(makeTarget("//pkg1:test_resume"), []byte("abc"), "some_other_file")
+	assert.Equal(t, 2, aCache.(*asyncCache).PendingUploads())
+	aCache.Shutdown()
+	assert.Equal(t, 0, len(mCache.stored))
+	// The next one should pick them up again.
+	mCache2, aCache2 := makeCaches()
+	aCache2.Shutdown()
+	stored := []string{}
+	for target, files := range mCache2.stored {
+		assert.Equal(t, "//pkg1:test_resume", target.Label.String())
+		stored = append(stored, files...)
+	}
+	sort.Strings(stored)
+	assert.Equal(t, []string{"", "some_other_file"}, stored)
+	// And now they should be gone from the journal.
+	mCache3, aCache3 := makeCaches()
+	aCache3.Shutdown()
+	assert.Equal(t, 0, len(mCache3.stored))
+}
+
+func TestNoResumePostBuild(t *testing.T) {
+	mCache := newMockCache()
+	config := core.DefaultConfiguration()
+	config.Cache.Workers = 0
+	aCache := newAsyncCache(mCache, config, true)
+	target := makeTarget("//pkg1:test_no_resume_post_build")
+	target.PostBuildFunction = 1
+	aCache.Store(target, []byte("abc"))
+	aCache.Shutdown()
+	// The next one can't recreate its post-build function, so shouldn't store it.
+	mCache2, aCache2 := makeCaches()
+	aCache2.Shutdown()
+	assert.Equal(t, 0, len(mCache2.stored))
+	// And it should be gone from the journal.
+	assert.Equal(t, 0, len(aCache2.(*asyncCache).journal.Pending()))
+}
+
+func TestFlushTimeout(t *testing.T) {
+	mCache := newMockCache()
+	config := core.DefaultConfiguration()
+	config.Cache.Workers = 1
+	config.Cache.FlushTimeout = cli.Duration(15 * time.Millisecond)
+	aCache := newAsyncCache(mCache, config, true)
+	for i := 0; i < 10; i++ {
+		aCache.Store(makeTarget(fmt.Sprintf("//pkg1:test_flush_timeout%d", i)), nil)
+	}
+	start := time.Now()
+	aCache.Shutdown()
+	assert.True(t, time.Since(start) < 100*time.Millisecond)
+	assert.True(t, aCache.(*asyncCache).PendingUploads() > 0)
+	// The one in progress when we gave up should have been allowed to finish before we returned.
+	mCache.Lock()
+	for target, inFlight := range mCache.inFlight {
+		assert.False(t, inFlight, "%s still being stored after shutdown", target.Label)
+	}
+	mCache.Unlock()
+	// Whatever didn't finish should be resumed next time.
+	mCache2, aCache2 := makeCaches()
+	aCache2.Shutdown()
+	// Anything that finished after we gave up shouldn't be stored again.
+	mCache.Lock()
+	defer mCache.Unlock()
+	labels := map[string]bool{}
+	for target := range mCache.stored {
+		labels[target.Label.String()] = true
+	}
+	for target := range mCache2.stored {
+		assert.False(t, labels[target.Label.String()], "%s stored twice", target.Label)
+		labels[target.Label.String()] = true
+	}
+	assert.Equal(t, 10, len(labels))
+}
+
+func TestNoResume(t *testing.T) {
+	mCache := newMockCache()
+	config := core.DefaultConfiguration()
+	config.Cache.Workers = 0
+	aCache := newAsyncCache(mCache, config, true)
+	aCache.Store(makeTarget("//pkg1:test_no_resume"), []byte("abc"))
+	aCache.Shutdown()
+	// This one isn't resuming so shouldn't pick it up...
+	config.Cache.Workers = 10
+	mCache2 := newMockCache()
+	aCache2 := newAsyncCache(mCache2, config, false)
+	assert.Equal(t, 0, aCache2.(*asyncCache).PendingUploads())
+	aCache2.Shutdown()
+	assert.Equal(t, 0, len(mCache2.stored))
+	// ...but it should still be there for the next one that does.
+	mCache3, aCache3 := makeCaches()
+	aCache3.Shutdown()
+	assert.Equal(t, 1, len(mCache3.stored))
+}
+
+func TestEvictDiscardsQueued(t *testing.T) {
+	mCache := newMockCache()
+	config := core.DefaultConfiguration()
+	config.Cache.Workers = 0
+	aCache := newAsyncCache(mCache, config, true)
+	aCache.Store(makeTarget("//pkg1:test_evict_discards"), []byte("abc"))
+	aCache.Store(makeTarget("//pkg1:test_evict_discards"), []byte("def"))
+	aCache.Store(makeTarget("//pkg1:test_evict_discards2"), []byte("abc"))
+	aCache.Shutdown()
+	// Evicting from a cache that isn't resuming should still drop the matching one from the journal.
+	aCache2 := newAsyncCache(newMockCache(), config, false)
+	aCache2.Evict(makeTarget("//pkg1:test_evict_discards"), []byte("abc"))
+	aCache2.Shutdown()
+	mCache3, aCache3 := makeCaches()
+	aCache3.Shutdown()
+	stored := []string{}
+	for target := range mCache3.stored {
+		stored = append(stored, target.Label.String())
+	}
+	sort.Strings(stored)
+	assert.Equal(t, []string{"//pkg1:test_evict_discards", "//pkg1:test_evict_discards2"}, stored)
+}
+
+func TestCleanDiscardsQueued(t *testing.T) {
+	mCache := newMockCache()
+	config := core.DefaultConfiguration()
+	config.Cache.Workers = 0
+	aCache := newAsyncCache(mCache, config, true)
+	aCache.Store(makeTarget("//pkg1:test_clean_discards"), []byte("abc"))
+	aCache.StoreExtra(makeTarget("//pkg1:test_clean_discards"), []byte("def"), "some_file")
+	assert.Equal(t, 2, aCache.(*asyncCache).PendingUploads())
+	aCache.Clean(makeTarget("//pkg1:test_clean_discards"))
+	assert.Equal(t, 0, aCache.(*asyncCache).PendingUploads())
+	aCache.Shutdown()
+	mCache2, aCache2 := makeCaches()
+	aCache2.Shutdown()
+	assert.Equal(t, 0, len(mCache2.stored))
+}
+
+func TestOutputsChanged(t *testing.T) {
+	// Requests shouldn't be stored if the outputs have changed since they were made.
+	target := makeTarget("//pkg1:test_outputs_changed")
+	target.AddOutput("out.txt")
+	filename := path.Join(target.OutDir(), "out.txt")
+	assert.NoError(t, os.MkdirAll(target.OutDir(), core.DirPermissions))
+	assert.NoError(t, ioutil.WriteFile(filename, []byte("first"), 0644))
+	config := core.DefaultConfiguration()
+	config.Cache.Workers = 0
+	aCache := newAsyncCache(newMockCache(), config, true)
+	aCache.Store(target, []byte("abc"))
+	aCache.Shutdown()
+	assert.NoError(t, ioutil.WriteFile(filename, []byte("second"), 0644))
+	mCache, aCache2 := makeCaches()
+	aCache2.Shutdown()
+	assert.Equal(t, 0, len(mCache.stored))
+}
+
 // Fake cache implementation to ensure our async cache behaves itself.
 type mockCache struct {
 	sync.Mutex
@@ -120,19 +281,33 @@ func (c *mockCache) Clean(target *core.BuildTarget) {
 	c.Retrieve(target, nil)
 }
 
+func (*mockCache) List(target *core.BuildTarget) []core.CacheEntry {
+	return nil
+}
+
+func (*mockCache) Evict(target *core.BuildTarget, key []byte) {}
+
+func (*mockCache) Stats() []core.CacheStats {
+	return nil
+}
+
 func (*mockCache) Shutdown() {}
 
 func makeTarget(label string) *core.BuildTarget {
 	return core.NewBuildTarget(core.ParseBuildLabel(label, ""))
 }
 
-func makeCaches() (mockCache, core.Cache) {
-	mCache := mockCache{
+func newMockCache() *mockCache {
+	return &mockCache{
 		inFlight:  make(map[*core.BuildTarget]bool),
 		completed: make(map[*core.BuildTarget]bool),
 		stored:    make(map[*core.BuildTarget][]string),
 	}
+}
+
+func makeCaches() (*mockCache, core.Cache) {
+	mCache := newMockCache()
 	config := core.DefaultConfiguration()
 	config.Cache.Workers = 10
-	return mCache, newAsyncCache(&mCache, config)
+	return mCache, newAsyncCache(mCache, config, true)
 }
@@ -4,7 +4,6 @@ package cache
 
 import (
 	"core"
-	"net/http"
 	"sync"
 
 	"gopkg.in/op/go-logging.v1"
@@ -13,10 +12,12 @@ import (
 var log = logging.MustGetLogger("cache")
 
 // NewCache is the factory function for creating a cache setup from the given config.
-func NewCache(config *core.Configuration) *core.Cache {
+// If resume is true it resumes any uploads left unfinished by previous runs; that should only
+// be done by commands that build things, since others may not run for long enough to finish them.
+func NewCache(config *core.Configuration, resume bool) *core.Cache {
 	c := newSyncCache(config)
 	if config.Cache.Workers > 0 {
-		c := newAsyncCache(*c, config)
+		c := newAsyncCache(*c, config, resume)
 		return &c
 	}
 	return c
@@ -27,8 +28,8 @@ func newSyncCache(config *core.Configuration) *core.Cache {
 	if config.Cache.Dir != "" {
 		mplex.caches = append(mplex.caches, newDirCache(config))
 	}
-	if config.Cache.RpcUrl != "" {
-		cache, err := newRpcCache(config)
+	if len(config.Cache.RpcUrl) > 0 {
+		cache, err := newRpcCluster(config)
 		if err == nil {
 			mplex.caches = append(mplex.caches, cache)
 		} else {
@@ -36,9 +37,9 @@ func newSyncCache(config *core.Configuration) *core.Cache {
 		}
 	}
 	if config.Cache.HttpUrl != "" {
-		res, err := http.Get(config.Cache.HttpUrl + "/ping")
-		if err == nil && res.StatusCode == 200 {
-			mplex.caches = append(mplex.caches, newHttpCache(config))
+		cache, err := newHttpCache(config)
+		if err == nil {
+			mplex.caches = append(mplex.caches, cache)
 		} else {
 			log.Warning("Http cache server could not be reached: %s.\nSkipping http caching...", err)
 		}
@@ -137,12 +138,50 @@ func (mplex cacheMultiplexer) Clean(target *core.BuildTarget) {
 	}
 }
 
+func (mplex cacheMultiplexer) List(target *core.BuildTarget) []core.CacheEntry {
+	ret := []core.CacheEntry{}
+	for _, cache := range mplex.caches {
+		ret = append(ret, cache.List(target)...)
+	}
+	return ret
+}
+
+func (mplex cacheMultiplexer) Evict(target *core.BuildTarget, key []byte) {
+	for _, cache := range mplex.caches {
+		cache.Evict(target, key)
+	}
+}
+
+func (mplex cacheMultiplexer) Stats() []core.CacheStats {
+	ret := []core.CacheStats{}
+	for _, cache := range mplex.caches {
+		ret = append(ret, cache.Stats()...)
+	}
+	return ret
+}
+
 func (mplex cacheMultiplexer) Shutdown() {
 	for _, cache := range mplex.caches {
 		cache.Shutdown()
 	}
 }
 
+// Layers returns the individual caches that the given cache is made up of, in the order they're
+// checked when retrieving artifacts. Caches that aren't made up of others are returned as they are.
+func Layers(cache core.Cache) []core.Cache {
+	switch c := cache.(type) {
+	case cacheMultiplexer:
+		ret := []core.Cache{}
+		for _, cache := range c.caches {
+			ret = append(ret, Layers(cache)...)
+		}
+		return ret
+	case *asyncCache:
+		return Layers(c.realCache)
+	}
+	return []core.Cache{cache}
+}
+
 // Yields all cacheable artifacts from this target. Useful for cache implementations
 // to not have to reinvent logic around post-build functions etc.
 func cacheArtifacts(target *core.BuildTarget) <-chan string {
@@ -0,0 +1,93 @@
+// Package cluster implements consistent hashing of cache artifacts across a set of cache servers.
+//
+// Both the clients and the servers use it to agree on which servers each artifact belongs on,
+// so they must all be given the same set of server addresses.
+package cluster
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// pointsPerNode is the number of points each node has on the ring. Having lots of them
+// spreads the keys more evenly between the nodes.
+const pointsPerNode = 100
+
+// A Ring assigns keys to nodes by consistent hashing, so adding or removing a node only
+// moves the keys that belong to it.
+type Ring struct {
+	nodes  []string
+	points points
+}
+
+// A point is a single position on the ring belonging to a node.
+type point struct {
+	hash uint64
+	node int
+}
+
+type points []point
+
+func (p points) Len() int           { return len(p) }
+func (p points) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p points) Less(i, j int) bool { return p[i].hash < p[j].hash }
+
+// NewRing creates a new ring from the given set of nodes, which should be distinct.
+// The order they're given in doesn't matter.
+func NewRing(nodes []string) *Ring {
+	r := &Ring{nodes: nodes, points: make(points, 0, len(nodes)*pointsPerNode)}
+	for i, node := range nodes {
+		for j := 0; j < pointsPerNode; j++ {
+			r.points = append(r.points, point{hash: hash([]byte(fmt.Sprintf("%s-%d", node, j))), node: i})
+		}
+	}
+	sort.Sort(r.points)
+	return r
+}
+
+// Nodes returns the nodes in this ring.
+func (r *Ring) Nodes() []string {
+	return r.nodes
+}
+
+// Replicas returns the n nodes that the given key belongs on, in order of preference.
+// If n is larger than the number of nodes then they're all returned, so Replicas(key, len(nodes))
+// gives the order to fall back through them in if some aren't available.
+func (r *Ring) Replicas(key []byte, n int) []string {
+	if n > len(r.nodes) {
+		n = len(r.nodes)
+	}
+	ret := make([]string, 0, n)
+	if n <= 0 {
+		return ret
+	}
+	h := hash(key)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	seen := make([]bool, len(r.nodes))
+	for i := 0; len(ret) < n; i++ {
+		p := r.points[(start+i)%len(r.points)]
+		if !seen[p.node] {
+			seen[p.node] = true
+			ret = append(ret, r.nodes[p.node])
+		}
+	}
+	return ret
+}
+
+// Contains returns true if the given node is among the n that the given key belongs on.
+func (r *Ring) Contains(key []byte, n int, node string) bool {
+	for _, replica := range r.Replicas(key, n) {
+		if replica == node {
+			return true
+		}
+	}
+	return false
+}
+
+// hash returns the position of something on the ring.
+func hash(b []byte) uint64 {
+	h := sha1.Sum(b)
+	return binary.BigEndian.Uint64(h[:8])
+}
@@ -0,0 +1,72 @@
+package cluster
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var nodes = []string{"cache1:7677", "cache2:7677", "cache3:7677", "cache4:7677"}
+
+func TestReplicas(t *testing.T) {
+	r := NewRing(nodes)
+	replicas := r.Replicas([]byte("key"), 2)
+	assert.Equal(t, 2, len(replicas))
+	assert.NotEqual(t, replicas[0], replicas[1])
+	// Asking for more should extend the same list.
+	assert.Equal(t, replicas, r.Replicas([]byte("key"), 3)[:2])
+}
+
+func TestReplicasCapped(t *testing.T) {
+	r := NewRing(nodes)
+	assert.Equal(t, 4, len(r.Replicas([]byte("key"), 10)))
+	assert.Equal(t, 0, len(r.Replicas([]byte("key"), 0)))
+	assert.Equal(t, 0, len(NewRing(nil).Replicas([]byte("key"), 2)))
+}
+
+func TestOrderIndependent(t *testing.T) {
+	r1 := NewRing(nodes)
+	r2 := NewRing([]string{nodes[3], nodes[1], nodes[0], nodes[2]})
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		assert.Equal(t, r1.Replicas(key, 2), r2.Replicas(key, 2))
+	}
+}
+
+func TestBalanced(t *testing.T) {
+	r := NewRing(nodes)
+	counts := map[string]int{}
+	for i := 0; i < 10000; i++ {
+		counts[r.Replicas([]byte(fmt.Sprintf("key%d", i)), 1)[0]]++
+	}
+	for _, node := range nodes {
+		// Perfect balance would be 2500 each; this is pretty loose but catches anything badly wrong.
+		assert.True(t, counts[node] > 1500, "%s has %d keys", node, counts[node])
+	}
+}
+
+func TestConsistent(t *testing.T) {
+	// Adding a node should only move keys onto that node, not between the existing ones.
+	r1 := NewRing(nodes[:3])
+	r2 := NewRing(nodes)
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		before := r1.Replicas(key, 1)[0]
+		after := r2.Replicas(key, 1)[0]
+		if before != after {
+			assert.Equal(t, nodes[3], after)
+			moved++
+		}
+	}
+	assert.True(t, moved > 100 && moved < 400, "%d keys moved", moved)
+}
+
+func TestContains(t *testing.T) {
+	r := NewRing(nodes)
+	replicas := r.Replicas([]byte("key"), 2)
+	assert.True(t, r.Contains([]byte("key"), 2, replicas[1]))
+	assert.False(t, r.Contains([]byte("key"), 1, replicas[1]))
+	assert.False(t, r.Contains([]byte("key"), 2, "cache5:7677"))
+}
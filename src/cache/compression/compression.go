@@ -0,0 +1,303 @@
+// Package compression implements compression of cache artifacts, both while they're being
+// transferred to and from the remote caches and while they're stored at rest in them.
+//
+// Artifacts are always identified by the digest of their uncompressed contents, so compression
+// is transparent to everything other than the code that reads and writes them.
+//
+// gzip is always available. zstd is only available when built with the zstd tag, since its
+// implementation needs a much newer Go than the rest of plz does.
+package compression
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"gopkg.in/op/go-logging.v1"
+)
+
+var log = logging.MustGetLogger("compression")
+
+// The compression algorithms we support. The names are the same as the HTTP content codings.
+const (
+	None = "none"
+	Gzip = "gzip"
+	Zstd = "zstd"
+)
+
+// Supported lists the algorithms we support, in order of preference.
+var Supported = []string{Gzip}
+
+// newZstdWriter and newZstdReader implement zstd; they're nil unless we're built with it.
+var newZstdWriter func(w io.Writer) (io.WriteCloser, error)
+var newZstdReader func(r io.Reader) (io.ReadCloser, error)
+
+// IsSupported returns true if the given algorithm is one we support.
+func IsSupported(algorithm string) bool {
+	for _, a := range Supported {
+		if a == algorithm {
+			return true
+		}
+	}
+	return false
+}
+
+// Configured returns the algorithm to use given the one in the config, which is empty for
+// none. If we don't support the configured one (i.e. zstd when we weren't built with it)
+// it warns and falls back to gzip.
+func Configured(algorithm string) string {
+	if algorithm == None || algorithm == "" {
+		return ""
+	} else if !IsSupported(algorithm) {
+		log.Warning("%s compression isn't available in this build of plz, using %s instead", algorithm, Gzip)
+		return Gzip
+	}
+	return algorithm
+}
+
+// Accepts returns the algorithms a client should advertise that it accepts given the one
+// it's configured to prefer. It's empty if it's configured not to use compression.
+func Accepts(preferred string) []string {
+	if !IsSupported(preferred) {
+		return nil
+	}
+	ret := []string{preferred}
+	for _, a := range Supported {
+		if a != preferred {
+			ret = append(ret, a)
+		}
+	}
+	return ret
+}
+
+// Choose returns the first of the given algorithms that we support, or the empty string
+// if there aren't any (in which case the content shouldn't be compressed).
+func Choose(accepted []string) string {
+	for _, a := range accepted {
+		if IsSupported(a) {
+			return a
+		}
+	}
+	return ""
+}
+
+// Negotiate returns the algorithm a client should compress what it sends with, given the one
+// it prefers and the ones the server accepts. It's empty if it shouldn't compress anything,
+// either because it prefers not to or because there aren't any that both sides support.
+func Negotiate(preferred string, accepted []string) string {
+	if !IsSupported(preferred) {
+		return ""
+	}
+	for _, a := range accepted {
+		if a == preferred {
+			return a
+		}
+	}
+	return Choose(accepted)
+}
+
+// ParseHeader parses the value of an HTTP Accept-Encoding header into a list of algorithms,
+// in the order they're given. Any that are explicitly refused (i.e. q=0) are omitted.
+func ParseHeader(header string) []string {
+	ret := []string{}
+	for _, coding := range strings.Split(header, ",") {
+		parts := strings.Split(coding, ";")
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		if name == "" || (len(parts) > 1 && strings.Replace(strings.TrimSpace(parts[1]), " ", "", -1) == "q=0") {
+			continue
+		}
+		ret = append(ret, name)
+	}
+	return ret
+}
+
+// NewWriter returns a writer that compresses everything written to it into w.
+// It must be closed to flush the compressed data; that doesn't close w.
+func NewWriter(algorithm string, w io.Writer) (io.WriteCloser, error) {
+	switch algorithm {
+	case Gzip:
+		return gzip.NewWriter(w), nil
+	case Zstd:
+		if newZstdWriter != nil {
+			return newZstdWriter(w)
+		}
+	}
+	return nil, fmt.Errorf("Unknown compression algorithm %s", algorithm)
+}
+
+// NewReader returns a reader that decompresses the contents of r.
+func NewReader(algorithm string, r io.Reader) (io.ReadCloser, error) {
+	switch algorithm {
+	case Gzip:
+		return gzip.NewReader(r)
+	case Zstd:
+		if newZstdReader != nil {
+			return newZstdReader(r)
+		}
+	}
+	return nil, fmt.Errorf("Unknown compression algorithm %s", algorithm)
+}
+
+// Compress compresses some content with the given algorithm.
+func Compress(algorithm string, data []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w, err := NewWriter(algorithm, &b)
+	if err != nil {
+		return nil, err
+	} else if _, err := w.Write(data); err != nil {
+		return nil, err
+	} else if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Decompress decompresses some content that was compressed with the given algorithm.
+func Decompress(algorithm string, data []byte) ([]byte, error) {
+	r, err := NewReader(algorithm, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// CompressIfSmaller compresses some content with the given algorithm if that makes it smaller.
+// It returns the content to send and the algorithm it's compressed with, which is empty if
+// it hasn't been compressed (because algorithm was empty, or it didn't compress well, or
+// it failed).
+func CompressIfSmaller(algorithm string, data []byte) ([]byte, string) {
+	if algorithm == "" || len(data) == 0 {
+		return data, ""
+	}
+	compressed, err := Compress(algorithm, data)
+	if err != nil || len(compressed) >= len(data) {
+		return data, ""
+	}
+	return compressed, algorithm
+}
+
+// SniffSize is the number of bytes from the start of a file that Compressible looks at.
+const SniffSize = 8
+
+// incompressibleExtensions are the extensions of files that are already compressed, so it isn't
+// worth compressing them again.
+var incompressibleExtensions = map[string]bool{
+	".7z":   true,
+	".bz2":  true,
+	".gif":  true,
+	".gz":   true,
+	".jar":  true,
+	".jpeg": true,
+	".jpg":  true,
+	".pex":  true,
+	".png":  true,
+	".tgz":  true,
+	".war":  true,
+	".whl":  true,
+	".xz":   true,
+	".zip":  true,
+	".zst":  true,
+}
+
+// incompressibleMagic are the magic numbers at the start of file formats that are already compressed.
+var incompressibleMagic = [][]byte{
+	{'P', 'K', 3, 4},                   // zip (and hence jar, whl etc)
+	{0x1f, 0x8b},                       // gzip
+	{0x28, 0xb5, 0x2f, 0xfd},           // zstd
+	{'B', 'Z', 'h'},                    // bzip2
+	{0xfd, '7', 'z', 'X', 'Z', 0},      // xz
+	{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}, // 7z
+	{0x89, 'P', 'N', 'G'},              // png
+	{0xff, 0xd8, 0xff},                 // jpeg
+}
+
+// Compressible returns true if it's worth compressing a file, given its name and either its
+// contents or at least the first SniffSize bytes of them. Files that are already compressed
+// (jars, pexes, tarballs etc) are not.
+func Compressible(filename string, head []byte) bool {
+	if incompressibleExtensions[strings.ToLower(path.Ext(filename))] {
+		return false
+	}
+	for _, magic := range incompressibleMagic {
+		if bytes.HasPrefix(head, magic) {
+			return false
+		}
+	}
+	return true
+}
+
+// FileCompressible is like Compressible but reads the start of the file itself.
+func FileCompressible(filename string) bool {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	head := make([]byte, SniffSize)
+	n, _ := io.ReadFull(f, head)
+	return Compressible(filename, head[:n])
+}
+
+// storedMagic starts anything that's stored compressed at rest. It's followed by the name of
+// the algorithm and a newline, and then the compressed contents.
+const storedMagic = "\x00plz-compressed:"
+
+// NewStoredWriter returns a writer that writes content to be stored compressed into w.
+// NewStoredReader recognises it again when it's read back.
+func NewStoredWriter(algorithm string, w io.Writer) (io.WriteCloser, error) {
+	if !IsSupported(algorithm) {
+		return nil, fmt.Errorf("Unknown compression algorithm %s", algorithm)
+	} else if _, err := io.WriteString(w, storedMagic+algorithm+"\n"); err != nil {
+		return nil, err
+	}
+	return NewWriter(algorithm, w)
+}
+
+// NewStoredReader returns a reader over the original contents of something that was written
+// either by NewStoredWriter or without compression at all.
+func NewStoredReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	if head, _ := br.Peek(len(storedMagic)); string(head) != storedMagic {
+		return ioutil.NopCloser(br), nil
+	}
+	br.Discard(len(storedMagic))
+	algorithm, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	return NewReader(strings.TrimSuffix(algorithm, "\n"), br)
+}
+
+// IsStored returns true if the given file was stored compressed by NewStoredWriter.
+func IsStored(filename string) bool {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	head := make([]byte, len(storedMagic))
+	n, _ := io.ReadFull(f, head)
+	return string(head[:n]) == storedMagic
+}
+
+// ReadStoredFile reads the original contents of a file that might have been stored compressed.
+func ReadStoredFile(filename string) ([]byte, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := NewStoredReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
@@ -0,0 +1,121 @@
+package compression
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var content = []byte(strings.Repeat("package main\n\nfunc main() {}\n", 100))
+
+func TestRoundTrip(t *testing.T) {
+	for _, algorithm := range Supported {
+		compressed, err := Compress(algorithm, content)
+		assert.NoError(t, err)
+		assert.True(t, len(compressed) < len(content), algorithm)
+		decompressed, err := Decompress(algorithm, compressed)
+		assert.NoError(t, err)
+		assert.Equal(t, content, decompressed, algorithm)
+	}
+}
+
+func TestUnknownAlgorithm(t *testing.T) {
+	_, err := Compress("lzma", content)
+	assert.Error(t, err)
+	_, err = Decompress("lzma", content)
+	assert.Error(t, err)
+}
+
+func TestCompressIfSmaller(t *testing.T) {
+	b, algorithm := CompressIfSmaller(Gzip, content)
+	assert.Equal(t, Gzip, algorithm)
+	assert.True(t, len(b) < len(content))
+	b, algorithm = CompressIfSmaller(Gzip, []byte("x"))
+	assert.Equal(t, "", algorithm)
+	assert.Equal(t, []byte("x"), b)
+	b, algorithm = CompressIfSmaller("", content)
+	assert.Equal(t, "", algorithm)
+	assert.Equal(t, content, b)
+}
+
+func TestAccepts(t *testing.T) {
+	accepts := Accepts(Gzip)
+	assert.Equal(t, Gzip, accepts[0])
+	assert.Equal(t, len(Supported), len(accepts))
+	assert.Nil(t, Accepts("lzma"))
+	assert.Nil(t, Accepts(None))
+	assert.Nil(t, Accepts(""))
+}
+
+func TestChoose(t *testing.T) {
+	assert.Equal(t, Gzip, Choose([]string{"br", Gzip, Zstd}))
+	assert.Equal(t, "", Choose([]string{"br", "identity"}))
+	assert.Equal(t, "", Choose(nil))
+}
+
+func TestNegotiate(t *testing.T) {
+	assert.Equal(t, Gzip, Negotiate(Gzip, []string{Zstd, Gzip}))
+	assert.Equal(t, Gzip, Negotiate(Gzip, []string{"br", Gzip}))
+	assert.Equal(t, "", Negotiate(Gzip, []string{"br"}))
+	assert.Equal(t, "", Negotiate(Gzip, nil))
+	assert.Equal(t, "", Negotiate("", []string{Zstd, Gzip}))
+}
+
+func TestConfigured(t *testing.T) {
+	assert.Equal(t, "", Configured(None))
+	assert.Equal(t, "", Configured(""))
+	assert.Equal(t, Gzip, Configured(Gzip))
+	if IsSupported(Zstd) {
+		assert.Equal(t, Zstd, Configured(Zstd))
+	} else {
+		assert.Equal(t, Gzip, Configured(Zstd))
+	}
+}
+
+func TestParseHeader(t *testing.T) {
+	assert.Equal(t, []string{Zstd, Gzip}, ParseHeader("zstd, gzip"))
+	assert.Equal(t, []string{Gzip, "br"}, ParseHeader("GZIP;q=0.5, zstd;q=0, br"))
+	assert.Equal(t, []string{}, ParseHeader(""))
+}
+
+func TestCompressible(t *testing.T) {
+	assert.True(t, Compressible("src/main.go", content[:SniffSize]))
+	assert.False(t, Compressible("lib.jar", content[:SniffSize]))
+	assert.False(t, Compressible("tool.PEX", nil))
+	assert.False(t, Compressible("archive", []byte{'P', 'K', 3, 4, 0, 0}))
+	assert.False(t, Compressible("data", []byte{0x1f, 0x8b, 8}))
+	assert.True(t, Compressible("empty", nil))
+}
+
+func TestStoredRoundTrip(t *testing.T) {
+	for _, algorithm := range Supported {
+		var b bytes.Buffer
+		w, err := NewStoredWriter(algorithm, &b)
+		assert.NoError(t, err)
+		w.Write(content)
+		assert.NoError(t, w.Close())
+		assert.True(t, b.Len() < len(content))
+		r, err := NewStoredReader(&b)
+		assert.NoError(t, err)
+		decompressed, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, content, decompressed, algorithm)
+	}
+}
+
+func TestStoredReaderUncompressed(t *testing.T) {
+	r, err := NewStoredReader(bytes.NewReader(content))
+	assert.NoError(t, err)
+	b, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, content, b)
+	// Shorter than the header.
+	r, err = NewStoredReader(bytes.NewReader([]byte("hi")))
+	assert.NoError(t, err)
+	b, err = ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hi"), b)
+}
@@ -0,0 +1,23 @@
+// +build zstd
+
+package compression
+
+import (
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func init() {
+	Supported = append([]string{Zstd}, Supported...)
+	newZstdWriter = func(w io.Writer) (io.WriteCloser, error) {
+		return zstd.NewWriter(w)
+	}
+	newZstdReader = func(r io.Reader) (io.ReadCloser, error) {
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+}
@@ -5,15 +5,22 @@ package cache
 import (
 	"encoding/base64"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
 	"syscall"
 
+	"cache/compression"
 	"core"
+	"metrics"
 )
 
 type dirCache struct {
 	Dir string
+	// Algorithm to compress artifacts with, or empty if they're stored as they are.
+	Compression string
 }
 
 func (cache *dirCache) Store(target *core.BuildTarget, key []byte) {
@@ -55,12 +62,100 @@ func (cache *dirCache) storeFile(target *core.BuildTarget, out, cacheDir string)
 	} else if err := os.MkdirAll(cacheDir, core.DirPermissions); err != nil {
 		log.Warning("Failed to create cache directory %s: %s", cacheDir, err)
 		return
+	} else if cache.Compression != "" {
+		if err := cache.storeCompressed(outFile, cachedFile, fileMode(target)); err != nil {
+			log.Warning("Failed to store cache file %s: %s", cachedFile, err)
+		}
 	} else if err := core.RecursiveCopyFile(outFile, cachedFile, fileMode(target), true, true); err != nil {
 		// Cannot hardlink files into the cache, must copy them for reals.
 		log.Warning("Failed to store cache file %s: %s", cachedFile, err)
 	}
 }
 
+// storeCompressed stores an output in the cache, compressing any of its files that are worth it.
+// The others are hardlinked as usual.
+func (cache *dirCache) storeCompressed(from, to string, mode os.FileMode) error {
+	return walkFiles(from, to, func(from, to string) error {
+		if !compression.FileCompressible(from) {
+			return core.RecursiveCopyFile(from, to, mode, true, true)
+		}
+		return cache.compressFile(from, to, mode)
+	})
+}
+
+// compressFile writes a compressed copy of a single file into the cache.
+func (cache *dirCache) compressFile(from, to string, mode os.FileMode) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	w, err := compression.NewStoredWriter(cache.Compression, out)
+	if err != nil {
+		return err
+	}
+	size, err := io.Copy(w, in)
+	if err != nil {
+		return err
+	} else if err := w.Close(); err != nil {
+		return err
+	}
+	if info, err := out.Stat(); err == nil {
+		metrics.RecordCompression(cache.Compression, int(size), int(info.Size()))
+	}
+	return nil
+}
+
+// retrieveFiles retrieves an output from the cache, decompressing any of its files that were
+// stored compressed (which they might have been even if we aren't compressing any more).
+// The others are hardlinked as usual.
+func retrieveFiles(from, to string, mode os.FileMode) error {
+	return walkFiles(from, to, func(from, to string) error {
+		if !compression.IsStored(from) {
+			return core.RecursiveCopyFile(from, to, mode, true, true)
+		}
+		f, err := os.Open(from)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r, err := compression.NewStoredReader(f)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		return core.WriteFile(r, to, mode)
+	})
+}
+
+// walkFiles calls f for each file in from, which can be a single file or a directory, along with
+// the corresponding path in to. Directories are created in to as it goes.
+func walkFiles(from, to string, f func(from, to string) error) error {
+	if info, err := os.Stat(from); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return f(from, to)
+	}
+	return filepath.Walk(from, func(name string, info os.FileInfo, err error) error {
+		dest := path.Join(to, name[len(from):])
+		if err != nil {
+			return err
+		} else if info.IsDir() {
+			return os.MkdirAll(dest, core.DirPermissions)
+		} else if (info.Mode() & os.ModeSymlink) != 0 {
+			if fi, err := os.Stat(name); err == nil && fi.IsDir() {
+				return walkFiles(name+"/", dest+"/", f)
+			}
+		}
+		return f(name, dest)
+	})
+}
+
 func (cache *dirCache) Retrieve(target *core.BuildTarget, key []byte) bool {
 	cacheDir := cache.getPath(target, key)
 	if !core.PathExists(cacheDir) {
@@ -98,7 +193,7 @@ func (cache *dirCache) RetrieveExtra(target *core.BuildTarget, key []byte, out s
 		return false
 	}
 	// Recursively hardlink files back out of the cache
-	if err := core.RecursiveCopyFile(cachedOut, realOut, fileMode(target), true, true); err != nil {
+	if err := retrieveFiles(cachedOut, realOut, fileMode(target)); err != nil {
 		log.Warning("Failed to move cached file to output: %s -> %s: %s", cachedOut, realOut, err)
 		return false
 	}
@@ -108,20 +203,82 @@ func (cache *dirCache) RetrieveExtra(target *core.BuildTarget, key []byte, out s
 
 func (cache *dirCache) Clean(target *core.BuildTarget) {
 	// Remove for all possible keys, so can't get getPath here
-	if err := os.RemoveAll(path.Join(cache.Dir, target.Label.PackageName, target.Label.Name)); err != nil {
+	if err := os.RemoveAll(cache.targetDir(target)); err != nil {
 		log.Warning("Failed to remove artifacts for %s from dir cache: %s", target.Label, err)
 	}
 }
 
+func (cache *dirCache) List(target *core.BuildTarget) []core.CacheEntry {
+	dir := cache.targetDir(target)
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warning("Failed to list artifacts for %s in dir cache: %s", target.Label, err)
+		}
+		return nil
+	}
+	ret := []core.CacheEntry{}
+	for _, info := range infos {
+		if key := dirCacheKey(info); key != nil {
+			ret = append(ret, core.CacheEntry{Cache: cache.name(), Key: key})
+		}
+	}
+	return ret
+}
+
+func (cache *dirCache) Evict(target *core.BuildTarget, key []byte) {
+	if err := os.RemoveAll(cache.getPath(target, key)); err != nil {
+		log.Warning("Failed to remove artifacts for %s from dir cache: %s", target.Label, err)
+	}
+}
+
+func (cache *dirCache) Stats() []core.CacheStats {
+	stats := core.CacheStats{Cache: cache.name()}
+	stats.Err = filepath.Walk(cache.Dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if !info.IsDir() {
+			stats.Size += info.Size()
+		} else if dirCacheKey(info) != nil {
+			stats.Entries++
+		}
+		return nil
+	})
+	return []core.CacheStats{stats}
+}
+
 func (cache *dirCache) Shutdown() {}
 
+// name returns a description of this cache.
+func (cache *dirCache) name() string {
+	return "dir " + cache.Dir
+}
+
+// dirCacheKey returns the key that a directory in the cache stores artifacts under, or nil if it
+// isn't one of those directories (e.g. because it's part of a package name, or an output).
+func dirCacheKey(info os.FileInfo) []byte {
+	if !info.IsDir() {
+		return nil
+	} else if key, err := base64.URLEncoding.DecodeString(info.Name()); err == nil && (len(key) == 20 || len(key) == 32) {
+		return key
+	}
+	return nil
+}
+
+// targetDir returns the directory that all artifacts for a target are stored under.
+// Each platform and configuration has its own so cleaning one doesn't affect the others.
+func (cache *dirCache) targetDir(target *core.BuildTarget) string {
+	return path.Join(cache.Dir, target.Label.VariantDir(), target.Label.PackageName, target.Label.Name)
+}
+
 func (cache *dirCache) getPath(target *core.BuildTarget, key []byte) string {
 	// NB. Is very important to use a padded encoding here so lengths are consistent for cache_cleaner.
-	return path.Join(cache.Dir, target.Label.PackageName, target.Label.Name, base64.URLEncoding.EncodeToString(key))
+	return path.Join(cache.targetDir(target), base64.URLEncoding.EncodeToString(key))
 }
 
 func newDirCache(config *core.Configuration) *dirCache {
 	cache := new(dirCache)
+	cache.Compression = compression.Configured(config.Cache.DirCompression)
 	// Absolute paths are allowed. Relative paths are interpreted relative to the repo root.
 	if config.Cache.Dir[0] == '/' {
 		cache.Dir = config.Cache.Dir
@@ -0,0 +1,113 @@
+package cache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"cache/compression"
+	"core"
+)
+
+var contents = bytes.Repeat([]byte("some file contents "), 1000)
+
+func TestStoreAndRetrieveCompressed(t *testing.T) {
+	config := core.DefaultConfiguration()
+	config.Cache.Dir = "plz-out/dir_cache_compressed"
+	config.Cache.DirCompression = "gzip"
+	cache := newDirCache(config)
+	target := makeDirTarget("compressed", "out.txt", "out.jar")
+	cache.Store(target, []byte("test_key"))
+	cacheDir := cache.getPath(target, []byte("test_key"))
+	assert.True(t, compression.IsStored(path.Join(cacheDir, "out.txt")), "Should be compressed in the cache")
+	assert.False(t, compression.IsStored(path.Join(cacheDir, "out.jar")), "Shouldn't compress a jar again")
+	assert.True(t, core.IsSameFile(path.Join(cacheDir, "out.jar"), path.Join(target.OutDir(), "out.jar")), "Should still be hardlinked")
+
+	assert.NoError(t, os.RemoveAll(target.OutDir()))
+	assert.True(t, cache.Retrieve(target, []byte("test_key")))
+	for _, out := range target.Outputs() {
+		b, err := ioutil.ReadFile(path.Join(target.OutDir(), out))
+		assert.NoError(t, err)
+		assert.Equal(t, contents, b)
+	}
+}
+
+func TestRetrieveCompressedWithoutCompression(t *testing.T) {
+	// Artifacts that were stored compressed can still be retrieved once compression is turned off.
+	config := core.DefaultConfiguration()
+	config.Cache.Dir = "plz-out/dir_cache_uncompressed"
+	config.Cache.DirCompression = "gzip"
+	target := makeDirTarget("uncompressed", "out.txt")
+	newDirCache(config).Store(target, []byte("test_key"))
+	config.Cache.DirCompression = "none"
+	cache := newDirCache(config)
+	assert.NoError(t, os.RemoveAll(target.OutDir()))
+	assert.True(t, cache.Retrieve(target, []byte("test_key")))
+	b, err := ioutil.ReadFile(path.Join(target.OutDir(), "out.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, contents, b)
+}
+
+func makeDirTarget(name string, outs ...string) *core.BuildTarget {
+	target := core.NewBuildTarget(core.NewBuildLabel("src/cache", name))
+	os.MkdirAll(target.OutDir(), core.DirPermissions)
+	for _, out := range outs {
+		target.AddOutput(out)
+		ioutil.WriteFile(path.Join(target.OutDir(), out), contents, 0644)
+	}
+	return target
+}
+
+func TestListAndEvict(t *testing.T) {
+	config := core.DefaultConfiguration()
+	config.Cache.Dir = "plz-out/dir_cache_list"
+	cache := newDirCache(config)
+	target := makeDirTarget("list", "out.txt")
+	key1 := bytes.Repeat([]byte{1}, 20)
+	key2 := bytes.Repeat([]byte{2}, 20)
+	cache.Store(target, key1)
+	cache.Store(target, key2)
+	assert.Equal(t, []core.CacheEntry{
+		{Cache: "dir " + cache.Dir, Key: key1},
+		{Cache: "dir " + cache.Dir, Key: key2},
+	}, cache.List(target))
+	cache.Evict(target, key1)
+	assert.Equal(t, []core.CacheEntry{{Cache: "dir " + cache.Dir, Key: key2}}, cache.List(target))
+	assert.False(t, cache.Retrieve(target, key1))
+	assert.True(t, cache.Retrieve(target, key2))
+}
+
+func TestStats(t *testing.T) {
+	config := core.DefaultConfiguration()
+	config.Cache.Dir = "plz-out/dir_cache_stats"
+	cache := newDirCache(config)
+	target := makeDirTarget("stats", "out1.txt", "out2.txt")
+	cache.Store(target, bytes.Repeat([]byte{1}, 20))
+	cache.Store(target, bytes.Repeat([]byte{2}, 32))
+	stats := cache.Stats()
+	assert.Equal(t, 1, len(stats))
+	assert.NoError(t, stats[0].Err)
+	assert.Equal(t, 2, stats[0].Entries)
+	assert.EqualValues(t, 4*len(contents), stats[0].Size)
+}
+
+func TestCleanOneConfig(t *testing.T) {
+	config := core.DefaultConfiguration()
+	config.Cache.Dir = "plz-out/dir_cache_configs"
+	cache := newDirCache(config)
+	target := makeDirTarget("configs", "out.txt")
+	variant := target.ForConfig("dbg")
+	assert.NoError(t, os.MkdirAll(variant.OutDir(), core.DirPermissions))
+	assert.NoError(t, ioutil.WriteFile(path.Join(variant.OutDir(), "out.txt"), contents, 0644))
+	key := bytes.Repeat([]byte{1}, 20)
+	cache.Store(target, key)
+	cache.Store(variant, key)
+	assert.NotEqual(t, cache.getPath(target, key), cache.getPath(variant, key))
+	cache.Clean(variant)
+	assert.Equal(t, 0, len(cache.List(variant)))
+	assert.Equal(t, []core.CacheEntry{{Cache: "dir " + cache.Dir, Key: key}}, cache.List(target))
+}
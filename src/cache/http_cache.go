@@ -3,25 +3,38 @@
 package cache
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"mime"
 	"mime/multipart"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
-	"runtime"
+	"strings"
 	"time"
 
+	"cache/compression"
 	"core"
+	"metrics"
 )
 
 type httpCache struct {
 	Url       string
 	Writeable bool
 	Timeout   time.Duration
-	OSName    string
+	// Bearer token to authenticate to the server with, if any.
+	token  string
+	client *http.Client
+	// Algorithm we'd prefer artifacts to be compressed with, or empty if they shouldn't be.
+	compression string
+	// Algorithm we compress artifacts we send with, which the server must support.
+	uploadCompression string
 }
 
 func (cache *httpCache) Store(target *core.BuildTarget, key []byte) {
@@ -48,23 +61,32 @@ func (cache *httpCache) Store(target *core.BuildTarget, key []byte) {
 func (cache *httpCache) StoreExtra(target *core.BuildTarget, key []byte, file string) {
 	if cache.Writeable {
 		artifact := path.Join(
-			cache.OSName,
-			target.Label.PackageName,
-			target.Label.Name,
+			targetPath(target),
 			base64.RawURLEncoding.EncodeToString(key),
 			file,
 		)
 		log.Info("Storing %s: %s in http cache...", target.Label, artifact)
 
 		// NB. Don't need to close this file, http.Post will do it for us.
-		file, err := os.Open(path.Join(target.OutDir(), file))
+		filename := path.Join(target.OutDir(), file)
+		file, err := os.Open(filename)
 		if err != nil {
 			log.Warning("Failed to read artifact: %s", err)
 			return
 		}
-		response, err := http.Post(cache.Url+"/artifact/"+artifact, "application/octet-stream", file)
+		req, err := cache.newRequest("POST", "/artifact/"+artifact, file)
 		if err != nil {
 			log.Warning("Failed to send artifact to %s: %s", cache.Url+"/artifact/"+artifact, err)
+			return
+		} else if cache.uploadCompression != "" && compression.FileCompressible(filename) {
+			req.Body = cache.compressBody(file)
+			req.ContentLength = -1
+			req.Header.Set("Content-Encoding", cache.uploadCompression)
+		}
+		response, err := cache.client.Do(req)
+		if err != nil {
+			log.Warning("Failed to send artifact to %s: %s", cache.Url+"/artifact/"+artifact, err)
+			return
 		} else if response.StatusCode < 200 || response.StatusCode > 299 {
 			log.Warning("Failed to send artifact to %s: got response %s", cache.Url+"/artifact/"+artifact, response.Status)
 		}
@@ -90,14 +112,20 @@ func (cache *httpCache) RetrieveExtra(target *core.BuildTarget, key []byte, file
 	log.Debug("Retrieving %s:%s from http cache...", target.Label, file)
 
 	artifact := path.Join(
-		cache.OSName,
-		target.Label.PackageName,
-		target.Label.Name,
+		targetPath(target),
 		base64.RawURLEncoding.EncodeToString(key),
 		file,
 	)
 
-	response, err := http.Get(cache.Url + "/artifact/" + artifact)
+	req, err := cache.newRequest("GET", "/artifact/"+artifact, nil)
+	if err != nil {
+		return false
+	} else if accepts := compression.Accepts(cache.compression); len(accepts) > 0 {
+		req.Header.Set("Accept-Encoding", strings.Join(accepts, ", "))
+	} else {
+		req.Header.Set("Accept-Encoding", "identity")
+	}
+	response, err := cache.client.Do(req)
 	if err != nil {
 		return false
 	}
@@ -107,15 +135,22 @@ func (cache *httpCache) RetrieveExtra(target *core.BuildTarget, key []byte, file
 	} else if response.StatusCode < 200 || response.StatusCode > 299 {
 		log.Warning("Error %d from http cache", response.StatusCode)
 		return false
-	} else if response.Header.Get("Content-Type") == "application/octet-stream" {
+	}
+	body, err := newResponseReader(response)
+	if err != nil {
+		log.Warning("Couldn't decompress response from http cache: %s", err)
+		return false
+	}
+	defer body.Close()
+	if response.Header.Get("Content-Type") == "application/octet-stream" {
 		// Single artifact
-		return cache.writeFile(target, file, response.Body)
+		return cache.writeFile(target, file, body)
 	} else if _, params, err := mime.ParseMediaType(response.Header.Get("Content-Type")); err != nil {
 		log.Warning("Couldn't parse response: %s", err)
 		return false
 	} else {
 		// Directory, comes back in multipart
-		mr := multipart.NewReader(response.Body, params["boundary"])
+		mr := multipart.NewReader(body, params["boundary"])
 		for {
 			if part, err := mr.NextPart(); err == io.EOF {
 				return true
@@ -150,27 +185,259 @@ func (cache *httpCache) writeFile(target *core.BuildTarget, file string, r io.Re
 }
 
 func (cache *httpCache) Clean(target *core.BuildTarget) {
-	var reader io.Reader
+	response, err := cache.do("DELETE", "/artifact/"+targetPath(target), nil)
+	if err != nil {
+		log.Warning("Failed to remove artifacts for %s from http cache: %s", target.Label, err)
+		return
+	} else if response.StatusCode < 200 || response.StatusCode > 299 {
+		// Most likely we don't have admin credentials for the server.
+		log.Warning("Failed to remove artifacts for %s from http cache: got response %s", target.Label, response.Status)
+	}
+	response.Body.Close()
+}
+
+func (cache *httpCache) List(target *core.BuildTarget) []core.CacheEntry {
+	response, err := cache.do("GET", "/list/"+targetPath(target), nil)
+	if err != nil {
+		log.Warning("Failed to list artifacts for %s in http cache: %s", target.Label, err)
+		return nil
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		// Older servers don't support this.
+		log.Warning("Failed to list artifacts for %s in http cache: got response %s", target.Label, response.Status)
+		return nil
+	}
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		log.Warning("Failed to list artifacts for %s in http cache: %s", target.Label, err)
+		return nil
+	}
+	ret := []core.CacheEntry{}
+	for _, line := range strings.Fields(string(body)) {
+		if key, err := base64.RawURLEncoding.DecodeString(line); err == nil {
+			ret = append(ret, core.CacheEntry{Cache: "http " + cache.Url, Key: key})
+		}
+	}
+	return ret
+}
+
+func (cache *httpCache) Evict(target *core.BuildTarget, key []byte) {
 	artifact := path.Join(
-		cache.OSName,
-		target.Label.PackageName,
-		target.Label.Name,
+		targetPath(target),
+		base64.RawURLEncoding.EncodeToString(key),
 	)
-	req, _ := http.NewRequest("DELETE", cache.Url+"/artifact/"+artifact, reader)
-	response, err := http.DefaultClient.Do(req)
+	response, err := cache.do("DELETE", "/artifact/"+artifact, nil)
 	if err != nil {
-		log.Warning("Failed to remove artifacts for %s from http cache: %s", target.Label, err)
+		log.Warning("Failed to remove %s from http cache: %s", artifact, err)
+		return
+	} else if response.StatusCode < 200 || response.StatusCode > 299 {
+		// As for Clean, most likely we don't have admin credentials.
+		log.Warning("Failed to remove %s from http cache: got response %s", artifact, response.Status)
 	}
 	response.Body.Close()
 }
 
+func (cache *httpCache) Stats() []core.CacheStats {
+	stats := core.CacheStats{Cache: "http " + cache.Url}
+	response, err := cache.do("GET", "/stats", nil)
+	if err != nil {
+		stats.Err = err
+		return []core.CacheStats{stats}
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		stats.Err = fmt.Errorf("Got response %s", response.Status)
+		return []core.CacheStats{stats}
+	}
+	var body struct {
+		Entries int   `json:"entries"`
+		Size    int64 `json:"size"`
+	}
+	stats.Err = json.NewDecoder(response.Body).Decode(&body)
+	stats.Entries = body.Entries
+	stats.Size = body.Size
+	return []core.CacheStats{stats}
+}
+
 func (cache *httpCache) Shutdown() {}
 
-func newHttpCache(config *core.Configuration) *httpCache {
+// do sends a request to the given path on the server, with our credentials if we have any.
+func (cache *httpCache) do(method, endpoint string, body io.Reader) (*http.Response, error) {
+	req, err := cache.newRequest(method, endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	return cache.client.Do(req)
+}
+
+// newRequest creates a new request to the given path on the server, with our credentials if we have any.
+func (cache *httpCache) newRequest(method, endpoint string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, cache.Url+endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	if cache.token != "" {
+		req.Header.Set("Authorization", "Bearer "+cache.token)
+	}
+	return req, nil
+}
+
+// ping checks that the server can be reached, and finds out which compression algorithms it
+// accepts artifacts in.
+func (cache *httpCache) ping() error {
+	response, err := cache.do("GET", "/ping", nil)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode != 200 {
+		return fmt.Errorf("Got response %s", response.Status)
+	}
+	// Older servers don't send this, in which case we can't compress anything we send them.
+	cache.uploadCompression = compression.Negotiate(cache.compression, compression.ParseHeader(response.Header.Get("Accept-Encoding")))
+	return nil
+}
+
+// compressBody returns a reader that compresses the given file as it's read.
+// The file is closed once it's been read.
+func (cache *httpCache) compressBody(file *os.File) io.ReadCloser {
+	r, w := io.Pipe()
+	go func() {
+		defer file.Close()
+		compressed := &countingWriter{w: w}
+		cw, err := compression.NewWriter(cache.uploadCompression, compressed)
+		if err != nil {
+			w.CloseWithError(err)
+			return
+		}
+		size, err := io.Copy(cw, file)
+		if err == nil {
+			err = cw.Close()
+		}
+		metrics.RecordCompression(cache.uploadCompression, int(size), compressed.n)
+		w.CloseWithError(err)
+	}()
+	return r
+}
+
+func newHttpCache(config *core.Configuration) (*httpCache, error) {
 	cache := new(httpCache)
-	cache.OSName = runtime.GOOS + "_" + runtime.GOARCH
 	cache.Url = config.Cache.HttpUrl
 	cache.Writeable = config.Cache.HttpWriteable
 	cache.Timeout = time.Duration(config.Cache.HttpTimeout)
-	return cache
+	// This bounds every request, including the initial ping, so an unresponsive server can't hang the build.
+	cache.client = &http.Client{Timeout: cache.Timeout}
+	cache.compression = compression.Configured(config.Cache.Compression)
+	if config.Cache.HttpCACert != "" || config.Cache.HttpPublicKey != "" {
+		tlsConfig, err := loadHTTPAuth(config.Cache.HttpCACert, config.Cache.HttpPublicKey, config.Cache.HttpPrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		cache.client.Transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		}
+	}
+	if config.Cache.HttpTokenFile != "" {
+		token, err := ioutil.ReadFile(core.ExpandHomePath(config.Cache.HttpTokenFile))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read token file: %s", err)
+		}
+		cache.token = strings.TrimSpace(string(token))
+	}
+	return cache, cache.ping()
+}
+
+// targetPath returns the path that all artifacts for a target are stored under on the server.
+// Each platform and configuration has its own so cleaning one doesn't affect the others.
+func targetPath(target *core.BuildTarget) string {
+	return path.Join(target.Label.TargetArch()+target.Label.ConfigSuffix(), target.Label.PackageName, target.Label.Name)
+}
+
+// loadHTTPAuth loads the TLS configuration for talking to the server, using the given CA cert
+// to verify it and optionally presenting the given client certificate.
+func loadHTTPAuth(caCert, publicKey, privateKey string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if publicKey != "" {
+		log.Debug("Loading client certificate from %s, key %s", publicKey, privateKey)
+		cert, err := tls.LoadX509KeyPair(publicKey, privateKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if caCert != "" {
+		log.Debug("Reading CA cert file from %s", caCert)
+		cert, err := ioutil.ReadFile(caCert)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(cert) {
+			return nil, fmt.Errorf("Failed to add any PEM certificates from %s", caCert)
+		}
+	}
+	return config, nil
+}
+
+// A responseReader reads the body of a response from the server, decompressing it if it's
+// compressed. Once it's closed it records how well it was compressed.
+type responseReader struct {
+	io.ReadCloser
+	algorithm    string
+	compressed   *countingReader
+	uncompressed *countingReader
+}
+
+func newResponseReader(response *http.Response) (io.ReadCloser, error) {
+	encoding := response.Header.Get("Content-Encoding")
+	if encoding == "" || encoding == "identity" {
+		return ioutil.NopCloser(response.Body), nil
+	}
+	compressed := &countingReader{r: response.Body}
+	r, err := compression.NewReader(encoding, compressed)
+	if err != nil {
+		return nil, err
+	}
+	uncompressed := &countingReader{r: r}
+	return &responseReader{
+		ReadCloser:   r,
+		algorithm:    encoding,
+		compressed:   compressed,
+		uncompressed: uncompressed,
+	}, nil
+}
+
+func (r *responseReader) Read(b []byte) (int, error) {
+	return r.uncompressed.Read(b)
+}
+
+func (r *responseReader) Close() error {
+	metrics.RecordCompression(r.algorithm, r.uncompressed.n, r.compressed.n)
+	return r.ReadCloser.Close()
+}
+
+// A countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.n += n
+	return n, err
+}
+
+// A countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.n += n
+	return n, err
 }
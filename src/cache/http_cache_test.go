@@ -1,15 +1,21 @@
 package cache
 
 import (
+	"bytes"
 	"io/ioutil"
+	"net/http"
 	"net/http/httptest"
+	"os"
 	"path"
 	"path/filepath"
 	"runtime"
 	"testing"
 	"time"
 
+	"github.com/stretchr/testify/assert"
+
 	"cache/server"
+	"cli"
 	"core"
 )
 
@@ -19,6 +25,7 @@ var (
 	httpcache *httpCache
 	key       []byte
 	osName    string
+	testURL   string
 )
 
 func init() {
@@ -29,12 +36,19 @@ func init() {
 	// Arbitrary large numbers so the cleaner never needs to run.
 	cache := server.NewCache("src/cache/test_data", 20*time.Hour, 100000, 100000000, 1000000000)
 	key, _ = ioutil.ReadFile("src/cache/test_data/testfile")
-	testServer := httptest.NewServer(server.BuildRouter(cache))
+	testServer := httptest.NewServer(server.BuildRouter(cache, &server.HTTPAuth{
+		AdminTokens: []string{"admin_token"},
+	}))
+	tokenFile, _ := ioutil.TempFile("", "http_cache_test")
+	tokenFile.WriteString("admin_token\n")
+	tokenFile.Close()
 
 	config := core.DefaultConfiguration()
 	config.Cache.HttpUrl = testServer.URL
 	config.Cache.HttpWriteable = true
-	httpcache = newHttpCache(config)
+	config.Cache.HttpTokenFile = tokenFile.Name()
+	httpcache, _ = newHttpCache(config)
+	testURL = testServer.URL
 }
 
 func TestStore(t *testing.T) {
@@ -52,6 +66,28 @@ func TestRetrieve(t *testing.T) {
 	}
 }
 
+func TestStoreAndRetrieveCompressed(t *testing.T) {
+	config := core.DefaultConfiguration()
+	config.Cache.HttpUrl = testURL
+	config.Cache.HttpWriteable = true
+	config.Cache.Compression = "gzip"
+	c, err := newHttpCache(config)
+	assert.NoError(t, err)
+	assert.Equal(t, "gzip", c.uploadCompression)
+	target := core.NewBuildTarget(core.NewBuildLabel("pkg/name", "compressed"))
+	target.AddOutput("compressed.txt")
+	outPath := path.Join(target.OutDir(), "compressed.txt")
+	contents := bytes.Repeat([]byte("compressed file "), 1000)
+	assert.NoError(t, os.MkdirAll(target.OutDir(), core.DirPermissions))
+	assert.NoError(t, ioutil.WriteFile(outPath, contents, 0644))
+	c.Store(target, []byte("test_key"))
+	assert.NoError(t, os.Remove(outPath))
+	assert.True(t, c.Retrieve(target, []byte("test_key")))
+	retrieved, err := ioutil.ReadFile(outPath)
+	assert.NoError(t, err)
+	assert.Equal(t, contents, retrieved)
+}
+
 func TestClean(t *testing.T) {
 	httpcache.Clean(target)
 	filename := path.Join("src/cache/test_data", osName, "pkg/name/label_name")
@@ -59,3 +95,60 @@ func TestClean(t *testing.T) {
 		t.Errorf("File %s was not removed from cache.", filename)
 	}
 }
+
+func TestListAndEvict(t *testing.T) {
+	target := core.NewBuildTarget(core.NewBuildLabel("pkg/name", "list"))
+	target.AddOutput("list.txt")
+	assert.NoError(t, os.MkdirAll(target.OutDir(), core.DirPermissions))
+	assert.NoError(t, ioutil.WriteFile(path.Join(target.OutDir(), "list.txt"), []byte("list"), 0644))
+	key1 := bytes.Repeat([]byte{1}, 20)
+	key2 := bytes.Repeat([]byte{2}, 20)
+	httpcache.Store(target, key1)
+	httpcache.Store(target, key2)
+	entries := httpcache.List(target)
+	assert.Equal(t, 2, len(entries))
+	assert.Contains(t, entries, core.CacheEntry{Cache: "http " + testURL, Key: key1})
+	assert.Contains(t, entries, core.CacheEntry{Cache: "http " + testURL, Key: key2})
+	httpcache.Evict(target, key1)
+	assert.Equal(t, []core.CacheEntry{{Cache: "http " + testURL, Key: key2}}, httpcache.List(target))
+}
+
+func TestCleanOneConfig(t *testing.T) {
+	target := core.NewBuildTarget(core.NewBuildLabel("pkg/name", "configs"))
+	target.AddOutput("configs.txt")
+	variant := target.ForConfig("dbg")
+	for _, t2 := range []*core.BuildTarget{target, variant} {
+		assert.NoError(t, os.MkdirAll(t2.OutDir(), core.DirPermissions))
+		assert.NoError(t, ioutil.WriteFile(path.Join(t2.OutDir(), "configs.txt"), []byte("configs"), 0644))
+	}
+	key := bytes.Repeat([]byte{1}, 20)
+	httpcache.Store(target, key)
+	httpcache.Store(variant, key)
+	httpcache.Clean(variant)
+	assert.Equal(t, 0, len(httpcache.List(variant)))
+	assert.Equal(t, []core.CacheEntry{{Cache: "http " + testURL, Key: key}}, httpcache.List(target))
+}
+
+func TestStats(t *testing.T) {
+	stats := httpcache.Stats()
+	assert.Equal(t, 1, len(stats))
+	assert.NoError(t, stats[0].Err)
+	assert.True(t, stats[0].Entries > 0)
+	assert.True(t, stats[0].Size > 0)
+}
+
+func TestPingTimeout(t *testing.T) {
+	done := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer s.Close()
+	defer close(done)
+	config := core.DefaultConfiguration()
+	config.Cache.HttpUrl = s.URL
+	config.Cache.HttpTimeout = cli.Duration(100 * time.Millisecond)
+	start := time.Now()
+	_, err := newHttpCache(config)
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
@@ -0,0 +1,247 @@
+// On-disk journal of pending uploads for the async cache.
+
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"core"
+)
+
+// journalDir is the directory that pending uploads are journaled to.
+const journalDir = "plz-out/upload_queue"
+
+// A journal records uploads that haven't been completed yet as one file each, so any that are
+// still pending when we're interrupted can be resumed by the next plz to run in this repo.
+type journal struct {
+	dir string
+	// Held while we're running so other plz processes don't resume our uploads.
+	// Nil if another one already held it when we started, or we weren't resuming uploads.
+	lock *os.File
+	// Used to generate unique names for entries.
+	prefix string
+	seq    int64
+}
+
+// A journalEntry is the serialised form of a single upload.
+type journalEntry struct {
+	Package, Name, Arch, Config string
+	Key                         []byte
+	// The extra file to store, or empty to store all the target's outputs.
+	File    string `json:",omitempty"`
+	Outputs []string
+	Binary  bool
+	// True if the target has a post-build function, which we can't restore.
+	PostBuild bool `json:",omitempty"`
+	// The state of the files to upload when it was queued.
+	Stamps map[string]stamp
+}
+
+// A stamp identifies a version of a file so we can tell if it's changed since it was queued.
+type stamp struct {
+	ModTime int64
+	Size    int64
+}
+
+// openJournal opens the journal in the given directory, creating it if needed.
+// If resume is false it doesn't take the lock, so Pending returns nothing and any uploads
+// from previous runs are left for the next plz that does resume them.
+func openJournal(dir string, resume bool) (*journal, error) {
+	if err := os.MkdirAll(dir, core.DirPermissions); err != nil {
+		return nil, err
+	}
+	j := &journal{
+		dir:    dir,
+		prefix: fmt.Sprintf("%019d-%d-", time.Now().UnixNano(), os.Getpid()),
+	}
+	if !resume {
+		return j, nil
+	}
+	f, err := os.OpenFile(path.Join(dir, ".lock"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	} else if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		log.Debug("Another plz is handling the upload queue: %s", err)
+		f.Close()
+	} else {
+		j.lock = f
+	}
+	return j, nil
+}
+
+// Pending returns any requests left in the journal by previous runs. It returns nothing if
+// another plz process is running which will be handling them.
+func (j *journal) Pending() []*cacheRequest {
+	if j.lock == nil {
+		return nil
+	}
+	infos, err := ioutil.ReadDir(j.dir)
+	if err != nil {
+		log.Warning("Failed to read upload queue: %s", err)
+		return nil
+	}
+	names := []string{}
+	for _, info := range infos {
+		if name := info.Name(); strings.HasSuffix(name, ".tmp") {
+			os.Remove(path.Join(j.dir, name)) // Never got written properly.
+		} else if strings.HasSuffix(name, ".json") && !strings.HasPrefix(name, j.prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names) // Names start with the time they were written so this keeps them in order.
+	ret := []*cacheRequest{}
+	for _, name := range names {
+		filename := path.Join(j.dir, name)
+		if r, err := j.read(filename); err != nil {
+			log.Warning("Discarding invalid upload queue entry %s: %s", name, err)
+			os.Remove(filename)
+		} else if r == nil {
+			log.Debug("Not resuming upload queue entry %s for a target with a post-build function", name)
+			os.Remove(filename)
+		} else {
+			ret = append(ret, r)
+		}
+	}
+	return ret
+}
+
+// read reads a single request from the journal.
+// It returns nil if the request is for a target with a post-build function; the target we'd
+// recreate here wouldn't have it, so it's not safe to store on its behalf.
+func (j *journal) read(filename string) (*cacheRequest, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	entry := journalEntry{}
+	if err := json.Unmarshal(b, &entry); err != nil {
+		return nil, err
+	} else if entry.PostBuild {
+		return nil, nil
+	}
+	target := core.NewBuildTarget(core.BuildLabel{
+		PackageName: entry.Package,
+		Name:        entry.Name,
+		Arch:        entry.Arch,
+		Config:      entry.Config,
+	})
+	for _, out := range entry.Outputs {
+		target.AddOutput(out)
+	}
+	target.IsBinary = entry.Binary
+	return &cacheRequest{
+		target:   target,
+		key:      entry.Key,
+		file:     entry.File,
+		stamps:   entry.Stamps,
+		filename: filename,
+	}, nil
+}
+
+// Add records a new request in the journal.
+func (j *journal) Add(r *cacheRequest) error {
+	b, err := json.Marshal(&journalEntry{
+		Package:   r.target.Label.PackageName,
+		Name:      r.target.Label.Name,
+		Arch:      r.target.Label.Arch,
+		Config:    r.target.Label.Config,
+		Key:       r.key,
+		File:      r.file,
+		Outputs:   r.target.Outputs(),
+		Binary:    r.target.IsBinary,
+		PostBuild: r.target.PostBuildFunction != 0,
+		Stamps:    r.stamps,
+	})
+	if err != nil {
+		return err
+	}
+	filename := path.Join(j.dir, fmt.Sprintf("%s%06d.json", j.prefix, atomic.AddInt64(&j.seq, 1)))
+	if err := ioutil.WriteFile(filename+".tmp", b, 0644); err != nil {
+		return err
+	} else if err := os.Rename(filename+".tmp", filename); err != nil {
+		return err
+	}
+	r.filename = filename
+	return nil
+}
+
+// Remove removes a request from the journal once it's complete.
+func (j *journal) Remove(r *cacheRequest) {
+	if r.filename != "" {
+		if err := os.Remove(r.filename); err != nil && !os.IsNotExist(err) {
+			log.Warning("Failed to remove upload queue entry %s: %s", r.filename, err)
+		}
+	}
+}
+
+// Discard removes all entries from the journal for the given target, including any from
+// previous runs. A nil key matches entries for any key.
+func (j *journal) Discard(label core.BuildLabel, key []byte) {
+	infos, err := ioutil.ReadDir(j.dir)
+	if err != nil {
+		log.Warning("Failed to read upload queue: %s", err)
+		return
+	}
+	for _, info := range infos {
+		if !strings.HasSuffix(info.Name(), ".json") {
+			continue
+		}
+		filename := path.Join(j.dir, info.Name())
+		entry := journalEntry{}
+		if b, err := ioutil.ReadFile(filename); err != nil || json.Unmarshal(b, &entry) != nil {
+			continue // Might have been removed in the meantime; invalid ones are dealt with by Pending.
+		}
+		if entry.Package == label.PackageName && entry.Name == label.Name && entry.Arch == label.Arch &&
+			entry.Config == label.Config && (key == nil || bytes.Equal(entry.Key, key)) {
+			j.Remove(&cacheRequest{filename: filename})
+		}
+	}
+}
+
+// Close releases the journal's lock.
+func (j *journal) Close() {
+	if j.lock != nil {
+		j.lock.Close()
+	}
+}
+
+// stampFiles returns stamps for the files that a request will upload.
+func stampFiles(target *core.BuildTarget, file string) map[string]stamp {
+	files := []string{file}
+	if file == "" {
+		files = target.Outputs()
+	}
+	ret := make(map[string]stamp, len(files))
+	for _, f := range files {
+		if info, err := os.Lstat(path.Join(target.OutDir(), f)); err == nil {
+			ret[f] = stamp{ModTime: info.ModTime().UnixNano(), Size: info.Size()}
+		} else {
+			ret[f] = stamp{} // Doesn't exist; the upload will fail later but it'll still match.
+		}
+	}
+	return ret
+}
+
+// stampsMatch returns true if the files that a request will upload haven't changed since it was queued.
+func stampsMatch(target *core.BuildTarget, file string, stamps map[string]stamp) bool {
+	current := stampFiles(target, file)
+	if len(current) != len(stamps) {
+		return false
+	}
+	for f, s := range current {
+		if stamps[f] != s {
+			return false
+		}
+	}
+	return true
+}
@@ -7,9 +7,11 @@
 package main
 
 import (
+	"encoding/base64"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/dustin/go-humanize"
@@ -57,18 +59,29 @@ func findSize(path string) (int64, error) {
 	}
 }
 
+// isCacheEntry returns true if the given directory name is the key of an entry in the cache.
+// Keys are 20-byte (sha1) or 32-byte (sha256 / blake2) hashes encoded to padded base64, which
+// always end in a = so we can check that to be "sure".
+func isCacheEntry(name string) bool {
+	if len(name) == 29 || len(name) == 45 {
+		name = name[:len(name)-1] // In case we appended an extra = (see below)
+	}
+	if !strings.HasSuffix(name, "=") {
+		return false
+	}
+	key, err := base64.URLEncoding.DecodeString(name)
+	return err == nil && (len(key) == 20 || len(key) == 32)
+}
+
 func start(directory string, highWaterMark, lowWaterMark int64) {
 	entries := CacheEntries{}
 	var totalSize int64 = 0
 	if err := filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
-		} else if (len(info.Name()) == 28 || len(info.Name()) == 29) && info.Name()[27] == '=' {
-			// Directory has the right length. We do this in an attempt to clean only entire
+		} else if isCacheEntry(info.Name()) {
+			// Directory is named for a hash. We do this in an attempt to clean only entire
 			// entries in the cache, not just individual files from them.
-			// 28 == length of 20-byte sha1 hash, encoded to base64, which always gets a trailing =
-			// as padding so we can check that to be "sure".
-			// Also 29 in case we appended an extra = (see below)
 			if size, err := findSize(path); err != nil {
 				return err
 			} else {
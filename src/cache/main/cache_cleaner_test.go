@@ -1,6 +1,9 @@
 package main
 
 import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
 	"sort"
 	"testing"
 
@@ -47,3 +50,15 @@ func TestCacheEntriesSortingWithTolerance(t *testing.T) {
 	assert.Equal(t, "path3", entries[1].Path)
 	assert.Equal(t, "path1", entries[2].Path)
 }
+
+func TestIsCacheEntry(t *testing.T) {
+	sha1Key := sha1.Sum([]byte("test"))
+	sha256Key := sha256.Sum256([]byte("test"))
+	assert.True(t, isCacheEntry(base64.URLEncoding.EncodeToString(sha1Key[:])))
+	assert.True(t, isCacheEntry(base64.URLEncoding.EncodeToString(sha1Key[:])+"="))
+	assert.True(t, isCacheEntry(base64.URLEncoding.EncodeToString(sha256Key[:])))
+	assert.True(t, isCacheEntry(base64.URLEncoding.EncodeToString(sha256Key[:])+"="))
+	assert.False(t, isCacheEntry("src"))
+	assert.False(t, isCacheEntry(base64.URLEncoding.EncodeToString(sha256Key[:16])))
+	assert.False(t, isCacheEntry(base64.RawURLEncoding.EncodeToString(sha256Key[:])))
+}
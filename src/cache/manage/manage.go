@@ -0,0 +1,300 @@
+// Package manage implements 'plz cache', which inspects and manages the artifacts that
+// are stored in the caches.
+//
+// Everything here works in terms of the core.Cache interface, so it applies equally to any
+// combination of dir, http and RPC caches that's configured.
+package manage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+	"gopkg.in/op/go-logging.v1"
+
+	"build"
+	"cache"
+	"core"
+)
+
+var log = logging.MustGetLogger("manage")
+
+// List prints the hashes that each of the given targets has artifacts stored under in each cache.
+// The target's current hash is marked if it can be calculated.
+func List(state *core.BuildState, labels []core.BuildLabel) error {
+	if state.Cache == nil {
+		return fmt.Errorf("No caches are configured")
+	}
+	for _, label := range labels {
+		target := state.Graph.TargetOrDie(label)
+		current, _ := build.ShortTargetHash(state, target)
+		fmt.Printf("%s:\n", label)
+		entries := (*state.Cache).List(target)
+		if len(entries) == 0 {
+			fmt.Printf("  No artifacts stored\n")
+		}
+		for _, entry := range entries {
+			if bytes.Equal(entry.Key, current) {
+				fmt.Printf("  %s  %s (current)\n", encodeHash(entry.Key), entry.Cache)
+			} else {
+				fmt.Printf("  %s  %s\n", encodeHash(entry.Key), entry.Cache)
+			}
+		}
+	}
+	return nil
+}
+
+// Get retrieves the artifacts stored for a target under the given hash into plz-out, or under its
+// current hash if none is given. They aren't considered up to date by later builds, which will
+// check the cache again.
+func Get(state *core.BuildState, label core.BuildLabel, hash string) error {
+	if state.Cache == nil {
+		return fmt.Errorf("No caches are configured")
+	}
+	target := state.Graph.TargetOrDie(label)
+	key, err := resolveKey(state, target, hash)
+	if err != nil {
+		return err
+	} else if err := build.RemoveOutputs(target); err != nil {
+		return err
+	} else if !(*state.Cache).Retrieve(target, key) {
+		return fmt.Errorf("Couldn't find artifacts for %s with hash %s in any cache", label, encodeHash(key))
+	}
+	for _, out := range target.Outputs() {
+		fmt.Println(path.Join(target.OutDir(), out))
+	}
+	return nil
+}
+
+// Evict removes the artifacts stored for each of the given targets under the given hash from all
+// caches, or under their current hashes if none is given. If all is true they're removed for
+// every hash.
+func Evict(state *core.BuildState, labels []core.BuildLabel, hash string, all bool) error {
+	if state.Cache == nil {
+		return fmt.Errorf("No caches are configured")
+	}
+	for _, label := range labels {
+		target := state.Graph.TargetOrDie(label)
+		if all {
+			log.Notice("Evicting all artifacts for %s", label)
+			(*state.Cache).Clean(target)
+			continue
+		}
+		key, err := resolveKey(state, target, hash)
+		if err != nil {
+			return err
+		}
+		log.Notice("Evicting artifacts for %s with hash %s", label, encodeHash(key))
+		(*state.Cache).Evict(target, key)
+	}
+	return nil
+}
+
+// Verify retrieves every set of artifacts stored for each of the given targets from each cache
+// in turn, and checks that the hash of them matches the one stored when they were built.
+// If evict is true any that don't match are removed from the cache they came from.
+// It returns true if none of them failed verification.
+// Artifacts stored by older versions of Please don't have a hash stored to check against,
+// so they're reported as unverified but don't count as failures.
+func Verify(state *core.BuildState, labels []core.BuildLabel, evict bool) bool {
+	if state.Cache == nil {
+		log.Error("No caches are configured")
+		return false
+	}
+	success := true
+	for _, label := range labels {
+		target := state.Graph.TargetOrDie(label)
+		fmt.Printf("%s:\n", label)
+		for _, layer := range cache.Layers(*state.Cache) {
+			for _, entry := range layer.List(target) {
+				err := verifyEntry(layer, target, entry.Key)
+				if err == errUnverified {
+					fmt.Printf("  %s  %s: unverified (no output hash stored)\n", encodeHash(entry.Key), entry.Cache)
+					continue
+				} else if err == nil {
+					fmt.Printf("  %s  %s: OK\n", encodeHash(entry.Key), entry.Cache)
+					continue
+				}
+				fmt.Printf("  %s  %s: FAILED: %s\n", encodeHash(entry.Key), entry.Cache, err)
+				success = false
+				if evict {
+					layer.Evict(target, entry.Key)
+				}
+			}
+		}
+		// Whatever's in plz-out now is from whichever entry we checked last, so remove it
+		// to make sure the next build doesn't mistake it for being up to date.
+		if err := removeOutputs(target); err != nil {
+			log.Warning("Failed to remove outputs of %s: %s", label, err)
+		}
+	}
+	return success
+}
+
+// errUnverified is returned by verifyEntry when there's no output hash to check against.
+var errUnverified = fmt.Errorf("No output hash stored")
+
+// verifyEntry retrieves a single set of artifacts from a cache and checks them against their
+// stored output hash.
+func verifyEntry(c core.Cache, target *core.BuildTarget, key []byte) error {
+	if err := removeOutputs(target); err != nil {
+		return err
+	} else if !c.Retrieve(target, key) {
+		return fmt.Errorf("Couldn't retrieve artifacts")
+	} else if !c.RetrieveExtra(target, key, core.OutputHashFileName(target)) {
+		return errUnverified
+	}
+	stored, err := ioutil.ReadFile(path.Join(target.OutDir(), core.OutputHashFileName(target)))
+	if err != nil {
+		return err
+	}
+	hash, err := build.OutputHash(target)
+	if err != nil {
+		return err
+	} else if !bytes.Equal(hash, stored) {
+		return fmt.Errorf("Output hash %s doesn't match stored hash %s", encodeHash(hash), encodeHash(stored))
+	}
+	return nil
+}
+
+// removeOutputs removes a target's outputs and its stored output hash from plz-out.
+func removeOutputs(target *core.BuildTarget) error {
+	if err := build.RemoveOutputs(target); err != nil {
+		return err
+	} else if err := os.Remove(path.Join(target.OutDir(), core.OutputHashFileName(target))); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Stats prints the number of entries in and the size of each cache that the given one is made up of.
+// It returns false if any of them couldn't be retrieved.
+func Stats(c *core.Cache) bool {
+	if c == nil {
+		log.Error("No caches are configured")
+		return false
+	}
+	success := true
+	stats := (*c).Stats()
+	width := len("Cache")
+	for _, s := range stats {
+		if len(s.Cache) > width {
+			width = len(s.Cache)
+		}
+	}
+	fmt.Printf("%-*s  %10s  %10s\n", width, "Cache", "Entries", "Size")
+	for _, s := range stats {
+		if s.Err != nil {
+			fmt.Printf("%-*s  Failed to get stats: %s\n", width, s.Cache, s.Err)
+			success = false
+		} else {
+			fmt.Printf("%-*s  %10d  %10s\n", width, s.Cache, s.Entries, humanize.Bytes(uint64(s.Size)))
+		}
+	}
+	return success
+}
+
+// Prefetch retrieves the artifacts for the given targets and all their dependencies from the
+// caches, which stores them in the dir cache so later builds don't have to fetch them again.
+// Nothing is built, so anything that isn't in any of the caches can't be prefetched, and
+// neither can anything that depends on it since its hash can't be calculated. The same goes
+// for targets with post-build functions, since their artifacts are stored under the hash
+// they have after it's run.
+// It returns true if everything was prefetched.
+func Prefetch(state *core.BuildState, labels []core.BuildLabel) bool {
+	if state.Cache == nil || state.Config.Cache.Dir == "" {
+		log.Error("No dir cache is configured to prefetch artifacts into")
+		return false
+	}
+	p := prefetcher{state: state, done: map[*core.BuildTarget]bool{}}
+	for _, label := range labels {
+		p.prefetch(state.Graph.TargetOrDie(label))
+	}
+	log.Notice("Prefetched %d targets, %d couldn't be prefetched", p.retrieved, p.failed)
+	return p.failed == 0
+}
+
+// A prefetcher walks the build graph prefetching targets.
+type prefetcher struct {
+	state *core.BuildState
+	// Records which targets we've already visited and whether they're now available.
+	done              map[*core.BuildTarget]bool
+	retrieved, failed int
+}
+
+// prefetch prefetches a single target after its dependencies. It returns true if its outputs are
+// now available.
+func (p *prefetcher) prefetch(target *core.BuildTarget) bool {
+	if available, present := p.done[target]; present {
+		return available
+	}
+	p.done[target] = false
+	for _, dep := range target.Dependencies() {
+		if !p.prefetch(dep) {
+			return false // Nothing more we can do, it'll have been reported already.
+		}
+	}
+	if target.IsFilegroup() || len(target.Outputs()) == 0 {
+		// These are never stored in the cache; if any of their outputs are needed, the hashes
+		// of the targets needing them will fail to calculate below.
+		p.done[target] = true
+		return true
+	}
+	if target.PostBuildFunction != 0 {
+		log.Warning("Can't prefetch %s, it has a post-build function so needs to be built", target.Label)
+		p.failed++
+		return false
+	}
+	key, err := build.ShortTargetHash(p.state, target)
+	if err != nil {
+		log.Warning("Can't calculate hash for %s: %s", target.Label, err)
+		p.failed++
+		return false
+	}
+	if !(*p.state.Cache).Retrieve(target, key) {
+		log.Warning("Couldn't find artifacts for %s with hash %s in any cache", target.Label, encodeHash(key))
+		p.failed++
+		return false
+	}
+	log.Debug("Prefetched %s", target.Label)
+	p.retrieved++
+	p.done[target] = true
+	return true
+}
+
+// resolveKey returns the key for a target, either the one decoded from the given hash or the
+// target's current one if it's empty.
+func resolveKey(state *core.BuildState, target *core.BuildTarget, hash string) ([]byte, error) {
+	if hash != "" {
+		return decodeHash(hash)
+	}
+	key, err := build.ShortTargetHash(state, target)
+	if err != nil {
+		return nil, fmt.Errorf("Can't calculate hash for %s (has it been built?): %s\nPass --hash to choose one from plz cache ls instead.", target.Label, err)
+	}
+	return key, nil
+}
+
+// encodeHash encodes a hash for printing.
+func encodeHash(hash []byte) string {
+	return base64.RawURLEncoding.EncodeToString(hash)
+}
+
+// decodeHash decodes a hash as printed by encodeHash. It also accepts the padded and
+// non-URL-safe variants of base64 since the caches use those in various places.
+func decodeHash(hash string) ([]byte, error) {
+	hash = strings.TrimRight(hash, "=")
+	hash = strings.NewReplacer("+", "-", "/", "_").Replace(hash)
+	key, err := base64.RawURLEncoding.DecodeString(hash)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid hash %s: %s", hash, err)
+	} else if len(key) != 20 && len(key) != 32 {
+		return nil, fmt.Errorf("Invalid hash %s: should be 20 or 32 bytes, was %d", hash, len(key))
+	}
+	return key, nil
+}
@@ -0,0 +1,97 @@
+package manage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"build"
+	"cache"
+	"core"
+)
+
+func TestDecodeHash(t *testing.T) {
+	key := bytes.Repeat([]byte{0xfb}, 20) // Encodes differently in the URL-safe encodings
+	for _, encoding := range []*base64.Encoding{
+		base64.RawURLEncoding,
+		base64.URLEncoding,
+		base64.RawStdEncoding,
+		base64.StdEncoding,
+	} {
+		decoded, err := decodeHash(encoding.EncodeToString(key))
+		assert.NoError(t, err)
+		assert.Equal(t, key, decoded)
+	}
+}
+
+func TestDecodeHashInvalid(t *testing.T) {
+	_, err := decodeHash("!!!")
+	assert.Error(t, err)
+	_, err = decodeHash(encodeHash([]byte("too short")))
+	assert.Error(t, err)
+}
+
+func TestVerify(t *testing.T) {
+	config := core.DefaultConfiguration()
+	config.Cache.Dir = "plz-out/manage_test_cache"
+	config.Cache.Workers = 0 // Store synchronously so everything's there to verify.
+	c := cache.NewCache(config, false)
+	state := core.NewBuildState(1, c, 4, config)
+	target := core.NewBuildTarget(core.NewBuildLabel("src/cache/manage", "verify"))
+	target.AddOutput("out.txt")
+	state.Graph.AddTarget(target)
+	labels := []core.BuildLabel{target.Label}
+
+	// Store two entries with the same stored hash, then corrupt one of them.
+	assert.NoError(t, os.MkdirAll(target.OutDir(), core.DirPermissions))
+	assert.NoError(t, ioutil.WriteFile(path.Join(target.OutDir(), "out.txt"), []byte("contents"), 0644))
+	hash, err := build.OutputHash(target)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(path.Join(target.OutDir(), core.OutputHashFileName(target)), hash, 0644))
+	good := bytes.Repeat([]byte{1}, 20)
+	bad := bytes.Repeat([]byte{2}, 20)
+	for _, key := range [][]byte{good, bad} {
+		(*c).Store(target, key)
+		(*c).StoreExtra(target, key, core.OutputHashFileName(target))
+	}
+	corrupted := path.Join(config.Cache.Dir, target.Label.Arch, "src/cache/manage/verify", base64.URLEncoding.EncodeToString(bad), "out.txt")
+	assert.NoError(t, os.Remove(corrupted)) // It's hardlinked to the output, so don't just overwrite it.
+	assert.NoError(t, ioutil.WriteFile(corrupted, []byte("corrupted"), 0644))
+
+	assert.False(t, Verify(state, labels, true))
+	assert.Equal(t, []core.CacheEntry{{Cache: "dir " + config.Cache.Dir, Key: good}}, (*c).List(target))
+	assert.True(t, Verify(state, labels, false))
+	assert.False(t, core.PathExists(path.Join(target.OutDir(), "out.txt")), "Outputs should be removed afterwards")
+}
+
+func TestPrefetchPostBuild(t *testing.T) {
+	config := core.DefaultConfiguration()
+	config.Cache.Dir = "plz-out/manage_test_prefetch_cache"
+	config.Cache.Workers = 0
+	c := cache.NewCache(config, false)
+	state := core.NewBuildState(1, c, 4, config)
+	dep := core.NewBuildTarget(core.NewBuildLabel("src/cache/manage", "prefetch_post_build"))
+	dep.AddOutput("dep.txt")
+	dep.PostBuildFunction = 1
+	target := core.NewBuildTarget(core.NewBuildLabel("src/cache/manage", "prefetch_dependent"))
+	target.AddOutput("out.txt")
+	target.AddDependency(dep.Label)
+	state.Graph.AddTarget(dep)
+	state.Graph.AddTarget(target)
+	state.Graph.AddDependency(target.Label, dep.Label)
+	// Its artifacts are in the cache, but under the hash from before its post-build function
+	// ran, so we can't know which ones to retrieve.
+	assert.NoError(t, os.MkdirAll(dep.OutDir(), core.DirPermissions))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dep.OutDir(), "dep.txt"), []byte("contents"), 0644))
+	key, err := build.ShortTargetHash(state, dep)
+	assert.NoError(t, err)
+	(*c).Store(dep, key)
+	assert.NoError(t, os.Remove(path.Join(dep.OutDir(), "dep.txt")))
+	assert.False(t, Prefetch(state, []core.BuildLabel{target.Label}))
+	assert.False(t, core.PathExists(path.Join(dep.OutDir(), "dep.txt")))
+}
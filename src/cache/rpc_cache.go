@@ -6,80 +6,256 @@ package cache
 import (
 	"bytes"
 	"core"
+	"crypto/sha1"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
-	"runtime"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/grpclog"
 	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 
+	"cache/compression"
 	pb "cache/proto/rpc_cache"
+	"metrics"
 )
 
 const maxErrors = 5
 
+// chunkSize is the size of chunks that we send file bodies in when streaming.
+const chunkSize = 1024 * 1024
+
 type rpcCache struct {
+	url        string
 	connection *grpc.ClientConn
 	client     pb.RpcCacheClient
 	Writeable  bool
-	Connected  bool
-	Connecting bool
 	OSName     string
 	numErrors  int32
 	timeout    time.Duration
 	startTime  time.Time
 	maxMsgSize int
+	// Set to 1 while we're connected to the server, or trying to (re)connect to it.
+	// These are updated in the background so are only accessed atomically.
+	connected  int32
+	connecting int32
+	// Set to 1 if the server doesn't support content-addressed blobs (i.e. it's an older version).
+	// These are set from concurrent requests so are only accessed atomically.
+	noBlobs int32
+	// Set to 1 if the server doesn't support the streaming RPCs.
+	noStreaming int32
+	// Algorithm we'd prefer artifacts to be compressed with, or empty if they shouldn't be.
+	compression string
+	// Algorithm we compress artifacts we send with, which the server must support.
+	// It's renegotiated whenever we reconnect, so it's only accessed atomically.
+	uploadCompression atomic.Value
 }
 
 func (cache *rpcCache) Store(target *core.BuildTarget, key []byte) {
 	if cache.isConnected() && cache.Writeable {
 		log.Debug("Storing %s in RPC cache...", target.Label)
-		artifacts := []*pb.Artifact{}
-		totalSize := 0
+		outs := []string{}
 		for out := range cacheArtifacts(target) {
-			artifacts2, size, err := cache.loadArtifacts(target, out)
-			if err != nil {
-				log.Warning("RPC cache failed to load artifact %s: %s", out, err)
-				cache.error()
-				return
-			}
-			totalSize += size
-			artifacts = append(artifacts, artifacts2...)
+			outs = append(outs, out)
 		}
-		if totalSize > cache.maxMsgSize {
-			log.Info("Artifacts for %s exceed maximum message size of %s bytes", target.Label, cache.maxMsgSize)
-			return
-		}
-		cache.sendArtifacts(target, key, artifacts)
+		cache.store(target, key, outs)
 	}
 }
 
 func (cache *rpcCache) StoreExtra(target *core.BuildTarget, key []byte, file string) {
 	if cache.isConnected() && cache.Writeable {
 		log.Debug("Storing %s : %s in RPC cache...", target.Label, file)
-		artifacts, totalSize, err := cache.loadArtifacts(target, file)
+		cache.store(target, key, []string{file})
+	}
+}
+
+// store stores the given outputs of a target. They're streamed to the server if it supports
+// that, otherwise they're all loaded and sent in a single message.
+func (cache *rpcCache) store(target *core.BuildTarget, key []byte, outs []string) {
+	if atomic.LoadInt32(&cache.noStreaming) == 0 && cache.streamArtifacts(target, key, outs) {
+		return
+	}
+	artifacts := []*pb.Artifact{}
+	totalSize := 0
+	for _, out := range outs {
+		artifacts2, size, err := cache.loadArtifacts(target, out)
 		if err != nil {
-			log.Warning("RPC cache failed to load artifact %s: %s", file, err)
+			log.Warning("RPC cache failed to load artifact %s: %s", out, err)
 			cache.error()
 			return
 		}
-		if totalSize > cache.maxMsgSize {
-			log.Info("Artifact %s for %s exceeds maximum message size of %s bytes", file, target.Label, cache.maxMsgSize)
-			return
+		totalSize += size
+		artifacts = append(artifacts, artifacts2...)
+	}
+	if totalSize > cache.maxMsgSize {
+		log.Info("Artifacts for %s exceed maximum message size of %s bytes", target.Label, cache.maxMsgSize)
+		return
+	}
+	cache.sendArtifacts(target, key, artifacts)
+}
+
+// streamArtifacts sends the given outputs of a target to the server using the streaming Store RPC.
+// It returns false if the server doesn't support that, in which case the caller should fall back
+// to the unary version.
+func (cache *rpcCache) streamArtifacts(target *core.BuildTarget, key []byte, outs []string) bool {
+	artifacts, err := cache.digestArtifacts(target, outs)
+	if err != nil {
+		log.Warning("RPC cache failed to load artifacts for %s: %s", target.Label, err)
+		cache.error()
+		return true
+	}
+	resp, err := cache.sendStream(target, key, artifacts, true)
+	if err == nil && !resp.Success && resp.MissingBlobs {
+		// The server's cleaned some blobs since it told us it had them; try again with all the contents.
+		log.Debug("RPC cache server no longer has some contents of %s, sending them again", target.Label)
+		resp, err = cache.sendStream(target, key, artifacts, false)
+	}
+	if err != nil {
+		return cache.streamError(err)
+	} else if !resp.Success {
+		log.Warning("Failed to store artifacts in RPC cache for %s", target.Label)
+	}
+	return true
+}
+
+// sendStream sends the given artifacts to the server on a single StoreStream call. If useBlobs is
+// true then any whose contents the server already has are sent by digest only.
+func (cache *rpcCache) sendStream(target *core.BuildTarget, key []byte, artifacts []*pb.Artifact, useBlobs bool) (*pb.StoreResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), cache.timeout)
+	defer cancel()
+	var missing map[string]bool
+	if useBlobs {
+		missing = cache.missingBlobs(ctx, artifacts)
+	}
+	stream, err := cache.client.StoreStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i, artifact := range artifacts {
+		req := &pb.StoreStreamRequest{}
+		if i == 0 {
+			req.Hash = key
+			req.Os, req.Arch = splitArch(target)
+		}
+		if missing != nil && !missing[string(artifact.Digest)] {
+			// Server already has the contents of this one.
+			req.Chunk = &pb.ArtifactChunk{
+				Package: artifact.Package,
+				Target:  artifact.Target,
+				File:    artifact.File,
+				Digest:  artifact.Digest,
+				Last:    true,
+			}
+			err = stream.Send(req)
+		} else {
+			delete(missing, string(artifact.Digest))
+			err = cache.sendFile(stream, req, target, artifact)
+		}
+		if err == io.EOF {
+			break // Server has ended the stream; we'll find out why below.
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return stream.CloseAndRecv()
+}
+
+// sendFile sends the contents of a single artifact on a Store stream in chunks.
+// The given request is used for the first chunk.
+func (cache *rpcCache) sendFile(stream pb.RpcCache_StoreStreamClient, req *pb.StoreStreamRequest, target *core.BuildTarget, artifact *pb.Artifact) error {
+	f, err := os.Open(path.Join(target.OutDir(), artifact.File))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	buf := make([]byte, chunkSize)
+	digest := artifact.Digest // Only needs sending on the first chunk.
+	algorithm := cache.getUploadCompression()
+	for first := true; ; first = false {
+		n, err := io.ReadFull(f, buf)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return err
+		}
+		if first && !compression.Compressible(artifact.File, buf[:n]) {
+			algorithm = ""
+		}
+		body, bodyCompression := compressBody(algorithm, buf[:n])
+		req.Chunk = &pb.ArtifactChunk{
+			Package:     artifact.Package,
+			Target:      artifact.Target,
+			File:        artifact.File,
+			Digest:      digest,
+			Body:        body,
+			Last:        last,
+			Compression: bodyCompression,
+		}
+		if err := stream.Send(req); err != nil || last {
+			return err
+		}
+		req = &pb.StoreStreamRequest{}
+		digest = nil
+	}
+}
+
+// digestArtifacts walks the given outputs of a target and returns artifacts for each file in
+// them with their digests set, but not their bodies.
+func (cache *rpcCache) digestArtifacts(target *core.BuildTarget, outs []string) ([]*pb.Artifact, error) {
+	artifacts := []*pb.Artifact{}
+	outDir := target.OutDir()
+	for _, out := range outs {
+		if err := filepath.Walk(path.Join(outDir, out), func(name string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			} else if !info.IsDir() {
+				f, err := os.Open(name)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				h := sha1.New()
+				if _, err := io.Copy(h, f); err != nil {
+					return err
+				}
+				artifacts = append(artifacts, &pb.Artifact{
+					Package: target.Label.PackageName,
+					Target:  target.Label.Name,
+					File:    name[len(outDir)+1:],
+					Digest:  h.Sum(nil),
+				})
+			}
+			return nil
+		}); err != nil {
+			return nil, err
 		}
-		cache.sendArtifacts(target, key, artifacts)
 	}
+	return artifacts, nil
+}
+
+// streamError handles an error from one of the streaming RPCs. It returns false if the error
+// indicates that the server doesn't support streaming, in which case the caller should fall
+// back to the unary RPCs.
+func (cache *rpcCache) streamError(err error) bool {
+	if grpc.Code(err) == codes.Unimplemented {
+		log.Info("RPC cache server doesn't support streaming, will fall back to single requests")
+		atomic.StoreInt32(&cache.noStreaming, 1)
+		return false
+	}
+	log.Warning("Error communicating with RPC cache server: %s", err)
+	cache.error()
+	return true
 }
 
 func (cache *rpcCache) loadArtifacts(target *core.BuildTarget, file string) ([]*pb.Artifact, int, error) {
@@ -95,13 +271,21 @@ func (cache *rpcCache) loadArtifacts(target *core.BuildTarget, file string) ([]*
 			if err != nil {
 				return err
 			}
+			digest := sha1.Sum(content)
+			algorithm := cache.getUploadCompression()
+			if !compression.Compressible(name, content) {
+				algorithm = ""
+			}
+			body, bodyCompression := compressBody(algorithm, content)
 			artifacts = append(artifacts, &pb.Artifact{
-				Package: target.Label.PackageName,
-				Target:  target.Label.Name,
-				File:    name[len(outDir)+1:],
-				Body:    content,
+				Package:     target.Label.PackageName,
+				Target:      target.Label.Name,
+				File:        name[len(outDir)+1:],
+				Body:        body,
+				Digest:      digest[:],
+				Compression: bodyCompression,
 			})
-			totalSize += len(content)
+			totalSize += len(body)
 		}
 		return nil
 	})
@@ -109,10 +293,17 @@ func (cache *rpcCache) loadArtifacts(target *core.BuildTarget, file string) ([]*
 }
 
 func (cache *rpcCache) sendArtifacts(target *core.BuildTarget, key []byte, artifacts []*pb.Artifact) {
-	req := pb.StoreRequest{Artifacts: artifacts, Hash: key, Os: runtime.GOOS, Arch: runtime.GOARCH}
 	ctx, cancel := context.WithTimeout(context.Background(), cache.timeout)
 	defer cancel()
+	goos, goarch := splitArch(target)
+	req := pb.StoreRequest{Artifacts: cache.stripExistingBlobs(ctx, artifacts), Hash: key, Os: goos, Arch: goarch}
 	resp, err := cache.client.Store(ctx, &req)
+	if err == nil && !resp.Success && resp.MissingBlobs {
+		// The server's cleaned some blobs since it told us it had them; try again with all the contents.
+		log.Debug("RPC cache server no longer has some contents of %s, sending them again", target.Label)
+		req.Artifacts = artifacts
+		resp, err = cache.client.Store(ctx, &req)
+	}
 	if err != nil {
 		log.Warning("Error communicating with RPC cache server: %s", err)
 		cache.error()
@@ -121,11 +312,70 @@ func (cache *rpcCache) sendArtifacts(target *core.BuildTarget, key []byte, artif
 	}
 }
 
+// stripExistingBlobs removes the bodies of any of the given artifacts whose contents the server
+// already has, so we don't need to send them again. Artifacts with identical contents are also
+// only sent once.
+func (cache *rpcCache) stripExistingBlobs(ctx context.Context, artifacts []*pb.Artifact) []*pb.Artifact {
+	missing := cache.missingBlobs(ctx, artifacts)
+	if missing == nil {
+		return artifacts
+	}
+	ret := make([]*pb.Artifact, len(artifacts))
+	for i, artifact := range artifacts {
+		if missing[string(artifact.Digest)] {
+			// Send this one, but the server will have it by the time it gets to any others.
+			delete(missing, string(artifact.Digest))
+			ret[i] = artifact
+		} else {
+			ret[i] = &pb.Artifact{
+				Package: artifact.Package,
+				Target:  artifact.Target,
+				File:    artifact.File,
+				Digest:  artifact.Digest,
+			}
+		}
+	}
+	return ret
+}
+
+// missingBlobs asks the server which of the given artifacts' contents it doesn't have yet and
+// returns the set of their digests. It returns nil if the server doesn't support content-addressed
+// blobs, in which case all contents should be sent.
+func (cache *rpcCache) missingBlobs(ctx context.Context, artifacts []*pb.Artifact) map[string]bool {
+	if atomic.LoadInt32(&cache.noBlobs) != 0 {
+		return nil
+	}
+	req := pb.FindMissingBlobsRequest{}
+	seen := map[string]bool{}
+	for _, artifact := range artifacts {
+		if !seen[string(artifact.Digest)] {
+			seen[string(artifact.Digest)] = true
+			req.Digests = append(req.Digests, artifact.Digest)
+		}
+	}
+	resp, err := cache.client.FindMissingBlobs(ctx, &req)
+	if err != nil {
+		if grpc.Code(err) == codes.Unimplemented {
+			log.Info("RPC cache server doesn't support content-addressed storage, will send all artifacts")
+			atomic.StoreInt32(&cache.noBlobs, 1)
+		} else {
+			log.Warning("Failed to find missing blobs in RPC cache: %s", err)
+		}
+		return nil
+	}
+	missing := map[string]bool{}
+	for _, digest := range resp.Missing {
+		missing[string(digest)] = true
+	}
+	return missing
+}
+
 func (cache *rpcCache) Retrieve(target *core.BuildTarget, key []byte) bool {
 	if !cache.isConnected() {
 		return false
 	}
-	req := pb.RetrieveRequest{Hash: key, Os: runtime.GOOS, Arch: runtime.GOARCH}
+	goos, goarch := splitArch(target)
+	req := pb.RetrieveRequest{Hash: key, Os: goos, Arch: goarch, DigestsOnly: atomic.LoadInt32(&cache.noBlobs) == 0, AcceptCompression: compression.Accepts(cache.compression)}
 	for out := range cacheArtifacts(target) {
 		artifact := pb.Artifact{Package: target.Label.PackageName, Target: target.Label.Name, File: out}
 		req.Artifacts = append(req.Artifacts, &artifact)
@@ -145,11 +395,24 @@ func (cache *rpcCache) RetrieveExtra(target *core.BuildTarget, key []byte, file
 	}
 	artifact := pb.Artifact{Package: target.Label.PackageName, Target: target.Label.Name, File: file}
 	artifacts := []*pb.Artifact{&artifact}
-	req := pb.RetrieveRequest{Hash: key, Os: runtime.GOOS, Arch: runtime.GOARCH, Artifacts: artifacts}
+	goos, goarch := splitArch(target)
+	req := pb.RetrieveRequest{
+		Hash:              key,
+		Os:                goos,
+		Arch:              goarch,
+		Artifacts:         artifacts,
+		DigestsOnly:       atomic.LoadInt32(&cache.noBlobs) == 0,
+		AcceptCompression: compression.Accepts(cache.compression),
+	}
 	return cache.retrieveArtifacts(target, &req, false)
 }
 
 func (cache *rpcCache) retrieveArtifacts(target *core.BuildTarget, req *pb.RetrieveRequest, remove bool) bool {
+	if atomic.LoadInt32(&cache.noStreaming) == 0 {
+		if success, supported := cache.retrieveStream(target, req, remove); supported {
+			return success
+		}
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), cache.timeout)
 	defer cancel()
 	response, err := cache.client.Retrieve(ctx, req)
@@ -162,20 +425,23 @@ func (cache *rpcCache) retrieveArtifacts(target *core.BuildTarget, req *pb.Retri
 		log.Debug("Couldn't retrieve artifacts for %s [key %s] from RPC cache", target.Label, base64.RawURLEncoding.EncodeToString(req.Hash))
 		return false
 	}
-	// Remove any existing outputs first; this is important for cases where the output is a
-	// directory, because we get back individual artifacts, and we need to make sure that
-	// only the retrieved artifacts are present in the output.
-	if remove {
-		for _, out := range target.Outputs() {
-			out := path.Join(target.OutDir(), out)
-			if err := os.RemoveAll(out); err != nil {
-				log.Error("Failed to remove artifact %s: %s", out, err)
-				return false
-			}
-		}
+	blobs, err := cache.retrieveBlobs(ctx, response.Artifacts)
+	if err != nil {
+		log.Warning("Failed to retrieve artifacts for %s: %s", target.Label, err)
+		return false
+	}
+	if remove && !cache.removeOutputs(target) {
+		return false
 	}
 	for _, artifact := range response.Artifacts {
-		if !cache.writeFile(target, artifact.File, artifact.Body) {
+		body := artifact.Body
+		if len(body) == 0 && len(artifact.Digest) != 0 {
+			body = blobs[string(artifact.Digest)]
+		} else if body, err = decompressBody(artifact.Compression, body); err != nil {
+			log.Warning("Failed to decompress artifact %s for %s: %s", artifact.File, target.Label, err)
+			return false
+		}
+		if !cache.writeFile(target, artifact.File, bytes.NewReader(body)) {
 			return false
 		}
 	}
@@ -183,13 +449,115 @@ func (cache *rpcCache) retrieveArtifacts(target *core.BuildTarget, req *pb.Retri
 	return len(response.Artifacts) > 0
 }
 
-func (cache *rpcCache) writeFile(target *core.BuildTarget, file string, body []byte) bool {
+// retrieveStream retrieves artifacts using the streaming Retrieve RPC, writing each file as it
+// arrives. The second return value is false if the server doesn't support streaming, in which
+// case the caller should fall back to the unary version.
+func (cache *rpcCache) retrieveStream(target *core.BuildTarget, req *pb.RetrieveRequest, remove bool) (bool, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), cache.timeout)
+	defer cancel()
+	stream, err := cache.client.RetrieveStream(ctx, req)
+	if err != nil {
+		return false, cache.streamError(err)
+	}
+	resp, err := stream.Recv()
+	if err == io.EOF {
+		return false, true
+	} else if err != nil {
+		return false, cache.streamError(err)
+	} else if !resp.Success || resp.Chunk == nil {
+		// Quiet, this is almost certainly just a 'not found'
+		log.Debug("Couldn't retrieve artifacts for %s [key %s] from RPC cache", target.Label, base64.RawURLEncoding.EncodeToString(req.Hash))
+		return false, true
+	}
+	if remove && !cache.removeOutputs(target) {
+		return false, true
+	}
+	for {
+		if resp.Chunk == nil || !cache.writeChunks(target, resp.Chunk, stream) {
+			return false, true
+		}
+		if resp, err = stream.Recv(); err == io.EOF {
+			return true, true
+		} else if err != nil {
+			log.Warning("Failed to retrieve artifacts for %s: %s", target.Label, err)
+			cache.error()
+			return false, true
+		}
+	}
+}
+
+// writeChunks writes a single file from a Retrieve stream, starting with the given chunk.
+// If the server sent a digest for it, it's checked against what was written and the file
+// is removed if they don't match.
+func (cache *rpcCache) writeChunks(target *core.BuildTarget, chunk *pb.ArtifactChunk, stream pb.RpcCache_RetrieveStreamClient) bool {
+	file, digest := chunk.File, chunk.Digest
+	h := sha1.New()
+	if !cache.writeFile(target, file, io.TeeReader(&chunkReader{stream: stream, chunk: chunk}, h)) {
+		return false
+	} else if len(digest) != 0 && !bytes.Equal(h.Sum(nil), digest) {
+		log.Warning("Digest mismatch for %s in %s retrieved from RPC cache", file, target.Label)
+		os.Remove(path.Join(target.OutDir(), file))
+		return false
+	}
+	return true
+}
+
+// removeOutputs removes any existing outputs of a target before retrieving it; this is important
+// for cases where the output is a directory, because we get back individual artifacts, and we need
+// to make sure that only the retrieved artifacts are present in the output.
+func (cache *rpcCache) removeOutputs(target *core.BuildTarget) bool {
+	for _, out := range target.Outputs() {
+		out := path.Join(target.OutDir(), out)
+		if err := os.RemoveAll(out); err != nil {
+			log.Error("Failed to remove artifact %s: %s", out, err)
+			return false
+		}
+	}
+	return true
+}
+
+// retrieveBlobs fetches the contents of any artifacts that were returned by digest only.
+// Each distinct blob is only fetched once. The returned map is keyed by digest.
+func (cache *rpcCache) retrieveBlobs(ctx context.Context, artifacts []*pb.Artifact) (map[string][]byte, error) {
+	ret := map[string][]byte{}
+	req := pb.RetrieveBlobsRequest{AcceptCompression: compression.Accepts(cache.compression)}
+	for _, artifact := range artifacts {
+		if len(artifact.Body) == 0 && len(artifact.Digest) != 0 {
+			if _, present := ret[string(artifact.Digest)]; !present {
+				ret[string(artifact.Digest)] = nil
+				req.Digests = append(req.Digests, artifact.Digest)
+			}
+		}
+	}
+	if len(req.Digests) == 0 {
+		return ret, nil
+	}
+	response, err := cache.client.RetrieveBlobs(ctx, &req)
+	if err != nil {
+		cache.error()
+		return nil, err
+	} else if !response.Success {
+		return nil, fmt.Errorf("Server failed to return blobs")
+	}
+	for _, blob := range response.Blobs {
+		body, err := decompressBody(blob.Compression, blob.Body)
+		if err != nil {
+			return nil, err
+		} else if digest := sha1.Sum(body); !bytes.Equal(digest[:], blob.Digest) {
+			return nil, fmt.Errorf("Digest mismatch for blob %x", blob.Digest)
+		}
+		ret[string(blob.Digest)] = body
+	}
+	return ret, nil
+}
+
+func (cache *rpcCache) writeFile(target *core.BuildTarget, file string, body io.Reader) bool {
 	out := path.Join(target.OutDir(), file)
 	if err := os.MkdirAll(path.Dir(out), core.DirPermissions); err != nil {
 		log.Warning("Failed to create directory for artifacts: %s", err)
 		return false
 	}
-	if err := core.WriteFile(bytes.NewReader(body), out, fileMode(target)); err != nil {
+	if err := core.WriteFile(body, out, fileMode(target)); err != nil {
 		log.Warning("RPC cache failed to write file %s", err)
 		return false
 	}
@@ -197,9 +565,74 @@ func (cache *rpcCache) writeFile(target *core.BuildTarget, file string, body []b
 	return true
 }
 
+// A chunkReader implements io.Reader over the chunks of a single file in a Retrieve stream.
+type chunkReader struct {
+	stream pb.RpcCache_RetrieveStreamClient
+	chunk  *pb.ArtifactChunk
+}
+
+func (r *chunkReader) Read(b []byte) (int, error) {
+	if err := decompressChunk(r.chunk); err != nil {
+		return 0, err
+	}
+	for len(r.chunk.Body) == 0 {
+		if r.chunk.Last {
+			return 0, io.EOF
+		}
+		resp, err := r.stream.Recv()
+		if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF // Stream ended before the last chunk.
+		} else if err != nil {
+			return 0, err
+		} else if resp.Chunk == nil {
+			return 0, fmt.Errorf("Missing artifact chunk in response")
+		}
+		r.chunk = resp.Chunk
+		if err := decompressChunk(r.chunk); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, r.chunk.Body)
+	r.chunk.Body = r.chunk.Body[n:]
+	return n, nil
+}
+
+// decompressChunk decompresses the body of a chunk in place, if it's compressed.
+func decompressChunk(chunk *pb.ArtifactChunk) error {
+	body, err := decompressBody(chunk.Compression, chunk.Body)
+	chunk.Body = body
+	chunk.Compression = ""
+	return err
+}
+
+// compressBody compresses a body we're about to send with the given algorithm, if it's not empty
+// and that makes it smaller. It returns the body to send and the algorithm it's compressed with.
+func compressBody(algorithm string, body []byte) ([]byte, string) {
+	compressed, algorithm := compression.CompressIfSmaller(algorithm, body)
+	if algorithm != "" {
+		metrics.RecordCompression(algorithm, len(body), len(compressed))
+	}
+	return compressed, algorithm
+}
+
+// decompressBody decompresses a body we've received that's compressed with the given algorithm.
+// If the algorithm is empty then it isn't compressed and is returned as is.
+func decompressBody(algorithm string, body []byte) ([]byte, error) {
+	if algorithm == "" {
+		return body, nil
+	}
+	decompressed, err := compression.Decompress(algorithm, body)
+	if err != nil {
+		return nil, err
+	}
+	metrics.RecordCompression(algorithm, len(decompressed), len(body))
+	return decompressed, nil
+}
+
 func (cache *rpcCache) Clean(target *core.BuildTarget) {
 	if cache.isConnected() && cache.Writeable {
-		req := pb.DeleteRequest{Os: runtime.GOOS, Arch: runtime.GOARCH}
+		goos, goarch := splitArch(target)
+		req := pb.DeleteRequest{Os: goos, Arch: goarch}
 		artifact := pb.Artifact{Package: target.Label.PackageName, Target: target.Label.Name}
 		req.Artifacts = []*pb.Artifact{&artifact}
 		response, err := cache.client.Delete(context.Background(), &req)
@@ -209,86 +642,237 @@ func (cache *rpcCache) Clean(target *core.BuildTarget) {
 	}
 }
 
+func (cache *rpcCache) List(target *core.BuildTarget) []core.CacheEntry {
+	if !cache.waitForConnection() {
+		return nil
+	}
+	hashes, err := cache.list(target)
+	if err != nil {
+		log.Warning("Failed to list artifacts for %s in RPC cache at %s: %s", target.Label, cache.url, err)
+		return nil
+	}
+	ret := make([]core.CacheEntry, len(hashes))
+	for i, hash := range hashes {
+		ret[i] = core.CacheEntry{Cache: "rpc " + cache.url, Key: hash}
+	}
+	return ret
+}
+
+// list asks the server for the hashes the given target has artifacts stored under.
+func (cache *rpcCache) list(target *core.BuildTarget) ([][]byte, error) {
+	goos, goarch := splitArch(target)
+	ctx, cancel := context.WithTimeout(context.Background(), cache.timeout)
+	defer cancel()
+	resp, err := cache.client.List(ctx, &pb.ListRequest{
+		Os:       goos,
+		Arch:     goarch,
+		Artifact: &pb.Artifact{Package: target.Label.PackageName, Target: target.Label.Name},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Hashes, nil
+}
+
+func (cache *rpcCache) Evict(target *core.BuildTarget, key []byte) {
+	if !cache.isConnected() || !cache.Writeable {
+		return
+	}
+	// Older servers ignore the hash on a delete request and remove everything for the target,
+	// so check it's new enough to understand it first. Those don't support listing either.
+	if _, err := cache.list(target); grpc.Code(err) == codes.Unimplemented {
+		log.Warning("RPC cache at %s doesn't support removing single hashes; not removing anything for %s", cache.url, target.Label)
+		return
+	}
+	goos, goarch := splitArch(target)
+	req := pb.DeleteRequest{Os: goos, Arch: goarch, Hash: key}
+	req.Artifacts = []*pb.Artifact{{Package: target.Label.PackageName, Target: target.Label.Name}}
+	response, err := cache.client.Delete(context.Background(), &req)
+	if err != nil || !response.Success {
+		log.Errorf("Failed to remove %s from RPC cache at %s", target.Label, cache.url)
+	}
+}
+
+func (cache *rpcCache) Stats() []core.CacheStats {
+	stats := core.CacheStats{Cache: "rpc " + cache.url}
+	if !cache.waitForConnection() {
+		stats.Err = fmt.Errorf("Not connected")
+		return []core.CacheStats{stats}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cache.timeout)
+	defer cancel()
+	if resp, err := cache.client.GetStats(ctx, &pb.GetStatsRequest{}); err != nil {
+		stats.Err = err
+	} else {
+		stats.Entries = int(resp.Entries)
+		stats.Size = resp.Size
+	}
+	return []core.CacheStats{stats}
+}
+
 func (cache *rpcCache) Shutdown() {}
 
 func (cache *rpcCache) connect(config *core.Configuration) {
-	// Change grpc to log using our implementation
-	grpclog.SetLogger(&grpcLogMabob{})
-	log.Info("Connecting to RPC cache at %s", config.Cache.RpcUrl)
+	// Change grpc to log using our implementation. There can be several of us connecting at once.
+	setGrpcLoggerOnce.Do(func() { grpclog.SetLogger(&grpcLogMabob{}) })
+	log.Info("Connecting to RPC cache at %s", cache.url)
 	opts := []grpc.DialOption{grpc.WithTimeout(cache.timeout)}
 	if config.Cache.RpcPublicKey != "" || config.Cache.RpcCACert != "" || config.Cache.RpcSecure {
-		auth, err := loadAuth(config.Cache.RpcCACert, config.Cache.RpcPublicKey, config.Cache.RpcPrivateKey)
+		auth, err := LoadAuth(config.Cache.RpcCACert, config.Cache.RpcPublicKey, config.Cache.RpcPrivateKey)
 		if err != nil {
 			log.Warning("Failed to load RPC cache auth keys: %s", err)
+			atomic.StoreInt32(&cache.connecting, 0)
 			return
 		}
 		opts = append(opts, auth)
 	} else {
 		opts = append(opts, grpc.WithInsecure())
 	}
-	connection, err := grpc.Dial(config.Cache.RpcUrl, opts...)
+	connection, err := grpc.Dial(cache.url, opts...)
 	if err != nil {
-		cache.Connecting = false
+		atomic.StoreInt32(&cache.connecting, 0)
 		log.Warning("Failed to connect to RPC cache: %s", err)
 		return
 	}
+	cache.connection = connection
+	cache.client = pb.NewRpcCacheClient(connection)
+	if err := cache.checkHealth(); err != nil {
+		log.Warning("%s", err)
+	} else {
+		log.Info("RPC cache connected after %0.2fs", time.Since(cache.startTime).Seconds())
+	}
+	atomic.StoreInt32(&cache.connecting, 0)
+}
+
+// reconnect checks whether a server that we've previously disconnected from is available again,
+// and reconnects to it if so. It returns true if it's reconnected.
+func (cache *rpcCache) reconnect() bool {
+	if cache.connection == nil {
+		return false // Couldn't even dial it in the first place, so there's no point trying again.
+	}
+	atomic.StoreInt32(&cache.connecting, 1)
+	err := cache.checkHealth()
+	atomic.StoreInt32(&cache.connecting, 0)
+	if err != nil {
+		log.Debug("%s", err)
+		return false
+	}
+	log.Notice("RPC cache at %s is available again", cache.url)
+	return true
+}
+
+// checkHealth checks that the server is serving, and marks the cache as connected if it is.
+func (cache *rpcCache) checkHealth() error {
 	// Note that we have to actually send it a message here to validate the connection;
 	// Dial() only seems to return errors for superficial failures like syntactically invalid addresses,
 	// it will return essentially immediately even if the server doesn't exist.
-	healthclient := healthpb.NewHealthClient(connection)
+	healthclient := healthpb.NewHealthClient(cache.connection)
 	ctx, cancel := context.WithTimeout(context.Background(), cache.timeout)
 	defer cancel()
 	resp, err := healthclient.Check(ctx, &healthpb.HealthCheckRequest{Service: "plz-rpc-cache"})
 	if err != nil {
-		cache.Connecting = false
-		log.Warning("Failed to contact RPC cache: %s", err)
+		return fmt.Errorf("Failed to contact RPC cache at %s: %s", cache.url, err)
 	} else if resp.Status != healthpb.HealthCheckResponse_SERVING {
-		cache.Connecting = false
-		log.Warning("RPC cache says it is not serving (%d)", resp.Status)
-	} else {
-		cache.connection = connection
-		cache.client = pb.NewRpcCacheClient(connection)
-		cache.Connected = true
-		cache.Connecting = false
-		log.Info("RPC cache connected after %0.2fs", time.Since(cache.startTime).Seconds())
+		return fmt.Errorf("RPC cache at %s says it is not serving (%d)", cache.url, resp.Status)
+	}
+	cache.loadCapabilities()
+	atomic.StoreInt32(&cache.numErrors, 0)
+	atomic.StoreInt32(&cache.connected, 1)
+	return nil
+}
+
+// loadCapabilities asks the server what it supports, so we know which compression algorithm
+// we can send artifacts to it with. Older servers don't support this, in which case we don't
+// compress anything we send them.
+func (cache *rpcCache) loadCapabilities() {
+	if cache.compression == "" {
+		return
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), cache.timeout)
+	defer cancel()
+	resp, err := cache.client.GetCapabilities(ctx, &pb.GetCapabilitiesRequest{})
+	if err != nil {
+		if grpc.Code(err) != codes.Unimplemented {
+			log.Warning("Failed to get RPC cache server capabilities: %s", err)
+		}
+		log.Info("RPC cache server doesn't support compression, will send artifacts uncompressed")
+		return
+	}
+	cache.uploadCompression.Store(compression.Negotiate(cache.compression, resp.AcceptCompression))
+}
+
+// getUploadCompression returns the algorithm to compress artifacts we send with, or the empty
+// string if they shouldn't be.
+func (cache *rpcCache) getUploadCompression() string {
+	algorithm, _ := cache.uploadCompression.Load().(string)
+	return algorithm
+}
+
+// splitArch returns the OS and architecture to send to the server for a target.
+// The configuration is added to the architecture so each one is stored separately on the
+// server and cleaning one doesn't affect the others.
+func splitArch(target *core.BuildTarget) (string, string) {
+	goos, goarch := core.SplitArch(target.Label.Arch)
+	return goos, goarch + target.Label.ConfigSuffix()
 }
 
 // isConnected checks if the cache is connected. If it's still trying to connect it allows a
 // very brief wait to give it a chance to come online.
 func (cache *rpcCache) isConnected() bool {
-	if cache.Connected {
+	if cache.isConnectedNow() {
 		return true
-	} else if !cache.Connecting {
+	} else if !cache.isConnecting() {
 		return false
 	}
 	ticker := time.NewTicker(10 * time.Millisecond)
-	for i := 0; i < 5 && cache.Connecting; i++ {
+	for i := 0; i < 5 && cache.isConnecting(); i++ {
 		<-ticker.C
 	}
 	ticker.Stop()
-	return cache.Connected
+	return cache.isConnectedNow()
+}
+
+// isConnectedNow returns true if the cache is connected, without waiting if it's still connecting.
+func (cache *rpcCache) isConnectedNow() bool {
+	return atomic.LoadInt32(&cache.connected) == 1
+}
+
+// isConnecting returns true if the cache is currently trying to (re)connect.
+func (cache *rpcCache) isConnecting() bool {
+	return atomic.LoadInt32(&cache.connecting) == 1
+}
+
+// waitForConnection is like isConnected but waits as long as it takes for the cache to finish
+// connecting. It's used for requests where there's nothing else to do in the meantime.
+func (cache *rpcCache) waitForConnection() bool {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for cache.isConnecting() {
+		<-ticker.C
+	}
+	return cache.isConnectedNow()
 }
 
 // error increments the error counter on the cache, and disables it if it gets too high.
-// Note that after this it won't reconnect; we could try that but it probably isn't worth it
-// (it's unlikely to restart in time if it's got a nontrivial set of artifacts to scan) and
-// the user has probably been pestered by enough messages already.
+// Note that it won't reconnect by itself after this; the rpcCluster it's part of periodically
+// checks whether it's come back.
 func (cache *rpcCache) error() {
-	if atomic.AddInt32(&cache.numErrors, 1) >= maxErrors && cache.Connected {
-		log.Warning("Disabling RPC cache, looks like the connection has been lost")
-		cache.Connected = false
+	if atomic.AddInt32(&cache.numErrors, 1) >= maxErrors && atomic.CompareAndSwapInt32(&cache.connected, 1, 0) {
+		log.Warning("Disabling RPC cache at %s, looks like the connection has been lost", cache.url)
 	}
 }
 
-func newRpcCache(config *core.Configuration) (*rpcCache, error) {
+// newRpcCache creates a new cache that talks to a single RPC server at the given URL.
+func newRpcCache(config *core.Configuration, url string) (*rpcCache, error) {
 	cache := &rpcCache{
+		url:        url,
 		Writeable:  config.Cache.RpcWriteable,
-		Connecting: true,
+		connecting: 1,
 		timeout:    time.Duration(config.Cache.RpcTimeout),
 		startTime:  time.Now(),
 		maxMsgSize: int(config.Cache.RpcMaxMsgSize),
 	}
+	cache.compression = compression.Configured(config.Cache.Compression)
 	go cache.connect(config)
 	return cache, nil
 }
@@ -296,6 +880,8 @@ func newRpcCache(config *core.Configuration) (*rpcCache, error) {
 // grpcLogMabob is an implementation of grpc's logging interface using our backend.
 type grpcLogMabob struct{}
 
+var setGrpcLoggerOnce sync.Once
+
 func (g *grpcLogMabob) Fatal(args ...interface{})                 { log.Fatal(args...) }
 func (g *grpcLogMabob) Fatalf(format string, args ...interface{}) { log.Fatalf(format, args...) }
 func (g *grpcLogMabob) Fatalln(args ...interface{})               { log.Fatal(args...) }
@@ -303,8 +889,9 @@ func (g *grpcLogMabob) Print(args ...interface{})                 { log.Warning(
 func (g *grpcLogMabob) Printf(format string, args ...interface{}) { log.Warning(format, args...) }
 func (g *grpcLogMabob) Println(args ...interface{})               { log.Warning("%s", args) }
 
-// loadAuth loads authentication credentials from a given pair of public / private key files.
-func loadAuth(caCert, publicKey, privateKey string) (grpc.DialOption, error) {
+// LoadAuth loads authentication credentials from a given pair of public / private key files.
+// It's also used by the remote executor, whose workers authenticate clients the same way.
+func LoadAuth(caCert, publicKey, privateKey string) (grpc.DialOption, error) {
 	config := tls.Config{}
 	if publicKey != "" {
 		log.Debug("Loading client certificate from %s, key %s", publicKey, privateKey)
@@ -1,7 +1,9 @@
 package cache
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
 	"runtime"
@@ -9,8 +11,10 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 
+	pb "cache/proto/rpc_cache"
 	"cache/server"
 	"core"
 )
@@ -39,24 +43,23 @@ func init() {
 func startServer(port int, keyFile, certFile, caCertFile string) *grpc.Server {
 	// Arbitrary large numbers so the cleaner never needs to run.
 	cache := server.NewCache("src/cache/test_data", 20*time.Hour, 100000, 100000000, 1000000000)
-	s, lis := server.BuildGrpcServer(port, cache, keyFile, certFile, caCertFile, "", "")
+	s, lis := server.BuildGrpcServer(port, cache, nil, keyFile, certFile, caCertFile, "", "")
 	go s.Serve(lis)
 	return s
 }
 
 func buildClient(port int, ca string) *rpcCache {
 	config := core.DefaultConfiguration()
-	config.Cache.RpcUrl = fmt.Sprintf("localhost:%d", port)
 	config.Cache.RpcWriteable = true
 	config.Cache.RpcCACert = ca
 
-	cache, err := newRpcCache(config)
+	cache, err := newRpcCache(config, fmt.Sprintf("localhost:%d", port))
 	if err != nil {
 		log.Fatalf("Failed to create RPC cache: %s", err)
 	}
 
 	// Busy-wait sucks but this isn't supposed to be visible from outside.
-	for i := 0; i < 10 && !cache.Connected && cache.Connecting; i++ {
+	for i := 0; i < 10 && !cache.isConnectedNow() && cache.isConnecting(); i++ {
 		time.Sleep(100 * time.Millisecond)
 	}
 	return cache
@@ -96,6 +99,146 @@ func TestStoreAndRetrieve(t *testing.T) {
 	}
 }
 
+func TestStoreAndRetrieveLargeArtifact(t *testing.T) {
+	// Needs a separate client so we can restrict the message size.
+	c := buildClient(7677, "")
+	c.maxMsgSize = chunkSize
+	target := core.NewBuildTarget(core.NewBuildLabel("pkg/name", "large_file"))
+	target.AddOutput("large_file.txt")
+	outPath := path.Join(target.OutDir(), target.Outputs()[0])
+	contents := bytes.Repeat([]byte("large file "), 3*chunkSize/10)
+	assert.NoError(t, ioutil.WriteFile(outPath, contents, 0644))
+	c.Store(target, []byte("test_key"))
+	// It should be stored despite being larger than the max message size, since it's streamed.
+	assert.NoError(t, os.Remove(outPath))
+	assert.True(t, c.Retrieve(target, []byte("test_key")))
+	retrieved, err := ioutil.ReadFile(outPath)
+	assert.NoError(t, err)
+	assert.Equal(t, contents, retrieved)
+}
+
+func TestStoreAndRetrieveWithoutStreaming(t *testing.T) {
+	// This is what happens against an older server that doesn't support streaming.
+	c := buildClient(7677, "")
+	c.noStreaming = 1
+	target := core.NewBuildTarget(core.NewBuildLabel("pkg/name", "unary"))
+	target.AddOutput("unary.txt")
+	outPath := path.Join(target.OutDir(), target.Outputs()[0])
+	assert.NoError(t, ioutil.WriteFile(outPath, []byte("unary"), 0644))
+	c.Store(target, []byte("test_key"))
+	assert.NoError(t, os.Remove(outPath))
+	assert.True(t, c.Retrieve(target, []byte("test_key")))
+	retrieved, err := ioutil.ReadFile(outPath)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("unary"), retrieved)
+}
+
+// A forgetfulClient claims the server has every blob, as if they'd been cleaned after it was asked.
+type forgetfulClient struct {
+	pb.RpcCacheClient
+}
+
+func (c forgetfulClient) FindMissingBlobs(ctx context.Context, in *pb.FindMissingBlobsRequest, opts ...grpc.CallOption) (*pb.FindMissingBlobsResponse, error) {
+	return &pb.FindMissingBlobsResponse{}, nil
+}
+
+func TestStoreResendsMissingBlobs(t *testing.T) {
+	for _, streaming := range []bool{true, false} {
+		c := buildClient(7677, "")
+		c.client = forgetfulClient{c.client}
+		if !streaming {
+			c.noStreaming = 1
+		}
+		name := fmt.Sprintf("missing_blobs_%v", streaming)
+		target := core.NewBuildTarget(core.NewBuildLabel("pkg/name", name))
+		target.AddOutput(name + ".txt")
+		outPath := path.Join(target.OutDir(), target.Outputs()[0])
+		contents := []byte("contents the server doesn't have: " + name)
+		assert.NoError(t, ioutil.WriteFile(outPath, contents, 0644))
+		c.Store(target, []byte("test_key"))
+		assert.NoError(t, os.Remove(outPath))
+		assert.True(t, c.Retrieve(target, []byte("test_key")))
+		retrieved, err := ioutil.ReadFile(outPath)
+		assert.NoError(t, err)
+		assert.Equal(t, contents, retrieved)
+	}
+}
+
+// A corruptingClient flips a byte in each file it retrieves by streaming.
+type corruptingClient struct {
+	pb.RpcCacheClient
+}
+
+func (c corruptingClient) RetrieveStream(ctx context.Context, in *pb.RetrieveRequest, opts ...grpc.CallOption) (pb.RpcCache_RetrieveStreamClient, error) {
+	stream, err := c.RpcCacheClient.RetrieveStream(ctx, in, opts...)
+	return corruptingStream{stream}, err
+}
+
+type corruptingStream struct {
+	pb.RpcCache_RetrieveStreamClient
+}
+
+func (s corruptingStream) Recv() (*pb.RetrieveStreamResponse, error) {
+	resp, err := s.RpcCache_RetrieveStreamClient.Recv()
+	if err == nil && resp.Chunk != nil && len(resp.Chunk.Digest) != 0 && len(resp.Chunk.Body) != 0 {
+		resp.Chunk.Body[0] ^= 0xff
+	}
+	return resp, err
+}
+
+func TestRetrieveStreamDigestMismatch(t *testing.T) {
+	c := buildClient(7677, "")
+	target := core.NewBuildTarget(core.NewBuildLabel("pkg/name", "corrupted"))
+	target.AddOutput("corrupted.txt")
+	outPath := path.Join(target.OutDir(), target.Outputs()[0])
+	assert.NoError(t, ioutil.WriteFile(outPath, []byte("corrupted"), 0644))
+	c.Store(target, []byte("test_key"))
+	assert.NoError(t, os.Remove(outPath))
+	c.client = corruptingClient{c.client}
+	assert.False(t, c.Retrieve(target, []byte("test_key")))
+	assert.False(t, core.PathExists(outPath))
+}
+
+func TestStoreAndRetrieveCompressed(t *testing.T) {
+	c := buildClient(7677, "")
+	c.compression = "gzip"
+	c.loadCapabilities()
+	assert.Equal(t, "gzip", c.getUploadCompression())
+	target := core.NewBuildTarget(core.NewBuildLabel("pkg/name", "compressed"))
+	target.AddOutput("compressed.txt")
+	outPath := path.Join(target.OutDir(), target.Outputs()[0])
+	contents := bytes.Repeat([]byte("compressed file "), chunkSize/5) // Spans several chunks
+	assert.NoError(t, ioutil.WriteFile(outPath, contents, 0644))
+	c.Store(target, []byte("test_key"))
+	assert.NoError(t, os.Remove(outPath))
+	assert.True(t, c.Retrieve(target, []byte("test_key")))
+	retrieved, err := ioutil.ReadFile(outPath)
+	assert.NoError(t, err)
+	assert.Equal(t, contents, retrieved)
+}
+
+func TestStoreAndRetrieveCompressedWithoutStreaming(t *testing.T) {
+	for _, noBlobs := range []int32{0, 1} {
+		c := buildClient(7677, "")
+		c.noStreaming = 1
+		c.noBlobs = noBlobs
+		c.compression = "gzip"
+		c.loadCapabilities()
+		assert.Equal(t, "gzip", c.getUploadCompression())
+		target := core.NewBuildTarget(core.NewBuildLabel("pkg/name", fmt.Sprintf("unary_compressed_%d", noBlobs)))
+		target.AddOutput("unary_compressed.txt")
+		outPath := path.Join(target.OutDir(), target.Outputs()[0])
+		contents := bytes.Repeat([]byte("unary compressed "), 1000)
+		assert.NoError(t, ioutil.WriteFile(outPath, contents, 0644))
+		c.Store(target, []byte("test_key"))
+		assert.NoError(t, os.Remove(outPath))
+		assert.True(t, c.Retrieve(target, []byte("test_key")))
+		retrieved, err := ioutil.ReadFile(outPath)
+		assert.NoError(t, err)
+		assert.Equal(t, contents, retrieved)
+	}
+}
+
 func TestClean(t *testing.T) {
 	target := core.NewBuildTarget(label)
 	rpccache.Clean(target)
@@ -105,6 +248,47 @@ func TestClean(t *testing.T) {
 	}
 }
 
+func TestListAndEvict(t *testing.T) {
+	target := core.NewBuildTarget(core.NewBuildLabel("pkg/name", "list"))
+	target.AddOutput("list.txt")
+	assert.NoError(t, os.MkdirAll(target.OutDir(), core.DirPermissions))
+	assert.NoError(t, ioutil.WriteFile(path.Join(target.OutDir(), "list.txt"), []byte("list"), 0644))
+	key1 := bytes.Repeat([]byte{1}, 20)
+	key2 := bytes.Repeat([]byte{2}, 20)
+	rpccache.Store(target, key1)
+	rpccache.Store(target, key2)
+	entries := rpccache.List(target)
+	assert.Equal(t, 2, len(entries))
+	assert.Contains(t, entries, core.CacheEntry{Cache: "rpc localhost:7677", Key: key1})
+	assert.Contains(t, entries, core.CacheEntry{Cache: "rpc localhost:7677", Key: key2})
+	rpccache.Evict(target, key1)
+	assert.Equal(t, []core.CacheEntry{{Cache: "rpc localhost:7677", Key: key2}}, rpccache.List(target))
+}
+
+func TestCleanOneConfig(t *testing.T) {
+	target := core.NewBuildTarget(core.NewBuildLabel("pkg/name", "configs"))
+	target.AddOutput("configs.txt")
+	variant := target.ForConfig("dbg")
+	for _, t2 := range []*core.BuildTarget{target, variant} {
+		assert.NoError(t, os.MkdirAll(t2.OutDir(), core.DirPermissions))
+		assert.NoError(t, ioutil.WriteFile(path.Join(t2.OutDir(), "configs.txt"), []byte("configs"), 0644))
+	}
+	key := bytes.Repeat([]byte{1}, 20)
+	rpccache.Store(target, key)
+	rpccache.Store(variant, key)
+	rpccache.Clean(variant)
+	assert.Equal(t, 0, len(rpccache.List(variant)))
+	assert.Equal(t, []core.CacheEntry{{Cache: "rpc localhost:7677", Key: key}}, rpccache.List(target))
+}
+
+func TestStats(t *testing.T) {
+	stats := rpccache.Stats()
+	assert.Equal(t, 1, len(stats))
+	assert.NoError(t, stats[0].Err)
+	assert.True(t, stats[0].Entries > 0)
+	assert.True(t, stats[0].Size > 0)
+}
+
 func TestDisconnectAfterEnoughErrors(t *testing.T) {
 	// Need a separate cache for this so we don't interfere with the other tests.
 	s := startServer(7676, "", "", "")
@@ -118,16 +302,16 @@ func TestDisconnectAfterEnoughErrors(t *testing.T) {
 	s.Stop()
 	// Now after we hit the max number of errors it should disconnect.
 	for i := 0; i < maxErrors; i++ {
-		assert.True(t, c.Connected)
+		assert.True(t, c.isConnectedNow())
 		assert.False(t, c.Retrieve(target, key))
 	}
-	assert.False(t, c.Connected)
+	assert.False(t, c.isConnectedNow())
 }
 
 func TestLoadCertificates(t *testing.T) {
-	_, err := loadAuth("", "src/cache/test_data/cert.pem", "src/cache/test_data/key.pem")
+	_, err := LoadAuth("", "src/cache/test_data/cert.pem", "src/cache/test_data/key.pem")
 	assert.NoError(t, err, "Trivial case with PEM files already")
-	_, err = loadAuth("", "id_rsa.pub", "id_rsa")
+	_, err = LoadAuth("", "id_rsa.pub", "id_rsa")
 	assert.Error(t, err, "Fails because files don't exist")
 }
 
@@ -136,7 +320,7 @@ func TestRetrieveSSL(t *testing.T) {
 	s := startServer(7675, "src/cache/test_data/key.pem", "src/cache/test_data/cert_signed.pem", "src/cache/test_data/ca.pem")
 	defer s.Stop()
 	c := buildClient(7675, "")
-	assert.False(t, c.Connected, "Should fail to connect without giving the client a CA cert")
+	assert.False(t, c.isConnectedNow(), "Should fail to connect without giving the client a CA cert")
 	c = buildClient(7675, "src/cache/test_data/ca.pem")
-	assert.True(t, c.Connected, "Connects OK this time")
+	assert.True(t, c.isConnectedNow(), "Connects OK this time")
 }
@@ -0,0 +1,162 @@
+// +build proto
+
+package cache
+
+import (
+	"sync"
+	"time"
+
+	"cache/cluster"
+	"core"
+)
+
+// An rpcCluster shards artifacts across a set of RPC cache servers by consistent hashing on their
+// target hashes, storing each one on several of them so it's still available if one goes down.
+// Servers that stop responding are ejected and rechecked periodically until they come back
+// (unless RpcRecheckFrequency is zero, in which case they stay ejected for the rest of the build).
+// With a single server it's just a thin wrapper around that one.
+type rpcCluster struct {
+	nodes    map[string]*rpcCache
+	ring     *cluster.Ring
+	replicas int
+	done     chan struct{}
+}
+
+func (c *rpcCluster) Store(target *core.BuildTarget, key []byte) {
+	c.store(key, func(node *rpcCache) { node.Store(target, key) })
+}
+
+func (c *rpcCluster) StoreExtra(target *core.BuildTarget, key []byte, file string) {
+	c.store(key, func(node *rpcCache) { node.StoreExtra(target, key, file) })
+}
+
+// store calls the given function in parallel for each of the servers the given key belongs on.
+func (c *rpcCluster) store(key []byte, f func(node *rpcCache)) {
+	var wg sync.WaitGroup
+	for _, node := range c.owners(key) {
+		wg.Add(1)
+		go func(node *rpcCache) {
+			f(node)
+			wg.Done()
+		}(node)
+	}
+	wg.Wait()
+}
+
+func (c *rpcCluster) Retrieve(target *core.BuildTarget, key []byte) bool {
+	for _, node := range c.owners(key) {
+		if node.Retrieve(target, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *rpcCluster) RetrieveExtra(target *core.BuildTarget, key []byte, file string) bool {
+	for _, node := range c.owners(key) {
+		if node.RetrieveExtra(target, key, file) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *rpcCluster) Clean(target *core.BuildTarget) {
+	// We don't know which hashes the servers have for this target, so they all need cleaning.
+	for _, node := range c.nodes {
+		node.Clean(target)
+	}
+}
+
+func (c *rpcCluster) List(target *core.BuildTarget) []core.CacheEntry {
+	ret := []core.CacheEntry{}
+	for _, url := range c.ring.Nodes() {
+		ret = append(ret, c.nodes[url].List(target)...)
+	}
+	return ret
+}
+
+func (c *rpcCluster) Evict(target *core.BuildTarget, key []byte) {
+	// Artifacts can end up on servers other than their owners while some are unavailable,
+	// so they all need checking.
+	for _, node := range c.nodes {
+		node.Evict(target, key)
+	}
+}
+
+func (c *rpcCluster) Stats() []core.CacheStats {
+	ret := []core.CacheStats{}
+	for _, url := range c.ring.Nodes() {
+		ret = append(ret, c.nodes[url].Stats()...)
+	}
+	return ret
+}
+
+func (c *rpcCluster) Shutdown() {
+	close(c.done)
+	for _, node := range c.nodes {
+		node.Shutdown()
+	}
+}
+
+// owners returns the servers that the given key belongs on, in order of preference.
+// Any that aren't available are skipped in favour of the next ones along the ring.
+func (c *rpcCluster) owners(key []byte) []*rpcCache {
+	ret := make([]*rpcCache, 0, c.replicas)
+	for _, url := range c.ring.Replicas(key, len(c.nodes)) {
+		if node := c.nodes[url]; node.isConnected() {
+			ret = append(ret, node)
+			if len(ret) == c.replicas {
+				break
+			}
+		}
+	}
+	return ret
+}
+
+// recheck periodically checks whether any servers that have been ejected are available again.
+func (c *rpcCluster) recheck(frequency time.Duration) {
+	ticker := time.NewTicker(frequency)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, node := range c.nodes {
+				if !node.isConnectedNow() && !node.isConnecting() {
+					node.reconnect()
+				}
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func newRpcCluster(config *core.Configuration) (*rpcCluster, error) {
+	c := &rpcCluster{
+		nodes:    map[string]*rpcCache{},
+		replicas: config.Cache.RpcReplicas,
+		done:     make(chan struct{}),
+	}
+	urls := []string{}
+	for _, url := range config.Cache.RpcUrl {
+		if _, present := c.nodes[url]; !present {
+			node, err := newRpcCache(config, url)
+			if err != nil {
+				return nil, err
+			}
+			c.nodes[url] = node
+			urls = append(urls, url)
+		}
+	}
+	if len(urls) > 1 {
+		log.Info("Using cluster of %d RPC cache servers, storing each artifact on %d of them", len(urls), c.replicas)
+	}
+	c.ring = cluster.NewRing(urls)
+	if config.Cache.RpcRecheckFrequency > 0 {
+		go c.recheck(time.Duration(config.Cache.RpcRecheckFrequency))
+	} else {
+		log.Debug("Not rechecking RPC cache servers that stop responding")
+	}
+	return c, nil
+}
@@ -0,0 +1,152 @@
+package cache
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+
+	"cache/cluster"
+	"cache/server"
+	"cli"
+	"core"
+)
+
+var clusterPorts = []int{7680, 7681, 7682}
+
+// recheckFrequency is how often the test cluster rechecks servers that have been ejected.
+const recheckFrequency = 100 * time.Millisecond
+
+var (
+	clusterURLs    []string
+	clusterServers = map[string]*grpc.Server{}
+	clusterDirs    = map[string]string{}
+	clusterCache   *rpcCluster
+	clusterTarget  *core.BuildTarget
+	clusterKey     []byte
+)
+
+func init() {
+	for i, port := range clusterPorts {
+		url := fmt.Sprintf("localhost:%d", port)
+		clusterURLs = append(clusterURLs, url)
+		clusterDirs[url] = fmt.Sprintf("rpc_cluster_test_%d", i)
+		startClusterServer(url)
+	}
+	config := core.DefaultConfiguration()
+	config.Cache.RpcUrl = clusterURLs
+	config.Cache.RpcWriteable = true
+	config.Cache.RpcReplicas = 2
+	config.Cache.RpcRecheckFrequency = cli.Duration(recheckFrequency)
+	c, err := newRpcCluster(config)
+	if err != nil {
+		log.Fatalf("Failed to create RPC cluster: %s", err)
+	}
+	clusterCache = c
+	// Busy-wait sucks but this isn't supposed to be visible from outside.
+	for _, node := range c.nodes {
+		for i := 0; i < 10 && !node.isConnectedNow() && node.isConnecting(); i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	clusterTarget = core.NewBuildTarget(core.NewBuildLabel("pkg/cluster", "target"))
+	clusterTarget.AddOutput("out.txt")
+	if err := os.MkdirAll(clusterTarget.OutDir(), core.DirPermissions); err != nil {
+		log.Fatalf("%s", err)
+	}
+	writeClusterOutput()
+	key := sha1.Sum([]byte("rpc_cluster_test"))
+	clusterKey = key[:]
+}
+
+func startClusterServer(url string) {
+	var port int
+	fmt.Sscanf(url, "localhost:%d", &port)
+	// Arbitrary large numbers so the cleaner never needs to run.
+	cache := server.NewCache(clusterDirs[url], 20*time.Hour, 100000, 100000000, 1000000000)
+	s, lis := server.BuildGrpcServer(port, cache, nil, "", "", "", "", "")
+	go s.Serve(lis)
+	clusterServers[url] = s
+}
+
+func writeClusterOutput() {
+	if err := ioutil.WriteFile(path.Join(clusterTarget.OutDir(), "out.txt"), []byte("cluster contents"), 0644); err != nil {
+		log.Fatalf("%s", err)
+	}
+}
+
+// storedOn returns true if the test artifact is stored on the server with the given URL.
+func storedOn(url string) bool {
+	osName := runtime.GOOS + "_" + runtime.GOARCH
+	return core.PathExists(path.Join(clusterDirs[url], osName, "pkg/cluster/target", base64.RawURLEncoding.EncodeToString(clusterKey), "out.txt"))
+}
+
+func TestClusterStore(t *testing.T) {
+	clusterCache.Store(clusterTarget, clusterKey)
+	owners := cluster.NewRing(clusterURLs).Replicas(clusterKey, len(clusterURLs))
+	assert.True(t, storedOn(owners[0]))
+	assert.True(t, storedOn(owners[1]))
+	assert.False(t, storedOn(owners[2]))
+}
+
+func TestClusterFailover(t *testing.T) {
+	clusterCache.Store(clusterTarget, clusterKey)
+	owner := cluster.NewRing(clusterURLs).Replicas(clusterKey, 1)[0]
+	node := clusterCache.nodes[owner]
+	clusterServers[owner].Stop()
+
+	for i := 0; i < maxErrors; i++ {
+		os.Remove(path.Join(clusterTarget.OutDir(), "out.txt"))
+		assert.True(t, clusterCache.Retrieve(clusterTarget, clusterKey))
+		b, err := ioutil.ReadFile(path.Join(clusterTarget.OutDir(), "out.txt"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("cluster contents"), b)
+	}
+	// By now it should have given up on the server that's down.
+	assert.False(t, node.isConnectedNow())
+	for _, n := range clusterCache.owners(clusterKey) {
+		assert.NotEqual(t, owner, n.url)
+	}
+	// It should get picked up again once it's back.
+	startClusterServer(owner)
+	for i := 0; i < 100 && !node.isConnectedNow(); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.True(t, node.isConnectedNow())
+	assert.Equal(t, owner, clusterCache.owners(clusterKey)[0].url)
+}
+
+func TestNoRecheck(t *testing.T) {
+	config := core.DefaultConfiguration()
+	config.Cache.RpcUrl = clusterURLs
+	config.Cache.RpcReplicas = 1
+	config.Cache.RpcRecheckFrequency = 0
+	c, err := newRpcCluster(config)
+	assert.NoError(t, err)
+	defer c.Shutdown()
+	owner := cluster.NewRing(clusterURLs).Replicas(clusterKey, 1)[0]
+	node := c.nodes[owner]
+	for i := 0; i < 10 && !node.isConnectedNow() && node.isConnecting(); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.True(t, node.isConnectedNow())
+	// Eject it as though it had stopped responding.
+	for i := 0; i < maxErrors; i++ {
+		node.error()
+	}
+	assert.False(t, node.isConnectedNow())
+	// Well past the interval the other tests recheck at, it should still be ejected.
+	time.Sleep(5 * recheckFrequency)
+	assert.False(t, node.isConnectedNow())
+	assert.False(t, node.isConnecting())
+	assert.NotEqual(t, owner, c.owners(clusterKey)[0].url)
+}
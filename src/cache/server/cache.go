@@ -2,7 +2,10 @@
 package server
 
 import (
-	"bytes"
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
@@ -11,11 +14,13 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/dustin/go-humanize"
 	"github.com/streamrail/concurrent-map"
 
+	"cache/compression"
 	"cache/tools"
 	"core"
 )
@@ -30,13 +35,36 @@ type cachedFile struct {
 	readCount int
 	// Size of the file
 	size int64
+	// Digest of the file's contents, if we know it.
+	digest []byte
+	// Root of the entry the file belongs to, ie. arch/package/target/hash.
+	root string
 }
 
+// entry returns the entry the file belongs to, or nil if it doesn't look like part of one.
+func (file *cachedFile) entry() *entry {
+	file.RLock()
+	defer file.RUnlock()
+	return parseEntry(file.root)
+}
+
+// blobDir is the directory (relative to the cache root) that blobs are stored in.
+// Each blob is named by the hex encoding of its digest; artifacts are hardlinked to them
+// so identical outputs from different targets are only stored on disk once.
+const blobDir = "_blobs"
+
+// tempBlobPrefix is the prefix of temporary files in the blob store that are still being written.
+const tempBlobPrefix = ".tmp_"
+
 // A Cache is the underlying implementation of our HTTP and RPC caches that handles storing & retrieving artifacts.
 type Cache struct {
 	cachedFiles cmap.ConcurrentMap
 	totalSize   int64
 	rootPath    string
+	// Guards the blob store against orphaned blobs being cleaned while they're being linked.
+	blobMutex sync.RWMutex
+	// Algorithm to compress blobs with when storing them, or empty if they're stored as they are.
+	compression string
 }
 
 // NewCache initialises the cache and fires off a background cleaner goroutine which runs every
@@ -57,6 +85,13 @@ func newCache(path string) *Cache {
 	return cache
 }
 
+// SetCompression makes the cache store new artifacts compressed with the given algorithm, if
+// they're worth compressing. Artifacts are always retrieved uncompressed regardless of how
+// they were stored.
+func (cache *Cache) SetCompression(algorithm string) {
+	cache.compression = compression.Configured(algorithm)
+}
+
 // scan scans the directory tree for files.
 func (cache *Cache) scan() {
 	cache.cachedFiles = cmap.New()
@@ -70,17 +105,25 @@ func (cache *Cache) scan() {
 	}
 
 	log.Info("Scanning cache directory %s...", cache.rootPath)
+	digests := cache.scanBlobs()
+	blobRoot := path.Join(cache.rootPath, blobDir)
 	filepath.Walk(cache.rootPath, func(name string, info os.FileInfo, err error) error {
 		if err != nil {
 			log.Fatalf("%s", err)
+		} else if info.IsDir() && name == blobRoot {
+			return filepath.SkipDir // Blobs aren't artifacts themselves.
 		} else if !info.IsDir() { // We don't have directory entries.
 			name = name[len(cache.rootPath)+1:]
 			log.Debug("Found file %s", name)
+			// We can't tell from here whether it's in a subdirectory of its entry, so assume it
+			// isn't; it'll be corrected if it's stored again.
 			size := info.Size()
 			cache.cachedFiles.Set(name, &cachedFile{
 				lastReadTime: time.Unix(tools.AccessTime(info), 0),
 				readCount:    0,
 				size:         size,
+				digest:       digests[inode(info)],
+				root:         path.Dir(name),
 			})
 			cache.totalSize += size
 		}
@@ -89,6 +132,30 @@ func (cache *Cache) scan() {
 	log.Info("Scan complete, found %d entries", cache.cachedFiles.Count())
 }
 
+// scanBlobs scans the blob store and returns a map of inode -> digest for each blob in it.
+// Since artifacts are hardlinked to their blobs this lets us recover their digests.
+func (cache *Cache) scanBlobs() map[uint64][]byte {
+	ret := map[uint64][]byte{}
+	blobRoot := path.Join(cache.rootPath, blobDir)
+	if !core.PathExists(blobRoot) {
+		return ret
+	}
+	filepath.Walk(blobRoot, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			log.Fatalf("%s", err)
+		} else if !info.IsDir() && !strings.HasPrefix(path.Base(name), tempBlobPrefix) {
+			if digest, err := hex.DecodeString(path.Base(name)); err != nil {
+				log.Warning("Unexpected file in blob store: %s", name)
+			} else {
+				ret[inode(info)] = digest
+			}
+		}
+		return nil
+	})
+	log.Info("Found %d blobs", len(ret))
+	return ret
+}
+
 // lockFile locks a file for reading or writing.
 // It returns a locked mutex corresponding to that file or nil if there is none.
 // The caller should .Unlock() the mutex once they're done with it.
@@ -146,7 +213,7 @@ func (cache *Cache) RetrieveArtifact(artPath string) (map[string][]byte, error)
 		for _, art := range core.Glob(cache.rootPath, []string{artPath}, nil, nil, true) {
 			fullPath := path.Join(cache.rootPath, art)
 			lock := cache.lockFile(fullPath, false, 0)
-			body, err := ioutil.ReadFile(fullPath)
+			body, err := compression.ReadStoredFile(fullPath)
 			if lock != nil {
 				lock.RUnlock()
 			}
@@ -174,7 +241,7 @@ func (cache *Cache) RetrieveArtifact(artPath string) (map[string][]byte, error)
 		if err != nil {
 			return err
 		} else if !info.IsDir() {
-			body, err := ioutil.ReadFile(name)
+			body, err := compression.ReadStoredFile(name)
 			if err != nil {
 				return err
 			}
@@ -211,24 +278,128 @@ func (cache *Cache) retrieveDir(artPath string) (map[string][]byte, error) {
 	return ret, err
 }
 
-// StoreArtifact takes in the artifact content and path as parameters and creates a file with
-// the given content in the given path.
+// StoreArtifact takes in the artifact path and a reader for its content as parameters and
+// creates a file with the given content in the given path. The content is written to disk
+// incrementally as it's read, so it doesn't all need to be held in memory at once.
+// The content is written to the blob store and the artifact is linked to it, so storing
+// identical content under multiple paths only uses the space once.
 // The function will return the first error found in the process, or nil if the process is successful.
-func (cache *Cache) StoreArtifact(artPath string, key []byte) error {
+func (cache *Cache) StoreArtifact(artPath string, r io.Reader) error {
+	return cache.storeArtifact(path.Dir(artPath), artPath, r)
+}
+
+// storeArtifact is like StoreArtifact but also takes the root of the entry the artifact belongs to,
+// for when it's stored in a subdirectory of it.
+func (cache *Cache) storeArtifact(root, artPath string, r io.Reader) error {
 	log.Info("Storing artifact %s", artPath)
-	lock := cache.lockFile(artPath, true, int64(len(key)))
+	cache.blobMutex.RLock()
+	defer cache.blobMutex.RUnlock()
+	digest, size, err := cache.storeBlob(artPath, r)
+	if err != nil {
+		return err
+	}
+	return cache.linkArtifact(root, artPath, digest, size)
+}
+
+// StoreArtifactFromBlob stores an artifact at the given path from a blob that's already in the
+// blob store. It returns an error satisfying os.IsNotExist if we don't have the blob.
+func (cache *Cache) StoreArtifactFromBlob(artPath string, digest []byte) error {
+	return cache.storeArtifactFromBlob(path.Dir(artPath), artPath, digest)
+}
+
+// storeArtifactFromBlob is like StoreArtifactFromBlob but also takes the root of the entry.
+func (cache *Cache) storeArtifactFromBlob(root, artPath string, digest []byte) error {
+	log.Info("Storing artifact %s from blob %s", artPath, hex.EncodeToString(digest))
+	cache.blobMutex.RLock()
+	defer cache.blobMutex.RUnlock()
+	info, err := os.Stat(cache.blobPath(digest))
+	if err != nil {
+		return err
+	}
+	return cache.linkArtifact(root, artPath, digest, info.Size())
+}
+
+// storeBlob writes some content into the blob store if it's not already there, compressing it
+// if the cache is set up to and the artifact it's for is worth compressing.
+// It returns the digest of the content and the size of the blob.
+// The caller should hold blobMutex for reading.
+func (cache *Cache) storeBlob(artPath string, r io.Reader) ([]byte, int64, error) {
+	blobRoot := path.Join(cache.rootPath, blobDir)
+	if err := os.MkdirAll(blobRoot, core.DirPermissions); err != nil {
+		return nil, 0, err
+	}
+	// We don't know the digest until we've read it all, so write to a temp file first.
+	f, err := ioutil.TempFile(blobRoot, tempBlobPrefix)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer os.Remove(f.Name()) // Harmless if it's been renamed.
+	h := sha1.New()
+	br := bufio.NewReader(r)
+	w := io.WriteCloser(f)
+	if head, _ := br.Peek(compression.SniffSize); cache.compression != "" && compression.Compressible(artPath, head) {
+		if w, err = compression.NewStoredWriter(cache.compression, f); err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+	}
+	_, err = io.Copy(w, io.TeeReader(br, h))
+	if w != f {
+		if err2 := w.Close(); err == nil {
+			err = err2
+		}
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		log.Errorf("Could not write blob: %s", err)
+		return nil, 0, err
+	}
+	digest := h.Sum(nil)
+	blobPath := cache.blobPath(digest)
+	if info, err := os.Stat(blobPath); err == nil {
+		return digest, info.Size(), nil // Already got it.
+	}
+	info, err := os.Stat(f.Name())
+	if err != nil {
+		return nil, 0, err
+	}
+	size := info.Size()
+	log.Debug("Writing blob to %s", blobPath)
+	if err := os.Chmod(f.Name(), 0664); err != nil {
+		return nil, 0, err
+	} else if err := os.MkdirAll(path.Dir(blobPath), core.DirPermissions); err != nil {
+		return nil, 0, err
+	} else if err := os.Rename(f.Name(), blobPath); err != nil {
+		log.Errorf("Could not write blob %s: %s", blobPath, err)
+		return nil, 0, err
+	}
+	return digest, size, nil
+}
+
+// linkArtifact creates an artifact at the given path by hardlinking it to a blob.
+// The caller should hold blobMutex for reading.
+func (cache *Cache) linkArtifact(root, artPath string, digest []byte, size int64) error {
+	lock := cache.lockFile(artPath, true, size)
 	defer lock.Unlock()
+	lock.digest = digest
+	lock.root = root
 
 	fullPath := path.Join(cache.rootPath, artPath)
 	dirPath := path.Dir(fullPath)
 	if err := os.MkdirAll(dirPath, core.DirPermissions); err != nil {
-		log.Warning("Couldn't create path %s in http cache: %s", dirPath, err)
+		log.Warning("Couldn't create path %s in cache: %s", dirPath, err)
 		cache.removeAndDeleteFile(artPath, lock)
 		os.RemoveAll(dirPath)
 		return err
 	}
-	log.Debug("Writing artifact to %s", fullPath)
-	if err := core.WriteFile(bytes.NewReader(key), fullPath, 0); err != nil {
+	log.Debug("Linking artifact %s to blob", fullPath)
+	if err := os.RemoveAll(fullPath); err != nil {
+		log.Errorf("Could not remove existing artifact %s: %s", fullPath, err)
+		cache.removeAndDeleteFile(artPath, lock)
+		return err
+	} else if err := os.Link(cache.blobPath(digest), fullPath); err != nil {
 		log.Errorf("Could not create %s artifact: %s", fullPath, err)
 		cache.removeAndDeleteFile(artPath, lock)
 		return err
@@ -236,6 +407,161 @@ func (cache *Cache) StoreArtifact(artPath string, key []byte) error {
 	return nil
 }
 
+// HasBlob returns true if the blob store contains a blob with the given digest.
+// It also marks the blob as recently used, so the cleaner leaves it alone for long enough
+// for a client that's been told we have it to store artifacts that refer to it.
+func (cache *Cache) HasBlob(digest []byte) bool {
+	cache.blobMutex.RLock()
+	defer cache.blobMutex.RUnlock()
+	now := time.Now()
+	return os.Chtimes(cache.blobPath(digest), now, now) == nil
+}
+
+// RetrieveBlob returns the contents of a single blob from the blob store.
+func (cache *Cache) RetrieveBlob(digest []byte) ([]byte, error) {
+	cache.blobMutex.RLock()
+	defer cache.blobMutex.RUnlock()
+	return compression.ReadStoredFile(cache.blobPath(digest))
+}
+
+// RetrieveDigests is like RetrieveArtifact but returns the digests of the artifacts rather
+// than their contents. Any artifacts that aren't in the blob store yet get added to it.
+func (cache *Cache) RetrieveDigests(artPath string) (map[string][]byte, error) {
+	files, err := cache.ArtifactFiles(artPath)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string][]byte, len(files))
+	for _, name := range files {
+		digest, err := cache.artifactDigest(name)
+		if err != nil {
+			return nil, err
+		}
+		ret[name] = digest
+	}
+	return ret, nil
+}
+
+// StreamFile calls the given function with a reader for a single file, holding a read lock on it
+// while it does so. This avoids reading the whole file into memory at once.
+func (cache *Cache) StreamFile(name string, f func(name string, r io.Reader) error) error {
+	lock := cache.lockFile(name, false, 0)
+	if lock == nil {
+		return os.ErrNotExist
+	}
+	defer lock.RUnlock()
+	file, err := os.Open(path.Join(cache.rootPath, name))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	r, err := compression.NewStoredReader(file)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return f(name, r)
+}
+
+// ArtifactFiles returns the paths of all the files that make up an artifact, which might be
+// a single file, a directory or a glob.
+func (cache *Cache) ArtifactFiles(artPath string) ([]string, error) {
+	if core.IsGlob(artPath) {
+		return core.Glob(cache.rootPath, []string{artPath}, nil, nil, true), nil
+	}
+	ret := []string{}
+	err := filepath.Walk(path.Join(cache.rootPath, artPath), func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if !info.IsDir() {
+			ret = append(ret, name[len(cache.rootPath)+1:])
+		}
+		return nil
+	})
+	return ret, err
+}
+
+// ArtifactHashes returns the hashes that a target has artifacts stored under, in no particular
+// order. The target is identified by its path in the cache, i.e. arch/package/target.
+func (cache *Cache) ArtifactHashes(targetPath string) [][]byte {
+	seen := map[string]bool{}
+	ret := [][]byte{}
+	for t := range cache.cachedFiles.IterBuffered() {
+		if !strings.HasPrefix(t.Key, targetPath+"/") {
+			continue
+		} else if e := t.Val.(*cachedFile).entry(); e != nil && !seen[e.root] && path.Dir(e.root) == targetPath {
+			seen[e.root] = true
+			ret = append(ret, e.key)
+		}
+	}
+	return ret
+}
+
+// Stats returns the number of sets of artifacts in the cache (i.e. distinct target / hash pairs)
+// and their total size.
+func (cache *Cache) Stats() (int, int64) {
+	roots := map[string]bool{}
+	for t := range cache.cachedFiles.IterBuffered() {
+		if e := t.Val.(*cachedFile).entry(); e != nil {
+			roots[e.root] = true
+		}
+	}
+	return len(roots), atomic.LoadInt64(&cache.totalSize)
+}
+
+// artifactDigest returns the digest of a single artifact, calculating it if we don't know it yet.
+func (cache *Cache) artifactDigest(artPath string) ([]byte, error) {
+	file := cache.lockFile(artPath, false, 0)
+	if file == nil {
+		return nil, os.ErrNotExist
+	} else if file.digest != nil {
+		defer file.RUnlock()
+		return file.digest, nil
+	}
+	// Must have been written before we had a blob store; adopt it into there now.
+	fullPath := path.Join(cache.rootPath, artPath)
+	body, err := compression.ReadStoredFile(fullPath)
+	if err != nil {
+		file.RUnlock()
+		return nil, err
+	}
+	digest := Digest(body)
+	cache.blobMutex.RLock()
+	if err := cache.adoptBlob(fullPath, digest); err != nil {
+		log.Warning("Failed to add %s to blob store: %s", artPath, err)
+	}
+	cache.blobMutex.RUnlock()
+	file.RUnlock()
+	file.Lock()
+	if file.digest == nil { // Could have been rewritten in the meantime.
+		file.digest = digest
+	}
+	file.Unlock()
+	return digest, nil
+}
+
+// adoptBlob links an existing file into the blob store if there isn't a blob for it already.
+func (cache *Cache) adoptBlob(fullPath string, digest []byte) error {
+	blobPath := cache.blobPath(digest)
+	if core.PathExists(blobPath) {
+		return nil
+	} else if err := os.MkdirAll(path.Dir(blobPath), core.DirPermissions); err != nil {
+		return err
+	} else if err := os.Link(fullPath, blobPath); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+// blobPath returns the path to a blob in the blob store.
+func (cache *Cache) blobPath(digest []byte) string {
+	h := hex.EncodeToString(digest)
+	if len(h) < 2 {
+		return path.Join(cache.rootPath, blobDir, h)
+	}
+	return path.Join(cache.rootPath, blobDir, h[:2], h)
+}
+
 // DeleteArtifact takes in the artifact path as a parameter and removes the artifact from disk.
 // The function will return the first error found in the process, or nil if the process is successful.
 func (cache *Cache) DeleteArtifact(artPath string) error {
@@ -262,6 +588,8 @@ func (cache *Cache) DeleteArtifact(artPath string) error {
 // The function will return the first error found in the process, or nil if the process is successful.
 func (cache *Cache) DeleteAllArtifacts() error {
 	// Empty entire cache now.
+	cache.blobMutex.Lock()
+	defer cache.blobMutex.Unlock()
 	cache.cachedFiles = cmap.New()
 	cache.totalSize = 0
 	// Move directory somewhere else
@@ -277,7 +605,36 @@ func (cache *Cache) clean(cleanFrequency, maxArtifactAge time.Duration, lowWater
 	for range time.NewTicker(cleanFrequency).C {
 		cache.cleanOldFiles(maxArtifactAge)
 		cache.singleClean(lowWaterMark, highWaterMark)
+		cache.cleanOrphanedBlobs(cleanFrequency)
+	}
+}
+
+// cleanOrphanedBlobs removes any blobs from the blob store that no artifacts refer to any more.
+// Blobs used within minAge are kept since a client may be about to store artifacts that refer to them.
+// Note that blobs don't count towards the total size of the cache since their artifacts already do.
+func (cache *Cache) cleanOrphanedBlobs(minAge time.Duration) int {
+	cache.blobMutex.Lock()
+	defer cache.blobMutex.Unlock()
+	blobRoot := path.Join(cache.rootPath, blobDir)
+	if !core.PathExists(blobRoot) {
+		return 0
 	}
+	cleaned := 0
+	filepath.Walk(blobRoot, func(name string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && numLinks(info) <= 1 && time.Since(info.ModTime()) >= minAge {
+			log.Debug("Removing orphaned blob %s", name)
+			if err := os.Remove(name); err != nil {
+				log.Warning("Failed to remove orphaned blob %s: %s", name, err)
+			} else {
+				cleaned++
+			}
+		}
+		return nil
+	})
+	if cleaned > 0 {
+		log.Notice("Removed %d orphaned blobs", cleaned)
+	}
+	return cleaned
 }
 
 // cleanOldFiles cleans any files whose last access time is older than the given duration.
@@ -351,3 +708,25 @@ func (cache *Cache) filesToClean(lowWaterMark int64) cachedFilePaths {
 	}
 	return ret
 }
+
+// Digest returns the digest of some content, as used to identify blobs.
+func Digest(body []byte) []byte {
+	digest := sha1.Sum(body)
+	return digest[:]
+}
+
+// inode returns the inode number of a file.
+func inode(info os.FileInfo) uint64 {
+	if s, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(s.Ino)
+	}
+	return 0
+}
+
+// numLinks returns the number of hard links to a file.
+func numLinks(info os.FileInfo) uint64 {
+	if s, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(s.Nlink)
+	}
+	return 0
+}
@@ -2,6 +2,7 @@
 package server
 
 import (
+	"bytes"
 	"crypto/sha1"
 	"fmt"
 	"math/rand"
@@ -30,7 +31,7 @@ func TestStoreFiles(t *testing.T) {
 	for _, i := range rand.Perm(size) {
 		go func(i int) {
 			path, contents := artifact(i)
-			assert.NoError(t, cache.StoreArtifact(path, contents))
+			assert.NoError(t, cache.StoreArtifact(path, bytes.NewReader(contents)))
 			wg.Done()
 		}(i)
 	}
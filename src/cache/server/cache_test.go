@@ -2,8 +2,12 @@
 package server
 
 import (
+	"bytes"
+	"encoding/base64"
+	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"testing"
@@ -96,14 +100,112 @@ func TestGlob(t *testing.T) {
 func TestStore(t *testing.T) {
 	fileContent := "This is a newly created file."
 	reader := strings.NewReader(fileContent)
-	key, err := ioutil.ReadAll(reader)
 
-	err = cache.StoreArtifact("/darwin_amd64/somepack/somelabel/somehash/somelabel.ext", key)
+	err := cache.StoreArtifact("/darwin_amd64/somepack/somelabel/somehash/somelabel.ext", reader)
 	if err != nil {
 		t.Error(err)
 	}
 }
 
+func TestStoreDeduplicatesBlobs(t *testing.T) {
+	c := newCache("test_store_dedupe")
+	content := []byte("Some content that's produced by two targets")
+	assert.NoError(t, c.StoreArtifact("linux_amd64/pack/label1/hash/out.txt", bytes.NewReader(content)))
+	assert.NoError(t, c.StoreArtifact("linux_amd64/pack/label2/hash/out.txt", bytes.NewReader(content)))
+	info1, err := os.Stat("test_store_dedupe/linux_amd64/pack/label1/hash/out.txt")
+	assert.NoError(t, err)
+	info2, err := os.Stat("test_store_dedupe/linux_amd64/pack/label2/hash/out.txt")
+	assert.NoError(t, err)
+	assert.True(t, os.SameFile(info1, info2))
+	assert.True(t, c.HasBlob(Digest(content)))
+	blob, err := c.RetrieveBlob(Digest(content))
+	assert.NoError(t, err)
+	assert.Equal(t, content, blob)
+}
+
+func TestStoreArtifactFromBlob(t *testing.T) {
+	c := newCache("test_store_from_blob")
+	content := []byte("Some more content")
+	assert.NoError(t, c.StoreArtifact("linux_amd64/pack/label1/hash/out.txt", bytes.NewReader(content)))
+	assert.NoError(t, c.StoreArtifactFromBlob("linux_amd64/pack/label2/hash/out.txt", Digest(content)))
+	ret, err := c.RetrieveArtifact("linux_amd64/pack/label2/hash/out.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, content, ret["linux_amd64/pack/label2/hash/out.txt"])
+	err = c.StoreArtifactFromBlob("linux_amd64/pack/label3/hash/out.txt", Digest([]byte("nope")))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestStoreCompressed(t *testing.T) {
+	c := newCache("test_store_compressed")
+	c.SetCompression("gzip")
+	content := bytes.Repeat([]byte("Some content that compresses well. "), 100)
+	assert.NoError(t, c.StoreArtifact("linux_amd64/pack/label/hash/out.txt", bytes.NewReader(content)))
+	info, err := os.Stat("test_store_compressed/linux_amd64/pack/label/hash/out.txt")
+	assert.NoError(t, err)
+	assert.True(t, info.Size() < int64(len(content)), "Artifact should be stored compressed")
+	ret, err := c.RetrieveArtifact("linux_amd64/pack/label/hash/out.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, content, ret["linux_amd64/pack/label/hash/out.txt"])
+	blob, err := c.RetrieveBlob(Digest(content))
+	assert.NoError(t, err)
+	assert.Equal(t, content, blob)
+	assert.NoError(t, c.StreamFile("linux_amd64/pack/label/hash/out.txt", func(name string, r io.Reader) error {
+		b, err := ioutil.ReadAll(r)
+		assert.Equal(t, content, b)
+		return err
+	}))
+	// Already-compressed artifacts aren't compressed again.
+	jar := bytes.Repeat([]byte("Pretend this is a jar. "), 100)
+	assert.NoError(t, c.StoreArtifact("linux_amd64/pack/label/hash/out.jar", bytes.NewReader(jar)))
+	info, err = os.Stat("test_store_compressed/linux_amd64/pack/label/hash/out.jar")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(jar)), info.Size())
+}
+
+func TestRetrieveDigests(t *testing.T) {
+	digests, err := cache.RetrieveDigests("darwin_amd64/pack/label/hash/label.ext")
+	assert.NoError(t, err)
+	content, err := ioutil.ReadFile(cachePath + "/darwin_amd64/pack/label/hash/label.ext")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"darwin_amd64/pack/label/hash/label.ext": Digest(content)}, digests)
+	// It should have been added to the blob store when we asked for its digest.
+	assert.True(t, cache.HasBlob(Digest(content)))
+}
+
+func TestScanRecoversDigests(t *testing.T) {
+	c := newCache("test_scan_digests")
+	content := []byte("Content that should be found again")
+	assert.NoError(t, c.StoreArtifact("linux_amd64/pack/label/hash/out.txt", bytes.NewReader(content)))
+	c = newCache("test_scan_digests")
+	file := c.lockFile("linux_amd64/pack/label/hash/out.txt", false, 0)
+	assert.NotNil(t, file)
+	file.RUnlock()
+	assert.Equal(t, Digest(content), file.digest)
+	assert.Equal(t, 1, c.cachedFiles.Count(), "Blobs shouldn't be counted as artifacts")
+}
+
+func TestCleanOrphanedBlobs(t *testing.T) {
+	c := newCache("test_clean_orphaned_blobs")
+	content1 := []byte("This will be deleted")
+	content2 := []byte("This will be kept")
+	assert.NoError(t, c.StoreArtifact("linux_amd64/pack/label1/hash/out.txt", bytes.NewReader(content1)))
+	assert.NoError(t, c.StoreArtifact("linux_amd64/pack/label2/hash/out.txt", bytes.NewReader(content2)))
+	assert.NoError(t, c.DeleteArtifact("linux_amd64/pack/label1"))
+	assert.Equal(t, 1, c.cleanOrphanedBlobs(0))
+	assert.False(t, c.HasBlob(Digest(content1)))
+	assert.True(t, c.HasBlob(Digest(content2)))
+}
+
+func TestCleanOrphanedBlobsKeepsRecent(t *testing.T) {
+	c := newCache("test_clean_recent_blobs")
+	content := []byte("This was only just stored")
+	assert.NoError(t, c.StoreArtifact("linux_amd64/pack/label/hash/out.txt", bytes.NewReader(content)))
+	assert.NoError(t, c.DeleteArtifact("linux_amd64/pack/label"))
+	// A client may have been told we have this blob and be about to store an artifact referring to it.
+	assert.Equal(t, 0, c.cleanOrphanedBlobs(time.Hour))
+	assert.True(t, c.HasBlob(Digest(content)))
+}
+
 func TestDeleteArtifact(t *testing.T) {
 	err := cache.DeleteArtifact("/linux_amd64/otherpack/label")
 	assert.NoError(t, err)
@@ -123,3 +225,28 @@ func TestDeleteAll(t *testing.T) {
 		t.Error("The cache was not cleaned.")
 	}
 }
+
+func TestArtifactHashesAndStats(t *testing.T) {
+	c := newCache("test_artifact_hashes")
+	key1 := base64.RawURLEncoding.EncodeToString(bytes.Repeat([]byte{1}, 20))
+	key2 := base64.RawURLEncoding.EncodeToString(bytes.Repeat([]byte{2}, 20))
+	for _, name := range []string{
+		"linux_amd64/pkg/name/" + key1 + "/out1",
+		"linux_amd64/pkg/name/" + key1 + "/out2",
+		"linux_amd64/pkg/name/" + key2 + "/out1",
+		"linux_amd64/pkg/name2/" + key1 + "/out1",
+		"linux_amd64/pkg/name/nested/" + key1 + "/out1",
+	} {
+		c.cachedFiles.Set(name, &cachedFile{size: 1000, root: path.Dir(name)})
+	}
+	c.totalSize = 5000
+	hashes := c.ArtifactHashes("linux_amd64/pkg/name")
+	assert.Equal(t, 2, len(hashes))
+	assert.Contains(t, hashes, bytes.Repeat([]byte{1}, 20))
+	assert.Contains(t, hashes, bytes.Repeat([]byte{2}, 20))
+	assert.Equal(t, [][]byte{bytes.Repeat([]byte{1}, 20)}, c.ArtifactHashes("linux_amd64/pkg/name2"))
+	assert.Equal(t, 0, len(c.ArtifactHashes("linux_amd64/pkg/name3")))
+	entries, size := c.Stats()
+	assert.Equal(t, 4, entries)
+	assert.EqualValues(t, 5000, size)
+}
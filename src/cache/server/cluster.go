@@ -0,0 +1,228 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"cache/cluster"
+	pb "cache/proto/rpc_cache"
+	"core"
+)
+
+// peerTimeout is the timeout for each request we make to another server in the cluster.
+const peerTimeout = 5 * time.Minute
+
+// A Cluster is a set of RPC cache servers that clients shard artifacts across by consistent
+// hashing on their target hashes, storing each one on several of them.
+// When its membership changes it moves the artifacts on this server to the ones they now belong on.
+type Cluster struct {
+	cache *Cache
+	// This server's address, as the clients see it.
+	address  string
+	dialOpts []grpc.DialOption
+	// Connections to the other servers, keyed by address. Only used while holding mutex.
+	peers map[string]pb.RpcCacheClient
+	// Held while rebalancing so only one happens at once.
+	mutex sync.Mutex
+}
+
+// NewCluster creates a new cluster that this server is part of, at the given address.
+// Its membership isn't known until it's first rebalanced.
+// The key, cert and CA cert files are used to talk to the other servers as for the server itself.
+func NewCluster(cache *Cache, address, keyFile, certFile, caCertFile string) *Cluster {
+	c := &Cluster{
+		cache:   cache,
+		address: address,
+		peers:   map[string]pb.RpcCacheClient{},
+	}
+	if keyFile == "" {
+		c.dialOpts = []grpc.DialOption{grpc.WithInsecure()}
+	} else {
+		config := ServerTLSConfig(keyFile, certFile, caCertFile)
+		config.RootCAs = config.ClientCAs // Use our own certificate to identify ourselves to the other servers.
+		c.dialOpts = []grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(config))}
+	}
+	return c
+}
+
+// Rebalance moves any artifacts on this server that belong on other servers in a cluster with
+// the given membership to them. Artifacts that don't belong on this server any more are
+// removed once they've been copied.
+// It returns an error if any artifacts couldn't be moved; they're left on this server.
+func (c *Cluster) Rebalance(nodes []string, replicas int) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	ring := cluster.NewRing(nodes)
+	log.Notice("Rebalancing cache across %d servers with %d replicas...", len(nodes), replicas)
+	copied, removed, failed := 0, 0, 0
+	for _, e := range c.entries() {
+		ok := true
+		for _, node := range ring.Replicas(e.key, replicas) {
+			if node == c.address {
+				continue
+			} else if sent, err := c.push(node, e); err != nil {
+				log.Warning("Failed to copy %s to %s: %s", e.root, node, err)
+				ok = false
+			} else if sent {
+				copied++
+			}
+		}
+		if !ok {
+			failed++
+		} else if !ring.Contains(e.key, replicas, c.address) {
+			if err := c.cache.DeleteArtifact(e.root); err != nil {
+				log.Warning("Failed to remove %s: %s", e.root, err)
+			}
+			removed++
+		}
+	}
+	log.Notice("Rebalance complete: copied %d entries to other servers, removed %d from here", copied, removed)
+	if failed > 0 {
+		return fmt.Errorf("Failed to copy %d entries to other servers", failed)
+	}
+	return nil
+}
+
+// An entry is the set of artifacts for a single target hash.
+type entry struct {
+	root              string
+	arch, pkg, target string
+	key               []byte
+	files             []string
+}
+
+// entries returns all the entries in the cache.
+func (c *Cluster) entries() []*entry {
+	ret := []*entry{}
+	entries := map[string]*entry{}
+	for t := range c.cache.cachedFiles.IterBuffered() {
+		e := t.Val.(*cachedFile).entry()
+		if e == nil {
+			log.Warning("Can't identify the entry that %s belongs to, it won't be rebalanced", t.Key)
+			continue
+		} else if existing, present := entries[e.root]; present {
+			e = existing
+		} else {
+			entries[e.root] = e
+			ret = append(ret, e)
+		}
+		e.files = append(e.files, t.Key)
+	}
+	return ret
+}
+
+// parseEntry parses the root of an entry in the cache, which is laid out as
+// arch/package/target/hash. The package can contain any number of directories but the rest
+// are always at the same depth from either end.
+// It returns nil if the root isn't laid out like that.
+func parseEntry(root string) *entry {
+	parts := strings.Split(root, "/")
+	if len(parts) < 3 {
+		return nil
+	}
+	key, err := base64.RawURLEncoding.DecodeString(parts[len(parts)-1])
+	if err != nil || len(key) == 0 {
+		return nil
+	}
+	return &entry{
+		root:   root,
+		arch:   parts[0],
+		pkg:    path.Join(parts[1 : len(parts)-2]...),
+		target: parts[len(parts)-2],
+		key:    key,
+	}
+}
+
+// push copies an entry to another server, unless it's already got it.
+// It returns true if the entry was copied.
+func (c *Cluster) push(node string, e *entry) (bool, error) {
+	client, err := c.peer(node)
+	if err != nil {
+		return false, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), peerTimeout)
+	defer cancel()
+	goos, goarch := core.SplitArch(e.arch)
+	artifact := &pb.Artifact{Package: e.pkg, Target: e.target}
+	resp, err := client.Retrieve(ctx, &pb.RetrieveRequest{
+		Os:          goos,
+		Arch:        goarch,
+		Hash:        e.key,
+		Artifacts:   []*pb.Artifact{artifact},
+		DigestsOnly: true,
+	})
+	if err != nil {
+		return false, err
+	} else if resp.Success && len(resp.Artifacts) == len(e.files) {
+		return false, nil // Already got it.
+	}
+	stream, err := client.StoreStream(ctx)
+	if err != nil {
+		return false, err
+	}
+	req := &pb.StoreStreamRequest{Hash: e.key, Os: goos, Arch: goarch}
+	for _, name := range e.files {
+		if err := c.cache.StreamFile(name, func(name string, r io.Reader) error {
+			return pushChunks(stream, req, e.pkg, e.target, name[len(e.root)+1:], r)
+		}); err == io.EOF {
+			break // Server has ended the stream; we'll find out why below.
+		} else if err != nil {
+			return false, err
+		}
+		req = &pb.StoreStreamRequest{}
+	}
+	if resp, err := stream.CloseAndRecv(); err != nil {
+		return false, err
+	} else if !resp.Success {
+		return false, fmt.Errorf("Server failed to store artifacts")
+	}
+	return true, nil
+}
+
+// pushChunks sends the contents of a single file on a Store stream in chunks.
+// The given request is used for the first chunk.
+func pushChunks(stream pb.RpcCache_StoreStreamClient, req *pb.StoreStreamRequest, pkg, target, file string, r io.Reader) error {
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return err
+		}
+		req.Chunk = &pb.ArtifactChunk{
+			Package: pkg,
+			Target:  target,
+			File:    file,
+			Body:    buf[:n],
+			Last:    last,
+		}
+		if err := stream.Send(req); err != nil || last {
+			return err
+		}
+		req = &pb.StoreStreamRequest{}
+	}
+}
+
+// peer returns a client for another server in the cluster.
+// The caller should hold c.mutex.
+func (c *Cluster) peer(node string) (pb.RpcCacheClient, error) {
+	if client, present := c.peers[node]; present {
+		return client, nil
+	}
+	connection, err := grpc.Dial(node, c.dialOpts...)
+	if err != nil {
+		return nil, err
+	}
+	client := pb.NewRpcCacheClient(connection)
+	c.peers[node] = client
+	return client, nil
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"path"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+
+	"cache/cluster"
+	pb "cache/proto/rpc_cache"
+)
+
+const (
+	clusterAddressA = "localhost:7740"
+	clusterAddressB = "localhost:7741"
+)
+
+func TestParseEntry(t *testing.T) {
+	key := sha1.Sum([]byte("key"))
+	hash := base64.RawURLEncoding.EncodeToString(key[:])
+	e := parseEntry(path.Join("linux_amd64/src/core/core", hash))
+	assert.NotNil(t, e)
+	assert.Equal(t, path.Join("linux_amd64/src/core/core", hash), e.root)
+	assert.Equal(t, "linux_amd64", e.arch)
+	assert.Equal(t, "src/core", e.pkg)
+	assert.Equal(t, "core", e.target)
+	assert.Equal(t, key[:], e.key)
+	// Root package.
+	e = parseEntry(path.Join("linux_amd64/target", hash))
+	assert.NotNil(t, e)
+	assert.Equal(t, "", e.pkg)
+	assert.Equal(t, "target", e.target)
+	// Keys aren't restricted to any particular length.
+	e = parseEntry("linux_amd64/pkg/target/a2V5")
+	assert.NotNil(t, e)
+	assert.Equal(t, []byte("key"), e.key)
+	assert.Nil(t, parseEntry("linux_amd64/pkg/target/not.a.hash"))
+	assert.Nil(t, parseEntry("linux_amd64/target"))
+}
+
+func TestEntriesInSubdirectories(t *testing.T) {
+	c := NewCluster(newCache("cluster_test_subdirs"), clusterAddressA, "", "", "")
+	s := &RpcCacheServer{cache: c.cache}
+	key := sha1.Sum([]byte("subdirs"))
+	// A package directory that happens to look like a hash shouldn't confuse it.
+	pkg := "pkg/" + base64.RawURLEncoding.EncodeToString(bytes.Repeat([]byte{'p'}, 20))
+	resp, err := s.Store(context.Background(), &pb.StoreRequest{
+		Os:   "linux",
+		Arch: "amd64",
+		Hash: key[:],
+		Artifacts: []*pb.Artifact{
+			{Package: pkg, Target: "target", File: "out/file1.txt", Body: []byte("file1")},
+			{Package: pkg, Target: "target", File: "out/dir/file2.txt", Body: []byte("file2")},
+		},
+	})
+	assert.NoError(t, err)
+	assert.True(t, resp.Success)
+	entries := c.entries()
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, pkg, entries[0].pkg)
+	assert.Equal(t, "target", entries[0].target)
+	assert.Equal(t, key[:], entries[0].key)
+	assert.Equal(t, 2, len(entries[0].files))
+}
+
+func TestRebalance(t *testing.T) {
+	a := newCache("cluster_test_a")
+	b := newCache("cluster_test_b")
+	s, lis := BuildGrpcServer(7741, b, nil, "", "", "", "", "")
+	go s.Serve(lis)
+	defer s.Stop()
+	c := NewCluster(a, clusterAddressA, "", "", "")
+
+	keys := [][]byte{}
+	for i := 0; i < 20; i++ {
+		key := sha1.Sum([]byte(fmt.Sprintf("key%d", i)))
+		keys = append(keys, key[:])
+		assert.NoError(t, a.StoreArtifact(artifactPath(key[:]), bytes.NewReader([]byte(fmt.Sprintf("contents%d", i)))))
+	}
+	nodes := []string{clusterAddressA, clusterAddressB}
+	ring := cluster.NewRing(nodes)
+	assert.NoError(t, c.Rebalance(nodes, 1))
+	for i, key := range keys {
+		owner := ring.Replicas(key, 1)[0]
+		_, errA := a.RetrieveArtifact(artifactPath(key))
+		artB, errB := b.RetrieveArtifact(artifactPath(key))
+		if owner == clusterAddressA {
+			assert.NoError(t, errA)
+			assert.Error(t, errB)
+		} else {
+			assert.Error(t, errA)
+			assert.NoError(t, errB)
+			assert.Equal(t, []byte(fmt.Sprintf("contents%d", i)), artB[artifactPath(key)])
+		}
+	}
+	// Now with two replicas everything should end up on both.
+	assert.NoError(t, c.Rebalance(nodes, 2))
+	for _, key := range keys {
+		if ring.Replicas(key, 1)[0] == clusterAddressA {
+			_, err := b.RetrieveArtifact(artifactPath(key))
+			assert.NoError(t, err)
+		}
+	}
+	// And when this server leaves the cluster, everything should move off it.
+	assert.NoError(t, c.Rebalance([]string{clusterAddressB}, 2))
+	for _, key := range keys {
+		_, err := a.RetrieveArtifact(artifactPath(key))
+		assert.Error(t, err)
+		_, err = b.RetrieveArtifact(artifactPath(key))
+		assert.NoError(t, err)
+	}
+}
+
+func TestRebalanceUnreachable(t *testing.T) {
+	a := newCache("cluster_test_c")
+	c := NewCluster(a, clusterAddressA, "", "", "")
+	key := sha1.Sum([]byte("unreachable"))
+	assert.NoError(t, a.StoreArtifact(artifactPath(key[:]), bytes.NewReader([]byte("contents"))))
+	// Nothing is listening on this one, so the artifact should stay where it is.
+	assert.Error(t, c.Rebalance([]string{"localhost:7742"}, 1))
+	_, err := a.RetrieveArtifact(artifactPath(key[:]))
+	assert.NoError(t, err)
+}
+
+func TestConcurrentRebalance(t *testing.T) {
+	a := newCache("cluster_test_d")
+	c := NewCluster(a, clusterAddressA, "", "", "")
+	for i := 0; i < 10; i++ {
+		key := sha1.Sum([]byte(fmt.Sprintf("concurrent%d", i)))
+		assert.NoError(t, a.StoreArtifact(artifactPath(key[:]), bytes.NewReader([]byte("contents"))))
+	}
+	// Membership can change again while a rebalance is still going; they mustn't trample
+	// each other's connections to the other servers.
+	var wg sync.WaitGroup
+	for _, nodes := range [][]string{{"localhost:7743", "localhost:7744"}, {"localhost:7744", "localhost:7745"}} {
+		wg.Add(1)
+		go func(nodes []string) {
+			defer wg.Done()
+			assert.Error(t, c.Rebalance(nodes, 1))
+		}(nodes)
+	}
+	wg.Wait()
+	assert.Equal(t, 3, len(c.peers))
+}
+
+func artifactPath(key []byte) string {
+	return path.Join("linux_amd64/pkg/name/target", base64.RawURLEncoding.EncodeToString(key), "out.txt")
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"crypto/x509"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// An accessLevel is how much a client of the HTTP cache server is allowed to do.
+// Each level allows everything the ones before it do.
+type accessLevel int
+
+const (
+	readAccess  accessLevel = iota // Retrieving artifacts.
+	writeAccess                    // Storing artifacts.
+	adminAccess                    // Deleting artifacts, or the entire cache.
+)
+
+// HTTPAuth describes the credentials that clients of the HTTP cache server can identify themselves with.
+// They can either send a bearer token in an Authorization header or present a client certificate
+// (which obviously requires the server to use TLS).
+//
+// Reading and writing are open to anyone if there are no credentials for them, much as the RPC
+// server does. Deleting artifacts isn't possible at all unless there are admin credentials.
+type HTTPAuth struct {
+	ReadTokens, WriteTokens, AdminTokens []string
+	ReadCerts, WriteCerts, AdminCerts    map[string]*x509.Certificate
+}
+
+// configured returns true if there are any credentials for the given level of access.
+func (auth *HTTPAuth) configured(level accessLevel) bool {
+	tokens, certs := auth.credentials(level)
+	return len(tokens) > 0 || len(certs) > 0
+}
+
+// credentials returns the tokens and certificates that grant exactly the given level of access.
+func (auth *HTTPAuth) credentials(level accessLevel) ([]string, map[string]*x509.Certificate) {
+	switch level {
+	case readAccess:
+		return auth.ReadTokens, auth.ReadCerts
+	case writeAccess:
+		return auth.WriteTokens, auth.WriteCerts
+	default:
+		return auth.AdminTokens, auth.AdminCerts
+	}
+}
+
+// allows returns true if the given request is allowed the given level of access.
+func (auth *HTTPAuth) allows(r *http.Request, level accessLevel) bool {
+	if level != adminAccess && !auth.configured(level) {
+		return true
+	}
+	token := bearerToken(r)
+	for l := level; l <= adminAccess; l++ {
+		tokens, certs := auth.credentials(l)
+		if token != "" && containsToken(tokens, token) {
+			return true
+		} else if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 && certAllowed(certs, r.TLS.PeerCertificates[0]) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorise wraps a handler so it's only called for requests that are allowed the given level of access.
+func (auth *HTTPAuth) authorise(level accessLevel, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if auth.allows(r, level) {
+			handler(w, r)
+		} else if bearerToken(r) == "" && (r.TLS == nil || len(r.TLS.PeerCertificates) == 0) {
+			log.Warning("Unauthenticated %s request for %s", r.Method, r.URL.Path)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+		} else {
+			log.Warning("Unauthorised %s request for %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}
+}
+
+// bearerToken returns the bearer token sent with a request, or the empty string if there isn't one.
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+}
+
+// containsToken returns true if the given token is one of the given ones.
+// The comparison is constant-time so as not to leak how much of a token matched.
+func containsToken(tokens []string, token string) bool {
+	found := false
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			found = true
+		}
+	}
+	return found
+}
+
+// LoadTokens loads bearer tokens from a file, one per line.
+// Blank lines and lines starting with # are ignored.
+func LoadTokens(filename string) []string {
+	f, err := os.Open(filename)
+	if err != nil {
+		log.Fatalf("Failed to read tokens from %s: %s", filename, err)
+	}
+	defer f.Close()
+	tokens := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			tokens = append(tokens, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatalf("Failed to read tokens from %s: %s", filename, err)
+	}
+	return tokens
+}
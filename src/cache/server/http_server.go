@@ -2,9 +2,10 @@ package server
 
 import (
 	"bytes"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"mime/multipart"
 	"net/http"
 	"os"
@@ -14,6 +15,8 @@ import (
 
 	"github.com/gorilla/mux"
 	"gopkg.in/op/go-logging.v1"
+
+	"cache/compression"
 )
 
 var log = logging.MustGetLogger("server")
@@ -24,7 +27,9 @@ type httpServer struct {
 
 // The pingHandler will return a 200 Accepted status
 // This handler will handle ping endpoint requests, in order to confirm whether the server can be accessed
+// It also advertises which compression algorithms artifacts can be sent in.
 func (s *httpServer) pingHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Accept-Encoding", strings.Join(compression.Supported, ", "))
 	fmt.Fprintf(w, "Server connection established successfully.")
 }
 
@@ -51,7 +56,21 @@ func (s *httpServer) getHandler(w http.ResponseWriter, r *http.Request) {
 	// send individually; here they don't know what they'll need to expect.
 	// We could use it for upload too which might be faster and would be more symmetric, but
 	// multipart is a bit fiddly so for now we're not bothering.
-	mw := multipart.NewWriter(w)
+	// The response is compressed if the client accepts that, unless the artifacts are already compressed.
+	var out io.Writer = w
+	w.Header().Set("Vary", "Accept-Encoding")
+	if algorithm := compression.Choose(compression.ParseHeader(r.Header.Get("Accept-Encoding"))); algorithm != "" && compressible(art) {
+		cw, err := compression.NewWriter(algorithm, w)
+		if err != nil {
+			log.Errorf("Failed to compress %s: %s", artifactPath, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		defer cw.Close()
+		w.Header().Set("Content-Encoding", algorithm)
+		out = cw
+	}
+	mw := multipart.NewWriter(out)
 	defer mw.Close()
 	w.Header().Set("Content-Type", mw.FormDataContentType())
 	for name, body := range art {
@@ -66,26 +85,41 @@ func (s *httpServer) getHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // The postHandler function handles the POST endpoint for the artifact path.
-// It reads the request body and sends it to the StoreArtifact function, along with the path where it should
+// It streams the request body to the StoreArtifact function, along with the path where it should
 // be stored.
 // The handler will either return an error or display a message confirming the file has been created.
 func (s *httpServer) postHandler(w http.ResponseWriter, r *http.Request) {
 	log.Debug("POST %s", r.URL.Path)
-	artifact, err := ioutil.ReadAll(r.Body)
 	filePath, fileName := path.Split(strings.TrimPrefix(r.URL.Path, "/artifact"))
-	if err == nil {
-		if err := s.cache.StoreArtifact(strings.TrimPrefix(r.URL.Path, "/artifact"), artifact); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			log.Errorf("Failed to store artifact %s: %s", fileName, err)
+	body := io.Reader(r.Body)
+	if encoding := r.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		cr, err := compression.NewReader(encoding, r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			log.Errorf("Can't decompress artifact %s: %s", fileName, err)
 			return
 		}
-		absPath, _ := filepath.Abs(filePath)
-		fmt.Fprintf(w, "%s was created in %s.", fileName, absPath)
-		log.Notice("%s was stored in the http cache.", fileName)
-	} else {
+		defer cr.Close()
+		body = cr
+	}
+	if err := s.cache.StoreArtifact(strings.TrimPrefix(r.URL.Path, "/artifact/"), body); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		log.Errorf("Failed to store artifact %s: %s", fileName, err)
+		return
+	}
+	absPath, _ := filepath.Abs(filePath)
+	fmt.Fprintf(w, "%s was created in %s.", fileName, absPath)
+	log.Notice("%s was stored in the http cache.", fileName)
+}
+
+// compressible returns true if any of the given artifacts are worth compressing.
+func compressible(artifacts map[string][]byte) bool {
+	for name, body := range artifacts {
+		if compression.Compressible(name, body) {
+			return true
+		}
 	}
+	return false
 }
 
 // The deleteAllHandler function handles the DELETE endpoint for the general server path.
@@ -106,7 +140,7 @@ func (s *httpServer) deleteAllHandler(w http.ResponseWriter, r *http.Request) {
 // It calls the DeleteArtifact function, sending the path of the artifact as a parameter.
 // The handler will either return an error or display a message confirming the artifact has been removed.
 func (s *httpServer) deleteHandler(w http.ResponseWriter, r *http.Request) {
-	artifactPath := strings.TrimPrefix(r.URL.Path, "/artifact")
+	artifactPath := strings.TrimPrefix(r.URL.Path, "/artifact/")
 	if err := s.cache.DeleteArtifact(artifactPath); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		log.Errorf("Failed to remove %s from http cache: %s", artifactPath, err)
@@ -117,15 +151,60 @@ func (s *httpServer) deleteHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// The listHandler function handles the GET endpoint for the list path.
+// It responds with the hashes that the target at the given path has artifacts stored under,
+// one per line.
+func (s *httpServer) listHandler(w http.ResponseWriter, r *http.Request) {
+	targetPath := strings.TrimPrefix(r.URL.Path, "/list/")
+	w.Header().Set("Content-Type", "text/plain")
+	for _, hash := range s.cache.ArtifactHashes(targetPath) {
+		fmt.Fprintln(w, base64.RawURLEncoding.EncodeToString(hash))
+	}
+}
+
+// The statsHandler function handles the GET endpoint for the stats path.
+// It responds with the number of sets of artifacts in the cache and their total size as JSON.
+func (s *httpServer) statsHandler(w http.ResponseWriter, r *http.Request) {
+	entries, size := s.cache.Stats()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int64{"entries": int64(entries), "size": size})
+}
+
 // The BuildRouter function creates a router, sets the base FileServer directory and the Handler Functions
 // for each endpoint, and then returns the router.
-func BuildRouter(cache *Cache) *mux.Router {
+// The endpoints that delete artifacts are only added if auth has some admin credentials.
+func BuildRouter(cache *Cache, auth *HTTPAuth) *mux.Router {
 	s := &httpServer{cache: cache}
 	r := mux.NewRouter()
 	r.HandleFunc("/ping", s.pingHandler).Methods("GET")
-	r.HandleFunc("/artifact/{os_name}/{artifact:.*}", s.getHandler).Methods("GET")
-	r.HandleFunc("/artifact/{os_name}/{artifact:.*}", s.postHandler).Methods("POST")
-	r.HandleFunc("/artifact/{artifact:.*}", s.deleteHandler).Methods("DELETE")
-	r.HandleFunc("/", s.deleteAllHandler).Methods("DELETE")
+	r.HandleFunc("/artifact/{os_name}/{artifact:.*}", auth.authorise(readAccess, s.getHandler)).Methods("GET")
+	r.HandleFunc("/artifact/{os_name}/{artifact:.*}", auth.authorise(writeAccess, s.postHandler)).Methods("POST")
+	r.HandleFunc("/list/{os_name}/{artifact:.*}", auth.authorise(readAccess, s.listHandler)).Methods("GET")
+	r.HandleFunc("/stats", auth.authorise(readAccess, s.statsHandler)).Methods("GET")
+	if auth.configured(adminAccess) {
+		r.HandleFunc("/artifact/{artifact:.*}", auth.authorise(adminAccess, s.deleteHandler)).Methods("DELETE")
+		r.HandleFunc("/", auth.authorise(adminAccess, s.deleteAllHandler)).Methods("DELETE")
+	} else {
+		log.Notice("No admin credentials given; deleting artifacts is disabled")
+	}
 	return r
 }
+
+// ServeHTTPForever constructs a new server on the given port and serves until killed.
+// It uses TLS if keyFile and certFile are given.
+func ServeHTTPForever(port int, cache *Cache, auth *HTTPAuth, keyFile, certFile, caCertFile string) {
+	s := &http.Server{
+		Addr:    fmt.Sprintf(":%d", port),
+		Handler: BuildRouter(cache, auth),
+	}
+	var err error
+	if keyFile != "" {
+		s.TLSConfig = ServerTLSConfig(keyFile, certFile, caCertFile)
+		log.Notice("Serving HTTPS cache on port %d", port)
+		err = s.ListenAndServeTLS("", "")
+	} else {
+		log.Notice("Serving HTTP cache on port %d", port)
+		err = s.ListenAndServe()
+	}
+	log.Fatalf("%s", err)
+}
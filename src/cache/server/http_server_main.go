@@ -1,8 +1,6 @@
 package main
 
 import (
-	"fmt"
-	"net/http"
 	"time"
 
 	"gopkg.in/op/go-logging.v1"
@@ -25,6 +23,23 @@ var opts struct {
 		CleanFrequency cli.Duration `short:"f" long:"clean_frequency" description:"Frequency to clean cache at" default:"10m"`
 		MaxArtifactAge cli.Duration `short:"m" long:"max_artifact_age" description:"Clean any artifact that's not been read in this long" default:"720h"`
 	} `group:"Options controlling when to clean the cache"`
+
+	Compression string `short:"z" long:"compression" choice:"none" choice:"gzip" choice:"zstd" default:"none" description:"Algorithm to compress stored artifacts with. Artifacts that are already compressed aren't compressed again. zstd falls back to gzip unless built with it."`
+
+	TLSFlags struct {
+		KeyFile       string `long:"key_file" description:"File containing PEM-encoded private key."`
+		CertFile      string `long:"cert_file" description:"File containing PEM-encoded certificate"`
+		CACertFile    string `long:"ca_cert_file" description:"File containing PEM-encoded CA certificate"`
+		ReadonlyCerts string `long:"readonly_certs" description:"File or directory containing certificates that are allowed to read from the cache"`
+		WritableCerts string `long:"writable_certs" description:"File or directory containing certificates that are allowed to write to the cache"`
+		AdminCerts    string `long:"admin_certs" description:"File or directory containing certificates that are allowed to delete from the cache"`
+	} `group:"Options controlling TLS communication & authentication"`
+
+	TokenFlags struct {
+		ReadonlyTokens string `long:"readonly_tokens" description:"File containing bearer tokens that are allowed to read from the cache, one per line"`
+		WritableTokens string `long:"writable_tokens" description:"File containing bearer tokens that are allowed to write to the cache, one per line"`
+		AdminTokens    string `long:"admin_tokens" description:"File containing bearer tokens that are allowed to delete from the cache, one per line"`
+	} `group:"Options controlling token authentication"`
 }
 
 func main() {
@@ -33,12 +48,38 @@ func main() {
 	if opts.LogFile != "" {
 		cli.InitFileLogging(opts.LogFile, opts.Verbosity)
 	}
+	if (opts.TLSFlags.KeyFile == "") != (opts.TLSFlags.CertFile == "") {
+		log.Fatalf("Must pass both --key_file and --cert_file if you pass one")
+	} else if opts.TLSFlags.KeyFile == "" && (opts.TLSFlags.ReadonlyCerts != "" || opts.TLSFlags.WritableCerts != "" || opts.TLSFlags.AdminCerts != "") {
+		log.Fatalf("You can only use --readonly_certs / --writable_certs / --admin_certs with https (--key_file and --cert_file)")
+	}
+	auth := &server.HTTPAuth{}
+	if opts.TLSFlags.ReadonlyCerts != "" {
+		auth.ReadCerts = server.LoadCerts(opts.TLSFlags.ReadonlyCerts)
+	}
+	if opts.TLSFlags.WritableCerts != "" {
+		auth.WriteCerts = server.LoadCerts(opts.TLSFlags.WritableCerts)
+	}
+	if opts.TLSFlags.AdminCerts != "" {
+		auth.AdminCerts = server.LoadCerts(opts.TLSFlags.AdminCerts)
+	}
+	if opts.TokenFlags.ReadonlyTokens != "" {
+		auth.ReadTokens = server.LoadTokens(opts.TokenFlags.ReadonlyTokens)
+	}
+	if opts.TokenFlags.WritableTokens != "" {
+		auth.WriteTokens = server.LoadTokens(opts.TokenFlags.WritableTokens)
+	}
+	if opts.TokenFlags.AdminTokens != "" {
+		auth.AdminTokens = server.LoadTokens(opts.TokenFlags.AdminTokens)
+	}
+	if opts.TLSFlags.KeyFile == "" && (auth.ReadTokens != nil || auth.WriteTokens != nil || auth.AdminTokens != nil) {
+		log.Warning("Bearer tokens are being accepted over plain http; anyone who can see the traffic can reuse them")
+	}
 	log.Notice("Initialising cache server...")
 	cache := server.NewCache(opts.Dir, time.Duration(opts.CleanFlags.CleanFrequency),
 		time.Duration(opts.CleanFlags.MaxArtifactAge),
 		uint64(opts.CleanFlags.LowWaterMark), uint64(opts.CleanFlags.HighWaterMark))
+	cache.SetCompression(opts.Compression)
 	log.Notice("Starting up http cache server on port %d...", opts.Port)
-	router := server.BuildRouter(cache)
-	http.Handle("/", router)
-	http.ListenAndServe(fmt.Sprintf(":%d", opts.Port), router)
+	server.ServeHTTPForever(opts.Port, cache, auth, opts.TLSFlags.KeyFile, opts.TLSFlags.CertFile, opts.TLSFlags.CACertFile)
 }
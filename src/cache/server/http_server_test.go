@@ -1,8 +1,11 @@
 package server
 
 import (
+	"bytes"
+	"compress/gzip"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -24,7 +27,7 @@ const cachePath = "src/cache/server/test_data"
 
 func init() {
 	c := newCache(cachePath)
-	server = httptest.NewServer(BuildRouter(c))
+	server = httptest.NewServer(BuildRouter(c, &HTTPAuth{AdminTokens: []string{"admin_token"}}))
 	realURL = fmt.Sprintf("%s/artifact/darwin_amd64/pack/label/hash/label.ext", server.URL)
 	otherRealURL = fmt.Sprintf("%s/artifact/linux_amd64/otherpack/label/hash/label.ext", server.URL)
 	extraRealURL = fmt.Sprintf("%s/artifact/extrapack/label", server.URL)
@@ -72,8 +75,53 @@ func TestPostHandler(t *testing.T) {
 	}
 }
 
+func TestPostAndGetCompressed(t *testing.T) {
+	content := []byte(strings.Repeat("This file is sent compressed. ", 100))
+	url := server.URL + "/artifact/linux_amd64/compressedpack/label/hash/compressed.txt"
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	w.Write(content)
+	w.Close()
+	request, _ := http.NewRequest("POST", url, &b)
+	request.Header.Set("Content-Encoding", "gzip")
+	res, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	} else if res.StatusCode != http.StatusOK {
+		t.Fatal("Expected response Status OK, got:", res.Status)
+	}
+	request, _ = http.NewRequest("GET", url, nil)
+	request.Header.Set("Accept-Encoding", "gzip")
+	res, err = http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	} else if res.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatal("Expected compressed response, got Content-Encoding:", res.Header.Get("Content-Encoding"))
+	}
+	r, err := gzip.NewReader(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(r)
+	if !bytes.Contains(body, content) {
+		t.Error("Compressed response doesn't contain the artifact")
+	}
+}
+
+func TestPostUnknownCompression(t *testing.T) {
+	request, _ := http.NewRequest("POST", server.URL+"/artifact/linux_amd64/compressedpack/label/hash/lzma.txt", strings.NewReader("wibble"))
+	request.Header.Set("Content-Encoding", "lzma")
+	res, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Error(err)
+	} else if res.StatusCode != http.StatusUnsupportedMediaType {
+		t.Error("Expected response Status Unsupported Media Type, got:", res.Status)
+	}
+}
+
 func TestDeleteHandler(t *testing.T) {
 	request, _ := http.NewRequest("DELETE", extraRealURL, reader)
+	request.Header.Set("Authorization", "Bearer admin_token")
 	res, err := http.DefaultClient.Do(request)
 	if err != nil {
 		t.Error(err)
@@ -86,6 +134,7 @@ func TestDeleteHandler(t *testing.T) {
 
 func TestDeleteAllHandler(t *testing.T) {
 	request, _ := http.NewRequest("DELETE", server.URL, reader)
+	request.Header.Set("Authorization", "Bearer admin_token")
 	res, err := http.DefaultClient.Do(request)
 	if err != nil {
 		t.Error(err)
@@ -95,3 +144,69 @@ func TestDeleteAllHandler(t *testing.T) {
 		t.Error("Expected response Status Accepted, got:", res.Status)
 	}
 }
+
+func TestDeleteHandlerUnauthenticated(t *testing.T) {
+	request, _ := http.NewRequest("DELETE", extraRealURL, nil)
+	res, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Error(err)
+	} else if res.StatusCode != http.StatusUnauthorized {
+		t.Error("Expected response Status Unauthorized, got:", res.Status)
+	}
+}
+
+func TestDeleteHandlerWrongToken(t *testing.T) {
+	request, _ := http.NewRequest("DELETE", server.URL, nil)
+	request.Header.Set("Authorization", "Bearer wibble")
+	res, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Error(err)
+	} else if res.StatusCode != http.StatusForbidden {
+		t.Error("Expected response Status Forbidden, got:", res.Status)
+	}
+}
+
+func TestDeleteDisabledWithoutAdmin(t *testing.T) {
+	s := httptest.NewServer(BuildRouter(newCache(cachePath), &HTTPAuth{}))
+	defer s.Close()
+	request, _ := http.NewRequest("DELETE", s.URL, nil)
+	res, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Error(err)
+	} else if res.StatusCode >= 200 && res.StatusCode <= 299 {
+		t.Error("Expected deleting to be disabled, got:", res.Status)
+	}
+}
+
+func TestWriteTokens(t *testing.T) {
+	s := httptest.NewServer(BuildRouter(newCache(cachePath), &HTTPAuth{
+		WriteTokens: []string{"write_token"},
+		AdminTokens: []string{"admin_token"},
+	}))
+	defer s.Close()
+	url := s.URL + "/artifact/darwin_amd64/somepack/somelabel/somehash/somelabel.ext"
+	for token, status := range map[string]int{
+		"":            http.StatusUnauthorized,
+		"wibble":      http.StatusForbidden,
+		"write_token": http.StatusOK,
+		"admin_token": http.StatusOK,
+	} {
+		request, _ := http.NewRequest("POST", url, strings.NewReader("written"))
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Error(err)
+		} else if res.StatusCode != status {
+			t.Errorf("Expected status %d with token %s, got %s", status, token, res.Status)
+		}
+	}
+	// Reading is still open to anyone since there aren't any read credentials.
+	res, err := http.Get(s.URL + "/artifact/darwin_amd64/pack/label/hash/label.ext")
+	if err != nil {
+		t.Error(err)
+	} else if res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden {
+		t.Error("Expected reading to be allowed, got:", res.Status)
+	}
+}
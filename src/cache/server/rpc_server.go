@@ -1,11 +1,13 @@
 package server
 
 import (
+	"bytes"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/pem"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
@@ -14,11 +16,13 @@ import (
 
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/health"
 	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/peer"
 
+	"cache/compression"
 	pb "cache/proto/rpc_cache"
 )
 
@@ -27,56 +31,319 @@ import (
 // TODO(pebers): we should limit it on the client side though.
 const maxMsgSize = 200 * 1024 * 1024
 
+// chunkSize is the size of chunks that we send file bodies in when streaming.
+const chunkSize = 1024 * 1024
+
 type RpcCacheServer struct {
 	cache        *Cache
+	cluster      *Cluster
 	readonlyKeys map[string]*x509.Certificate
 	writableKeys map[string]*x509.Certificate
 }
 
 func (r *RpcCacheServer) Store(ctx context.Context, req *pb.StoreRequest) (*pb.StoreResponse, error) {
-	if err := r.authenticateClient(r.writableKeys, ctx); err != nil {
+	if err := AuthenticateClient(r.writableKeys, ctx); err != nil {
 		return nil, err
 	}
 	arch := req.Os + "_" + req.Arch
 	hash := base64.RawURLEncoding.EncodeToString(req.Hash)
 	for _, artifact := range req.Artifacts {
-		path := path.Join(arch, artifact.Package, artifact.Target, hash, artifact.File)
-		if err := r.cache.StoreArtifact(path, artifact.Body); err != nil {
-			return &pb.StoreResponse{Success: false}, nil
+		root := path.Join(arch, artifact.Package, artifact.Target, hash)
+		if err := r.storeArtifact(root, path.Join(root, artifact.File), artifact); err != nil {
+			return &pb.StoreResponse{Success: false, MissingBlobs: os.IsNotExist(err)}, nil
 		}
 	}
 	return &pb.StoreResponse{Success: true}, nil
 }
 
+// storeArtifact stores a single artifact. If it has a digest but no body then it's
+// linked to an existing blob that the client has previously found we already have.
+func (r *RpcCacheServer) storeArtifact(root, path string, artifact *pb.Artifact) error {
+	if artifact.Compression != "" {
+		body, err := compression.Decompress(artifact.Compression, artifact.Body)
+		if err != nil {
+			log.Warning("Failed to decompress artifact %s: %s", path, err)
+			return err
+		}
+		artifact.Body = body
+	}
+	if len(artifact.Digest) == 0 || bytes.Equal(artifact.Digest, Digest(artifact.Body)) {
+		return r.cache.storeArtifact(root, path, bytes.NewReader(artifact.Body))
+	} else if len(artifact.Body) == 0 {
+		return r.cache.storeArtifactFromBlob(root, path, artifact.Digest)
+	}
+	log.Warning("Digest mismatch for artifact %s", path)
+	return fmt.Errorf("Digest mismatch for artifact %s", path)
+}
+
 func (r *RpcCacheServer) Retrieve(ctx context.Context, req *pb.RetrieveRequest) (*pb.RetrieveResponse, error) {
-	if err := r.authenticateClient(r.readonlyKeys, ctx); err != nil {
+	if err := AuthenticateClient(r.readonlyKeys, ctx); err != nil {
 		return nil, err
 	}
 	response := pb.RetrieveResponse{Success: true}
+	algorithm := compression.Choose(req.AcceptCompression)
 	arch := req.Os + "_" + req.Arch
 	hash := base64.RawURLEncoding.EncodeToString(req.Hash)
 	for _, artifact := range req.Artifacts {
 		root := path.Join(arch, artifact.Package, artifact.Target, hash)
 		fileRoot := path.Join(root, artifact.File)
+		if req.DigestsOnly {
+			digests, err := r.cache.RetrieveDigests(fileRoot)
+			if err != nil {
+				log.Debug("Failed to retrieve artifact digests %s: %s", fileRoot, err)
+				return &pb.RetrieveResponse{Success: false}, nil
+			}
+			for name, digest := range digests {
+				response.Artifacts = append(response.Artifacts, &pb.Artifact{
+					Package: artifact.Package,
+					Target:  artifact.Target,
+					File:    name[len(root)+1:],
+					Digest:  digest,
+				})
+			}
+			continue
+		}
 		art, err := r.cache.RetrieveArtifact(fileRoot)
 		if err != nil {
 			log.Debug("Failed to retrieve artifact %s: %s", fileRoot, err)
 			return &pb.RetrieveResponse{Success: false}, nil
 		}
 		for name, body := range art {
+			body, bodyCompression := compressBody(algorithm, name, body)
 			response.Artifacts = append(response.Artifacts, &pb.Artifact{
-				Package: artifact.Package,
-				Target:  artifact.Target,
-				File:    name[len(root)+1:],
-				Body:    body,
+				Package:     artifact.Package,
+				Target:      artifact.Target,
+				File:        name[len(root)+1:],
+				Body:        body,
+				Compression: bodyCompression,
 			})
 		}
 	}
 	return &response, nil
 }
 
+func (r *RpcCacheServer) FindMissingBlobs(ctx context.Context, req *pb.FindMissingBlobsRequest) (*pb.FindMissingBlobsResponse, error) {
+	if err := AuthenticateClient(r.writableKeys, ctx); err != nil {
+		return nil, err
+	}
+	response := pb.FindMissingBlobsResponse{}
+	for _, digest := range req.Digests {
+		if !r.cache.HasBlob(digest) {
+			response.Missing = append(response.Missing, digest)
+		}
+	}
+	return &response, nil
+}
+
+func (r *RpcCacheServer) RetrieveBlobs(ctx context.Context, req *pb.RetrieveBlobsRequest) (*pb.RetrieveBlobsResponse, error) {
+	if err := AuthenticateClient(r.readonlyKeys, ctx); err != nil {
+		return nil, err
+	}
+	response := pb.RetrieveBlobsResponse{Success: true}
+	algorithm := compression.Choose(req.AcceptCompression)
+	for _, digest := range req.Digests {
+		body, err := r.cache.RetrieveBlob(digest)
+		if err != nil {
+			log.Debug("Failed to retrieve blob %x: %s", digest, err)
+			return &pb.RetrieveBlobsResponse{Success: false}, nil
+		}
+		body, bodyCompression := compressBody(algorithm, "", body)
+		response.Blobs = append(response.Blobs, &pb.Blob{Digest: digest, Body: body, Compression: bodyCompression})
+	}
+	return &response, nil
+}
+
+func (r *RpcCacheServer) StoreStream(stream pb.RpcCache_StoreStreamServer) error {
+	if err := AuthenticateClient(r.writableKeys, stream.Context()); err != nil {
+		return err
+	}
+	req, err := stream.Recv()
+	if err == io.EOF {
+		return stream.SendAndClose(&pb.StoreResponse{Success: true}) // Nothing to store.
+	} else if err != nil {
+		return err
+	}
+	arch := req.Os + "_" + req.Arch
+	hash := base64.RawURLEncoding.EncodeToString(req.Hash)
+	for {
+		chunk := req.Chunk
+		if chunk == nil {
+			return fmt.Errorf("Missing artifact chunk in request")
+		}
+		root := path.Join(arch, chunk.Package, chunk.Target, hash)
+		path := path.Join(root, chunk.File)
+		if err := r.storeChunks(root, path, &chunkReader{stream: stream, chunk: chunk}); err != nil {
+			log.Warning("Failed to store artifact %s: %s", path, err)
+			return stream.SendAndClose(&pb.StoreResponse{Success: false, MissingBlobs: os.IsNotExist(err)})
+		}
+		if req, err = stream.Recv(); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	return stream.SendAndClose(&pb.StoreResponse{Success: true})
+}
+
+// storeChunks stores a single artifact from a sequence of chunks.
+func (r *RpcCacheServer) storeChunks(root, path string, reader *chunkReader) error {
+	if chunk := reader.chunk; len(chunk.Body) == 0 && chunk.Last && len(chunk.Digest) != 0 && !bytes.Equal(chunk.Digest, Digest(nil)) {
+		return r.cache.storeArtifactFromBlob(root, path, chunk.Digest)
+	}
+	return r.cache.storeArtifact(root, path, reader)
+}
+
+func (r *RpcCacheServer) RetrieveStream(req *pb.RetrieveRequest, stream pb.RpcCache_RetrieveStreamServer) error {
+	if err := AuthenticateClient(r.readonlyKeys, stream.Context()); err != nil {
+		return err
+	}
+	arch := req.Os + "_" + req.Arch
+	hash := base64.RawURLEncoding.EncodeToString(req.Hash)
+	algorithm := compression.Choose(req.AcceptCompression)
+	// Find all the files first so we can fail cleanly if any of them are missing.
+	roots := make([]string, len(req.Artifacts))
+	files := make([][]string, len(req.Artifacts))
+	for i, artifact := range req.Artifacts {
+		roots[i] = path.Join(arch, artifact.Package, artifact.Target, hash)
+		fileRoot := path.Join(roots[i], artifact.File)
+		f, err := r.cache.ArtifactFiles(fileRoot)
+		if err != nil || len(f) == 0 {
+			log.Debug("Failed to retrieve artifact %s: %s", fileRoot, err)
+			return stream.Send(&pb.RetrieveStreamResponse{Success: false})
+		}
+		files[i] = f
+	}
+	for i, artifact := range req.Artifacts {
+		for _, name := range files[i] {
+			// Sent so the client can check what it got. If it's rewritten before we send it
+			// the client will just treat it as missing.
+			digest, err := r.cache.artifactDigest(name)
+			if err != nil {
+				return err
+			}
+			if err := r.cache.StreamFile(name, func(name string, f io.Reader) error {
+				return sendChunks(stream, artifact.Package, artifact.Target, name[len(roots[i])+1:], digest, f, algorithm)
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// sendChunks sends the contents of a single file on a stream in chunks, with its digest on the first one.
+// The chunks are compressed with the given algorithm if it's not empty and the file is worth compressing.
+func sendChunks(stream pb.RpcCache_RetrieveStreamServer, pkg, target, file string, digest []byte, r io.Reader, algorithm string) error {
+	buf := make([]byte, chunkSize)
+	for first := true; ; first = false {
+		n, err := io.ReadFull(r, buf)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return err
+		}
+		if first && !compression.Compressible(file, buf[:n]) {
+			algorithm = ""
+		}
+		body, bodyCompression := compression.CompressIfSmaller(algorithm, buf[:n])
+		chunk := &pb.ArtifactChunk{
+			Package:     pkg,
+			Target:      target,
+			File:        file,
+			Body:        body,
+			Last:        last,
+			Compression: bodyCompression,
+		}
+		if first {
+			chunk.Digest = digest
+		}
+		if err := stream.Send(&pb.RetrieveStreamResponse{Success: true, Chunk: chunk}); err != nil {
+			return err
+		} else if last {
+			return nil
+		}
+	}
+}
+
+// A chunkReader implements io.Reader over the chunks of a single file in a Store stream.
+type chunkReader struct {
+	stream pb.RpcCache_StoreStreamServer
+	chunk  *pb.ArtifactChunk
+}
+
+func (r *chunkReader) Read(b []byte) (int, error) {
+	if err := decompressChunk(r.chunk); err != nil {
+		return 0, err
+	}
+	for len(r.chunk.Body) == 0 {
+		if r.chunk.Last {
+			return 0, io.EOF
+		}
+		req, err := r.stream.Recv()
+		if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF // Stream ended before the last chunk.
+		} else if err != nil {
+			return 0, err
+		} else if req.Chunk == nil {
+			return 0, fmt.Errorf("Missing artifact chunk in request")
+		}
+		r.chunk = req.Chunk
+		if err := decompressChunk(r.chunk); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, r.chunk.Body)
+	r.chunk.Body = r.chunk.Body[n:]
+	return n, nil
+}
+
+// decompressChunk decompresses the body of a chunk in place, if it's compressed.
+func decompressChunk(chunk *pb.ArtifactChunk) error {
+	if chunk.Compression == "" {
+		return nil
+	}
+	body, err := compression.Decompress(chunk.Compression, chunk.Body)
+	if err != nil {
+		return err
+	}
+	chunk.Body = body
+	chunk.Compression = ""
+	return nil
+}
+
+// compressBody compresses the body of a file with the given algorithm if it's not empty and
+// the file is worth compressing. It returns the body to send and the algorithm it's compressed with.
+func compressBody(algorithm, name string, body []byte) ([]byte, string) {
+	if !compression.Compressible(name, body) {
+		return body, ""
+	}
+	return compression.CompressIfSmaller(algorithm, body)
+}
+
+func (r *RpcCacheServer) GetCapabilities(ctx context.Context, req *pb.GetCapabilitiesRequest) (*pb.GetCapabilitiesResponse, error) {
+	if err := AuthenticateClient(r.readonlyKeys, ctx); err != nil {
+		return nil, err
+	}
+	return &pb.GetCapabilitiesResponse{AcceptCompression: compression.Supported}, nil
+}
+
+func (r *RpcCacheServer) Rebalance(ctx context.Context, req *pb.RebalanceRequest) (*pb.RebalanceResponse, error) {
+	if err := AuthenticateClient(r.writableKeys, ctx); err != nil {
+		return nil, err
+	} else if r.cluster == nil {
+		return nil, grpc.Errorf(codes.FailedPrecondition, "Server is not part of a cluster")
+	} else if req.Replicas <= 0 {
+		return nil, grpc.Errorf(codes.InvalidArgument, "Must store at least one replica of each artifact")
+	}
+	go func() {
+		if err := r.cluster.Rebalance(req.Nodes, int(req.Replicas)); err != nil {
+			log.Error("Rebalance failed: %s", err)
+		}
+	}()
+	return &pb.RebalanceResponse{Success: true}, nil
+}
+
 func (r *RpcCacheServer) Delete(ctx context.Context, req *pb.DeleteRequest) (*pb.DeleteResponse, error) {
-	if err := r.authenticateClient(r.writableKeys, ctx); err != nil {
+	if err := AuthenticateClient(r.writableKeys, ctx); err != nil {
 		return nil, err
 	}
 	if req.Everything {
@@ -85,14 +352,38 @@ func (r *RpcCacheServer) Delete(ctx context.Context, req *pb.DeleteRequest) (*pb
 	success := true
 	arch := req.Os + "_" + req.Arch
 	for _, artifact := range req.Artifacts {
-		if r.cache.DeleteArtifact(path.Join(arch, artifact.Package, artifact.Target)) != nil {
+		artPath := path.Join(arch, artifact.Package, artifact.Target)
+		if len(req.Hash) > 0 {
+			artPath = path.Join(artPath, base64.RawURLEncoding.EncodeToString(req.Hash))
+		}
+		if r.cache.DeleteArtifact(artPath) != nil {
 			success = false
 		}
 	}
 	return &pb.DeleteResponse{Success: success}, nil
 }
 
-func (r *RpcCacheServer) authenticateClient(certs map[string]*x509.Certificate, ctx context.Context) error {
+func (r *RpcCacheServer) List(ctx context.Context, req *pb.ListRequest) (*pb.ListResponse, error) {
+	if err := AuthenticateClient(r.readonlyKeys, ctx); err != nil {
+		return nil, err
+	} else if req.Artifact == nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "Must specify an artifact to list")
+	}
+	arch := req.Os + "_" + req.Arch
+	return &pb.ListResponse{Hashes: r.cache.ArtifactHashes(path.Join(arch, req.Artifact.Package, req.Artifact.Target))}, nil
+}
+
+func (r *RpcCacheServer) GetStats(ctx context.Context, req *pb.GetStatsRequest) (*pb.GetStatsResponse, error) {
+	if err := AuthenticateClient(r.readonlyKeys, ctx); err != nil {
+		return nil, err
+	}
+	entries, size := r.cache.Stats()
+	return &pb.GetStatsResponse{Entries: int64(entries), Size: size}, nil
+}
+
+// AuthenticateClient checks that the client of a request presented one of the given certificates.
+// Anyone is allowed if there aren't any certificates.
+func AuthenticateClient(certs map[string]*x509.Certificate, ctx context.Context) error {
 	if len(certs) == 0 {
 		return nil // Open to anyone.
 	}
@@ -107,30 +398,37 @@ func (r *RpcCacheServer) authenticateClient(certs map[string]*x509.Certificate,
 	if len(info.State.PeerCertificates) == 0 {
 		return fmt.Errorf("No peer certificate available")
 	}
-	cert := info.State.PeerCertificates[0]
-	if okCert := certs[string(cert.RawSubject)]; okCert != nil && okCert.Equal(cert) {
+	if certAllowed(certs, info.State.PeerCertificates[0]) {
 		return nil
 	}
 	return fmt.Errorf("Invalid or unknown certificate")
 }
 
-func loadKeys(filename string) map[string]*x509.Certificate {
+// certAllowed returns true if the given client certificate is one of the given ones.
+func certAllowed(certs map[string]*x509.Certificate, cert *x509.Certificate) bool {
+	okCert := certs[string(cert.RawSubject)]
+	return okCert != nil && okCert.Equal(cert)
+}
+
+// LoadCerts loads PEM-encoded certificates from a file, or all the files in a directory,
+// keyed by their subjects.
+func LoadCerts(filename string) map[string]*x509.Certificate {
 	ret := map[string]*x509.Certificate{}
 	if err := filepath.Walk(filename, func(name string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		} else if !info.IsDir() {
-			data, err := ioutil.ReadFile(filename)
+			data, err := ioutil.ReadFile(name)
 			if err != nil {
-				log.Fatalf("Failed to read cert from %s: %s", filename, err)
+				log.Fatalf("Failed to read cert from %s: %s", name, err)
 			}
 			p, _ := pem.Decode(data)
 			if p == nil {
-				log.Fatalf("Couldn't decode PEM data from %s: %s", filename, err)
+				log.Fatalf("Couldn't decode PEM data from %s: %s", name, err)
 			}
 			cert, err := x509.ParseCertificate(p.Bytes)
 			if err != nil {
-				log.Fatalf("Couldn't parse certificate from %s: %s", filename, err)
+				log.Fatalf("Couldn't parse certificate from %s: %s", name, err)
 			}
 			ret[string(cert.RawSubject)] = cert
 		}
@@ -143,18 +441,19 @@ func loadKeys(filename string) map[string]*x509.Certificate {
 
 // BuildGrpcServer creates a new, unstarted grpc.Server and returns it.
 // It also returns a net.Listener to start it on.
-func BuildGrpcServer(port int, cache *Cache, keyFile, certFile, caCertFile, readonlyKeys, writableKeys string) (*grpc.Server, net.Listener) {
+// The cluster is nil if this server isn't part of one.
+func BuildGrpcServer(port int, cache *Cache, cluster *Cluster, keyFile, certFile, caCertFile, readonlyKeys, writableKeys string) (*grpc.Server, net.Listener) {
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
 		log.Fatalf("Failed to listen on port %d: %v", port, err)
 	}
 	s := serverWithAuth(keyFile, certFile, caCertFile)
-	r := &RpcCacheServer{cache: cache}
+	r := &RpcCacheServer{cache: cache, cluster: cluster}
 	if writableKeys != "" {
-		r.writableKeys = loadKeys(writableKeys)
+		r.writableKeys = LoadCerts(writableKeys)
 	}
 	if readonlyKeys != "" {
-		r.readonlyKeys = loadKeys(readonlyKeys)
+		r.readonlyKeys = LoadCerts(readonlyKeys)
 		if len(r.readonlyKeys) > 0 {
 			// This saves duplication when checking later; writable keys are implicitly readable too.
 			for k, v := range r.writableKeys {
@@ -172,8 +471,8 @@ func BuildGrpcServer(port int, cache *Cache, keyFile, certFile, caCertFile, read
 }
 
 // ServeGrpcForever constructs a new server on the given port and serves until killed.
-func ServeGrpcForever(port int, cache *Cache, keyFile, certFile, caCertFile, readonlyKeys, writableKeys string) {
-	s, lis := BuildGrpcServer(port, cache, keyFile, certFile, caCertFile, readonlyKeys, writableKeys)
+func ServeGrpcForever(port int, cache *Cache, cluster *Cluster, keyFile, certFile, caCertFile, readonlyKeys, writableKeys string) {
+	s, lis := BuildGrpcServer(port, cache, cluster, keyFile, certFile, caCertFile, readonlyKeys, writableKeys)
 	log.Notice("Serving RPC cache on port %d", port)
 	s.Serve(lis)
 }
@@ -183,12 +482,18 @@ func serverWithAuth(keyFile, certFile, caCertFile string) *grpc.Server {
 	if keyFile == "" {
 		return grpc.NewServer(grpc.MaxMsgSize(maxMsgSize)) // No auth.
 	}
+	return grpc.NewServer(grpc.Creds(credentials.NewTLS(ServerTLSConfig(keyFile, certFile, caCertFile))), grpc.MaxMsgSize(maxMsgSize))
+}
+
+// serverTLSConfig loads the TLS configuration for a server from the given key / cert files.
+// Client certificates are requested but not required; it's up to the server to check them.
+func ServerTLSConfig(keyFile, certFile, caCertFile string) *tls.Config {
 	log.Debug("Loading x509 key pair from key: %s cert: %s", keyFile, certFile)
 	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
 	if err != nil {
 		log.Fatalf("Failed to load x509 key pair: %s", err)
 	}
-	config := tls.Config{
+	config := &tls.Config{
 		Certificates: []tls.Certificate{cert},
 		ClientAuth:   tls.RequestClientCert,
 	}
@@ -202,5 +507,5 @@ func serverWithAuth(keyFile, certFile, caCertFile string) *grpc.Server {
 			log.Fatalf("Failed to find any PEM certificates in CA cert")
 		}
 	}
-	return grpc.NewServer(grpc.Creds(credentials.NewTLS(&config)), grpc.MaxMsgSize(maxMsgSize))
+	return config
 }
@@ -24,6 +24,8 @@ var opts struct {
 		MaxArtifactAge cli.Duration `short:"m" long:"max_artifact_age" description:"Clean any artifact that's not been read in this long" default:"720h"`
 	} `group:"Options controlling when to clean the cache"`
 
+	Compression string `short:"z" long:"compression" choice:"none" choice:"gzip" choice:"zstd" default:"none" description:"Algorithm to compress stored artifacts with. Artifacts that are already compressed aren't compressed again. zstd falls back to gzip unless built with it."`
+
 	TLSFlags struct {
 		KeyFile       string `long:"key_file" description:"File containing PEM-encoded private key."`
 		CertFile      string `long:"cert_file" description:"File containing PEM-encoded certificate"`
@@ -31,6 +33,12 @@ var opts struct {
 		WritableCerts string `long:"writable_certs" description:"File or directory containing certificates that are allowed to write to the cache"`
 		ReadonlyCerts string `long:"readonly_certs" description:"File or directory containing certificates that are allowed to read from the cache"`
 	} `group:"Options controlling TLS communication & authentication"`
+
+	ClusterFlags struct {
+		Address  string   `long:"cluster_address" description:"Address of this server as clients see it, as given to --cluster_node"`
+		Nodes    []string `long:"cluster_node" description:"Address of a server in the cluster, including this one. Repeat for each of them; they must be the same as the RpcUrls clients are configured with."`
+		Replicas int      `long:"replicas" description:"Number of servers in the cluster each artifact is stored on" default:"2"`
+	} `group:"Options controlling clustering with other servers"`
 }
 
 func main() {
@@ -43,12 +51,27 @@ func main() {
 		log.Fatalf("Must pass both --key_file and --cert_file if you pass one")
 	} else if opts.TLSFlags.KeyFile == "" && (opts.TLSFlags.WritableCerts != "" || opts.TLSFlags.ReadonlyCerts != "") {
 		log.Fatalf("You can only use --writable_certs / --readonly_certs with https (--key_file and --cert_file)")
+	} else if (opts.ClusterFlags.Address == "") != (len(opts.ClusterFlags.Nodes) == 0) {
+		log.Fatalf("Must pass both --cluster_address and --cluster_node if you pass one")
+	} else if opts.ClusterFlags.Replicas <= 0 {
+		log.Fatalf("--replicas must be at least 1")
 	}
 	log.Notice("Scanning existing cache directory %s...", opts.Dir)
 	cache := server.NewCache(opts.Dir, time.Duration(opts.CleanFlags.CleanFrequency),
 		time.Duration(opts.CleanFlags.MaxArtifactAge),
 		uint64(opts.CleanFlags.LowWaterMark), uint64(opts.CleanFlags.HighWaterMark))
+	cache.SetCompression(opts.Compression)
+	var cluster *server.Cluster
+	if opts.ClusterFlags.Address != "" {
+		cluster = server.NewCluster(cache, opts.ClusterFlags.Address, opts.TLSFlags.KeyFile, opts.TLSFlags.CertFile, opts.TLSFlags.CACertFile)
+		// Membership may have changed since we last ran, so make sure everything's in the right place.
+		go func() {
+			if err := cluster.Rebalance(opts.ClusterFlags.Nodes, opts.ClusterFlags.Replicas); err != nil {
+				log.Error("Rebalance failed: %s", err)
+			}
+		}()
+	}
 	log.Notice("Starting up RPC cache server on port %d...", opts.Port)
-	server.ServeGrpcForever(opts.Port, cache, opts.TLSFlags.KeyFile, opts.TLSFlags.CertFile,
+	server.ServeGrpcForever(opts.Port, cache, cluster, opts.TLSFlags.KeyFile, opts.TLSFlags.CertFile,
 		opts.TLSFlags.CACertFile, opts.TLSFlags.ReadonlyCerts, opts.TLSFlags.WritableCerts)
 }
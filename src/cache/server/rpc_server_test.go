@@ -6,6 +6,7 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"runtime"
 	"testing"
@@ -30,11 +31,11 @@ const (
 func startServer(port int, auth bool, readonlyCerts, writableCerts string) *grpc.Server {
 	cache := NewCache(testDir, 20*time.Hour, 100, 1000000, 1000000)
 	if !auth {
-		s, lis := BuildGrpcServer(port, cache, "", "", "", readonlyCerts, writableCerts)
+		s, lis := BuildGrpcServer(port, cache, nil, "", "", "", readonlyCerts, writableCerts)
 		go s.Serve(lis)
 		return s
 	}
-	s, lis := BuildGrpcServer(port, cache, testKey, testCert, testCa, readonlyCerts, writableCerts)
+	s, lis := BuildGrpcServer(port, cache, nil, testKey, testCert, testCa, readonlyCerts, writableCerts)
 	go s.Serve(lis)
 	return s
 }
@@ -153,3 +154,176 @@ func TestMaxMessageSize(t *testing.T) {
 	})
 	assert.NoError(t, err)
 }
+
+func TestFindMissingBlobs(t *testing.T) {
+	s := startServer(7683, false, "", "")
+	defer s.Stop()
+	c := buildClient(t, 7683, false)
+	ctx, cancel := ctx()
+	defer cancel()
+	content := []byte("Content to be deduplicated")
+	digest := Digest(content)
+	resp, err := c.FindMissingBlobs(ctx, &pb.FindMissingBlobsRequest{Digests: [][]byte{digest}})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{digest}, resp.Missing)
+	_, err = c.Store(ctx, &pb.StoreRequest{
+		Os:   runtime.GOOS,
+		Arch: runtime.GOARCH,
+		Hash: bytes.Repeat([]byte{'b'}, 28),
+		Artifacts: []*pb.Artifact{
+			{
+				Package: "src/cache/server",
+				Target:  "blob_test",
+				File:    "blob_test.txt",
+				Body:    content,
+				Digest:  digest,
+			},
+			{
+				Package: "src/cache/server",
+				Target:  "blob_test",
+				File:    "blob_test2.txt",
+				Digest:  digest,
+			},
+		},
+	})
+	assert.NoError(t, err)
+	resp, err = c.FindMissingBlobs(ctx, &pb.FindMissingBlobsRequest{Digests: [][]byte{digest}})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(resp.Missing))
+
+	retrieved, err := c.Retrieve(ctx, &pb.RetrieveRequest{
+		Os:          runtime.GOOS,
+		Arch:        runtime.GOARCH,
+		Hash:        bytes.Repeat([]byte{'b'}, 28),
+		DigestsOnly: true,
+		Artifacts: []*pb.Artifact{
+			{
+				Package: "src/cache/server",
+				Target:  "blob_test",
+				File:    "blob_test2.txt",
+			},
+		},
+	})
+	assert.NoError(t, err)
+	assert.True(t, retrieved.Success)
+	assert.Equal(t, 1, len(retrieved.Artifacts))
+	assert.Equal(t, digest, retrieved.Artifacts[0].Digest)
+	assert.Equal(t, 0, len(retrieved.Artifacts[0].Body))
+
+	blobs, err := c.RetrieveBlobs(ctx, &pb.RetrieveBlobsRequest{Digests: [][]byte{digest}})
+	assert.NoError(t, err)
+	assert.True(t, blobs.Success)
+	assert.Equal(t, 1, len(blobs.Blobs))
+	assert.Equal(t, content, blobs.Blobs[0].Body)
+}
+
+func TestStoreMissingBlob(t *testing.T) {
+	s := startServer(7686, false, "", "")
+	defer s.Stop()
+	c := buildClient(t, 7686, false)
+	ctx, cancel := ctx()
+	defer cancel()
+	resp, err := c.Store(ctx, &pb.StoreRequest{
+		Os:   runtime.GOOS,
+		Arch: runtime.GOARCH,
+		Hash: bytes.Repeat([]byte{'m'}, 28),
+		Artifacts: []*pb.Artifact{
+			{
+				Package: "src/cache/server",
+				Target:  "missing_blob_test",
+				File:    "missing_blob_test.txt",
+				Digest:  Digest([]byte("Content the server has never seen")),
+			},
+		},
+	})
+	assert.NoError(t, err)
+	assert.False(t, resp.Success)
+	assert.True(t, resp.MissingBlobs)
+}
+
+func TestStoreAndRetrieveStream(t *testing.T) {
+	s := startServer(7684, false, "", "")
+	defer s.Stop()
+	c := buildClient(t, 7684, false)
+	ctx, cancel := ctx()
+	defer cancel()
+	hash := bytes.Repeat([]byte{'c'}, 28)
+	contents := bytes.Repeat([]byte{'c'}, chunkSize+100)
+	stream, err := c.StoreStream(ctx)
+	assert.NoError(t, err)
+	assert.NoError(t, stream.Send(&pb.StoreStreamRequest{
+		Os:   runtime.GOOS,
+		Arch: runtime.GOARCH,
+		Hash: hash,
+		Chunk: &pb.ArtifactChunk{
+			Package: "src/cache/server",
+			Target:  "stream_test",
+			File:    "stream_test.txt",
+			Body:    contents[:chunkSize],
+		},
+	}))
+	assert.NoError(t, stream.Send(&pb.StoreStreamRequest{
+		Chunk: &pb.ArtifactChunk{
+			Package: "src/cache/server",
+			Target:  "stream_test",
+			File:    "stream_test.txt",
+			Body:    contents[chunkSize:],
+			Last:    true,
+		},
+	}))
+	resp, err := stream.CloseAndRecv()
+	assert.NoError(t, err)
+	assert.True(t, resp.Success)
+
+	retrieve, err := c.RetrieveStream(ctx, &pb.RetrieveRequest{
+		Os:   runtime.GOOS,
+		Arch: runtime.GOARCH,
+		Hash: hash,
+		Artifacts: []*pb.Artifact{
+			{
+				Package: "src/cache/server",
+				Target:  "stream_test",
+			},
+		},
+	})
+	assert.NoError(t, err)
+	retrieved := []byte{}
+	for first := true; ; first = false {
+		resp, err := retrieve.Recv()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		assert.True(t, resp.Success)
+		assert.Equal(t, "stream_test.txt", resp.Chunk.File)
+		if first {
+			// The first chunk should carry the digest so the client can check what it got.
+			assert.Equal(t, Digest(contents), resp.Chunk.Digest)
+		}
+		retrieved = append(retrieved, resp.Chunk.Body...)
+	}
+	assert.Equal(t, contents, retrieved)
+}
+
+func TestRetrieveStreamNotFound(t *testing.T) {
+	s := startServer(7685, false, "", "")
+	defer s.Stop()
+	c := buildClient(t, 7685, false)
+	ctx, cancel := ctx()
+	defer cancel()
+	retrieve, err := c.RetrieveStream(ctx, &pb.RetrieveRequest{
+		Os:   runtime.GOOS,
+		Arch: runtime.GOARCH,
+		Hash: bytes.Repeat([]byte{'d'}, 28),
+		Artifacts: []*pb.Artifact{
+			{
+				Package: "src/cache/server",
+				Target:  "not_there",
+			},
+		},
+	})
+	assert.NoError(t, err)
+	resp, err := retrieve.Recv()
+	assert.NoError(t, err)
+	assert.False(t, resp.Success)
+}
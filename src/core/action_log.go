@@ -0,0 +1,158 @@
+// Persistent logs of the actions run to build and test targets.
+//
+// Each time we run a build or test command we write what it did (its command, environment,
+// exit code, how long it took and its output) to a file under plz-out/log, so it can be looked
+// at afterwards (e.g. via 'plz query log') without having to run it again.
+// Variables passed through from the host environment (e.g. credentials) are logged by name only.
+// A few previous logs are kept for each action; older ones are rotated away.
+
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// LogDir is the directory we write logs to.
+const LogDir string = "plz-out/log"
+
+// An ActionLog describes a single run of a build or test action.
+type ActionLog struct {
+	// The target the action was for.
+	Label BuildLabel
+	// The kind of action, e.g. "build" or "test".
+	Action string
+	// The command that was run and the directory it was run in.
+	Command, Dir string
+	// Environment variables the command was run with.
+	Env []string
+	// Combined stdout and stderr of the command.
+	Output []byte
+	// Error it failed with, if any.
+	Err error
+	// When it started and how long it took.
+	Start    time.Time
+	Duration time.Duration
+}
+
+// NewActionLog creates a new log for an action on the given target that's starting now.
+func NewActionLog(label BuildLabel, action, command, dir string, env []string) *ActionLog {
+	return &ActionLog{
+		Label:   label,
+		Action:  action,
+		Command: command,
+		Dir:     dir,
+		Env:     env,
+		Start:   time.Now(),
+	}
+}
+
+// Finish records the result of the action and writes its log, rotating away the oldest one.
+// Failing to write it isn't fatal to the build so errors are only logged.
+func (al *ActionLog) Finish(state *BuildState, output []byte, err error) {
+	al.Duration = time.Since(al.Start)
+	al.Output = output
+	al.Err = err
+	size := int(state.Config.Build.ActionLogSize)
+	if size <= 0 {
+		return
+	}
+	filename := ActionLogFile(al.Label, al.Action, 0)
+	if err := os.MkdirAll(path.Dir(filename), DirPermissions); err != nil {
+		log.Warning("Failed to create log directory for %s: %s", al.Label, err)
+		return
+	}
+	rotateActionLogs(al.Label, al.Action, state.Config.Build.ActionLogHistory)
+	passEnv := state.Config.Build.PassEnv
+	if target := state.Graph.Target(al.Label); target != nil {
+		passEnv = append(passEnv[:len(passEnv):len(passEnv)], target.PassEnv...)
+	}
+	al.Env = redactEnv(al.Env, passEnv)
+	if err := ioutil.WriteFile(filename, al.contents(size), 0644); err != nil {
+		log.Warning("Failed to write %s log for %s: %s", al.Action, al.Label, err)
+	}
+}
+
+// contents returns the contents of the log file, with the output truncated to at most the given size.
+func (al *ActionLog) contents(size int) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "Target: %s\n", al.Label)
+	fmt.Fprintf(&b, "Action: %s\n", al.Action)
+	fmt.Fprintf(&b, "Started: %s\n", al.Start.Format(time.RFC3339))
+	fmt.Fprintf(&b, "Duration: %0.2fs\n", al.Duration.Seconds())
+	fmt.Fprintf(&b, "Exit code: %d\n", ExitCode(al.Err))
+	if al.Err != nil {
+		fmt.Fprintf(&b, "Error: %s\n", al.Err)
+	}
+	fmt.Fprintf(&b, "Directory: %s\n", al.Dir)
+	fmt.Fprintf(&b, "Command:\n%s\n", strings.TrimSpace(al.Command))
+	fmt.Fprintf(&b, "Environment:\n%s\n", strings.Join(al.Env, "\n"))
+	b.WriteString("Output:\n")
+	// It's usually the end of the output that explains what went wrong, so that's the part we keep.
+	if len(al.Output) > size {
+		fmt.Fprintf(&b, "[%d bytes truncated]\n", len(al.Output)-size)
+		b.Write(al.Output[len(al.Output)-size:])
+	} else {
+		b.Write(al.Output)
+	}
+	return b.Bytes()
+}
+
+// redactEnv returns a copy of the given environment with the values of the named variables hidden.
+func redactEnv(env []string, names []string) []string {
+	if len(names) == 0 {
+		return env
+	}
+	redacted := make([]string, len(env))
+	for i, kv := range env {
+		redacted[i] = kv
+		for _, name := range names {
+			if strings.HasPrefix(kv, name+"=") {
+				redacted[i] = name + "=[redacted]"
+				break
+			}
+		}
+	}
+	return redacted
+}
+
+// ActionLogFile returns the log file for an action on the given target.
+// previous is 0 for the latest log, 1 for the one before, and so on.
+func ActionLogFile(label BuildLabel, action string, previous int) string {
+	filename := path.Join(LogDir, label.VariantDir(), label.PackageName, label.Name, action+".log")
+	if previous > 0 {
+		return filename + "." + strconv.Itoa(previous)
+	}
+	return filename
+}
+
+// rotateActionLogs moves each existing log for an action back by one, dropping any beyond
+// the given number of previous logs to keep.
+func rotateActionLogs(label BuildLabel, action string, keep int) {
+	os.Remove(ActionLogFile(label, action, keep))
+	for i := keep; i > 0; i-- {
+		os.Rename(ActionLogFile(label, action, i-1), ActionLogFile(label, action, i))
+	}
+}
+
+// ExitCode returns the exit code of a command that failed with the given error.
+// It's 0 if the error is nil and -1 if the command didn't exit normally (e.g. it was killed
+// after timing out, or couldn't be run at all).
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	} else if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			return status.ExitStatus()
+		}
+	}
+	return -1
+}
@@ -0,0 +1,83 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestActionLogFile(t *testing.T) {
+	label := ParseBuildLabel("//src/core:action_log", "")
+	assert.Equal(t, "plz-out/log/src/core/action_log/build.log", ActionLogFile(label, "build", 0))
+	assert.Equal(t, "plz-out/log/src/core/action_log/test.log.2", ActionLogFile(label, "test", 2))
+	assert.Equal(t, "plz-out/log/@dbg/src/core/action_log/build.log", ActionLogFile(label.ForConfig("dbg"), "build", 0))
+}
+
+func TestActionLogWrite(t *testing.T) {
+	state := NewBuildState(1, nil, 1, DefaultConfiguration())
+	label := ParseBuildLabel("//src/core:action_log_write", "")
+	al := NewActionLog(label, "build", "echo hello", "plz-out/tmp/src/core", []string{"PKG=src/core"})
+	al.Finish(state, []byte("hello\n"), nil)
+	contents := readActionLog(t, label, 0)
+	assert.Contains(t, contents, "Target: //src/core:action_log_write\n")
+	assert.Contains(t, contents, "Exit code: 0\n")
+	assert.Contains(t, contents, "Command:\necho hello\n")
+	assert.Contains(t, contents, "Environment:\nPKG=src/core\n")
+	assert.True(t, strings.HasSuffix(contents, "Output:\nhello\n"))
+}
+
+func TestActionLogRedactsPassEnv(t *testing.T) {
+	config := DefaultConfiguration()
+	config.Build.PassEnv = []string{"SECRET_TOKEN"}
+	state := NewBuildState(1, nil, 1, config)
+	label := ParseBuildLabel("//src/core:action_log_redacted", "")
+	target := NewBuildTarget(label)
+	target.PassEnv = []string{"OTHER_SECRET"}
+	state.Graph.AddTarget(target)
+	env := []string{"PKG=src/core", "SECRET_TOKEN=hunter2", "OTHER_SECRET=swordfish"}
+	NewActionLog(label, "build", "true", "", env).Finish(state, nil, nil)
+	contents := readActionLog(t, label, 0)
+	assert.Contains(t, contents, "Environment:\nPKG=src/core\nSECRET_TOKEN=[redacted]\nOTHER_SECRET=[redacted]\n")
+	assert.NotContains(t, contents, "hunter2")
+	assert.NotContains(t, contents, "swordfish")
+}
+
+func TestActionLogTruncated(t *testing.T) {
+	config := DefaultConfiguration()
+	config.Build.ActionLogSize = 10
+	state := NewBuildState(1, nil, 1, config)
+	label := ParseBuildLabel("//src/core:action_log_truncated", "")
+	NewActionLog(label, "build", "true", "", nil).Finish(state, []byte("0123456789abcdef"), nil)
+	assert.True(t, strings.HasSuffix(readActionLog(t, label, 0), "Output:\n[6 bytes truncated]\n6789abcdef"))
+}
+
+func TestActionLogRotation(t *testing.T) {
+	config := DefaultConfiguration()
+	config.Build.ActionLogHistory = 2
+	state := NewBuildState(1, nil, 1, config)
+	label := ParseBuildLabel("//src/core:action_log_rotation", "")
+	for i := 0; i < 4; i++ {
+		NewActionLog(label, "build", "true", "", nil).Finish(state, []byte(fmt.Sprintf("run %d", i)), nil)
+	}
+	assert.True(t, strings.HasSuffix(readActionLog(t, label, 0), "run 3"))
+	assert.True(t, strings.HasSuffix(readActionLog(t, label, 1), "run 2"))
+	assert.True(t, strings.HasSuffix(readActionLog(t, label, 2), "run 1"))
+	_, err := ioutil.ReadFile(ActionLogFile(label, "build", 3))
+	assert.Error(t, err)
+}
+
+func TestExitCode(t *testing.T) {
+	assert.Equal(t, 0, ExitCode(nil))
+	assert.Equal(t, 3, ExitCode(exec.Command("bash", "-c", "exit 3").Run()))
+	assert.Equal(t, -1, ExitCode(fmt.Errorf("Worker failed")))
+}
+
+func readActionLog(t *testing.T, label BuildLabel, previous int) string {
+	b, err := ioutil.ReadFile(ActionLogFile(label, "build", previous))
+	assert.NoError(t, err)
+	return string(b)
+}
@@ -0,0 +1,107 @@
+// Support for cross-compiling targets for another platform.
+//
+// Targets that are built for a platform other than the one we're running on have the
+// platform recorded in their labels, written as ///linux_arm64//src/core:core (or
+// ///linux_arm64@dbg//src/core:core if they're in another configuration too). They're
+// parsed again with that platform's configuration and built into separate directories
+// under plz-out. Tools are always built for the host, since they have to run here.
+
+package core
+
+import (
+	"fmt"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+// HostArch is the platform we're running on, in the same os_arch form that --arch takes.
+var HostArch = runtime.GOOS + "_" + runtime.GOARCH
+
+const archName = "([a-z0-9]+_[a-z0-9]+)"
+
+var archOnly = regexp.MustCompile("^" + archName + "$")
+
+// Matches the platform and / or configuration prefix of a label, e.g. ///linux_arm64//src/core:core,
+// ///@dbg//src/core:core or ///linux_arm64@dbg//src/core:core
+var archPrefix = regexp.MustCompile("^///(?:" + archName + "(?:@" + configName + ")?|@" + configName + ")(//.*)$")
+
+// ValidateArch returns an error if the given string isn't a valid os_arch pair.
+func ValidateArch(arch string) error {
+	if !archOnly.MatchString(arch) {
+		return fmt.Errorf("Invalid architecture %s; it should look like linux_amd64", arch)
+	}
+	return nil
+}
+
+// SplitArch splits an os_arch pair into its two components.
+// An empty string is treated as the host platform.
+func SplitArch(arch string) (string, string) {
+	if arch == "" {
+		return runtime.GOOS, runtime.GOARCH
+	}
+	parts := strings.SplitN(arch, "_", 2)
+	if len(parts) != 2 {
+		return arch, ""
+	}
+	return parts[0], parts[1]
+}
+
+// TargetArch returns the platform this label is built for, which is the host platform
+// if it doesn't specify one.
+func (label BuildLabel) TargetArch() string {
+	if label.Arch == "" {
+		return HostArch
+	}
+	return label.Arch
+}
+
+// ForArch returns a copy of this label for the given platform.
+// Passing the host platform returns a host label (i.e. one with no explicit platform).
+func (label BuildLabel) ForArch(arch string) BuildLabel {
+	if arch == HostArch {
+		arch = ""
+	}
+	label.Arch = arch
+	return label
+}
+
+// TryParseBuildLabelFor is like TryParseBuildLabel, but parses a label that's referred to by the
+// given target or package. Relative labels are in its package, and the label is built for the same
+// platform and configuration unless it specifies them itself. This is used for labels within
+// packages built for another platform (or configuration), whose dependencies have to be built for it too.
+func TryParseBuildLabelFor(target string, owner BuildLabel) (BuildLabel, error) {
+	label, err := TryParseBuildLabel(target, owner.PackageName)
+	if err != nil {
+		return label, err
+	} else if !archPrefix.MatchString(target) {
+		label.Arch = owner.Arch
+		label.Config = owner.Config
+	} else if label.Config == "" {
+		label.Config = owner.Config
+	}
+	return label, nil
+}
+
+// ArchConfigFile returns the name of the config file that's read for the given platform.
+func ArchConfigFile(arch string) string {
+	return ".plzconfig_" + arch
+}
+
+// SetArchConfig sets the configuration used for targets built for the given platform.
+// It should be called before the build starts.
+func (state *BuildState) SetArchConfig(arch string, config *Configuration) {
+	if state.archConfigs == nil {
+		state.archConfigs = map[string]*Configuration{}
+	}
+	state.archConfigs[arch] = config
+}
+
+// ArchConfig returns the configuration for targets built for the given platform.
+// This is the usual configuration for the host or any platform we haven't got a specific one for.
+func (state *BuildState) ArchConfig(arch string) *Configuration {
+	if config, present := state.archConfigs[arch]; present {
+		return config
+	}
+	return state.Config
+}
@@ -0,0 +1,99 @@
+package core
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseArchLabel(t *testing.T) {
+	label, err := TryParseBuildLabel("///linux_arm64//src/core:core", "")
+	assert.NoError(t, err)
+	assert.Equal(t, BuildLabel{PackageName: "src/core", Name: "core", Arch: "linux_arm64"}, label)
+	assert.Equal(t, "///linux_arm64//src/core:core", label.String())
+}
+
+func TestParseArchLabelImplicitName(t *testing.T) {
+	label, err := TryParseBuildLabel("///linux_arm64//src/core", "")
+	assert.NoError(t, err)
+	assert.Equal(t, BuildLabel{PackageName: "src/core", Name: "core", Arch: "linux_arm64"}, label)
+}
+
+func TestParseArchLabelHost(t *testing.T) {
+	// Labels for the host are always represented the same way, however they're written.
+	label, err := TryParseBuildLabel("///"+HostArch+"//src/core:core", "")
+	assert.NoError(t, err)
+	assert.Equal(t, BuildLabel{PackageName: "src/core", Name: "core"}, label)
+	assert.Equal(t, "//src/core:core", label.String())
+}
+
+func TestParseArchLabelInvalid(t *testing.T) {
+	_, err := TryParseBuildLabel("///linux_arm64//src/core:core:core", "")
+	assert.Error(t, err)
+	_, err = TryParseBuildLabel("///linux//src/core:core", "")
+	assert.Error(t, err)
+}
+
+func TestTryParseBuildLabelFor(t *testing.T) {
+	owner := BuildLabel{PackageName: "src/core", Name: "all", Arch: "linux_arm64"}
+	label, err := TryParseBuildLabelFor(":core", owner)
+	assert.NoError(t, err)
+	assert.Equal(t, BuildLabel{PackageName: "src/core", Name: "core", Arch: "linux_arm64"}, label)
+	// Labels that specify a platform keep it.
+	label, err = TryParseBuildLabelFor("///darwin_amd64//src/core:core", owner)
+	assert.NoError(t, err)
+	assert.Equal(t, "darwin_amd64", label.Arch)
+}
+
+func TestValidateArch(t *testing.T) {
+	assert.NoError(t, ValidateArch("linux_arm64"))
+	assert.NoError(t, ValidateArch("freebsd_386"))
+	assert.Error(t, ValidateArch("linux"))
+	assert.Error(t, ValidateArch("linux_arm64/"))
+}
+
+func TestSplitArch(t *testing.T) {
+	goos, goarch := SplitArch("linux_arm64")
+	assert.Equal(t, "linux", goos)
+	assert.Equal(t, "arm64", goarch)
+	goos, goarch = SplitArch("")
+	assert.Equal(t, runtime.GOOS, goos)
+	assert.Equal(t, runtime.GOARCH, goarch)
+}
+
+func TestArchDirs(t *testing.T) {
+	target := NewBuildTarget(ParseBuildLabel("///linux_arm64//src/core:core", ""))
+	assert.Equal(t, "plz-out/gen/linux_arm64/src/core", target.OutDir())
+	assert.Equal(t, "plz-out/tmp/linux_arm64/src/core/core._build", target.TmpDir())
+	assert.Equal(t, "plz-out/tmp/linux_arm64/src/core/core._test", target.TestDir())
+	target.IsBinary = true
+	assert.Equal(t, "plz-out/bin/linux_arm64/src/core", target.OutDir())
+}
+
+func TestArchEnvironment(t *testing.T) {
+	state := NewBuildState(1, nil, 1, DefaultConfiguration())
+	target := NewBuildTarget(ParseBuildLabel("///linux_arm64//src/core:core", ""))
+	env := BuildEnvironment(state, target, false)
+	assert.Contains(t, env, "OS=linux")
+	assert.Contains(t, env, "ARCH=arm64")
+	assert.Contains(t, env, "GOOS=linux")
+	assert.Contains(t, env, "GOARCH=arm64")
+	// Host targets don't get GOOS / GOARCH.
+	target = NewBuildTarget(ParseBuildLabel("//src/core:core", ""))
+	env = BuildEnvironment(state, target, false)
+	assert.Contains(t, env, "OS="+runtime.GOOS)
+	assert.NotContains(t, env, "GOOS="+runtime.GOOS)
+}
+
+func TestArchConfig(t *testing.T) {
+	state := NewBuildState(1, nil, 1, DefaultConfiguration())
+	config := DefaultConfiguration()
+	config.Build.Path = []string{"/opt/cross/bin", "/usr/bin"}
+	state.SetArchConfig("linux_arm64", config)
+	assert.Equal(t, config, state.ArchConfig("linux_arm64"))
+	assert.Equal(t, state.Config, state.ArchConfig(""))
+	assert.Equal(t, state.Config, state.ArchConfig("darwin_amd64"))
+	target := NewBuildTarget(ParseBuildLabel("///linux_arm64//src/core:core", ""))
+	assert.Contains(t, BuildEnvironment(state, target, false), "PATH=/opt/cross/bin:/usr/bin")
+}
@@ -5,7 +5,7 @@ import (
 	"os"
 	"path"
 	"regexp"
-	"runtime"
+	"strconv"
 	"strings"
 )
 
@@ -22,84 +22,131 @@ func ExpandHomePath(path string) string {
 // BuildEnvironment creates the shell env vars to be passed
 // into the exec.Command calls made by plz. Use test=true for plz test targets.
 func BuildEnvironment(state *BuildState, target *BuildTarget, test bool) []string {
+	if test {
+		return TestEnvironment(state, target, 0)
+	}
 	sources := target.AllSourcePaths(state.Graph)
+	env := baseEnvironment(state, target)
+	env = append(env,
+		"TMP_DIR="+path.Join(RepoRoot, target.TmpDir()),
+		"SRCS="+strings.Join(sources, " "),
+		"OUTS="+strings.Join(target.Outputs(), " "),
+		"NAME="+target.Label.Name,
+	)
+	tools := make([]string, len(target.Tools))
+	for i, tool := range target.Tools {
+		tools[i] = toolPath(state, tool)
+	}
+	env = append(env, "TOOLS="+strings.Join(tools, " "))
+	// The OUT variable is only available on rules that have a single output.
+	if len(target.Outputs()) == 1 {
+		env = append(env, "OUT="+path.Join(RepoRoot, target.TmpDir(), target.Outputs()[0]))
+	}
+	// The SRC variable is only available on rules that have a single source file.
+	if len(sources) == 1 {
+		env = append(env, "SRC="+sources[0])
+	}
+	// Similarly, TOOL is only available on rules with a single tool.
+	if len(target.Tools) == 1 {
+		env = append(env, "TOOL="+toolPath(state, target.Tools[0]))
+	}
+	// Named source groups if the target declared any.
+	for name, srcs := range target.NamedSources {
+		paths := target.SourcePaths(state.Graph, srcs)
+		env = append(env, "SRCS_"+strings.ToUpper(name)+"="+strings.Join(paths, " "))
+	}
+	if state.Config.Bazel.Compatibility {
+		// Obviously this is only a subset of the variables Bazel would expose, but there's
+		// no point populating ones that we literally have no clue what they should be.
+		// To be honest I don't terribly like these, I'm pretty sure that using $GENDIR in
+		// your genrule is not a good sign.
+		env = append(env, "GENDIR="+path.Join(RepoRoot, GenDir))
+		env = append(env, "BINDIR="+path.Join(RepoRoot, BinDir))
+	}
+	return env
+}
+
+// TestEnvironment creates the shell env vars for running a single shard of a test.
+// Sharded tests additionally get TEST_SHARD_INDEX and TEST_TOTAL_SHARDS so they can pick
+// which of their test cases to run; for tests that aren't sharded the shard is always 0.
+func TestEnvironment(state *BuildState, target *BuildTarget, shard int) []string {
+	testDir := target.ShardTestDir(shard)
+	env := append(baseEnvironment(state, target), "TEST_DIR="+path.Join(RepoRoot, testDir))
+	if state.NeedCoverage {
+		env = append(env, "COVERAGE=true", "COVERAGE_FILE="+path.Join(RepoRoot, testDir, "test.coverage"))
+	}
+	if len(target.Outputs()) > 0 {
+		env = append(env, "TEST="+path.Join(RepoRoot, testDir, target.Outputs()[0]))
+	}
+	// Bit of a hack for gcov which needs access to its .gcno files.
+	if target.HasLabel("cc") {
+		env = append(env, "GCNO_DIR="+path.Join(RepoRoot, GenDir, target.Label.VariantDir(), target.Label.PackageName))
+	}
+	if target.Shards > 1 {
+		env = append(env, "TEST_SHARD_INDEX="+strconv.Itoa(shard), "TEST_TOTAL_SHARDS="+strconv.Itoa(target.Shards))
+	}
+	return env
+}
+
+// baseEnvironment returns the env vars that are common to building and testing.
+func baseEnvironment(state *BuildState, target *BuildTarget) []string {
+	return append([]string{"PKG=" + target.Label.PackageName}, WorkerEnvironment(state, target)...)
+}
+
+// WorkerEnvironment returns the env vars for a persistent worker started to build the given target.
+// Workers are shared between targets, so this is the part of their environment that doesn't
+// depend on which target it is beyond its architecture and the variables it passes through.
+func WorkerEnvironment(state *BuildState, target *BuildTarget) []string {
+	config := state.ArchConfig(target.Label.Arch)
+	goos, goarch := SplitArch(target.Label.Arch)
 	env := []string{
-		"PKG=" + target.Label.PackageName,
 		// Need to know these for certain rules, particularly Go rules.
-		"ARCH=" + runtime.GOARCH,
-		"OS=" + runtime.GOOS,
+		"ARCH=" + goarch,
+		"OS=" + goos,
 		// Need this for certain tools, for example sass
-		"LANG=" + state.Config.Please.Lang,
+		"LANG=" + config.Please.Lang,
 		// Use a restricted PATH; it'd be easier for the user if we pass it through
 		// but really external environment variables shouldn't affect this.
 		// The only concession is that ~ is expanded as the user's home directory
 		// in PATH entries.
-		"PATH=" + ExpandHomePath(strings.Join(state.Config.Build.Path, ":")),
-	}
-	if state.Config.Go.GoRoot != "" {
-		env = append(env, "GOROOT="+state.Config.Go.GoRoot)
-	}
-	if !test {
-		env = append(env,
-			"TMP_DIR="+path.Join(RepoRoot, target.TmpDir()),
-			"SRCS="+strings.Join(sources, " "),
-			"OUTS="+strings.Join(target.Outputs(), " "),
-			"NAME="+target.Label.Name,
-		)
-		tools := make([]string, len(target.Tools))
-		for i, tool := range target.Tools {
-			tools[i] = toolPath(state, tool)
-		}
-		env = append(env, "TOOLS="+strings.Join(tools, " "))
-		// The OUT variable is only available on rules that have a single output.
-		if len(target.Outputs()) == 1 {
-			env = append(env, "OUT="+path.Join(RepoRoot, target.TmpDir(), target.Outputs()[0]))
-		}
-		// The SRC variable is only available on rules that have a single source file.
-		if len(sources) == 1 {
-			env = append(env, "SRC="+sources[0])
-		}
-		// Similarly, TOOL is only available on rules with a single tool.
-		if len(target.Tools) == 1 {
-			env = append(env, "TOOL="+toolPath(state, target.Tools[0]))
-		}
-		// Named source groups if the target declared any.
-		for name, srcs := range target.NamedSources {
-			paths := target.SourcePaths(state.Graph, srcs)
-			env = append(env, "SRCS_"+strings.ToUpper(name)+"="+strings.Join(paths, " "))
-		}
-		if state.Config.Bazel.Compatibility {
-			// Obviously this is only a subset of the variables Bazel would expose, but there's
-			// no point populating ones that we literally have no clue what they should be.
-			// To be honest I don't terribly like these, I'm pretty sure that using $GENDIR in
-			// your genrule is not a good sign.
-			env = append(env, "GENDIR="+path.Join(RepoRoot, GenDir))
-			env = append(env, "BINDIR="+path.Join(RepoRoot, BinDir))
-		}
-	} else {
-		env = append(env, "TEST_DIR="+path.Join(RepoRoot, target.TestDir()))
-		if state.NeedCoverage {
-			env = append(env, "COVERAGE=true", "COVERAGE_FILE="+path.Join(RepoRoot, target.TestDir(), "test.coverage"))
-		}
-		if len(target.Outputs()) > 0 {
-			env = append(env, "TEST="+path.Join(RepoRoot, target.TestDir(), target.Outputs()[0]))
-		}
-		// Bit of a hack for gcov which needs access to its .gcno files.
-		if target.HasLabel("cc") {
-			env = append(env, "GCNO_DIR="+path.Join(RepoRoot, GenDir, target.Label.PackageName))
+		"PATH=" + ExpandHomePath(strings.Join(config.Build.Path, ":")),
+	}
+	if target.Label.Arch != "" {
+		// The Go tools pick the platform to build for from these.
+		env = append(env, "GOOS="+goos, "GOARCH="+goarch)
+	}
+	if config.Go.GoRoot != "" {
+		env = append(env, "GOROOT="+config.Go.GoRoot)
+	}
+	env = passEnv(env, config.Build.PassEnv)
+	return passEnv(env, target.PassEnv)
+}
+
+// passEnv appends the given variables from the host environment to env.
+// Any that aren't set on the host are left out rather than being passed as empty.
+func passEnv(env []string, names []string) []string {
+	for _, name := range names {
+		if value, present := os.LookupEnv(name); present {
+			env = append(env, name+"="+value)
 		}
 	}
 	return env
 }
 
 // StampedBuildEnvironment returns the shell env vars to be passed into exec.Command.
-// Optionally includes a stamp if the target is marked as such.
-func StampedBuildEnvironment(state *BuildState, target *BuildTarget, test bool, stamp []byte) []string {
+// Optionally includes a stamp and the workspace status if the target is marked as such,
+// in which case it returns an error if the workspace status command failed.
+func StampedBuildEnvironment(state *BuildState, target *BuildTarget, test bool, stamp []byte) ([]string, error) {
 	env := BuildEnvironment(state, target, test)
 	if target.Stamp {
-		return append(env, "STAMP="+base64.RawURLEncoding.EncodeToString(stamp))
+		status, err := state.WorkspaceStatus()
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, "STAMP="+base64.RawURLEncoding.EncodeToString(stamp))
+		return append(env, status.Environment()...), nil
 	}
-	return env
+	return env, nil
 }
 
 func toolPath(state *BuildState, tool BuildInput) string {
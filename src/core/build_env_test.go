@@ -2,6 +2,7 @@ package core
 
 import (
 	"os"
+	"path"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -35,3 +36,58 @@ func TestReplaceEnvironment(t *testing.T) {
 		os.Expand("$TMP_DIR ${PKG} ${SRCS}", r))
 	assert.Equal(t, "", os.Expand("$WIBBLE", r))
 }
+
+func TestTestEnvironmentShards(t *testing.T) {
+	state := NewBuildState(1, nil, 1, DefaultConfiguration())
+	target := NewBuildTarget(ParseBuildLabel("//src/core:test_env", ""))
+	env := TestEnvironment(state, target, 0)
+	assert.Contains(t, env, "TEST_DIR="+path.Join(RepoRoot, "plz-out/tmp/src/core/test_env._test"))
+	assert.NotContains(t, env, "TEST_SHARD_INDEX=0")
+
+	target.Shards = 3
+	env = TestEnvironment(state, target, 2)
+	assert.Contains(t, env, "TEST_DIR="+path.Join(RepoRoot, "plz-out/tmp/src/core/test_env_shard2._test"))
+	assert.Contains(t, env, "TEST_SHARD_INDEX=2")
+	assert.Contains(t, env, "TEST_TOTAL_SHARDS=3")
+}
+
+func TestPassEnv(t *testing.T) {
+	os.Setenv("PLZ_TEST_CONFIG_VAR", "wibble")
+	os.Setenv("PLZ_TEST_TARGET_VAR", "wobble")
+	os.Unsetenv("PLZ_TEST_UNSET_VAR")
+	config := DefaultConfiguration()
+	config.Build.PassEnv = []string{"PLZ_TEST_CONFIG_VAR"}
+	state := NewBuildState(1, nil, 1, config)
+	target := NewBuildTarget(ParseBuildLabel("//src/core:pass_env", ""))
+	target.PassEnv = []string{"PLZ_TEST_TARGET_VAR", "PLZ_TEST_UNSET_VAR"}
+	env := BuildEnvironment(state, target, false)
+	assert.Contains(t, env, "PLZ_TEST_CONFIG_VAR=wibble")
+	assert.Contains(t, env, "PLZ_TEST_TARGET_VAR=wobble")
+	assert.NotContains(t, env, "PLZ_TEST_UNSET_VAR=")
+	env = TestEnvironment(state, target, 0)
+	assert.Contains(t, env, "PLZ_TEST_CONFIG_VAR=wibble")
+	assert.Contains(t, env, "PLZ_TEST_TARGET_VAR=wobble")
+}
+
+func TestPassEnvConfigHash(t *testing.T) {
+	os.Setenv("PLZ_TEST_CONFIG_VAR", "wibble")
+	config := DefaultConfiguration()
+	config.Build.PassEnv = []string{"PLZ_TEST_CONFIG_VAR"}
+	hash := config.Hash()
+	os.Setenv("PLZ_TEST_CONFIG_VAR", "wobble")
+	assert.NotEqual(t, hash, config.Hash())
+}
+
+func TestWorkerEnvironment(t *testing.T) {
+	config := DefaultConfiguration()
+	config.Build.PassEnv = []string{"PLZ_WORKER_ENV_TEST"}
+	os.Setenv("PLZ_WORKER_ENV_TEST", "wibble")
+	defer os.Unsetenv("PLZ_WORKER_ENV_TEST")
+	state := NewBuildState(1, nil, 1, config)
+	target := NewBuildTarget(ParseBuildLabel("//src/core:worker_env", ""))
+	env := WorkerEnvironment(state, target)
+	assert.Contains(t, env, "PLZ_WORKER_ENV_TEST=wibble")
+	// Workers are shared between packages so shouldn't get anything specific to one.
+	assert.NotContains(t, env, "PKG=src/core")
+	assert.Contains(t, BuildEnvironment(state, target, false), "PKG=src/core")
+}
@@ -20,6 +20,10 @@ var log = logging.MustGetLogger("core")
 type BuildLabel struct {
 	PackageName string
 	Name        string
+	// The platform this target is built for, e.g. linux_arm64. Empty for the host platform.
+	Arch string
+	// The build configuration this target is built for, e.g. dbg. Empty for the primary one.
+	Config string
 }
 
 // Build label that represents parsing the entire graph.
@@ -68,10 +72,14 @@ var packageNameOnly = regexp.MustCompile(fmt.Sprintf("^%s?$", packageName))
 var targetNameOnly = regexp.MustCompile(fmt.Sprintf("^%s$", targetName))
 
 func (label BuildLabel) String() string {
+	prefix := "//"
+	if variant := label.VariantDir(); variant != "" {
+		prefix = "///" + variant + "//"
+	}
 	if label.Name != "" {
-		return "//" + label.PackageName + ":" + label.Name
+		return prefix + label.PackageName + ":" + label.Name
 	}
-	return "//" + label.PackageName
+	return prefix + label.PackageName
 }
 
 // NewBuildLabel constructs a new build label from the given components. Panics on failure.
@@ -110,6 +118,10 @@ func ParseBuildLabel(target string, currentPath string) BuildLabel {
 
 // TryParseBuildLabel attempts to parse a single build label from a string. Returns an error if unsuccessful.
 func TryParseBuildLabel(target string, currentPath string) (BuildLabel, error) {
+	if matches := archPrefix.FindStringSubmatch(target); matches != nil {
+		label, err := TryParseBuildLabel(matches[4], currentPath)
+		return label.ForArch(matches[1]).ForConfig(matches[2] + matches[3]), err
+	}
 	matches := absoluteTarget.FindStringSubmatch(target)
 	if matches != nil {
 		return NewBuildLabel(matches[1], matches[2]), nil
@@ -217,11 +229,20 @@ func (label BuildLabel) includes(that BuildLabel) bool {
 }
 
 func (this BuildLabel) Less(that BuildLabel) bool {
-	if this.PackageName == that.PackageName {
-		return this.Name < that.Name
-	} else {
+	if this.PackageName != that.PackageName {
 		return this.PackageName < that.PackageName
+	} else if this.Name != that.Name {
+		return this.Name < that.Name
+	} else if this.Arch != that.Arch {
+		return this.Arch < that.Arch
 	}
+	return this.Config < that.Config
+}
+
+// PackageLabel returns the label that identifies the package this label is in, i.e. //pkg:all
+// built for the same platform and configuration.
+func (label BuildLabel) PackageLabel() BuildLabel {
+	return BuildLabel{PackageName: label.PackageName, Name: "all", Arch: label.Arch, Config: label.Config}
 }
 
 // Implementation of BuildInput interface
@@ -63,6 +63,9 @@ type BuildTarget struct {
 	TestCommands map[string]string
 	// Represents the state of this build target (see below)
 	state int32
+	// For targets built for another configuration, the target in the primary configuration whose
+	// outputs they share, if they turned out to be the same (see BuildGraph.ShareOutputs).
+	sharedWith *BuildTarget
 	// True if this target is a binary (ie. runnable, will appear in plz-out/bin)
 	IsBinary bool
 	// True if this target is a test
@@ -84,6 +87,8 @@ type BuildTarget struct {
 	// If true, the rule is given an env var at build time that contains the hash of its
 	// transitive dependencies, which can be used to identify the output in a predictable way.
 	Stamp bool
+	// True if the target should be built and tested in a sandbox.
+	Sandbox bool
 	// Containerisation settings that override the defaults.
 	ContainerSettings *TargetContainerSettings
 	// Results of test, if it is one
@@ -117,6 +122,12 @@ type BuildTarget struct {
 	// Flakiness of test, ie. number of times we will rerun it before giving up. 0 is the default and
 	// is interpreted the same way as 1 would be (ie. one run only).
 	Flakiness int
+	// Number of shards to split the test into. Each is run as a separate process in parallel.
+	// 0 or 1 both mean the test isn't sharded.
+	Shards int
+	// Number of CPUs and amount of memory (in megabytes) the target needs to build or test.
+	// These are used to avoid overloading the machine; 0 means one CPU and an unknown amount of memory.
+	Cpus, Memory int
 	// Timeouts for build/test actions
 	BuildTimeout time.Duration
 	TestTimeout  time.Duration
@@ -126,6 +137,9 @@ type BuildTarget struct {
 	// Extra output files from the test.
 	// These are in addition to the usual test.results output file.
 	TestOutputs []string
+	// Names of environment variables to pass through from the host to the build and test actions,
+	// in addition to any given in the config.
+	PassEnv []string
 }
 
 type depInfo struct {
@@ -133,6 +147,7 @@ type depInfo struct {
 	deps     []*BuildTarget // list of actual deps
 	resolved bool           // has the graph resolved it
 	exported bool           // is it an exported dependency
+	internal bool           // only orders the build; it isn't really one of the target's dependencies
 }
 
 type BuildTargetState int32
@@ -158,12 +173,15 @@ type TestResults struct {
 	ExpectedFailures int // Number of tests that were expected to fail (counts as a pass, but displayed differently)
 	Skipped          int // Number of tests skipped (also count as passes)
 	Flakes           int // Number of failed attempts to run the test
+	Quarantined      int // Number of tests that failed but are quarantined (don't count as failures)
 	Failures         []TestFailure
 	Passes           []string
-	Output           string  // Stdout / stderr from the test.
-	Cached           bool    // True if the test results were retrieved from cache
-	TimedOut         bool    // True if the test failed because we timed it out.
-	Duration         float64 // Length of time this test took, in seconds.
+	Flaky            []string      // Names of tests that failed but then passed when rerun.
+	QuarantinedTests []TestFailure // Failures of quarantined tests.
+	Output           string        // Stdout / stderr from the test.
+	Cached           bool          // True if the test results were retrieved from cache
+	TimedOut         bool          // True if the test failed because we timed it out.
+	Duration         float64       // Length of time this test took, in seconds.
 }
 
 type TestFailure struct {
@@ -182,8 +200,11 @@ func (this *TestResults) Aggregate(that TestResults) {
 	this.ExpectedFailures += that.ExpectedFailures
 	this.Skipped += that.Skipped
 	this.Flakes += that.Flakes
+	this.Quarantined += that.Quarantined
 	this.Failures = append(this.Failures, that.Failures...)
 	this.Passes = append(this.Passes, that.Passes...)
+	this.Flaky = append(this.Flaky, that.Flaky...)
+	this.QuarantinedTests = append(this.QuarantinedTests, that.QuarantinedTests...)
 	this.Duration += that.Duration
 	// Output can't really be aggregated sensibly.
 }
@@ -229,16 +250,23 @@ func NewBuildTarget(label BuildLabel) *BuildTarget {
 // to attempt to keep rules from duplicating the names of sub-packages; obviously that is not
 // 100% reliable but we don't have a better solution right now.
 func (target *BuildTarget) TmpDir() string {
-	return path.Join(TmpDir, target.Label.PackageName, target.Label.Name+buildDirSuffix)
+	return path.Join(TmpDir, target.Label.VariantDir(), target.Label.PackageName, target.Label.Name+buildDirSuffix)
 }
 
 // Returns the output directory for this target, eg.
 // //mickey/donald:goofy -> plz-out/gen/mickey/donald (or plz-out/bin if it's a binary)
+// Targets built for another platform go in a subdirectory for it, eg.
+// ///linux_arm64//mickey/donald:goofy -> plz-out/gen/linux_arm64/mickey/donald
+// and similarly targets built for another configuration go in one named for that, eg.
+// ///@dbg//mickey/donald:goofy -> plz-out/gen/@dbg/mickey/donald, unless they share the
+// outputs of the primary configuration.
 func (target *BuildTarget) OutDir() string {
-	if target.IsBinary {
-		return path.Join(BinDir, target.Label.PackageName)
+	if target.sharedWith != nil {
+		return target.sharedWith.OutDir()
+	} else if target.IsBinary {
+		return path.Join(BinDir, target.Label.VariantDir(), target.Label.PackageName)
 	} else {
-		return path.Join(GenDir, target.Label.PackageName)
+		return path.Join(GenDir, target.Label.VariantDir(), target.Label.PackageName)
 	}
 }
 
@@ -247,7 +275,17 @@ func (target *BuildTarget) OutDir() string {
 // This is different to TmpDir so we run tests in a clean environment
 // and to facilitate containerising tests.
 func (target *BuildTarget) TestDir() string {
-	return path.Join(TmpDir, target.Label.PackageName, target.Label.Name+testDirSuffix)
+	return target.ShardTestDir(0)
+}
+
+// ShardTestDir returns the test directory for a single shard of this target, eg.
+// //mickey/donald:goofy -> plz-out/tmp/mickey/donald/goofy_shard2._test
+// For targets that aren't sharded it's the same as TestDir.
+func (target *BuildTarget) ShardTestDir(shard int) string {
+	if target.Shards <= 1 {
+		return path.Join(TmpDir, target.Label.VariantDir(), target.Label.PackageName, target.Label.Name+testDirSuffix)
+	}
+	return path.Join(TmpDir, target.Label.VariantDir(), target.Label.PackageName, fmt.Sprintf("%s_shard%d%s", target.Label.Name, shard, testDirSuffix))
 }
 
 // AllSourcePaths returns all the source paths for this target
@@ -263,7 +301,9 @@ func (target *BuildTarget) AllSourcePaths(graph *BuildGraph) []string {
 func (target *BuildTarget) DeclaredDependencies() []BuildLabel {
 	ret := make(BuildLabels, 0, len(target.dependencies))
 	for _, dep := range target.dependencies {
-		ret = append(ret, dep.declared)
+		if !dep.internal {
+			ret = append(ret, dep.declared)
+		}
 	}
 	sort.Sort(ret)
 	return ret
@@ -273,8 +313,8 @@ func (target *BuildTarget) DeclaredDependencies() []BuildLabel {
 func (target *BuildTarget) Dependencies() []*BuildTarget {
 	ret := make(BuildTargets, 0, len(target.dependencies))
 	for _, deps := range target.dependencies {
-		for _, dep := range deps.deps {
-			ret = append(ret, dep)
+		if !deps.internal {
+			ret = append(ret, deps.deps...)
 		}
 	}
 	sort.Sort(ret)
@@ -411,6 +451,9 @@ func (target *BuildTarget) CanSee(dep *BuildTarget) bool {
 // Returns an error if not, or nil if all's well.
 func (target *BuildTarget) CheckDependencyVisibility(graph *BuildGraph) error {
 	for _, d := range target.dependencies {
+		if d.internal {
+			continue
+		}
 		dep := graph.TargetOrDie(d.declared)
 		if !target.CanSee(dep) {
 			return fmt.Errorf("Target %s isn't visible to %s", dep.Label, target.Label)
@@ -604,12 +647,12 @@ func (target *BuildTarget) AddTestCommand(config, command string) {
 	}
 }
 
-// GetCommand returns the command we should use to build this target for the current config.
+// GetCommand returns the command we should use to build this target for its config.
 func (target *BuildTarget) GetCommand() string {
 	return target.getCommand(target.Commands, target.Command)
 }
 
-// GetTestCommand returns the command we should use to test this target for the current config.
+// GetTestCommand returns the command we should use to test this target for its config.
 func (target *BuildTarget) GetTestCommand() string {
 	return target.getCommand(target.TestCommands, target.TestCommand)
 }
@@ -617,7 +660,12 @@ func (target *BuildTarget) GetTestCommand() string {
 func (target *BuildTarget) getCommand(commands map[string]string, singleCommand string) string {
 	if commands == nil {
 		return singleCommand
-	} else if command, present := commands[State.Config.Build.Config]; present {
+	}
+	config := target.Label.Config
+	if config == "" {
+		config = State.Config.Build.Config
+	}
+	if command, present := commands[config]; present {
 		return command // Has command for current config, good
 	} else if command, present := commands[State.Config.Build.FallbackConfig]; present {
 		return command // Has command for default config, fall back to that
@@ -633,7 +681,7 @@ func (target *BuildTarget) getCommand(commands map[string]string, singleCommand
 		}
 	}
 	log.Warning("%s doesn't have a command for %s (or %s), falling back to %s",
-		target.Label, State.Config.Build.Config, State.Config.Build.FallbackConfig, highestConfig)
+		target.Label, config, State.Config.Build.FallbackConfig, highestConfig)
 	return highestCommand
 }
 
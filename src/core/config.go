@@ -3,7 +3,6 @@
 package core
 
 import (
-	"crypto/sha1"
 	"encoding/gob"
 	"fmt"
 	"os"
@@ -24,7 +23,7 @@ import (
 const ConfigFileName string = ".plzconfig"
 
 // Architecture-specific config file which overrides the repo one. Also normally checked in if needed.
-var ArchConfigFileName string = fmt.Sprintf(".plzconfig_%s_%s", runtime.GOOS, runtime.GOARCH)
+var ArchConfigFileName string = ArchConfigFile(HostArch)
 
 // File name for the local repo config - this is not normally checked in and used to
 // override settings on the local machine.
@@ -62,6 +61,7 @@ func ReadConfigFiles(filenames []string) (*Configuration, error) {
 	// them upfront as we would with other config values.
 	setDefault(&config.Please.BuildFileName, []string{"BUILD"})
 	setDefault(&config.Build.Path, []string{"/usr/local/bin", "/usr/bin", "/bin"})
+	setDefault(&config.Build.SandboxDirs, []string{"/etc", "/lib", "/lib64", "/usr/lib", "/usr/lib64", "/usr/libexec", "/usr/include", "/usr/share"})
 	setDefault(&config.Cover.FileExtension, []string{".go", ".py", ".java", ".js", ".cc", ".h", ".c"})
 	setDefault(&config.Cover.ExcludeExtension, []string{".pb.go", "_pb2.py", ".pb.cc", ".pb.h", "_test.py", "_test.go", "_pb.go", "_bindata.go", "_test_main.cc"})
 	setDefault(&config.Proto.Language, []string{"cc", "py", "java", "go"})
@@ -71,12 +71,25 @@ func ReadConfigFiles(filenames []string) (*Configuration, error) {
 	defaultPath(&config.Go.TestTool, config.Please.Location, "please_go_test")
 	defaultPath(&config.Python.PexTool, config.Please.Location, "please_pex")
 	defaultPath(&config.Java.JarCatTool, config.Please.Location, "jarcat")
+	defaultPath(&config.Java.JavacWorker, config.Please.Location, "javac_worker")
 	defaultPath(&config.Java.PleaseMavenTool, config.Please.Location, "please_maven")
 	defaultPath(&config.Java.JUnitRunner, config.Please.Location, "junit_runner.jar")
+	defaultPath(&config.Build.SandboxTool, config.Please.Location, "please_sandbox")
 
 	if (config.Cache.RpcPrivateKey == "") != (config.Cache.RpcPublicKey == "") {
 		return config, fmt.Errorf("Must pass both rpcprivatekey and rpcpublickey properties for cache")
 	}
+	if (config.Cache.HttpPrivateKey == "") != (config.Cache.HttpPublicKey == "") {
+		return config, fmt.Errorf("Must pass both httpprivatekey and httppublickey properties for cache")
+	}
+	if config.Cache.RpcReplicas < 1 {
+		return config, fmt.Errorf("rpcreplicas must be at least 1")
+	}
+	for _, c := range []string{config.Cache.Compression, config.Cache.DirCompression} {
+		if c != "none" && c != "gzip" && c != "zstd" {
+			return config, fmt.Errorf("Unknown cache compression %s; must be one of none, gzip or zstd", c)
+		}
+	}
 	return config, nil
 }
 
@@ -102,16 +115,25 @@ func DefaultConfiguration() *Configuration {
 	config.Please.Lang = "en_GB.UTF-8" // Not the language of the UI, the language passed to rules.
 	config.Please.Nonce = "1402"       // Arbitrary nonce to invalidate config when needed.
 	config.Build.Timeout = cli.Duration(10 * time.Minute)
+	config.Build.HashFunction = DefaultHashFunction
 	config.Build.Config = "opt"         // Optimised builds by default
 	config.Build.FallbackConfig = "opt" // Optimised builds as a fallback on any target that doesn't have a matching one set
+	config.Build.MaxWorkers = 4
+	config.Build.ActionLogSize = 1024 * 1024
+	config.Build.ActionLogHistory = 2
 	config.Cache.HttpTimeout = cli.Duration(5 * time.Second)
 	config.Cache.RpcTimeout = cli.Duration(5 * time.Second)
+	config.Cache.RpcReplicas = 2
+	config.Cache.RpcRecheckFrequency = cli.Duration(30 * time.Second)
 	config.Cache.Dir = ".plz-cache"
 	config.Cache.DirCacheHighWaterMark = "10G"
 	config.Cache.DirCacheLowWaterMark = "8G"
-	// Temporarily disabled, we are not 100% sure it is working correctly.
-	// config.Cache.Workers = runtime.NumCPU() + 2 // Mirrors the number of workers in please.go.
+	config.Cache.DirCompression = "none"
+	config.Cache.Compression = "none"
+	config.Cache.Workers = runtime.NumCPU() + 2 // Mirrors the number of workers in please.go.
+	config.Cache.FlushTimeout = cli.Duration(1 * time.Minute)
 	config.Cache.RpcMaxMsgSize.UnmarshalFlag("200MiB")
+	config.Remote.Timeout = cli.Duration(5 * time.Second)
 	config.Metrics.PushFrequency = cli.Duration(400 * time.Millisecond)
 	config.Metrics.PushTimeout = cli.Duration(500 * time.Millisecond)
 	config.Test.Timeout = cli.Duration(10 * time.Minute)
@@ -182,30 +204,57 @@ type Configuration struct {
 		ExperimentalDir  string
 	}
 	Build struct {
-		Timeout        cli.Duration
-		Path           []string
-		Config         string
-		FallbackConfig string
+		Timeout                cli.Duration
+		Path                   []string
+		Config                 string
+		FallbackConfig         string
+		HashFunction           HashFunction
+		Sandbox                bool
+		SandboxTool            string
+		SandboxDirs            []string
+		Cpus                   int
+		Memory                 int
+		MaxWorkers             int
+		WorkspaceStatusCommand string
+		PassEnv                []string
+		ActionLogSize          cli.ByteSize
+		ActionLogHistory       int
 	}
 	BuildConfig map[string]string
 	Cache       struct {
 		Workers               int
+		FlushTimeout          cli.Duration
 		Dir                   string
 		DirCacheCleaner       string
 		DirCacheHighWaterMark string
 		DirCacheLowWaterMark  string
+		DirCompression        string
+		Compression           string
 		HttpUrl               string
 		HttpWriteable         bool
 		HttpTimeout           cli.Duration
-		RpcUrl                string
+		HttpCACert            string
+		HttpPublicKey         string
+		HttpPrivateKey        string
+		HttpTokenFile         string
+		RpcUrl                []string
 		RpcWriteable          bool
 		RpcTimeout            cli.Duration
+		RpcReplicas           int
+		RpcRecheckFrequency   cli.Duration
 		RpcPublicKey          string
 		RpcPrivateKey         string
 		RpcCACert             string
 		RpcSecure             bool
 		RpcMaxMsgSize         cli.ByteSize
 	}
+	Remote struct {
+		Workers    []string
+		Timeout    cli.Duration
+		CACert     string
+		PublicKey  string
+		PrivateKey string
+	}
 	Metrics struct {
 		PushGatewayURL string
 		PushFrequency  cli.Duration
@@ -215,6 +264,8 @@ type Configuration struct {
 	Test               struct {
 		Timeout          cli.Duration
 		DefaultContainer ContainerImplementation
+		Quarantine       []string
+		QuarantineFile   string
 	}
 	Cover struct {
 		FileExtension    []string
@@ -250,6 +301,7 @@ type Configuration struct {
 	}
 	Java struct {
 		JavacTool          string
+		JavacWorker        string
 		JarTool            string
 		JarCatTool         string
 		PleaseMavenTool    string
@@ -302,7 +354,7 @@ type Configuration struct {
 }
 
 func (config *Configuration) Hash() []byte {
-	h := sha1.New()
+	h := NewHash()
 	// These fields are the ones that need to be in the general hash; other things will be
 	// picked up by relevant rules (particularly tool paths etc).
 	// Note that container settings are handled separately.
@@ -314,6 +366,11 @@ func (config *Configuration) Hash() []byte {
 	for _, p := range config.Build.Path {
 		h.Write([]byte(p))
 	}
+	// The values of these variables are passed to every build action so they have to be hashed too.
+	for _, env := range config.Build.PassEnv {
+		h.Write([]byte(env))
+		h.Write([]byte(os.Getenv(env)))
+	}
 	for _, l := range config.Licences.Reject {
 		h.Write([]byte(l))
 	}
@@ -322,7 +379,7 @@ func (config *Configuration) Hash() []byte {
 
 // ContainerisationHash returns the hash of the containerisation part of the config.
 func (config *Configuration) ContainerisationHash() []byte {
-	h := sha1.New()
+	h := NewHash()
 	encoder := gob.NewEncoder(h)
 	if err := encoder.Encode(config.Docker); err != nil {
 		panic(err)
@@ -356,7 +413,7 @@ func (config *Configuration) ApplyOverrides(overrides map[string]string) error {
 		}
 		switch field.Kind() {
 		case reflect.String:
-			field.Set(reflect.ValueOf(v))
+			field.SetString(v)
 		case reflect.Bool:
 			v = strings.ToLower(v)
 			// Mimics the set of truthy things gcfg accepts in our config file.
@@ -398,3 +455,14 @@ const (
 	ContainerImplementationNone   ContainerImplementation = "none"
 	ContainerImplementationDocker ContainerImplementation = "docker"
 )
+
+// HashFunction is the name of one of the hash functions we support (see hash.go).
+type HashFunction string
+
+func (hf *HashFunction) UnmarshalText(text []byte) error {
+	if IsHashFunction(string(text)) {
+		*hf = HashFunction(text)
+		return nil
+	}
+	return fmt.Errorf("Unknown hash function: %s; must be one of %s", string(text), strings.Join(HashFunctions(), ", "))
+}
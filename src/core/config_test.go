@@ -149,3 +149,17 @@ func TestReadContainers(t *testing.T) {
 	config, err = ReadConfigFiles([]string{"src/core/test_data/container_bad.plzconfig"})
 	assert.Error(t, err)
 }
+
+func TestReadHashFunction(t *testing.T) {
+	config, err := ReadConfigFiles([]string{"src/core/test_data/hashfunction_good.plzconfig"})
+	assert.NoError(t, err)
+	assert.EqualValues(t, "sha256", config.Build.HashFunction)
+	config, err = ReadConfigFiles([]string{"src/core/test_data/hashfunction_bad.plzconfig"})
+	assert.Error(t, err)
+}
+
+func TestDefaultHashFunction(t *testing.T) {
+	config, err := ReadConfigFiles(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultHashFunction, config.Build.HashFunction)
+}
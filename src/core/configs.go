@@ -0,0 +1,215 @@
+// Support for building targets in more than one configuration at once (e.g. plz build -c opt -c dbg).
+//
+// The first configuration is the primary one and is built exactly as usual. For each of the others,
+// every package is given a copy of its targets (with the configuration recorded in their labels)
+// rather than being parsed again. Those copies that turn out to have the same command and
+// dependencies as the primary configuration's target share its outputs; the rest are built into
+// separate directories under plz-out, e.g. plz-out/gen/@dbg/src/core. The @ can't appear in a
+// package name so those can't collide with any package's outputs.
+
+package core
+
+import (
+	"fmt"
+	"regexp"
+)
+
+const configName = "([A-Za-z0-9_-]+)"
+
+var configOnly = regexp.MustCompile("^" + configName + "$")
+
+// ValidateConfig returns an error if the given string isn't a valid configuration name.
+func ValidateConfig(config string) error {
+	if !configOnly.MatchString(config) {
+		return fmt.Errorf("Invalid config %s; it can only contain letters, numbers, underscores and hyphens", config)
+	}
+	return nil
+}
+
+// ForConfig returns a copy of this label for the given configuration.
+// Passing an empty string returns the label for the primary configuration.
+func (label BuildLabel) ForConfig(config string) BuildLabel {
+	label.Config = config
+	return label
+}
+
+// ConfigSuffix returns the suffix added to this label's platform directory for its configuration,
+// e.g. "@dbg", or an empty string for the primary configuration.
+func (label BuildLabel) ConfigSuffix() string {
+	if label.Config == "" {
+		return ""
+	}
+	return "@" + label.Config
+}
+
+// VariantDir returns the directory that outputs for this label's platform and configuration go in,
+// relative to plz-out/gen and similar. It's empty for the host platform and primary configuration.
+func (label BuildLabel) VariantDir() string {
+	return label.Arch + label.ConfigSuffix()
+}
+
+// Configs returns all the configurations we're building in, the primary one first.
+func (state *BuildState) Configs() []string {
+	return append([]string{state.Config.Build.Config}, state.ExtraConfigs...)
+}
+
+// AddConfig adds a configuration to build the original targets in, unless we're already building in it.
+// It must be called before the build starts.
+func (state *BuildState) AddConfig(config string) {
+	for _, c := range state.Configs() {
+		if c == config {
+			return
+		}
+	}
+	state.ExtraConfigs = append(state.ExtraConfigs, config)
+}
+
+// ForConfig returns a copy of this package for the given configuration, containing copies of all
+// its targets. Outputs aren't registered on the new package; that happens when it's added to the graph.
+func (pkg *Package) ForConfig(config string) *Package {
+	p := NewPackage(pkg.Name)
+	p.Arch = pkg.Arch
+	p.Config = config
+	p.Filename = pkg.Filename
+	p.Subincludes = pkg.Subincludes
+	for name, target := range pkg.Targets {
+		p.Targets[name] = target.ForConfig(config)
+	}
+	return p
+}
+
+// ForConfig returns a copy of this target for the given configuration.
+// Its dependencies are for the same configuration too, except tools which are always built in
+// the primary one (much like they're always built for the host platform).
+func (target *BuildTarget) ForConfig(config string) *BuildTarget {
+	t := *target
+	t.Label = target.Label.ForConfig(config)
+	t.state = int32(Inactive)
+	t.sharedWith = nil
+	t.dependencies = make([]depInfo, 0, len(target.dependencies))
+	for _, dep := range target.dependencies {
+		if !dep.internal {
+			t.dependencies = append(t.dependencies, depInfo{declared: t.inputLabel(dep.declared), exported: dep.exported})
+		}
+	}
+	t.Sources = t.inputsForConfig(target.Sources)
+	if target.NamedSources != nil {
+		t.NamedSources = make(map[string][]BuildInput, len(target.NamedSources))
+		for name, sources := range target.NamedSources {
+			t.NamedSources[name] = t.inputsForConfig(sources)
+		}
+	}
+	t.Data = t.inputsForConfig(target.Data)
+	if target.Provides != nil {
+		t.Provides = make(map[string]BuildLabel, len(target.Provides))
+		for language, label := range target.Provides {
+			t.Provides[language] = label.ForConfig(config)
+		}
+	}
+	t.Commands = copyStringMap(target.Commands)
+	t.TestCommands = copyStringMap(target.TestCommands)
+	// Copy these so anything appended to one target (e.g. by a post-build function) doesn't affect the other.
+	t.outputs = copyStrings(target.outputs)
+	t.OptionalOutputs = copyStrings(target.OptionalOutputs)
+	t.Labels = copyStrings(target.Labels)
+	t.Licences = copyStrings(target.Licences)
+	t.TestOutputs = copyStrings(target.TestOutputs)
+	t.Hashes = copyStrings(target.Hashes)
+	t.Requires = copyStrings(target.Requires)
+	t.PassEnv = copyStrings(target.PassEnv)
+	t.Visibility = append([]BuildLabel(nil), target.Visibility...)
+	t.Tools = append([]BuildInput(nil), target.Tools...)
+	t.Results = TestResults{}
+	t.RuleHash = nil
+	return &t
+}
+
+// inputLabel returns the label this target should depend on for one that its original declared.
+func (target *BuildTarget) inputLabel(label BuildLabel) BuildLabel {
+	if target.IsTool(label) {
+		return label
+	}
+	return label.ForConfig(target.Label.Config)
+}
+
+// inputsForConfig returns a copy of the given inputs with any labels changed to this target's configuration.
+func (target *BuildTarget) inputsForConfig(inputs []BuildInput) []BuildInput {
+	if inputs == nil {
+		return nil
+	}
+	ret := make([]BuildInput, len(inputs))
+	for i, input := range inputs {
+		if label, ok := input.(BuildLabel); ok {
+			ret[i] = target.inputLabel(label)
+		} else {
+			ret[i] = input
+		}
+	}
+	return ret
+}
+
+// linkConfigVariant makes a target built for another configuration wait for the same target in the
+// primary configuration, since it might turn out to share its outputs.
+// The graph's mutex must be held when calling it.
+func (graph *BuildGraph) linkConfigVariant(target *BuildTarget) {
+	if base, present := graph.targets[target.Label.ForConfig("")]; present {
+		target.dependencies = append(target.dependencies, depInfo{
+			declared: base.Label,
+			deps:     []*BuildTarget{base},
+			resolved: true,
+			internal: true,
+		})
+		graph.revDeps[base.Label] = append(graph.revDeps[base.Label], target)
+	}
+}
+
+// ShareOutputs checks whether a target built for another configuration would be the same as
+// the target in the primary configuration, and if so makes it share that target's outputs
+// instead of being built again. It returns true if it does so.
+// It must only be called once the target's dependencies have been built.
+//
+// Targets are the same if their commands are the same for both configurations and all their
+// dependencies are the same too. Tests are never shared since they're run for each configuration,
+// and neither are targets with pre- or post-build functions since those can change them arbitrarily.
+func (graph *BuildGraph) ShareOutputs(target *BuildTarget) bool {
+	if target.Label.Config == "" || target.IsTest || target.PreBuildFunction != 0 || target.PostBuildFunction != 0 {
+		return false
+	}
+	base := graph.Target(target.Label.ForConfig(""))
+	if base == nil || base.State() < Built || base.GetCommand() != target.GetCommand() {
+		return false
+	}
+	graph.mutex.RLock()
+	defer graph.mutex.RUnlock()
+	for _, dep := range target.Dependencies() {
+		if dep.Label.Config != "" && dep.sharedWith == nil {
+			return false
+		}
+	}
+	target.sharedWith = base
+	return true
+}
+
+// SharedWith returns the target in the primary configuration whose outputs this target shares,
+// or nil if it doesn't share them.
+func (target *BuildTarget) SharedWith() *BuildTarget {
+	return target.sharedWith
+}
+
+func copyStrings(s []string) []string {
+	if s == nil {
+		return nil
+	}
+	return append([]string(nil), s...)
+}
+
+func copyStringMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	ret := make(map[string]string, len(m))
+	for k, v := range m {
+		ret[k] = v
+	}
+	return ret
+}
@@ -0,0 +1,139 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigLabelString(t *testing.T) {
+	label := ParseBuildLabel("//src/core:core", "").ForConfig("dbg")
+	assert.Equal(t, "///@dbg//src/core:core", label.String())
+	assert.Equal(t, BuildLabel{PackageName: "src/core", Name: "all", Config: "dbg"}, label.PackageLabel())
+}
+
+func TestTryParseBuildLabelForConfig(t *testing.T) {
+	owner := BuildLabel{PackageName: "src/core", Name: "core", Config: "dbg"}
+	label, err := TryParseBuildLabelFor("//src/build:build", owner)
+	assert.NoError(t, err)
+	assert.Equal(t, BuildLabel{PackageName: "src/build", Name: "build", Config: "dbg"}, label)
+}
+
+func TestConfigLabelRoundTrip(t *testing.T) {
+	for _, s := range []string{"///@dbg//src/core:core", "///linux_arm64@dbg//src/core:core", "///linux_arm64//src/core:core"} {
+		label, err := TryParseBuildLabel(s, "")
+		assert.NoError(t, err)
+		assert.Equal(t, s, label.String())
+	}
+	label, err := TryParseBuildLabel("///@dbg//src/core", "")
+	assert.NoError(t, err)
+	assert.Equal(t, BuildLabel{PackageName: "src/core", Name: "core", Config: "dbg"}, label)
+	_, err = TryParseBuildLabel("///@d.b.g//src/core:core", "")
+	assert.Error(t, err)
+}
+
+func TestTryParseBuildLabelForExplicitConfig(t *testing.T) {
+	owner := BuildLabel{PackageName: "src/core", Name: "core", Config: "dbg"}
+	label, err := TryParseBuildLabelFor("///@opt//src/build:build", owner)
+	assert.NoError(t, err)
+	assert.Equal(t, BuildLabel{PackageName: "src/build", Name: "build", Config: "opt"}, label)
+}
+
+func TestValidateConfig(t *testing.T) {
+	assert.NoError(t, ValidateConfig("dbg"))
+	assert.NoError(t, ValidateConfig("opt-2_x"))
+	assert.Error(t, ValidateConfig("d b g"))
+	assert.Error(t, ValidateConfig(""))
+}
+
+func TestAddConfig(t *testing.T) {
+	state := NewBuildState(1, nil, 4, DefaultConfiguration())
+	state.AddConfig("dbg")
+	state.AddConfig("opt")
+	state.AddConfig("dbg")
+	assert.Equal(t, []string{"opt", "dbg"}, state.Configs())
+}
+
+func TestTargetForConfig(t *testing.T) {
+	target := NewBuildTarget(ParseBuildLabel("//src/core:core", ""))
+	target.AddSource(ParseBuildLabel("//src/core:srcs", ""))
+	target.AddSource(FileLabel{File: "core.go", Package: "src/core"})
+	target.AddDependency(ParseBuildLabel("//src/core:srcs", ""))
+	target.AddDependency(ParseBuildLabel("//src/tools:tool", ""))
+	target.Tools = append(target.Tools, ParseBuildLabel("//src/tools:tool", ""))
+	target.AddOutput("core.a")
+	t2 := target.ForConfig("dbg")
+	assert.Equal(t, "dbg", t2.Label.Config)
+	assert.Equal(t, []BuildInput{
+		BuildLabel{PackageName: "src/core", Name: "srcs", Config: "dbg"},
+		FileLabel{File: "core.go", Package: "src/core"},
+	}, t2.Sources)
+	// The tool is still built in the primary configuration.
+	assert.Equal(t, []BuildLabel{
+		{PackageName: "src/core", Name: "srcs", Config: "dbg"},
+		{PackageName: "src/tools", Name: "tool"},
+	}, t2.DeclaredDependencies())
+	// Changing the copy doesn't change the original.
+	t2.AddOutput("core.o")
+	assert.Equal(t, []string{"core.a"}, target.Outputs())
+}
+
+func TestOutDirForConfig(t *testing.T) {
+	target := NewBuildTarget(BuildLabel{PackageName: "src/core", Name: "core", Config: "dbg"})
+	assert.Equal(t, "plz-out/gen/@dbg/src/core", target.OutDir())
+	assert.Equal(t, "plz-out/tmp/@dbg/src/core/core._build", target.TmpDir())
+}
+
+func TestShareOutputs(t *testing.T) {
+	NewBuildState(1, nil, 4, DefaultConfiguration())
+	graph := NewGraph()
+	base := NewBuildTarget(ParseBuildLabel("//src/core:core", ""))
+	base.Command = "true"
+	graph.AddTarget(base)
+	variant := graph.AddTarget(base.ForConfig("dbg"))
+	// It has to wait for the base target.
+	assert.False(t, graph.AllDepsBuilt(variant))
+	base.SetState(Built)
+	assert.True(t, graph.AllDepsBuilt(variant))
+	assert.Equal(t, 0, len(variant.DeclaredDependencies()))
+	assert.True(t, graph.ShareOutputs(variant))
+	assert.Equal(t, base, variant.SharedWith())
+	assert.Equal(t, "plz-out/gen/src/core", variant.OutDir())
+}
+
+func TestShareOutputsDifferentCommand(t *testing.T) {
+	NewBuildState(1, nil, 4, DefaultConfiguration())
+	graph := NewGraph()
+	base := NewBuildTarget(ParseBuildLabel("//src/core:core", ""))
+	base.AddCommand("opt", "cc -O2")
+	base.AddCommand("dbg", "cc -g")
+	graph.AddTarget(base)
+	variant := graph.AddTarget(base.ForConfig("dbg"))
+	base.SetState(Built)
+	assert.False(t, graph.ShareOutputs(variant))
+	assert.Nil(t, variant.SharedWith())
+	assert.Equal(t, "plz-out/gen/@dbg/src/core", variant.OutDir())
+}
+
+func TestShareOutputsDifferentDependency(t *testing.T) {
+	NewBuildState(1, nil, 4, DefaultConfiguration())
+	graph := NewGraph()
+	dep := NewBuildTarget(ParseBuildLabel("//src/core:lib", ""))
+	dep.AddCommand("opt", "cc -O2")
+	dep.AddCommand("dbg", "cc -g")
+	base := NewBuildTarget(ParseBuildLabel("//src/core:core", ""))
+	base.Command = "true"
+	base.AddDependency(dep.Label)
+	graph.AddTarget(dep)
+	graph.AddTarget(base)
+	graph.AddDependency(base.Label, dep.Label)
+	depVariant := graph.AddTarget(dep.ForConfig("dbg"))
+	variant := graph.AddTarget(base.ForConfig("dbg"))
+	graph.AddDependency(variant.Label, depVariant.Label)
+	dep.SetState(Built)
+	base.SetState(Built)
+	assert.False(t, graph.ShareOutputs(depVariant))
+	depVariant.SetState(Built)
+	// Its command is the same but it depends on something that isn't.
+	assert.False(t, graph.ShareOutputs(variant))
+}
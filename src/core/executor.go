@@ -0,0 +1,85 @@
+// Support for running build actions, either locally or elsewhere.
+
+package core
+
+import (
+	"path"
+	"time"
+
+	"cli"
+)
+
+// An Executor runs build actions.
+// The default runs them on the local machine; alternatives (e.g. the remote executor in
+// src/remote) can farm them out to other machines.
+type Executor interface {
+	// Execute runs a single build action. Once it returns successfully the action's outputs
+	// will be present in its working directory.
+	// It returns the stdout of the command and its combined stdout and stderr.
+	Execute(action *BuildAction) ([]byte, []byte, error)
+	// Shutdown shuts down the executor, releasing any resources it holds.
+	Shutdown()
+}
+
+// A BuildAction describes a single command that's run to build a target.
+type BuildAction struct {
+	// The target being built.
+	Target *BuildTarget
+	// The command to run. It's run through bash in Dir.
+	Command string
+	// Environment variables for the command, as returned by BuildEnvironment.
+	Env []string
+	// Directory to run the command in, relative to the repo root.
+	Dir string
+	// Timeout for the command. DefaultTimeout is used if this is zero.
+	Timeout        time.Duration
+	DefaultTimeout cli.Duration
+	// True to print the command's output to stderr as it runs.
+	ShowOutput bool
+	// True to run the command in a sandbox.
+	Sandbox bool
+	// Source files of the action, paired with where they should appear for it.
+	Sources []SourcePair
+	// Tools that the action uses which are within the repo, relative to the repo root.
+	Tools []string
+	// Outputs that the action should create, relative to Dir.
+	Outputs []string
+}
+
+// NewBuildAction creates a new action for building the given target.
+func NewBuildAction(state *BuildState, target *BuildTarget, command string, env []string) *BuildAction {
+	action := &BuildAction{
+		Target:         target,
+		Command:        command,
+		Env:            env,
+		Dir:            target.TmpDir(),
+		Timeout:        target.BuildTimeout,
+		DefaultTimeout: state.Config.Build.Timeout,
+		ShowOutput:     state.ShowAllOutput,
+		Sandbox:        target.Sandbox,
+		Outputs:        target.Outputs(),
+	}
+	for source := range IterSources(state.Graph, target) {
+		action.Sources = append(action.Sources, source)
+	}
+	for _, tool := range target.Tools {
+		for _, p := range tool.FullPaths(state.Graph) {
+			// Tools outside the repo (e.g. ones found on the PATH) aren't ours to provide.
+			if !path.IsAbs(p) {
+				action.Tools = append(action.Tools, p)
+			}
+		}
+	}
+	return action
+}
+
+// LocalExecutor is the default Executor, which runs actions on the local machine.
+type LocalExecutor struct{}
+
+// Execute implements the Executor interface.
+func (e *LocalExecutor) Execute(action *BuildAction) ([]byte, []byte, error) {
+	return ExecWithTimeoutShell(action.Dir, action.Env, action.Timeout, action.DefaultTimeout, action.ShowOutput, action.Sandbox, action.Command)
+}
+
+// Shutdown implements the Executor interface.
+func (e *LocalExecutor) Shutdown() {}
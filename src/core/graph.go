@@ -10,8 +10,8 @@ import "sync"
 type BuildGraph struct {
 	// Map of all currently known targets by their label.
 	targets map[BuildLabel]*BuildTarget
-	// Map of all currently known packages.
-	packages map[string]*Package
+	// Map of all currently known packages, keyed by their package labels (see BuildLabel.PackageLabel).
+	packages map[BuildLabel]*Package
 	// Reverse dependencies that are pending on targets actually being added to the graph.
 	pendingRevDeps map[BuildLabel]map[BuildLabel]*BuildTarget
 	// Actual reverse dependencies
@@ -42,6 +42,9 @@ func (graph *BuildGraph) AddTarget(target *BuildTarget) *BuildTarget {
 		}
 		delete(graph.pendingRevDeps, target.Label) // Don't need any more
 	}
+	if target.Label.Config != "" {
+		graph.linkConfigVariant(target)
+	}
 	return target
 }
 
@@ -49,10 +52,10 @@ func (graph *BuildGraph) AddTarget(target *BuildTarget) *BuildTarget {
 func (graph *BuildGraph) AddPackage(pkg *Package) {
 	graph.mutex.Lock()
 	defer graph.mutex.Unlock()
-	if _, present := graph.packages[pkg.Name]; present {
-		panic("Attempt to readd existing package: " + pkg.Name)
+	if _, present := graph.packages[pkg.Label()]; present {
+		panic("Attempt to readd existing package: " + pkg.Label().String())
 	}
-	graph.packages[pkg.Name] = pkg
+	graph.packages[pkg.Label()] = pkg
 }
 
 // Target retrieves a target from the graph by label
@@ -71,18 +74,23 @@ func (graph *BuildGraph) TargetOrDie(label BuildLabel) *BuildTarget {
 	return target
 }
 
-// Package retrieves a package from the graph by name
+// Package retrieves a package for the host platform from the graph by name
 func (graph *BuildGraph) Package(name string) *Package {
+	return graph.PackageByLabel(BuildLabel{PackageName: name})
+}
+
+// PackageByLabel retrieves the package containing the given label from the graph.
+func (graph *BuildGraph) PackageByLabel(label BuildLabel) *Package {
 	graph.mutex.RLock()
 	defer graph.mutex.RUnlock()
-	return graph.packages[name]
+	return graph.packages[label.PackageLabel()]
 }
 
-// PackageOrDie retrieves a package by name, and dies if it can't be found.
-func (graph *BuildGraph) PackageOrDie(name string) *Package {
-	pkg := graph.Package(name)
+// PackageOrDie retrieves the package containing the given label, and dies if it can't be found.
+func (graph *BuildGraph) PackageOrDie(label BuildLabel) *Package {
+	pkg := graph.PackageByLabel(label)
 	if pkg == nil {
-		log.Fatalf("Package %s doesn't exist in graph", name)
+		log.Fatalf("Package %s doesn't exist in graph", label.PackageLabel())
 	}
 	return pkg
 }
@@ -110,8 +118,8 @@ func (graph *BuildGraph) PackageMap() map[string]*Package {
 	graph.mutex.RLock()
 	defer graph.mutex.RUnlock()
 	packages := make(map[string]*Package)
-	for name, pkg := range graph.packages {
-		packages[name] = pkg
+	for label, pkg := range graph.packages {
+		packages[label.String()] = pkg
 	}
 	return packages
 }
@@ -137,7 +145,7 @@ func (graph *BuildGraph) AddDependency(from BuildLabel, to BuildLabel) {
 func NewGraph() *BuildGraph {
 	graph := new(BuildGraph)
 	graph.targets = make(map[BuildLabel]*BuildTarget)
-	graph.packages = make(map[string]*Package)
+	graph.packages = make(map[BuildLabel]*Package)
 	graph.pendingRevDeps = make(map[BuildLabel]map[BuildLabel]*BuildTarget)
 	graph.revDeps = make(map[BuildLabel][]*BuildTarget)
 	return graph
@@ -0,0 +1,80 @@
+// Support for choosing the hash function used throughout the build.
+
+package core
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// hashFunctions maps the names of the hash functions we support to their constructors.
+var hashFunctions = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"blake2": newBlake2b,
+}
+
+// DefaultHashFunction is the hash function we use if one isn't configured.
+const DefaultHashFunction HashFunction = "sha1"
+
+// The currently selected hash function, its name and the size of its output.
+// Defaults to SHA-1 for compatibility.
+var newHash = sha1.New
+var hashFunctionName = string(DefaultHashFunction)
+var hashSize = sha1.Size
+
+// SetHashFunction sets the hash function to use for all subsequent hashing.
+// It returns an error if the name isn't one we know about.
+func SetHashFunction(name HashFunction) error {
+	f, present := hashFunctions[string(name)]
+	if !present {
+		return fmt.Errorf("Unknown hash function %s; must be one of %s", name, strings.Join(HashFunctions(), ", "))
+	}
+	newHash = f
+	hashFunctionName = string(name)
+	hashSize = f().Size()
+	return nil
+}
+
+// HashFunctions returns the names of all the hash functions we support, in sorted order.
+func HashFunctions() []string {
+	ret := make([]string, 0, len(hashFunctions))
+	for name := range hashFunctions {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// IsHashFunction returns true if the given name is one of our supported hash functions.
+func IsHashFunction(name string) bool {
+	_, present := hashFunctions[name]
+	return present
+}
+
+// HashFunctionName returns the name of the hash function currently in use.
+func HashFunctionName() string {
+	return hashFunctionName
+}
+
+// NewHash returns a new hash.Hash using the currently configured hash function.
+func NewHash() hash.Hash {
+	return newHash()
+}
+
+// HashSize returns the size in bytes of hashes produced by the currently configured hash function.
+func HashSize() int {
+	return hashSize
+}
+
+// newBlake2b returns a new unkeyed 256-bit BLAKE2b hash.
+func newBlake2b() hash.Hash {
+	h, _ := blake2b.New256(nil) // Can only fail if the key is too long.
+	return h
+}
@@ -13,6 +13,10 @@ import (
 type Package struct {
 	// Name of the package, ie. //spam/eggs
 	Name string
+	// Platform the package's targets are built for. Empty for the host.
+	Arch string
+	// Build configuration the package's targets are built for. Empty for the primary one.
+	Config string
 	// Filename of the build file that defined this package
 	Filename string
 	// Subincluded build defs files that this package imported
@@ -38,6 +42,11 @@ func NewPackage(name string) *Package {
 	return pkg
 }
 
+// Label returns the label identifying this package, ie. //spam/eggs:all.
+func (pkg *Package) Label() BuildLabel {
+	return BuildLabel{PackageName: pkg.Name, Name: "all", Arch: pkg.Arch, Config: pkg.Config}
+}
+
 // RegisterSubinclude adds a new subinclude to this package, guaranteeing uniqueness.
 func (pkg *Package) RegisterSubinclude(label BuildLabel) {
 	if !pkg.HasSubinclude(label) {
@@ -0,0 +1,76 @@
+// Resource-aware scheduling of build & test tasks.
+//
+// Each worker runs one task at a time, but tasks vary a lot in how much of the machine they
+// use; a big link step can use several cores and a lot of memory while a small genrule
+// barely registers. Targets can declare how many CPUs and how much memory they need and we
+// keep the running totals within the limits set in the config.
+
+package core
+
+import "sync"
+
+// ExclusiveLabel is the label that marks tests that must run on their own.
+const ExclusiveLabel = "exclusive"
+
+// A resourcePool tracks the resources used by the currently running tasks.
+type resourcePool struct {
+	// Limits on the total resources used. A memory limit of 0 means it's unlimited.
+	cpus, memory int
+	// Resources currently in use.
+	usedCpus, usedMemory int
+	// Tasks are granted resources strictly in the order they ask for them, otherwise a stream of
+	// small tasks could keep a large one waiting indefinitely.
+	nextTicket, serving int64
+	cond                *sync.Cond
+}
+
+func newResourcePool(cpus, memory int) *resourcePool {
+	return &resourcePool{cpus: cpus, memory: memory, cond: sync.NewCond(&sync.Mutex{})}
+}
+
+// usage returns the CPUs and memory that the given task needs.
+// These are capped at the limits so any task can always run on its own.
+func (pool *resourcePool) usage(target *BuildTarget, t TaskType) (int, int) {
+	cpus := target.Cpus
+	memory := target.Memory
+	if cpus <= 0 {
+		cpus = 1
+	}
+	if t == Test && target.HasLabel(ExclusiveLabel) {
+		cpus = pool.cpus
+		memory = pool.memory
+	}
+	if cpus > pool.cpus {
+		cpus = pool.cpus
+	}
+	if pool.memory <= 0 {
+		memory = 0
+	} else if memory > pool.memory {
+		memory = pool.memory
+	}
+	return cpus, memory
+}
+
+// acquire blocks until the given resources are available and then takes them.
+func (pool *resourcePool) acquire(cpus, memory int) {
+	pool.cond.L.Lock()
+	defer pool.cond.L.Unlock()
+	ticket := pool.nextTicket
+	pool.nextTicket++
+	for ticket != pool.serving || pool.usedCpus+cpus > pool.cpus || (pool.memory > 0 && pool.usedMemory+memory > pool.memory) {
+		pool.cond.Wait()
+	}
+	pool.serving++
+	pool.usedCpus += cpus
+	pool.usedMemory += memory
+	pool.cond.Broadcast() // The next task in line might fit as well.
+}
+
+// release returns resources previously taken by acquire.
+func (pool *resourcePool) release(cpus, memory int) {
+	pool.cond.L.Lock()
+	defer pool.cond.L.Unlock()
+	pool.usedCpus -= cpus
+	pool.usedMemory -= memory
+	pool.cond.Broadcast()
+}
@@ -0,0 +1,96 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResourceUsage(t *testing.T) {
+	pool := newResourcePool(8, 4096)
+	target := NewBuildTarget(ParseBuildLabel("//src/core:resources_test", ""))
+	cpus, memory := pool.usage(target, Build)
+	assert.Equal(t, 1, cpus)
+	assert.Equal(t, 0, memory)
+	target.Cpus = 4
+	target.Memory = 1024
+	cpus, memory = pool.usage(target, Build)
+	assert.Equal(t, 4, cpus)
+	assert.Equal(t, 1024, memory)
+	// Usage is capped at the limits so the target can still run.
+	target.Cpus = 16
+	target.Memory = 8192
+	cpus, memory = pool.usage(target, Build)
+	assert.Equal(t, 8, cpus)
+	assert.Equal(t, 4096, memory)
+}
+
+func TestResourceUsageNoMemoryLimit(t *testing.T) {
+	pool := newResourcePool(8, 0)
+	target := NewBuildTarget(ParseBuildLabel("//src/core:resources_test", ""))
+	target.Memory = 1024
+	_, memory := pool.usage(target, Build)
+	assert.Equal(t, 0, memory)
+}
+
+func TestResourceUsageExclusive(t *testing.T) {
+	pool := newResourcePool(8, 4096)
+	target := NewBuildTarget(ParseBuildLabel("//src/core:resources_test", ""))
+	target.AddLabel(ExclusiveLabel)
+	// Only applies to tests; it can build alongside other things.
+	cpus, memory := pool.usage(target, Build)
+	assert.Equal(t, 1, cpus)
+	assert.Equal(t, 0, memory)
+	cpus, memory = pool.usage(target, Test)
+	assert.Equal(t, 8, cpus)
+	assert.Equal(t, 4096, memory)
+}
+
+func TestResourceAcquireBlocks(t *testing.T) {
+	pool := newResourcePool(4, 0)
+	pool.acquire(3, 0)
+	acquired := make(chan struct{})
+	go func() {
+		pool.acquire(2, 0)
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquired resources that weren't available")
+	case <-time.After(50 * time.Millisecond):
+	}
+	pool.release(3, 0)
+	select {
+	case <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("failed to acquire resources after they were released")
+	}
+	assert.Equal(t, 2, pool.usedCpus)
+}
+
+func TestResourceAcquireInOrder(t *testing.T) {
+	pool := newResourcePool(4, 0)
+	pool.acquire(3, 0)
+	first := make(chan struct{})
+	go func() {
+		pool.acquire(4, 0)
+		close(first)
+	}()
+	time.Sleep(50 * time.Millisecond) // Make sure it's in line first.
+	second := make(chan struct{})
+	go func() {
+		pool.acquire(1, 0)
+		close(second)
+	}()
+	// The second task would fit but mustn't jump the queue ahead of the first.
+	select {
+	case <-second:
+		t.Fatal("task acquired resources out of order")
+	case <-time.After(50 * time.Millisecond):
+	}
+	pool.release(3, 0)
+	<-first
+	pool.release(4, 0)
+	<-second
+}
@@ -0,0 +1,63 @@
+// Support for running commands in a sandbox.
+//
+// The sandbox itself is implemented by a separate helper binary (see src/sandbox) which
+// uses Linux namespaces to give the command its own view of the filesystem and network.
+// Here we just work out what it needs to see and prefix the command with it.
+
+package core
+
+import (
+	"path"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+var sandboxWarning sync.Once
+
+// sandboxCommand returns the given command wrapped to run within the sandbox.
+// The command's working directory is writable within the sandbox; the directories on its
+// PATH, any absolute tools it uses and the configured system directories are visible
+// read-only, and nothing else is visible at all.
+func sandboxCommand(env, argv []string) []string {
+	if runtime.GOOS != "linux" || State == nil {
+		sandboxWarning.Do(func() {
+			log.Warning("Sandboxing is only supported on Linux, commands will not be sandboxed")
+		})
+		return argv
+	}
+	cmd := []string{ExpandHomePath(State.Config.Build.SandboxTool)}
+	for _, dir := range sandboxDirs(env, State.Config.Build.SandboxDirs) {
+		cmd = append(cmd, "-r", dir)
+	}
+	cmd = append(cmd, "--")
+	return append(cmd, argv...)
+}
+
+// sandboxDirs returns the set of directories & files that should be visible read-only within
+// the sandbox for a command with the given environment.
+func sandboxDirs(env, extra []string) []string {
+	dirs := []string{}
+	seen := map[string]bool{}
+	add := func(dir string) {
+		if dir = path.Clean(dir); path.IsAbs(dir) && !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	for _, e := range env {
+		if strings.HasPrefix(e, "PATH=") {
+			for _, dir := range strings.Split(strings.TrimPrefix(e, "PATH="), ":") {
+				add(dir)
+			}
+		} else if strings.HasPrefix(e, "TOOLS=") {
+			for _, tool := range strings.Fields(strings.TrimPrefix(e, "TOOLS=")) {
+				add(tool)
+			}
+		}
+	}
+	for _, dir := range extra {
+		add(ExpandHomePath(dir))
+	}
+	return dirs
+}
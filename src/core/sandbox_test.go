@@ -0,0 +1,26 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSandboxDirs(t *testing.T) {
+	env := []string{
+		"PATH=/usr/local/bin:/usr/bin:/bin:/usr/bin",
+		"TOOLS=/opt/tools/javac plz-out/bin/tool",
+		"SRCS=/wibble/wobble",
+	}
+	dirs := sandboxDirs(env, []string{"/etc", "/lib/", "relative"})
+	assert.Equal(t, []string{"/usr/local/bin", "/usr/bin", "/bin", "/opt/tools/javac", "/etc", "/lib"}, dirs)
+}
+
+func TestSandboxCommand(t *testing.T) {
+	config := DefaultConfiguration()
+	config.Build.SandboxTool = "/opt/please/please_sandbox"
+	config.Build.SandboxDirs = []string{"/etc"}
+	NewBuildState(1, nil, 1, config)
+	cmd := sandboxCommand([]string{"PATH=/bin"}, []string{"bash", "-c", "true"})
+	assert.Equal(t, []string{"/opt/please/please_sandbox", "-r", "/bin", "-r", "/etc", "--", "bash", "-c", "true"}, cmd)
+}
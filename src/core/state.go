@@ -35,10 +35,21 @@ type pendingTask struct {
 	Label    BuildLabel // Label of target to parse
 	Dependor BuildLabel // The target that depended on it (only for parse tasks)
 	Type     TaskType
+	Estimate float64 // Estimated time (in seconds) until everything depending on this task is done.
 }
 
 func (t pendingTask) Compare(that queue.Item) int {
-	return int((t.Type & priorityMask) - (that.(pendingTask).Type & priorityMask))
+	other := that.(pendingTask)
+	if diff := int((t.Type & priorityMask) - (other.Type & priorityMask)); diff != 0 {
+		return diff
+	}
+	// Among tasks of equal priority, start the longest ones first.
+	if t.Estimate > other.Estimate {
+		return -1
+	} else if t.Estimate < other.Estimate {
+		return 1
+	}
+	return 0
 }
 
 // Passed about to track the current state of the build.
@@ -50,6 +61,13 @@ type BuildState struct {
 	Results chan *BuildResult
 	// Configuration options
 	Config *Configuration
+	// Platform to build the original targets for (ie. 'plz build --arch'). Empty for the host.
+	Arch string
+	// Configuration for each platform we're cross-compiling for.
+	archConfigs map[string]*Configuration
+	// Further build configurations to build the original targets in, besides Config.Build.Config
+	// (ie. 'plz build -c opt -c dbg').
+	ExtraConfigs []string
 	// Hashes of variouts bits of the configuration, used for incrementality.
 	Hashes struct {
 		// Hash of the general config, not including specialised bits.
@@ -61,6 +79,8 @@ type BuildState struct {
 	Verbosity int
 	// Cache to store / retrieve old build results.
 	Cache *Cache
+	// Executor that runs build actions.
+	Executor Executor
 	// Targets that we were originally requested to build
 	OriginalTargets []BuildLabel
 	// Arguments to tests.
@@ -94,6 +114,22 @@ type BuildState struct {
 	ShowTestOutput bool
 	// True to print all output of all tasks to stderr.
 	ShowAllOutput bool
+	// True to build the original targets twice and check that their outputs are the same.
+	CheckDeterminism bool
+	// True to record why each target needed to be rebuilt (ie. 'plz build --explain').
+	Explain bool
+	// Explanations of why each target was rebuilt. Only populated if Explain is true.
+	explanations     map[BuildLabel]string
+	explanationMutex sync.Mutex
+	// Output of the workspace status command, populated the first time it's needed.
+	workspaceStatus     *WorkspaceStatus
+	workspaceStatusErr  error
+	workspaceStatusOnce sync.Once
+	// Tracks the resources used by running tasks so we don't overload the machine.
+	resources *resourcePool
+	// Memoised estimates of the critical path through each target, used to prioritise tasks.
+	criticalPaths     map[BuildLabel]float64
+	criticalPathMutex sync.Mutex
 	// Number of running workers
 	numWorkers int
 	// Experimental directory
@@ -137,6 +173,47 @@ func (state *BuildState) AddPendingTest(label BuildLabel) {
 	}
 }
 
+// estimate returns the estimated time for the given task, based on how long things took previously.
+// For tests that's just how long the test takes; for builds it's the longest path through the
+// target and anything depending on it, since we want to start things on the critical path first.
+func (state *BuildState) estimate(label BuildLabel, t TaskType) float64 {
+	if t == Test {
+		return Timings.Get(label).Test
+	}
+	state.criticalPathMutex.Lock()
+	defer state.criticalPathMutex.Unlock()
+	return state.criticalPath(label)
+}
+
+// criticalPath returns the estimated time to build & test the given target and everything that
+// depends on it. The criticalPathMutex must be held when calling it.
+// Estimates are memoised so won't reflect any reverse dependencies added after they're calculated;
+// since this is only a heuristic that's fine.
+func (state *BuildState) criticalPath(label BuildLabel) float64 {
+	if estimate, present := state.criticalPaths[label]; present {
+		return estimate
+	}
+	target := state.Graph.Target(label)
+	if target == nil {
+		return 0.0
+	}
+	state.criticalPaths[label] = 0.0 // Guards against infinite recursion if there's a cycle.
+	timing := Timings.Get(label)
+	estimate := timing.Build
+	if target.IsTest && state.NeedTests {
+		estimate += timing.Test
+	}
+	longest := 0.0
+	for _, revdep := range state.Graph.ReverseDependencies(target) {
+		if path := state.criticalPath(revdep.Label); path > longest {
+			longest = path
+		}
+	}
+	estimate += longest
+	state.criticalPaths[label] = estimate
+	return estimate
+}
+
 // NextTask receives the next task that should be processed according to the priority queues.
 func (state *BuildState) NextTask() (BuildLabel, BuildLabel, TaskType) {
 	t, err := state.pendingTasks.Get(1)
@@ -149,7 +226,7 @@ func (state *BuildState) NextTask() (BuildLabel, BuildLabel, TaskType) {
 
 func (state *BuildState) addPending(label BuildLabel, t TaskType) {
 	atomic.AddInt64(&state.numPending, 1)
-	state.pendingTasks.Put(pendingTask{Label: label, Type: t})
+	state.pendingTasks.Put(pendingTask{Label: label, Type: t, Estimate: state.estimate(label, t)})
 }
 
 // TaskDone indicates that a single task is finished. Should be called after one is finished with
@@ -180,10 +257,55 @@ func (state *BuildState) KillAll() {
 	state.Kill(state.numWorkers)
 }
 
+// AcquireResources blocks until there are enough resources available to run the given task, and
+// then takes them. ReleaseResources must be called with the same arguments once it's done.
+func (state *BuildState) AcquireResources(label BuildLabel, t TaskType) {
+	if target := state.Graph.Target(label); target != nil {
+		state.resources.acquire(state.resources.usage(target, t))
+	}
+}
+
+// ReleaseResources releases the resources taken by an earlier call to AcquireResources.
+func (state *BuildState) ReleaseResources(label BuildLabel, t TaskType) {
+	if target := state.Graph.Target(label); target != nil {
+		state.resources.release(state.resources.usage(target, t))
+	}
+}
+
+// cpuLimit returns the limit on the number of CPUs used by concurrently running tasks.
+// By default it's the number of threads, so each thread can run one ordinary task.
+func cpuLimit(config *Configuration, numThreads int) int {
+	if config.Build.Cpus > 0 {
+		return config.Build.Cpus
+	} else if numThreads > 0 {
+		return numThreads
+	}
+	return 1
+}
+
+// ExplainRebuild records the reason a target needed to be rebuilt.
+// If it's called more than once for the same target the latest reason wins.
+func (state *BuildState) ExplainRebuild(label BuildLabel, reason string) {
+	state.explanationMutex.Lock()
+	defer state.explanationMutex.Unlock()
+	state.explanations[label] = reason
+}
+
+// Explanations returns the reasons each target was rebuilt, as recorded by ExplainRebuild.
+func (state *BuildState) Explanations() map[BuildLabel]string {
+	state.explanationMutex.Lock()
+	defer state.explanationMutex.Unlock()
+	ret := make(map[BuildLabel]string, len(state.explanations))
+	for label, reason := range state.explanations {
+		ret[label] = reason
+	}
+	return ret
+}
+
 // IsOriginalTarget returns true if a target is an original target, ie. one specified on the command line.
 func (state *BuildState) IsOriginalTarget(label BuildLabel) bool {
 	for _, original := range state.OriginalTargets {
-		if original == label || (original.IsAllTargets() && original.PackageName == label.PackageName) {
+		if original == label || (original.IsAllTargets() && original.PackageLabel() == label.PackageLabel()) {
 			return true
 		}
 	}
@@ -204,7 +326,12 @@ func (state *BuildState) SetIncludeAndExclude(include, exclude []string) {
 }
 
 // AddOriginalTarget adds one of the original targets and enqueues it for parsing / building.
+// If we're cross-compiling it's built for the requested platform unless it specifies one,
+// and it's built in each of the configurations we're building in.
 func (state *BuildState) AddOriginalTarget(label BuildLabel) {
+	if label.Arch == "" {
+		label = label.ForArch(state.Arch)
+	}
 	// Check it's not excluded first.
 	for _, e := range state.ExcludeTargets {
 		if e.includes(label) {
@@ -213,6 +340,10 @@ func (state *BuildState) AddOriginalTarget(label BuildLabel) {
 	}
 	state.OriginalTargets = append(state.OriginalTargets, label)
 	state.AddPendingParse(label, OriginalTarget, false)
+	for _, config := range state.ExtraConfigs {
+		state.OriginalTargets = append(state.OriginalTargets, label.ForConfig(config))
+		state.AddPendingParse(label.ForConfig(config), OriginalTarget, false)
+	}
 }
 
 func (state *BuildState) LogBuildResult(tid int, label BuildLabel, status BuildResultStatus, description string) {
@@ -266,7 +397,7 @@ func (state *BuildState) ExpandOriginalTargets() BuildLabels {
 	ret := BuildLabels{}
 	for _, label := range state.OriginalTargets {
 		if label.IsAllTargets() {
-			for _, target := range state.Graph.PackageOrDie(label.PackageName).Targets {
+			for _, target := range state.Graph.PackageOrDie(label).Targets {
 				if target.ShouldInclude(state.Include, state.Exclude) && (!state.NeedTests || target.IsTest) {
 					ret = append(ret, target.Label)
 				}
@@ -287,14 +418,21 @@ func NewBuildState(numThreads int, cache *Cache, verbosity int, config *Configur
 		Config:            config,
 		Verbosity:         verbosity,
 		Cache:             cache,
+		Executor:          &LocalExecutor{},
 		VerifyHashes:      true,
 		NeedBuild:         true,
 		numActive:         1, // One for the initial target adding on the main thread.
 		numPending:        1,
 		Coverage:          TestCoverage{Files: map[string][]LineCoverage{}},
+		criticalPaths:     map[BuildLabel]float64{},
+		explanations:      map[BuildLabel]string{},
+		resources:         newResourcePool(cpuLimit(config, numThreads), config.Build.Memory),
 		numWorkers:        numThreads,
 		experimentalLabel: BuildLabel{PackageName: config.Please.ExperimentalDir, Name: "..."},
 	}
+	if err := SetHashFunction(config.Build.HashFunction); err != nil {
+		log.Fatalf("%s", err)
+	}
 	State.Hashes.Config = config.Hash()
 	State.Hashes.Containerisation = config.ContainerisationHash()
 	return State
@@ -371,10 +509,36 @@ type Cache interface {
 	RetrieveExtra(target *BuildTarget, key []byte, file string) bool
 	// Cleans any artifacts associated with this target from the cache, for any possible key.
 	Clean(target *BuildTarget)
+	// Lists the keys that artifacts for this target are stored under in the cache.
+	List(target *BuildTarget) []CacheEntry
+	// Removes the artifacts stored for this target under a single key from the cache.
+	Evict(target *BuildTarget, key []byte)
+	// Returns statistics about the contents of the cache, one for each cache it's made up of.
+	Stats() []CacheStats
 	// Shuts down the cache, blocking until any potentially pending requests are done.
 	Shutdown()
 }
 
+// A CacheEntry describes a set of artifacts for a target stored in a cache.
+type CacheEntry struct {
+	// Description of the cache they're stored in.
+	Cache string
+	// Key they're stored under.
+	Key []byte
+}
+
+// CacheStats describes the contents of a single cache.
+type CacheStats struct {
+	// Description of the cache.
+	Cache string
+	// Number of sets of artifacts stored in it.
+	Entries int
+	// Total size of them, in bytes.
+	Size int64
+	// Set if the stats couldn't be retrieved.
+	Err error
+}
+
 // This is a pretty simple coverage format; we record one int for each line
 // stating what its coverage is.
 type TestCoverage struct {
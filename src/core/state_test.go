@@ -59,7 +59,7 @@ func TestMergeCoverageLines8(t *testing.T) {
 
 func TestExpandOriginalTargets(t *testing.T) {
 	state := NewBuildState(1, nil, 4, DefaultConfiguration())
-	state.OriginalTargets = []BuildLabel{{"src/core", "all"}, {"src/parse", "parse"}}
+	state.OriginalTargets = []BuildLabel{{PackageName: "src/core", Name: "all"}, {PackageName: "src/parse", Name: "parse"}}
 	state.Include = []string{"go"}
 	state.Exclude = []string{"py"}
 
@@ -77,14 +77,14 @@ func TestExpandOriginalTargets(t *testing.T) {
 	// //src/parse:parse doesn't have 'go' but was explicitly requested so will be
 	// added anyway.
 	assert.Equal(t, state.ExpandOriginalTargets(), BuildLabels{
-		{"src/core", "target1"},
-		{"src/parse", "parse"},
+		{PackageName: "src/core", Name: "target1"},
+		{PackageName: "src/parse", Name: "parse"},
 	})
 }
 
 func TestExpandOriginalTestTargets(t *testing.T) {
 	state := NewBuildState(1, nil, 4, DefaultConfiguration())
-	state.OriginalTargets = []BuildLabel{{"src/core", "all"}}
+	state.OriginalTargets = []BuildLabel{{PackageName: "src/core", Name: "all"}}
 	state.NeedTests = true
 	state.Include = []string{"go"}
 	state.Exclude = []string{"py"}
@@ -96,7 +96,7 @@ func TestExpandOriginalTestTargets(t *testing.T) {
 	addTarget(state, "//src/core:target4_test", "go", "manual")
 	// Only the one target comes out here; it must be a test and otherwise follows
 	// the same include / exclude logic as the previous test.
-	assert.Equal(t, state.ExpandOriginalTargets(), BuildLabels{{"src/core", "target1_test"}})
+	assert.Equal(t, state.ExpandOriginalTargets(), BuildLabels{{PackageName: "src/core", Name: "target1_test"}})
 }
 
 func TestComparePendingTasks(t *testing.T) {
@@ -143,3 +143,13 @@ func addTarget(state *BuildState, name string, labels ...string) {
 	pkg.Targets[target.Label.Name] = target
 	state.Graph.AddTarget(target)
 }
+
+func TestPendingTaskOrdering(t *testing.T) {
+	short := pendingTask{Type: Test, Estimate: 1.0}
+	long := pendingTask{Type: Build, Estimate: 10.0}
+	subinclude := pendingTask{Type: SubincludeBuild}
+	assert.True(t, long.Compare(short) < 0, "Longer tasks should go first")
+	assert.True(t, short.Compare(long) > 0)
+	assert.True(t, subinclude.Compare(long) < 0, "Subincludes should go first regardless of estimate")
+	assert.Equal(t, 0, short.Compare(pendingTask{Type: Parse, Estimate: 1.0}))
+}
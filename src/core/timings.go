@@ -0,0 +1,213 @@
+// Persistent database of how long targets take to build and test.
+//
+// We use this to start the longest tasks first, since a build that's dominated by a few
+// slow tests finishes much sooner if they're started early rather than once everything
+// else is done. It's also available to users via 'plz query slowest'.
+
+package core
+
+import (
+	"bytes"
+	"encoding/gob"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// timingDBFile is the file we store the timing database in.
+const timingDBFile = "plz-out/.timing_db"
+
+// timingDBMaxAge is how long entries are kept without being updated before they're dropped.
+const timingDBMaxAge = 30 * 24 * time.Hour
+
+// timingWeight is the weight given to a new timing relative to the existing average.
+// Timings vary a fair bit from run to run so we smooth them out rather than taking the latest.
+const timingWeight = 0.5
+
+// A TargetTiming records how long a target has historically taken.
+type TargetTiming struct {
+	Label BuildLabel
+	// Average time the target took to build and to test, in seconds.
+	// These are zero if it's never been built / tested (or was always retrieved from the cache).
+	Build, Test float64
+	// Unix time this entry was last updated.
+	LastUpdated int64
+}
+
+// Total returns the total time the target takes to build and test.
+func (timing *TargetTiming) Total() float64 {
+	return timing.Build + timing.Test
+}
+
+// A TimingDB is the in-memory form of the timing database.
+type TimingDB struct {
+	filename string
+	entries  map[BuildLabel]*TargetTiming
+	// Labels whose entries we've updated during this invocation.
+	dirty    map[BuildLabel]bool
+	mutex    sync.Mutex
+	loadOnce sync.Once
+}
+
+// Timings is the singleton instance of the timing database.
+var Timings = NewTimingDB(timingDBFile)
+
+// NewTimingDB creates a new timing database backed by the given file.
+// It isn't read until it's first needed.
+func NewTimingDB(filename string) *TimingDB {
+	return &TimingDB{filename: filename, dirty: map[BuildLabel]bool{}}
+}
+
+// Get returns the historical timing for the given target. It's all zeroes if we have none.
+func (db *TimingDB) Get(label BuildLabel) TargetTiming {
+	db.loadOnce.Do(db.load)
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if entry, present := db.entries[label]; present {
+		return *entry
+	}
+	return TargetTiming{Label: label}
+}
+
+// RecordBuild records the time it took to build a target.
+func (db *TimingDB) RecordBuild(label BuildLabel, duration time.Duration) {
+	db.record(label, func(entry *TargetTiming) { entry.Build = average(entry.Build, duration.Seconds()) })
+}
+
+// RecordTest records the time it took to test a target.
+func (db *TimingDB) RecordTest(label BuildLabel, duration time.Duration) {
+	db.record(label, func(entry *TargetTiming) { entry.Test = average(entry.Test, duration.Seconds()) })
+}
+
+func (db *TimingDB) record(label BuildLabel, f func(*TargetTiming)) {
+	db.loadOnce.Do(db.load)
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	entry, present := db.entries[label]
+	if !present {
+		entry = &TargetTiming{Label: label}
+		db.entries[label] = entry
+	}
+	f(entry)
+	entry.LastUpdated = time.Now().Unix()
+	db.dirty[label] = true
+}
+
+// average returns the new average timing given the old one and a new sample.
+func average(old, sample float64) float64 {
+	if old == 0.0 {
+		return sample
+	}
+	return old*(1.0-timingWeight) + sample*timingWeight
+}
+
+// Slowest returns up to n of the slowest targets, slowest first. If n is zero it returns all of them.
+func (db *TimingDB) Slowest(n int) []TargetTiming {
+	db.loadOnce.Do(db.load)
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	ret := make(targetTimings, 0, len(db.entries))
+	for _, entry := range db.entries {
+		ret = append(ret, *entry)
+	}
+	sort.Sort(ret)
+	if n > 0 && n < len(ret) {
+		return ret[:n]
+	}
+	return ret
+}
+
+// targetTimings sorts timings with the slowest first.
+type targetTimings []TargetTiming
+
+func (slice targetTimings) Len() int {
+	return len(slice)
+}
+func (slice targetTimings) Less(i, j int) bool {
+	if slice[i].Total() != slice[j].Total() {
+		return slice[i].Total() > slice[j].Total()
+	}
+	return slice[i].Label.Less(slice[j].Label)
+}
+func (slice targetTimings) Swap(i, j int) {
+	slice[i], slice[j] = slice[j], slice[i]
+}
+
+// load loads the database from disk.
+func (db *TimingDB) load() {
+	db.entries = db.read()
+}
+
+// read reads the current contents of the database on disk. It returns an empty map if it doesn't exist.
+func (db *TimingDB) read() map[BuildLabel]*TargetTiming {
+	entries := map[BuildLabel]*TargetTiming{}
+	f, err := os.Open(db.filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warning("Failed to open timing database: %s", err)
+		}
+		return entries
+	}
+	defer f.Close()
+	timings := []*TargetTiming{}
+	if err := gob.NewDecoder(f).Decode(&timings); err != nil {
+		log.Warning("Failed to read timing database, will recreate it: %s", err)
+		return entries
+	}
+	for _, timing := range timings {
+		entries[timing.Label] = timing
+	}
+	return entries
+}
+
+// Save writes any entries updated during this invocation back to disk.
+// Like the file hash database, it merges with whatever's on disk under an exclusive lock
+// so it's safe for concurrent plz processes to call it.
+func (db *TimingDB) Save() error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if len(db.dirty) == 0 {
+		return nil
+	}
+	lock, err := os.OpenFile(db.filename+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+	entries := db.read()
+	for label := range db.dirty {
+		entries[label] = db.entries[label]
+	}
+	threshold := time.Now().Add(-timingDBMaxAge).Unix()
+	timings := make([]*TargetTiming, 0, len(entries))
+	for label, entry := range entries {
+		if entry.LastUpdated < threshold {
+			delete(entries, label)
+		} else {
+			timings = append(timings, entry)
+		}
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(timings); err != nil {
+		return err
+	}
+	if err := WriteFile(&buf, db.filename, 0644); err != nil {
+		return err
+	}
+	db.entries = entries
+	db.dirty = map[BuildLabel]bool{}
+	return nil
+}
+
+// SaveTimings writes the timing database to disk. It should be called at the end of a build.
+func SaveTimings() {
+	if err := Timings.Save(); err != nil {
+		log.Warning("Failed to save timing database: %s", err)
+	}
+}
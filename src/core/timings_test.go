@@ -0,0 +1,51 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimingsAverage(t *testing.T) {
+	db := NewTimingDB("plz-out/.timing_db_test")
+	label := ParseBuildLabel("//src/core:timings_test", "")
+	db.RecordBuild(label, 10*time.Second)
+	assert.Equal(t, 10.0, db.Get(label).Build)
+	db.RecordBuild(label, 20*time.Second)
+	assert.Equal(t, 15.0, db.Get(label).Build)
+	assert.Equal(t, 0.0, db.Get(label).Test)
+}
+
+func TestTimingsSlowest(t *testing.T) {
+	db := NewTimingDB("plz-out/.timing_db_test")
+	label1 := ParseBuildLabel("//src/core:slow", "")
+	label2 := ParseBuildLabel("//src/core:slower", "")
+	label3 := ParseBuildLabel("//src/core:slowest", "")
+	db.RecordBuild(label1, 1*time.Second)
+	db.RecordTest(label2, 5*time.Second)
+	db.RecordBuild(label3, 5*time.Second)
+	db.RecordTest(label3, 5*time.Second)
+	slowest := db.Slowest(2)
+	assert.Equal(t, 2, len(slowest))
+	assert.Equal(t, label3, slowest[0].Label)
+	assert.Equal(t, label2, slowest[1].Label)
+	assert.Equal(t, 3, len(db.Slowest(0)))
+}
+
+func TestTimingsSaveAndLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timings_test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "timing_db")
+	label := ParseBuildLabel("//src/core:timings_test", "")
+	db := NewTimingDB(filename)
+	db.RecordTest(label, 3*time.Second)
+	assert.NoError(t, db.Save())
+
+	db = NewTimingDB(filename)
+	assert.Equal(t, 3.0, db.Get(label).Test)
+}
@@ -3,7 +3,6 @@ package core
 import (
 	"bytes"
 	"context"
-	"crypto/sha1"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -214,11 +213,15 @@ func (sb *safeBuffer) Bytes() []byte {
 // ExecWithTimeout runs an external command with a timeout.
 // If the command times out the returned error will be a context.DeadlineExceeded error.
 // If showOutput is true then output will be printed to stderr as well as returned.
+// If sandbox is true then the command is run in a sandbox (see sandboxCommand).
 // It returns the stdout only, combined stdout and stderr and any error that occurred.
-func ExecWithTimeout(dir string, env []string, timeout time.Duration, defaultTimeout cli.Duration, showOutput bool, argv []string) ([]byte, []byte, error) {
+func ExecWithTimeout(dir string, env []string, timeout time.Duration, defaultTimeout cli.Duration, showOutput, sandbox bool, argv []string) ([]byte, []byte, error) {
 	if timeout == 0 {
 		timeout = time.Duration(defaultTimeout)
 	}
+	if sandbox {
+		argv = sandboxCommand(env, argv)
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
@@ -241,25 +244,26 @@ func ExecWithTimeout(dir string, env []string, timeout time.Duration, defaultTim
 // ExecWithTimeoutShell runs an external command within a Bash shell.
 // Other arguments are as ExecWithTimeout.
 // Note that the command is deliberately a single string.
-func ExecWithTimeoutShell(dir string, env []string, timeout time.Duration, defaultTimeout cli.Duration, showOutput bool, cmd string) ([]byte, []byte, error) {
+func ExecWithTimeoutShell(dir string, env []string, timeout time.Duration, defaultTimeout cli.Duration, showOutput, sandbox bool, cmd string) ([]byte, []byte, error) {
 	c := append([]string{"bash", "-u", "-o", "pipefail", "-c"}, cmd)
-	return ExecWithTimeout(dir, env, timeout, defaultTimeout, showOutput, c)
+	return ExecWithTimeout(dir, env, timeout, defaultTimeout, showOutput, sandbox, c)
 }
 
 // ExecWithTimeoutSimple runs an external command with a timeout.
 // It's a simpler version of ExecWithTimeout that gives less control.
 func ExecWithTimeoutSimple(timeout cli.Duration, cmd ...string) ([]byte, error) {
-	_, out, err := ExecWithTimeout("", nil, time.Duration(timeout), timeout, false, cmd)
+	_, out, err := ExecWithTimeout("", nil, time.Duration(timeout), timeout, false, false, cmd)
 	return out, err
 }
 
-type sourcePair struct{ Src, Tmp string }
+// A SourcePair is a source file and the location it should be linked to in a rule's temp directory.
+type SourcePair struct{ Src, Tmp string }
 
 // IterSources returns all the sources for a function, allowing for sources that are other rules
 // and rules that require transitive dependencies.
 // Yielded values are pairs of the original source location and its temporary location for this rule.
-func IterSources(graph *BuildGraph, target *BuildTarget) <-chan sourcePair {
-	ch := make(chan sourcePair)
+func IterSources(graph *BuildGraph, target *BuildTarget) <-chan SourcePair {
+	ch := make(chan SourcePair)
 	done := map[BuildLabel]bool{}
 	donePaths := map[string]bool{}
 	tmpDir := target.TmpDir()
@@ -272,7 +276,7 @@ func IterSources(graph *BuildGraph, target *BuildTarget) <-chan sourcePair {
 					fullPaths := providedSource.FullPaths(graph)
 					for i, sourcePath := range providedSource.Paths(graph) {
 						tmpPath := path.Join(tmpDir, sourcePath)
-						ch <- sourcePair{fullPaths[i], tmpPath}
+						ch <- SourcePair{fullPaths[i], tmpPath}
 						donePaths[tmpPath] = true
 					}
 				}
@@ -284,7 +288,7 @@ func IterSources(graph *BuildGraph, target *BuildTarget) <-chan sourcePair {
 				depPath := path.Join(outDir, dep)
 				tmpPath := path.Join(tmpDir, dependency.Label.PackageName, dep)
 				if !donePaths[tmpPath] {
-					ch <- sourcePair{depPath, tmpPath}
+					ch <- SourcePair{depPath, tmpPath}
 					donePaths[tmpPath] = true
 				}
 			}
@@ -361,9 +365,9 @@ func recursivelyProvideSource(graph *BuildGraph, target *BuildTarget, src BuildI
 }
 
 // Yields all the runtime files for a rule (outputs & data files), similar to above.
-func IterRuntimeFiles(graph *BuildGraph, target *BuildTarget, absoluteOuts bool) <-chan sourcePair {
+func IterRuntimeFiles(graph *BuildGraph, target *BuildTarget, absoluteOuts bool) <-chan SourcePair {
 	done := map[string]bool{}
-	ch := make(chan sourcePair)
+	ch := make(chan SourcePair)
 
 	makeOut := func(out string) string {
 		if absoluteOuts {
@@ -376,7 +380,7 @@ func IterRuntimeFiles(graph *BuildGraph, target *BuildTarget, absoluteOuts bool)
 	pushOut := func(src, out string) {
 		out = makeOut(out)
 		if !done[out] {
-			ch <- sourcePair{src, out}
+			ch <- SourcePair{src, out}
 			done[out] = true
 		}
 	}
@@ -481,7 +485,7 @@ func PrepareSource(sourcePath string, tmpPath string) error {
 	return RecursiveCopyFile(sourcePath, tmpPath, 0, true, true)
 }
 
-func PrepareSourcePair(pair sourcePair) error {
+func PrepareSourcePair(pair SourcePair) error {
 	if path.IsAbs(pair.Src) {
 		return PrepareSource(pair.Src, pair.Tmp)
 	}
@@ -492,24 +496,42 @@ func PostBuildOutputFileName(target *BuildTarget) string {
 	return ".build_output_" + target.Label.Name
 }
 
+// OutputHashFileName returns the name of the file that the hash of a target's outputs is stored
+// in alongside its artifacts in the cache, so they can be verified later.
+func OutputHashFileName(target *BuildTarget) string {
+	return ".output_hash_" + target.Label.Name
+}
+
+// JoinWithin joins a relative path onto the given root directory. It returns an error if the
+// path is absolute or refers to something outside the root once it's been cleaned, which is
+// important when the path has come from somewhere we don't entirely trust.
+func JoinWithin(root, p string) (string, error) {
+	clean := path.Clean(p)
+	if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("Path %s is not within %s", p, root)
+	}
+	return path.Join(root, clean), nil
+}
+
 // CollapseHash combines our usual four-part hash into one by XOR'ing them together.
 // This helps keep things short in places where sometimes we get complaints about filenames being too long (?)
 // and where we don't especially care about breaking out the individual parts of hashes, which
 // is important for many parts of the system.
 func CollapseHash(key []byte) []byte {
-	short := [sha1.Size]byte{}
+	size := len(key) / 4
+	short := make([]byte, size)
 	// We store the rule hash twice, if it's repeated we must make sure not to xor it
 	// against itself.
-	if bytes.Equal(key[0:sha1.Size], key[sha1.Size:2*sha1.Size]) {
-		for i := 0; i < sha1.Size; i++ {
-			short[i] = key[i] ^ key[i+2*sha1.Size] ^ key[i+3*sha1.Size]
+	if bytes.Equal(key[0:size], key[size:2*size]) {
+		for i := 0; i < size; i++ {
+			short[i] = key[i] ^ key[i+2*size] ^ key[i+3*size]
 		}
 	} else {
-		for i := 0; i < sha1.Size; i++ {
-			short[i] = key[i] ^ key[i+sha1.Size] ^ key[i+2*sha1.Size] ^ key[i+3*sha1.Size]
+		for i := 0; i < size; i++ {
+			short[i] = key[i] ^ key[i+size] ^ key[i+2*size] ^ key[i+3*size]
 		}
 	}
-	return short[:]
+	return short
 }
 
 // LookPath does roughly the same as exec.LookPath, i.e. looks for the named file on the path.
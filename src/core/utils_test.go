@@ -3,6 +3,7 @@ package core
 import (
 	"context"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/base64"
 	"io/ioutil"
 	"os"
@@ -30,6 +31,29 @@ func TestCollapseHash(t *testing.T) {
 	assert.NotEqual(t, output1, output2)
 }
 
+func TestCollapseHashSHA256(t *testing.T) {
+	input := [sha256.Size * 4]byte{}
+	for i := 0; i < sha256.Size; i++ {
+		input[i] = byte(i)
+	}
+	output := CollapseHash(input[:])
+	assert.Equal(t, sha256.Size, len(output))
+	assert.Equal(t, input[:sha256.Size], output)
+}
+
+func TestSetHashFunction(t *testing.T) {
+	defer SetHashFunction(DefaultHashFunction)
+	assert.Equal(t, sha1.Size, HashSize())
+	assert.NoError(t, SetHashFunction("sha256"))
+	assert.Equal(t, sha256.Size, HashSize())
+	assert.Equal(t, sha256.Size, len(NewHash().Sum(nil)))
+	assert.Equal(t, "sha256", HashFunctionName())
+	assert.NoError(t, SetHashFunction("blake2"))
+	assert.Equal(t, 32, HashSize())
+	assert.Error(t, SetHashFunction("md5"))
+	assert.Equal(t, "blake2", HashFunctionName(), "Should be unchanged after an error")
+}
+
 func TestCollapseHash2(t *testing.T) {
 	// Test of a couple of cases that weren't different...
 	input1, err1 := base64.URLEncoding.DecodeString("mByUsoTswXV2X_W6FHhBwJUCQM-YHJSyhOzBdXZf9boUeEHAlQJAz-DzaA7MCXxt5_FFws2WO51vKlqt-JThKzdEQn_bghpDDCuKOI9qGNI=")
@@ -43,47 +67,47 @@ func TestCollapseHash2(t *testing.T) {
 
 func TestIterSources(t *testing.T) {
 	graph := buildGraph()
-	iterSources := func(label string) []sourcePair {
+	iterSources := func(label string) []SourcePair {
 		return toSlice(IterSources(graph, graph.TargetOrDie(ParseBuildLabel(label, ""))))
 	}
 
-	assert.Equal(t, []sourcePair{
+	assert.Equal(t, []SourcePair{
 		{"src/core/target1.go", "plz-out/tmp/src/core/target1._build/src/core/target1.go"},
 	}, iterSources("//src/core:target1"))
 
-	assert.Equal(t, []sourcePair{
+	assert.Equal(t, []SourcePair{
 		{"src/core/target2.go", "plz-out/tmp/src/core/target2._build/src/core/target2.go"},
 		{"plz-out/gen/src/core/target1.a", "plz-out/tmp/src/core/target2._build/src/core/target1.a"},
 	}, iterSources("//src/core:target2"))
 
-	assert.Equal(t, []sourcePair{
+	assert.Equal(t, []SourcePair{
 		{"src/build/target1.go", "plz-out/tmp/src/build/target1._build/src/build/target1.go"},
 		{"plz-out/gen/src/core/target1.a", "plz-out/tmp/src/build/target1._build/src/core/target1.a"},
 	}, iterSources("//src/build:target1"))
 
-	assert.Equal(t, []sourcePair{
+	assert.Equal(t, []SourcePair{
 		{"src/output/output1.go", "plz-out/tmp/src/output/output1._build/src/output/output1.go"},
 		{"plz-out/gen/src/build/target1.a", "plz-out/tmp/src/output/output1._build/src/build/target1.a"},
 	}, iterSources("//src/output:output1"))
 
-	assert.Equal(t, []sourcePair{
+	assert.Equal(t, []SourcePair{
 		{"src/output/output1.go", "plz-out/tmp/src/output/output1._build/src/output/output1.go"},
 		{"plz-out/gen/src/build/target1.a", "plz-out/tmp/src/output/output1._build/src/build/target1.a"},
 	}, iterSources("//src/output:output1"))
 
-	assert.Equal(t, []sourcePair{
+	assert.Equal(t, []SourcePair{
 		{"src/output/output2.go", "plz-out/tmp/src/output/output2._build/src/output/output2.go"},
 		{"plz-out/gen/src/core/target2.a", "plz-out/tmp/src/output/output2._build/src/core/target2.a"},
 		{"plz-out/gen/src/output/output1.a", "plz-out/tmp/src/output/output2._build/src/output/output1.a"},
 	}, iterSources("//src/output:output2"))
 
-	assert.Equal(t, []sourcePair{
+	assert.Equal(t, []SourcePair{
 		{"src/parse/target1.go", "plz-out/tmp/src/parse/target1._build/src/parse/target1.go"},
 		{"plz-out/gen/src/core/target2.a", "plz-out/tmp/src/parse/target1._build/src/core/target2.a"},
 		{"plz-out/gen/src/core/target1.a", "plz-out/tmp/src/parse/target1._build/src/core/target1.a"},
 	}, iterSources("//src/parse:target1"))
 
-	assert.Equal(t, []sourcePair{
+	assert.Equal(t, []SourcePair{
 		{"src/parse/target2.go", "plz-out/tmp/src/parse/target2._build/src/parse/target2.go"},
 		{"plz-out/gen/src/parse/target1.a", "plz-out/tmp/src/parse/target2._build/src/parse/target1.a"},
 	}, iterSources("//src/parse:target2"))
@@ -175,14 +199,14 @@ func TestExecWithTimeoutDeadline(t *testing.T) {
 }
 
 func TestExecWithTimeoutOutput(t *testing.T) {
-	out, stderr, err := ExecWithTimeoutShell("", nil, tenSecondsTime, tenSeconds, false, "echo hello")
+	out, stderr, err := ExecWithTimeoutShell("", nil, tenSecondsTime, tenSeconds, false, false, "echo hello")
 	assert.NoError(t, err)
 	assert.Equal(t, "hello\n", string(out))
 	assert.Equal(t, "hello\n", string(stderr))
 }
 
 func TestExecWithTimeoutStderr(t *testing.T) {
-	out, stderr, err := ExecWithTimeoutShell("", nil, tenSecondsTime, tenSeconds, false, "echo hello 1>&2")
+	out, stderr, err := ExecWithTimeoutShell("", nil, tenSecondsTime, tenSeconds, false, false, "echo hello 1>&2")
 	assert.NoError(t, err)
 	assert.Equal(t, "", string(out))
 	assert.Equal(t, "hello\n", string(stderr))
@@ -226,10 +250,30 @@ func makeTarget(graph *BuildGraph, label string, deps ...string) *BuildTarget {
 	return target
 }
 
-func toSlice(ch <-chan sourcePair) []sourcePair {
-	ret := []sourcePair{}
+func toSlice(ch <-chan SourcePair) []SourcePair {
+	ret := []SourcePair{}
 	for x := range ch {
 		ret = append(ret, x)
 	}
 	return ret
 }
+
+func TestJoinWithin(t *testing.T) {
+	p, err := JoinWithin("root", "a/b")
+	assert.NoError(t, err)
+	assert.Equal(t, "root/a/b", p)
+	p, err = JoinWithin("root", "a/../b")
+	assert.NoError(t, err)
+	assert.Equal(t, "root/b", p)
+	p, err = JoinWithin("root", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "root", p)
+	_, err = JoinWithin("root", "/etc/passwd")
+	assert.Error(t, err)
+	_, err = JoinWithin("root", "../b")
+	assert.Error(t, err)
+	_, err = JoinWithin("root", "a/../../b")
+	assert.Error(t, err)
+	_, err = JoinWithin("root", "..")
+	assert.Error(t, err)
+}
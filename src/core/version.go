@@ -3,3 +3,6 @@ package core
 import "github.com/coreos/go-semver/semver"
 
 var PleaseVersion = *semver.New("1.0.9999")
+
+// GitCommit is the git revision Please was built from. It's set at link time when stamped.
+var GitCommit string
@@ -0,0 +1,104 @@
+// Support for stamping builds with information about the workspace.
+//
+// The workspace status command is run once per build (up front, so a failure is reported once)
+// and prints one key / value pair per line, separated by the first space, for example:
+//   STABLE_GIT_COMMIT 0123456789abcdef
+//   BUILD_TIMESTAMP 1500000000
+// Each of these is exposed as an environment variable to targets marked with stamp=True.
+// Keys prefixed with STABLE_ are included in the rule hash of those targets so they're rebuilt
+// when the values change; the rest are volatile and won't cause a rebuild on their own, so the
+// values in a cached output might be out of date.
+
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// StablePrefix is the prefix of keys from the workspace status command that are considered stable.
+const StablePrefix = "STABLE_"
+
+var workspaceStatusKey = regexp.MustCompile("^[A-Z_][A-Z0-9_]*$")
+
+// A WorkspaceStatus holds the key / value pairs output by the workspace status command.
+type WorkspaceStatus struct {
+	Stable, Volatile map[string]string
+}
+
+// WorkspaceStatus returns the output of the configured workspace status command, running it if
+// it hasn't been already. If the command failed, every call returns the same error.
+// If there's no command configured it returns an empty status.
+func (state *BuildState) WorkspaceStatus() (*WorkspaceStatus, error) {
+	state.workspaceStatusOnce.Do(func() {
+		state.workspaceStatus, state.workspaceStatusErr = runWorkspaceStatusCommand(state.Config)
+	})
+	return state.workspaceStatus, state.workspaceStatusErr
+}
+
+// runWorkspaceStatusCommand runs the workspace status command and parses its output.
+func runWorkspaceStatusCommand(config *Configuration) (*WorkspaceStatus, error) {
+	cmd := config.Build.WorkspaceStatusCommand
+	if cmd == "" {
+		return parseWorkspaceStatus(nil)
+	}
+	log.Debug("Running workspace status command %s", cmd)
+	env := []string{
+		"PATH=" + ExpandHomePath(strings.Join(config.Build.Path, ":")),
+		"HOME=" + home,
+	}
+	out, combined, err := ExecWithTimeoutShell(RepoRoot, env, 0, config.Build.Timeout, false, false, cmd)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to run workspace status command %s: %s\n%s", cmd, err, combined)
+	}
+	return parseWorkspaceStatus(out)
+}
+
+// parseWorkspaceStatus parses the output of a workspace status command.
+func parseWorkspaceStatus(output []byte) (*WorkspaceStatus, error) {
+	status := &WorkspaceStatus{Stable: map[string]string{}, Volatile: map[string]string{}}
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, " ", 2)
+		key := parts[0]
+		value := ""
+		if len(parts) == 2 {
+			value = strings.TrimSpace(parts[1])
+		}
+		if !workspaceStatusKey.MatchString(key) {
+			return nil, fmt.Errorf("Invalid key in workspace status output: %s", key)
+		} else if strings.HasPrefix(key, StablePrefix) {
+			status.Stable[key] = value
+		} else {
+			status.Volatile[key] = value
+		}
+	}
+	return status, scanner.Err()
+}
+
+// StableEnvironment returns the stable keys as environment variables, in sorted order.
+func (status *WorkspaceStatus) StableEnvironment() []string {
+	return statusEnvironment(status.Stable)
+}
+
+// Environment returns all the keys as environment variables, in sorted order.
+func (status *WorkspaceStatus) Environment() []string {
+	return append(statusEnvironment(status.Stable), statusEnvironment(status.Volatile)...)
+}
+
+func statusEnvironment(values map[string]string) []string {
+	env := make([]string, 0, len(values))
+	for k, v := range values {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	return env
+}
@@ -0,0 +1,52 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseWorkspaceStatus(t *testing.T) {
+	status, err := parseWorkspaceStatus([]byte("STABLE_GIT_COMMIT abcdef\nBUILD_USER someone\n\nBUILD_MESSAGE hello world\nEMPTY\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"STABLE_GIT_COMMIT": "abcdef"}, status.Stable)
+	assert.Equal(t, map[string]string{
+		"BUILD_USER":    "someone",
+		"BUILD_MESSAGE": "hello world",
+		"EMPTY":         "",
+	}, status.Volatile)
+}
+
+func TestParseWorkspaceStatusInvalidKey(t *testing.T) {
+	_, err := parseWorkspaceStatus([]byte("STABLE_GIT_COMMIT abcdef\nbuild-user someone\n"))
+	assert.Error(t, err)
+}
+
+func TestWorkspaceStatusEnvironment(t *testing.T) {
+	status, err := parseWorkspaceStatus([]byte("STABLE_B b\nSTABLE_A a\nBUILD_TIMESTAMP 1500000000\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"STABLE_A=a", "STABLE_B=b"}, status.StableEnvironment())
+	assert.Equal(t, []string{"STABLE_A=a", "STABLE_B=b", "BUILD_TIMESTAMP=1500000000"}, status.Environment())
+}
+
+func TestRunWorkspaceStatusCommand(t *testing.T) {
+	config := DefaultConfiguration()
+	config.Build.WorkspaceStatusCommand = "echo STABLE_REVISION 1234 && echo BUILD_HOST $(echo somewhere)"
+	status, err := runWorkspaceStatusCommand(config)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"STABLE_REVISION": "1234"}, status.Stable)
+	assert.Equal(t, map[string]string{"BUILD_HOST": "somewhere"}, status.Volatile)
+}
+
+func TestRunWorkspaceStatusCommandNotConfigured(t *testing.T) {
+	status, err := runWorkspaceStatusCommand(DefaultConfiguration())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(status.Environment()))
+}
+
+func TestRunWorkspaceStatusCommandFails(t *testing.T) {
+	config := DefaultConfiguration()
+	config.Build.WorkspaceStatusCommand = "echo STABLE_REVISION 1234 && false"
+	_, err := runWorkspaceStatusCommand(config)
+	assert.Error(t, err)
+}
@@ -11,6 +11,7 @@ import (
 	"os/user"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/shlex"
@@ -36,6 +37,11 @@ type metrics struct {
 	timeout                                       time.Duration
 	buildCounter, cacheCounter, testCounter       *prometheus.CounterVec
 	buildHistogram, cacheHistogram, testHistogram *prometheus.HistogramVec
+	compressionCounter                            *prometheus.CounterVec
+	compressionRatio                              *prometheus.GaugeVec
+	// Total uncompressed & compressed sizes for each algorithm, to calculate the ratio from.
+	compressionTotals map[string][2]float64
+	compressionMutex  sync.Mutex
 }
 
 // m is the singleton metrics instance.
@@ -57,6 +63,8 @@ func InitFromConfig(config *core.Configuration) {
 		prometheus.MustRegister(m.buildHistogram)
 		prometheus.MustRegister(m.cacheHistogram)
 		prometheus.MustRegister(m.testHistogram)
+		prometheus.MustRegister(m.compressionCounter)
+		prometheus.MustRegister(m.compressionRatio)
 	}
 }
 
@@ -77,9 +85,10 @@ func initMetrics(url string, frequency, timeout time.Duration, customLabels map[
 	}
 
 	m = &metrics{
-		url:      url,
-		stopChan: make(chan bool),
-		timeout:  timeout,
+		url:               url,
+		stopChan:          make(chan bool),
+		timeout:           timeout,
+		compressionTotals: map[string][2]float64{},
 	}
 
 	// Count of builds for each target.
@@ -127,6 +136,20 @@ func initMetrics(url string, frequency, timeout time.Duration, customLabels map[
 		ConstLabels: constLabels,
 	}, []string{})
 
+	// Sizes of artifacts that are compressed on their way to or from the cache.
+	m.compressionCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name:        "cache_compression_bytes",
+		Help:        "Sizes of artifacts before and after compression for the cache",
+		ConstLabels: constLabels,
+	}, []string{"algorithm", "compressed"})
+
+	// Overall compression ratio for each algorithm
+	m.compressionRatio = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name:        "cache_compression_ratio",
+		Help:        "Ratio of uncompressed to compressed size of artifacts compressed for the cache",
+		ConstLabels: constLabels,
+	}, []string{"algorithm"})
+
 	go m.keepPushing(frequency)
 
 	return m
@@ -177,6 +200,29 @@ func (m *metrics) record(target *core.BuildTarget, duration time.Duration) {
 	m.newMetrics = true
 }
 
+// RecordCompression records the sizes of an artifact that was compressed with the given
+// algorithm on its way to or from the cache.
+func RecordCompression(algorithm string, uncompressed, compressed int) {
+	if m != nil {
+		m.recordCompression(algorithm, uncompressed, compressed)
+	}
+}
+
+func (m *metrics) recordCompression(algorithm string, uncompressed, compressed int) {
+	m.compressionCounter.WithLabelValues(algorithm, "false").Add(float64(uncompressed))
+	m.compressionCounter.WithLabelValues(algorithm, "true").Add(float64(compressed))
+	m.compressionMutex.Lock()
+	defer m.compressionMutex.Unlock()
+	totals := m.compressionTotals[algorithm]
+	totals[0] += float64(uncompressed)
+	totals[1] += float64(compressed)
+	m.compressionTotals[algorithm] = totals
+	if totals[1] > 0 {
+		m.compressionRatio.WithLabelValues(algorithm).Set(totals[0] / totals[1])
+	}
+	m.newMetrics = true
+}
+
 func b(value bool) string {
 	if value {
 		return "true"
@@ -106,6 +106,15 @@ func TestCustomLabelsCommandNewlines(t *testing.T) {
 	})
 }
 
+func TestCompressionMetrics(t *testing.T) {
+	m := initMetrics(url, verySlow, timeout, nil)
+	m.recordCompression("zstd", 1000, 200)
+	m.recordCompression("zstd", 1000, 300)
+	assert.Equal(t, [2]float64{2000, 500}, m.compressionTotals["zstd"])
+	m.stop()
+	assert.Equal(t, 1, m.errors, "Stop should push once more when there are metrics")
+}
+
 func TestExportedFunctions(t *testing.T) {
 	// For various reasons it's important that this is the only test that uses the global singleton.
 	config := core.DefaultConfiguration()
@@ -11,5 +11,8 @@ func InitFromConfig(config *core.Configuration) {}
 // Record does nothing in this file, it's just a stub.
 func Record(target *core.BuildTarget, d time.Duration) {}
 
+// RecordCompression does nothing in this file, it's just a stub.
+func RecordCompression(algorithm string, uncompressed, compressed int) {}
+
 // Stop does nothing in this file, it's just a stub.
 func Stop() {}
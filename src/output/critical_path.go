@@ -0,0 +1,174 @@
+// Critical path analysis of a completed build.
+//
+// The trace file shows when each target ran, but it's hard to see from that why the build took
+// as long as it did. This finds the longest chain of dependencies (weighted by how long each
+// target took) which bounds how quickly the build could have gone regardless of parallelism.
+
+package output
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"core"
+)
+
+// A targetSpan records when a target was built & tested during this build.
+type targetSpan struct {
+	buildStart, buildEnd, testStart, testEnd time.Time
+}
+
+// duration returns the total time the target spent building & testing.
+func (span *targetSpan) duration() time.Duration {
+	var d time.Duration
+	if !span.buildStart.IsZero() && !span.buildEnd.IsZero() {
+		d += span.buildEnd.Sub(span.buildStart)
+	}
+	if !span.testStart.IsZero() && !span.testEnd.IsZero() {
+		d += span.testEnd.Sub(span.testStart)
+	}
+	return d
+}
+
+var spans = map[core.BuildLabel]*targetSpan{}
+
+// addSpan records the timing of a single build result.
+func addSpan(result *core.BuildResult) {
+	if result.Status == core.PackageParsing || result.Status == core.PackageParsed || result.Status == core.ParseFailed {
+		return
+	}
+	span, present := spans[result.Label]
+	if !present {
+		span = &targetSpan{}
+		spans[result.Label] = span
+	}
+	switch result.Status {
+	case core.TargetBuilding:
+		if span.buildStart.IsZero() {
+			span.buildStart = result.Time
+		}
+	case core.TargetBuilt, core.TargetCached, core.TargetBuildFailed, core.TargetBuildStopped:
+		span.buildEnd = result.Time
+	case core.TargetTesting:
+		if span.testStart.IsZero() {
+			span.testStart = result.Time
+		}
+	case core.TargetTested, core.TargetTestFailed:
+		span.testEnd = result.Time
+	}
+}
+
+// A criticalPathLink is a single target on the critical path.
+type criticalPathLink struct {
+	Label    core.BuildLabel
+	Duration time.Duration
+	State    core.BuildTargetState
+}
+
+// criticalPath returns the longest chain of dependencies in the build, starting from the
+// first one that was built.
+func criticalPath(graph *core.BuildGraph) []criticalPathLink {
+	// longest memoises the longest path ending at each target, and next the dependency it goes through.
+	longest := map[core.BuildLabel]time.Duration{}
+	next := map[core.BuildLabel]*core.BuildTarget{}
+	var visit func(target *core.BuildTarget) time.Duration
+	visit = func(target *core.BuildTarget) time.Duration {
+		if d, present := longest[target.Label]; present {
+			return d
+		}
+		longest[target.Label] = 0 // Guards against cycles, although there shouldn't be any by now.
+		var max time.Duration
+		for _, dep := range target.Dependencies() {
+			if _, present := spans[dep.Label]; present {
+				if d := visit(dep); d > max || next[target.Label] == nil {
+					max = d
+					next[target.Label] = dep
+				}
+			}
+		}
+		d := max + spans[target.Label].duration()
+		longest[target.Label] = d
+		return d
+	}
+	var end *core.BuildTarget
+	var max time.Duration
+	for label, span := range spans {
+		if target := graph.Target(label); target != nil && !span.buildStart.IsZero() {
+			if d := visit(target); end == nil || d > max || (d == max && label.Less(end.Label)) {
+				max = d
+				end = target
+			}
+		}
+	}
+	links := []criticalPathLink{}
+	for target := end; target != nil; target = next[target.Label] {
+		links = append([]criticalPathLink{{
+			Label:    target.Label,
+			Duration: spans[target.Label].duration(),
+			State:    target.State(),
+		}}, links...)
+	}
+	return links
+}
+
+// parallelism returns the average number of targets that were building or testing at once.
+func parallelism(duration time.Duration) float64 {
+	var total time.Duration
+	for _, span := range spans {
+		total += span.duration()
+	}
+	if duration <= 0 {
+		return 0.0
+	}
+	return total.Seconds() / duration.Seconds()
+}
+
+// writeCriticalPath writes the critical path analysis to the given file, or stdout if it's "-".
+func writeCriticalPath(state *core.BuildState, filename string, numThreads int, duration time.Duration) {
+	if filename == "-" {
+		printCriticalPath(os.Stdout, state.Graph, numThreads, duration)
+		return
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		log.Errorf("Couldn't create critical path file: %s", err)
+		return
+	}
+	defer f.Close()
+	printCriticalPath(f, state.Graph, numThreads, duration)
+}
+
+func printCriticalPath(w io.Writer, graph *core.BuildGraph, numThreads int, duration time.Duration) {
+	links := criticalPath(graph)
+	var total time.Duration
+	for _, link := range links {
+		total += link.Duration
+	}
+	fmt.Fprintf(w, "Critical path (%s, %0.2fs of %0.2fs total):\n", pluralise(len(links), "target", "targets"), total.Seconds(), duration.Seconds())
+	for _, link := range links {
+		fmt.Fprintf(w, "  %7.2fs  %-9s %s\n", link.Duration.Seconds(), stateDescription(link.State), link.Label)
+	}
+	p := parallelism(duration)
+	fmt.Fprintf(w, "Parallelism: %0.2f of %d threads busy on average (%0.1f%%)\n", p, numThreads, 100.0*p/float64(numThreads))
+}
+
+// stateDescription returns a short description of how a target was built.
+func stateDescription(state core.BuildTargetState) string {
+	switch state {
+	case core.Built:
+		return "built"
+	case core.Cached:
+		return "cached"
+	case core.Unchanged:
+		return "unchanged"
+	case core.Reused:
+		return "reused"
+	case core.Failed:
+		return "failed"
+	case core.Stopped:
+		return "stopped"
+	}
+	return "other"
+}
@@ -0,0 +1,55 @@
+package output
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"core"
+)
+
+func TestCriticalPath(t *testing.T) {
+	// //src:a depends on //src:b and //src:c, which both depend on //src:d.
+	graph := core.NewGraph()
+	a := addCriticalPathTarget(graph, "//src:a", "//src:b", "//src:c")
+	b := addCriticalPathTarget(graph, "//src:b", "//src:d")
+	c := addCriticalPathTarget(graph, "//src:c", "//src:d")
+	d := addCriticalPathTarget(graph, "//src:d")
+	for _, target := range graph.AllTargets() {
+		for _, dep := range target.DeclaredDependencies() {
+			graph.AddDependency(target.Label, dep)
+		}
+	}
+	a.SetState(core.Built)
+	b.SetState(core.Cached)
+	c.SetState(core.Built)
+	d.SetState(core.Reused)
+
+	start := time.Now()
+	addTestSpan(a, start.Add(10*time.Second), 2*time.Second)
+	addTestSpan(b, start.Add(time.Second), time.Second)
+	addTestSpan(c, start.Add(time.Second), 5*time.Second)
+	addTestSpan(d, start, time.Second)
+
+	links := criticalPath(graph)
+	assert.Equal(t, []criticalPathLink{
+		{Label: d.Label, Duration: time.Second, State: core.Reused},
+		{Label: c.Label, Duration: 5 * time.Second, State: core.Built},
+		{Label: a.Label, Duration: 2 * time.Second, State: core.Built},
+	}, links)
+	assert.InDelta(t, 0.75, parallelism(12*time.Second), 0.001)
+}
+
+func addCriticalPathTarget(graph *core.BuildGraph, label string, deps ...string) *core.BuildTarget {
+	target := core.NewBuildTarget(core.ParseBuildLabel(label, ""))
+	for _, dep := range deps {
+		target.AddDependency(core.ParseBuildLabel(dep, ""))
+	}
+	return graph.AddTarget(target)
+}
+
+func addTestSpan(target *core.BuildTarget, start time.Time, duration time.Duration) {
+	addSpan(&core.BuildResult{Label: target.Label, Status: core.TargetBuilding, Time: start})
+	addSpan(&core.BuildResult{Label: target.Label, Status: core.TargetBuilt, Time: start.Add(duration)})
+}
@@ -0,0 +1,183 @@
+// Machine-readable stream of build events.
+//
+// This writes newline-delimited JSON events as the build progresses, so other tools (CI
+// dashboards etc) can follow what's going on without scraping our terminal output.
+// Each line is a single self-contained event; they're written as soon as they happen.
+
+package output
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"core"
+)
+
+// An event is a single entry in the event stream.
+type event struct {
+	Time        time.Time `json:"time"`
+	Type        string    `json:"type"`
+	Label       string    `json:"label,omitempty"`
+	Thread      int       `json:"thread"`
+	Description string    `json:"description,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	// Only populated for test results.
+	Tests *testEvent `json:"tests,omitempty"`
+	// Only populated for the final summary.
+	Summary *summaryEvent `json:"summary,omitempty"`
+}
+
+// A testEvent describes the results of a test target.
+type testEvent struct {
+	NumTests    int                `json:"num_tests"`
+	Passed      int                `json:"passed"`
+	Failed      int                `json:"failed"`
+	Skipped     int                `json:"skipped"`
+	Flakes      int                `json:"flakes"`
+	Quarantined int                `json:"quarantined"`
+	Cached      bool               `json:"cached"`
+	TimedOut    bool               `json:"timed_out"`
+	Duration    float64            `json:"duration"`
+	Failures    []testFailureEvent `json:"failures,omitempty"`
+	Flaky       []string           `json:"flaky,omitempty"`
+}
+
+// A testFailureEvent describes a single failed test case.
+type testFailureEvent struct {
+	Name      string `json:"name"`
+	Type      string `json:"type,omitempty"`
+	Traceback string `json:"traceback,omitempty"`
+	Stdout    string `json:"stdout,omitempty"`
+	Stderr    string `json:"stderr,omitempty"`
+}
+
+// A summaryEvent describes the overall result of the build.
+type summaryEvent struct {
+	Success       bool       `json:"success"`
+	Duration      float64    `json:"duration"`
+	FailedTargets []string   `json:"failed_targets,omitempty"`
+	Tests         *testEvent `json:"tests,omitempty"`
+}
+
+// eventTypes maps build result statuses to the types of events we emit for them.
+var eventTypes = map[core.BuildResultStatus]string{
+	core.PackageParsing:     "parse_start",
+	core.PackageParsed:      "parse_end",
+	core.ParseFailed:        "parse_failed",
+	core.TargetBuilding:     "building",
+	core.TargetBuildStopped: "build_stopped",
+	core.TargetBuilt:        "built",
+	core.TargetCached:       "cached",
+	core.TargetBuildFailed:  "build_failed",
+	core.TargetTesting:      "testing",
+	core.TargetTested:       "tested",
+	core.TargetTestFailed:   "test_failed",
+}
+
+// An eventStream writes events to a file.
+type eventStream struct {
+	file    *os.File
+	encoder *json.Encoder
+}
+
+// newEventStream creates a new event stream writing to the given file.
+// It returns nil if the file can't be created.
+func newEventStream(filename string) *eventStream {
+	f, err := os.Create(filename)
+	if err != nil {
+		log.Errorf("Couldn't create event stream file: %s", err)
+		return nil
+	}
+	return &eventStream{file: f, encoder: json.NewEncoder(f)}
+}
+
+// write writes a single event to the stream.
+func (stream *eventStream) write(e *event) {
+	if err := stream.encoder.Encode(e); err != nil {
+		log.Warning("Failed to write to event stream: %s", err)
+	}
+}
+
+// Result writes the event(s) for a single build result.
+func (stream *eventStream) Result(state *core.BuildState, result *core.BuildResult) {
+	e := &event{
+		Time:        result.Time,
+		Type:        eventTypes[result.Status],
+		Label:       result.Label.String(),
+		Thread:      result.ThreadId,
+		Description: result.Description,
+	}
+	if result.Err != nil {
+		e.Error = result.Err.Error()
+	}
+	if result.Status == core.TargetTested || result.Status == core.TargetTestFailed {
+		e.Tests = newTestEvent(result.Tests)
+	}
+	if cache := cacheEventType(state, result); cache != "" {
+		stream.write(&event{Time: result.Time, Type: cache, Label: e.Label, Thread: e.Thread})
+	}
+	stream.write(e)
+}
+
+// cacheEventType returns the type of cache event implied by a build result, or the empty string if
+// it doesn't imply one.
+func cacheEventType(state *core.BuildState, result *core.BuildResult) string {
+	if state.Cache == nil || (result.Status != core.TargetBuilt && result.Status != core.TargetCached) {
+		return ""
+	}
+	target := state.Graph.Target(result.Label)
+	if target == nil || target.IsFilegroup() {
+		return ""
+	}
+	switch target.State() {
+	case core.Cached, core.Unchanged:
+		if result.Status == core.TargetCached {
+			return "cache_hit"
+		}
+		return "cache_miss" // It was built, but the output happened not to change.
+	case core.Built:
+		return "cache_miss"
+	}
+	return "" // Reused from a previous build, so we never needed to look in the cache.
+}
+
+// Summary writes the final summary of the build to the stream and closes it.
+func (stream *eventStream) Summary(success bool, duration float64, failedTargets []core.BuildLabel, tests core.TestResults) {
+	summary := &summaryEvent{Success: success, Duration: duration}
+	for _, label := range failedTargets {
+		summary.FailedTargets = append(summary.FailedTargets, label.String())
+	}
+	if tests.NumTests > 0 {
+		summary.Tests = newTestEvent(tests)
+	}
+	stream.write(&event{Time: time.Now(), Type: "summary", Summary: summary})
+	if err := stream.file.Close(); err != nil {
+		log.Warning("Failed to close event stream: %s", err)
+	}
+}
+
+func newTestEvent(results core.TestResults) *testEvent {
+	e := &testEvent{
+		NumTests:    results.NumTests,
+		Passed:      results.Passed,
+		Failed:      results.Failed,
+		Skipped:     results.Skipped,
+		Flakes:      results.Flakes,
+		Quarantined: results.Quarantined,
+		Cached:      results.Cached,
+		TimedOut:    results.TimedOut,
+		Duration:    results.Duration,
+		Flaky:       results.Flaky,
+	}
+	for _, failure := range results.Failures {
+		e.Failures = append(e.Failures, testFailureEvent{
+			Name:      failure.Name,
+			Type:      failure.Type,
+			Traceback: failure.Traceback,
+			Stdout:    failure.Stdout,
+			Stderr:    failure.Stderr,
+		})
+	}
+	return e
+}
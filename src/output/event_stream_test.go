@@ -0,0 +1,73 @@
+package output
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"core"
+)
+
+func TestEventStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "event_stream_test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "events.json")
+
+	state := core.NewBuildState(1, nil, 1, core.DefaultConfiguration())
+	label := core.ParseBuildLabel("//src/output:event_stream_test", "")
+	stream := newEventStream(filename)
+	stream.Result(state, &core.BuildResult{Label: label, Status: core.PackageParsing, Time: time.Now()})
+	stream.Result(state, &core.BuildResult{Label: label, Status: core.TargetBuilt, Time: time.Now(), Description: "Built"})
+	results := core.TestResults{
+		NumTests: 2,
+		Passed:   1,
+		Failed:   1,
+		Failures: []core.TestFailure{{Name: "TestWibble", Traceback: "wibble.go:12"}},
+	}
+	stream.Result(state, &core.BuildResult{Label: label, Status: core.TargetTestFailed, Time: time.Now(), Tests: results})
+	stream.Summary(false, 2.5, []core.BuildLabel{label}, results)
+
+	f, err := os.Open(filename)
+	assert.NoError(t, err)
+	defer f.Close()
+	events := []event{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		e := event{}
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &e))
+		events = append(events, e)
+	}
+	assert.Equal(t, 4, len(events))
+	assert.Equal(t, "parse_start", events[0].Type)
+	assert.Equal(t, "built", events[1].Type)
+	assert.Equal(t, "Built", events[1].Description)
+	assert.Equal(t, "test_failed", events[2].Type)
+	assert.Equal(t, 1, events[2].Tests.Failed)
+	assert.Equal(t, "TestWibble", events[2].Tests.Failures[0].Name)
+	assert.Equal(t, "summary", events[3].Type)
+	assert.False(t, events[3].Summary.Success)
+	assert.Equal(t, []string{label.String()}, events[3].Summary.FailedTargets)
+}
+
+func TestCacheEventType(t *testing.T) {
+	var cache core.Cache
+	state := core.NewBuildState(1, &cache, 1, core.DefaultConfiguration())
+	target := state.Graph.AddTarget(core.NewBuildTarget(core.ParseBuildLabel("//src/output:cache_event", "")))
+	result := &core.BuildResult{Label: target.Label, Status: core.TargetCached}
+	target.SetState(core.Cached)
+	assert.Equal(t, "cache_hit", cacheEventType(state, result))
+	target.SetState(core.Reused)
+	assert.Equal(t, "", cacheEventType(state, result))
+	result.Status = core.TargetBuilt
+	target.SetState(core.Built)
+	assert.Equal(t, "cache_miss", cacheEventType(state, result))
+	result.Status = core.TargetTesting
+	assert.Equal(t, "", cacheEventType(state, result))
+}
@@ -15,6 +15,21 @@ import (
 	"core"
 )
 
+// An uploadQueue is implemented by caches that store artifacts in the background.
+type uploadQueue interface {
+	PendingUploads() int
+}
+
+// pendingUploads returns the number of artifacts waiting to be stored in the cache.
+func pendingUploads(state *core.BuildState) int {
+	if state.Cache != nil {
+		if q, ok := (*state.Cache).(uploadQueue); ok {
+			return q.PendingUploads()
+		}
+	}
+	return 0
+}
+
 // We only set the terminal title for terminals that at least claim to be xterm
 // (note that most terminals do for compatibility; some report as xterm-color, hence HasPrefix)
 var terminalClaimsToBeXterm = strings.HasPrefix(os.Getenv("TERM"), "xterm")
@@ -69,7 +84,11 @@ func moveToFirstLine(buildingTargets []buildingTarget, outputLines, maxInteracti
 
 func printLines(state *core.BuildState, buildingTargets []buildingTarget, maxLines, cols int) {
 	now := time.Now()
-	printf("Building [%d/%d, %3.1fs]:\n", state.NumDone(), state.NumActive(), time.Since(startTime).Seconds())
+	if uploads := pendingUploads(state); uploads > 0 {
+		printf("Building [%d/%d, %3.1fs, %d uploading]:\n", state.NumDone(), state.NumActive(), time.Since(startTime).Seconds(), uploads)
+	} else {
+		printf("Building [%d/%d, %3.1fs]:\n", state.NumDone(), state.NumActive(), time.Since(startTime).Seconds())
+	}
 	for i := 0; i < len(buildingTargets) && i < maxLines; i++ {
 		buildingTargets[i].Lock()
 		// Take a local copy of the structure, which isn't *that* big, so we don't need to retain the lock
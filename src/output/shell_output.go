@@ -10,6 +10,7 @@ import (
 	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -49,7 +50,9 @@ type buildingTargetData struct {
 	Colour      string
 }
 
-func MonitorState(state *core.BuildState, numThreads int, plainOutput, keepGoing, shouldBuild, shouldTest, shouldRun bool, traceFile string) bool {
+// If criticalPathFile is non-empty a critical path analysis is written to it once the build is done
+// (or to stdout if it's "-"). If eventStreamFile is non-empty events are written to it as they happen.
+func MonitorState(state *core.BuildState, numThreads int, plainOutput, keepGoing, shouldBuild, shouldTest, shouldRun bool, traceFile, criticalPathFile, eventStreamFile string) bool {
 	failedTargetMap := map[core.BuildLabel]error{}
 	buildingTargets := make([]buildingTarget, numThreads, numThreads)
 
@@ -61,8 +64,18 @@ func MonitorState(state *core.BuildState, numThreads int, plainOutput, keepGoing
 	aggregatedResults := core.TestResults{}
 	failedTargets := []core.BuildLabel{}
 	failedNonTests := []core.BuildLabel{}
+	var stream *eventStream
+	if eventStreamFile != "" {
+		stream = newEventStream(eventStreamFile)
+	}
 	for result := range state.Results {
+		if stream != nil {
+			stream.Result(state, result)
+		}
 		processResult(state, result, buildingTargets, &aggregatedResults, plainOutput, keepGoing, &failedTargets, &failedNonTests, failedTargetMap, traceFile != "")
+		if criticalPathFile != "" {
+			addSpan(result)
+		}
 	}
 	if !plainOutput {
 		stop <- struct{}{}
@@ -71,7 +84,13 @@ func MonitorState(state *core.BuildState, numThreads int, plainOutput, keepGoing
 	if traceFile != "" {
 		writeTrace(traceFile)
 	}
+	if criticalPathFile != "" {
+		writeCriticalPath(state, criticalPathFile, numThreads, time.Since(startTime))
+	}
 	duration := time.Since(startTime).Seconds()
+	if stream != nil {
+		stream.Summary(len(failedTargetMap) == 0, duration, failedTargets, aggregatedResults)
+	}
 	if len(failedNonTests) > 0 { // Something failed in the build step.
 		if state.Verbosity > 0 {
 			printFailedBuildResults(failedNonTests, failedTargetMap, duration)
@@ -94,6 +113,9 @@ func MonitorState(state *core.BuildState, numThreads int, plainOutput, keepGoing
 	if state.Verbosity > 0 && shouldBuild {
 		if shouldTest { // Got to the test phase, report their results.
 			printTestResults(state, aggregatedResults, failedTargets, duration)
+			if state.Explain {
+				printExplanations(state)
+			}
 		} else if state.NeedHashesOnly {
 			printHashes(state, duration)
 		} else if state.PrepareOnly {
@@ -188,6 +210,12 @@ func printTestResults(state *core.BuildState, aggregatedResults core.TestResults
 			} else {
 				printf("${GREEN}%s${RESET} %s\n", target.Label, testResultMessage(target.Results, failedTargets))
 			}
+			for _, flaky := range target.Results.Flaky {
+				printf("    ${BOLD_MAGENTA}Flaky:${RESET} %s passed when rerun\n", flaky)
+			}
+			for _, failure := range target.Results.QuarantinedTests {
+				printf("    ${BOLD_YELLOW}Quarantined:${RESET} %s failed\n", failure.Name)
+			}
 			if state.ShowTestOutput && target.Results.Output != "" {
 				printf("Test output:\n%s\n", target.Results.Output)
 			}
@@ -222,6 +250,9 @@ func testResultMessage(results core.TestResults, failedTargets []core.BuildLabel
 		if results.Flakes > 0 {
 			msg += fmt.Sprintf(", ${BOLD_MAGENTA}%s${RESET}", pluralise(results.Flakes, "flake", "flakes"))
 		}
+		if results.Quarantined > 0 {
+			msg += fmt.Sprintf(", ${BOLD_YELLOW}%d quarantined${RESET}", results.Quarantined)
+		}
 		if results.Cached {
 			msg += " ${GREEN}[cached]${RESET}"
 		}
@@ -253,10 +284,76 @@ func printBuildResults(state *core.BuildState, duration float64) {
 			fmt.Printf("  %s\n", result)
 		}
 	}
+	if state.Explain {
+		printExplanations(state)
+	}
+}
+
+// An explanationGroup is a set of targets that needed rebuilding and ended up the same way.
+type explanationGroup struct {
+	Heading string
+	Labels  core.BuildLabels
+}
+
+// explanationHeadings describes what happened to targets that needed rebuilding, by the state they finished in.
+var explanationHeadings = []struct {
+	State            core.BuildTargetState
+	Singular, Plural string
+}{
+	{core.Built, "target was rebuilt", "targets were rebuilt"},
+	{core.Cached, "target was retrieved from the cache", "targets were retrieved from the cache"},
+	{core.Unchanged, "target needed rebuilding but its outputs didn't change", "targets needed rebuilding but their outputs didn't change"},
+	{core.Failed, "target failed to build", "targets failed to build"},
+}
+
+// printExplanations prints the reasons each target needed to be rebuilt.
+func printExplanations(state *core.BuildState) {
+	groups := groupExplanations(state)
+	if len(groups) == 0 {
+		printf("Nothing needed to be rebuilt.\n")
+		return
+	}
+	explanations := state.Explanations()
+	for _, group := range groups {
+		printf("%s:\n", group.Heading)
+		for _, label := range group.Labels {
+			printf("  ${BOLD_WHITE}%s${RESET}: %s\n", label, explanations[label])
+		}
+	}
+}
+
+// groupExplanations groups the targets that needed rebuilding by what happened to them.
+func groupExplanations(state *core.BuildState) []explanationGroup {
+	byState := map[core.BuildTargetState]core.BuildLabels{}
+	for label := range state.Explanations() {
+		s := core.Inactive
+		if target := state.Graph.Target(label); target != nil {
+			s = target.State()
+		}
+		byState[s] = append(byState[s], label)
+	}
+	groups := []explanationGroup{}
+	for _, h := range explanationHeadings {
+		if labels := byState[h.State]; len(labels) > 0 {
+			sort.Sort(labels)
+			groups = append(groups, explanationGroup{Heading: pluralise(len(labels), h.Singular, h.Plural), Labels: labels})
+			delete(byState, h.State)
+		}
+	}
+	// Anything else didn't get built, e.g. because we stopped before it or reused another config's outputs.
+	other := core.BuildLabels{}
+	for _, labels := range byState {
+		other = append(other, labels...)
+	}
+	if len(other) > 0 {
+		sort.Sort(other)
+		groups = append(groups, explanationGroup{Heading: pluralise(len(other), "target needed rebuilding", "targets needed rebuilding"), Labels: other})
+	}
+	return groups
 }
 
 func printHashes(state *core.BuildState, duration float64) {
-	fmt.Printf("Hashes calculated, total time %0.2fs:\n", duration)
+	fmt.Printf("Hashes calculated using %s, total time %0.2fs:\n", core.HashFunctionName(), duration)
 	for _, label := range state.ExpandOriginalTargets() {
 		hash, err := build.OutputHash(state.Graph.TargetOrDie(label))
 		if err != nil {
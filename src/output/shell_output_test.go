@@ -52,3 +52,42 @@ func assertTarget(t *testing.T, target *core.BuildTarget, label string) {
 		t.Errorf("Unexpected target in detected cycle; expected %s, was %s", label, target.Label)
 	}
 }
+
+func TestGroupExplanations(t *testing.T) {
+	state := core.NewBuildState(1, nil, 1, core.DefaultConfiguration())
+	for label, s := range map[string]core.BuildTargetState{
+		"//src/output:built1":    core.Built,
+		"//src/output:built2":    core.Built,
+		"//src/output:cached":    core.Cached,
+		"//src/output:unchanged": core.Unchanged,
+		"//src/output:stopped":   core.Stopped,
+	} {
+		target := makeTarget(label)
+		target.SetState(s)
+		state.Graph.AddTarget(target)
+		state.ExplainRebuild(target.Label, "rule has changed")
+	}
+	groups := groupExplanations(state)
+	expected := []explanationGroup{
+		{"2 targets were rebuilt", []core.BuildLabel{core.ParseBuildLabel("//src/output:built1", ""), core.ParseBuildLabel("//src/output:built2", "")}},
+		{"1 target was retrieved from the cache", []core.BuildLabel{core.ParseBuildLabel("//src/output:cached", "")}},
+		{"1 target needed rebuilding but its outputs didn't change", []core.BuildLabel{core.ParseBuildLabel("//src/output:unchanged", "")}},
+		{"1 target needed rebuilding", []core.BuildLabel{core.ParseBuildLabel("//src/output:stopped", "")}},
+	}
+	if len(groups) != len(expected) {
+		t.Fatalf("Expected %d groups, got %d: %v", len(expected), len(groups), groups)
+	}
+	for i, group := range groups {
+		if group.Heading != expected[i].Heading {
+			t.Errorf("Unexpected heading %q, expected %q", group.Heading, expected[i].Heading)
+		} else if len(group.Labels) != len(expected[i].Labels) {
+			t.Errorf("Unexpected labels for %q: %v", group.Heading, group.Labels)
+		} else {
+			for j, label := range group.Labels {
+				if label != expected[i].Labels[j] {
+					t.Errorf("Unexpected label %s for %q, expected %s", label, group.Heading, expected[i].Labels[j])
+				}
+			}
+		}
+	}
+}
@@ -22,6 +22,8 @@ _build_code_cache = {}
 _c_subinclude_package_name = None
 _subinclude_package_name = None
 _subinclude_package = None
+# Configs for platforms we're cross-compiling for, keyed by os_arch. The host one is in _please_globals.
+_arch_configs = {}
 
 # List of everything we keep in the builtins module. This is a pretty agricultural way
 # of restricting what build files can do - no doubt there'd be clever ways of working
@@ -56,11 +58,10 @@ _FFI_DEFER_PARSE = ffi_from_string(_DEFER_PARSE)
 
 
 @ffi.def_extern('ParseFile')
-def parse_file(c_filename, c_package_name, c_package):
+def parse_file(c_filename, c_package_name, c_arch, c_package):
     try:
         filename = ffi_to_string(c_filename)
-        package_name = ffi_to_string(c_package_name)
-        builtins = _get_globals(c_package, c_package_name)
+        builtins = _get_globals(c_package, c_package_name, ffi_to_string(c_arch))
         _parse_build_code(filename, builtins)
         return ffi.NULL
     except DeferParse as err:
@@ -134,10 +135,11 @@ _BAZEL_KEYWORD_REWRITES = {
 
 
 @ffi.def_extern('SetConfigValue')
-def set_config_value(c_name, c_value):
+def set_config_value(c_arch, c_name, c_value):
+    arch = ffi_to_string(c_arch)
     name = ffi_to_string(c_name)
     value = ffi_to_string(c_value)
-    config = _please_globals['CONFIG']
+    config = _arch_configs.setdefault(arch, _default_config()) if arch else _please_globals['CONFIG']
     existing = config.get(name)
     # A little gentle hack to make it convenient to set repeated config values; we could
     # do it via another callback but we already have so many of them...
@@ -190,13 +192,18 @@ def build_rule(globals_dict, package, name, cmd, test_cmd=None, srcs=None, data=
                needs_transitive_deps=False, output_is_complete=False, container=False,
                no_test_output=False, flaky=0, build_timeout=0, test_timeout=0,
                pre_build=None, post_build=None, requires=None, provides=None, licences=None,
-               test_outputs=None, system_srcs=None, stamp=False, tag='', optional_outs=None):
+               test_outputs=None, system_srcs=None, stamp=False, tag='', optional_outs=None,
+               sandbox=None, shards=0, cpus=0, memory=0, pass_env=None):
     if name == 'all':
         raise ValueError('"all" is a reserved build target name.')
     if '/' in name or ':' in name:
         raise ValueError(': and / are reserved characters in build target names')
     if container and not test:
         raise ValueError('Only tests can have container=True')
+    if shards and not test:
+        raise ValueError('Only tests can be sharded')
+    if cpus < 0 or memory < 0:
+        raise ValueError('cpus and memory can\'t be negative')
     if test_cmd and not test:
         raise ValueError('Target %s has been given a test command but isn\'t a test' % name)
     if tag:
@@ -212,6 +219,8 @@ def build_rule(globals_dict, package, name, cmd, test_cmd=None, srcs=None, data=
         licences = globals_dict['CONFIG'].get('DEFAULT_LICENCES')
     if test_only is None:
         test_only = globals_dict['CONFIG'].get('DEFAULT_TESTONLY')
+    if sandbox is None:
+        sandbox = globals_dict['CONFIG'].get('SANDBOX')
 
     # Further calls to package() are now banned; it's too difficult to ensure pre/post build
     # functions work as expected if the user changes things after adding the target but before
@@ -231,7 +240,11 @@ def build_rule(globals_dict, package, name, cmd, test_cmd=None, srcs=None, data=
                          no_test_output,
                          test_only or test,  # Tests are implicitly test_only
                          stamp,
+                         bool(sandbox),
                          3 if flaky is True else flaky,  # Default is to rerun three times.
+                         shards,
+                         cpus,
+                         memory,
                          build_timeout,
                          test_timeout,
                          ffi_string(building_description))
@@ -277,6 +290,7 @@ def build_rule(globals_dict, package, name, cmd, test_cmd=None, srcs=None, data=
     _add_strings(target, _add_licence, licences, 'licences')
     _add_strings(target, _add_test_output, test_outputs, 'test_outputs')
     _add_strings(target, _add_require, requires, 'requires')
+    _add_strings(target, _add_pass_env, pass_env, 'pass_env')
     if provides:
         if not isinstance(provides, Mapping):
             raise ValueError('"provides" argument for rule %s is not a mapping' % name)
@@ -391,7 +405,7 @@ def _null_terminated_array(arr):
         yield arr[i]
 
 
-def _get_globals(c_package, c_package_name):
+def _get_globals(c_package, c_package_name, arch=''):
     """Creates a copy of the builtin set of globals to use on interpreting new files.
 
     Best not to ask about any of this really. If you must know: all Python functions store their
@@ -407,6 +421,8 @@ def _get_globals(c_package, c_package_name):
             local_globals[k] = bazel_wrapper(func) if bazel_compat else func
         else:
             local_globals[k] = v
+    if arch:
+        local_globals['CONFIG'] = _arch_configs[arch]
     # Need to pass some hidden arguments to these guys.
     package_name = ffi_to_string(c_package_name)
     local_globals['subinclude'] = lambda *args, **kwargs: subinclude(c_package, local_globals, *args, **kwargs)
@@ -471,10 +487,15 @@ class DotDict(dict):
     def copy(self):
         return DotDict(self)
 
-_please_globals['CONFIG'] = DotDict()
-_please_globals['CONFIG']['DEFAULT_VISIBILITY'] = None
-_please_globals['CONFIG']['DEFAULT_LICENCES'] = None
-_please_globals['CONFIG']['DEFAULT_TESTONLY'] = False
+
+def _default_config():
+    config = DotDict()
+    config['DEFAULT_VISIBILITY'] = None
+    config['DEFAULT_LICENCES'] = None
+    config['DEFAULT_TESTONLY'] = False
+    return config
+
+_please_globals['CONFIG'] = _default_config()
 _please_globals['defaultdict'] = defaultdict
 _please_globals['ParseError'] = ParseError
 _please_globals['DuplicateTargetError'] = DuplicateTargetError
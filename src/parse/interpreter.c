@@ -4,22 +4,22 @@
 
 // Since we dlsym() the callbacks out of the parser .so, we have variables for them as
 // well as extern definitions which cffi uses. The two must match, of course.
-char* (*parse_file)(char*, char*, size_t);
+char* (*parse_file)(char*, char*, char*, size_t);
 char* (*parse_code)(char*, char*, size_t);
-void (*set_config_value)(char*, char*);
+void (*set_config_value)(char*, char*, char*);
 char* (*pre_build_callback_runner)(void*, size_t, char*);
 char* (*post_build_callback_runner)(void*, size_t, char*, char*);
 
-char* ParseFile(char* filename, char* package_name, size_t package) {
-  return (*parse_file)(filename, package_name, package);
+char* ParseFile(char* filename, char* package_name, char* arch, size_t package) {
+  return (*parse_file)(filename, package_name, arch, package);
 }
 
 char* ParseCode(char* filename, char* package_name, size_t package) {
   return (*parse_code)(filename, package_name, package);
 }
 
-void SetConfigValue(char* name, char* value) {
-  (*set_config_value)(name, value);
+void SetConfigValue(char* arch, char* name, char* value) {
+  (*set_config_value)(arch, name, value);
 }
 
 char* RunPreBuildFunction(size_t callback, size_t package, char* name) {
@@ -49,7 +49,7 @@ int InitialiseInterpreter(char* parser_location) {
   //               like reg("_add_target", typeof(AddTarget), AddTarget) would be sweet.
   //               As far as I know this is only possible in C++ using typeid though :(
   reg("_add_target", "size_t (*)(size_t, char*, char*, char*, uint8, uint8, uint8, uint8, "
-      "uint8, uint8, uint8, uint8, int64, int64, int64, char*)", AddTarget);
+      "uint8, uint8, uint8, uint8, uint8, int64, int64, int64, int64, int64, int64, char*)", AddTarget);
   reg("_add_src", "char* (*)(size_t, char*)", AddSource);
   reg("_add_data", "char* (*)(size_t, char*)", AddData);
   reg("_add_dep", "char* (*)(size_t, char*)", AddDep);
@@ -63,6 +63,7 @@ int InitialiseInterpreter(char* parser_location) {
   reg("_add_licence", "char* (*)(size_t, char*)", AddLicence);
   reg("_add_test_output", "char* (*)(size_t, char*)", AddTestOutput);
   reg("_add_require", "char* (*)(size_t, char*)", AddRequire);
+  reg("_add_pass_env", "char* (*)(size_t, char*)", AddPassEnv);
   reg("_add_provide", "char* (*)(size_t, char*, char*)", AddProvide);
   reg("_add_named_src", "char* (*)(size_t, char*, char*)", AddNamedSource);
   reg("_add_command", "char* (*)(size_t, char*, char*)", AddCommand);
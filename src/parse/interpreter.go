@@ -49,6 +49,10 @@ const pyDeferParse = "_DEFER_"
 // To ensure we only initialise once.
 var initializeOnce sync.Once
 
+// To ensure we only set up the config for each platform we're cross-compiling for once.
+var archOnces = map[string]*sync.Once{}
+var archOnceMutex sync.Mutex
+
 // Code to initialise the Python interpreter.
 func initializeInterpreter(config *core.Configuration) {
 	log.Debug("Initialising interpreter...")
@@ -75,6 +79,38 @@ func initializeInterpreter(config *core.Configuration) {
 			log.Fatalf("Can't initialise any Please parser engine. Please is putting itself out of its misery.")
 		}
 	}
+	setConfigValues("", config)
+
+	// Load all the builtin rules
+	log.Debug("Loading builtin build rules...")
+	dir, _ := AssetDir("")
+	sort.Strings(dir)
+	for _, filename := range dir {
+		loadBuiltinRules(filename)
+	}
+	loadSubincludePackage()
+	log.Debug("Interpreter ready")
+}
+
+// initializeArch sets up the config for a platform we're cross-compiling for, if it hasn't been already.
+func initializeArch(state *core.BuildState, arch string) {
+	archOnceMutex.Lock()
+	once, present := archOnces[arch]
+	if !present {
+		once = &sync.Once{}
+		archOnces[arch] = once
+	}
+	archOnceMutex.Unlock()
+	once.Do(func() {
+		log.Debug("Setting up config for %s...", arch)
+		setConfigValues(arch, state.ArchConfig(arch))
+	})
+}
+
+// setConfigValues sets the values of the CONFIG object that build files see for the given platform.
+func setConfigValues(arch string, config *core.Configuration) {
+	setConfigValue := func(name, value string) { setArchConfigValue(arch, name, value) }
+	goos, goarch := core.SplitArch(arch)
 	setConfigValue("PLZ_VERSION", config.Please.Version.String())
 	setConfigValue("GO_VERSION", config.Go.GoVersion)
 	setConfigValue("GO_TEST_TOOL", config.Go.TestTool)
@@ -88,6 +124,7 @@ func initializeInterpreter(config *core.Configuration) {
 	setConfigValue("PYTHON_DEFAULT_PIP_REPO", config.Python.DefaultPipRepo)
 	setConfigValue("USE_PYPI", pythonBool(config.Python.UsePyPI))
 	setConfigValue("JAVAC_TOOL", config.Java.JavacTool)
+	setConfigValue("JAVAC_WORKER", config.Java.JavacWorker)
 	setConfigValue("JARCAT_TOOL", config.Java.JarCatTool)
 	setConfigValue("JUNIT_RUNNER", config.Java.JUnitRunner)
 	setConfigValue("DEFAULT_TEST_PACKAGE", config.Java.DefaultTestPackage)
@@ -110,8 +147,9 @@ func initializeInterpreter(config *core.Configuration) {
 	setConfigValue("DEFAULT_LDFLAGS", config.Cpp.DefaultLdflags)
 	setConfigValue("DEFAULT_NAMESPACE", config.Cpp.DefaultNamespace)
 	setConfigValue("CPP_COVERAGE", pythonBool(config.Cpp.Coverage))
-	setConfigValue("OS", runtime.GOOS)
-	setConfigValue("ARCH", runtime.GOARCH)
+	setConfigValue("SANDBOX", pythonBool(config.Build.Sandbox))
+	setConfigValue("OS", goos)
+	setConfigValue("ARCH", goarch)
 	for _, language := range config.Proto.Language {
 		setConfigValue("PROTO_LANGUAGES", language)
 	}
@@ -131,16 +169,6 @@ func initializeInterpreter(config *core.Configuration) {
 	for k, v := range config.BuildConfig {
 		setConfigValue(strings.Replace(strings.ToUpper(k), "-", "_", -1), v)
 	}
-
-	// Load all the builtin rules
-	log.Debug("Loading builtin build rules...")
-	dir, _ := AssetDir("")
-	sort.Strings(dir)
-	for _, filename := range dir {
-		loadBuiltinRules(filename)
-	}
-	loadSubincludePackage()
-	log.Debug("Interpreter ready")
 }
 
 // pythonBool returns the representation of a bool we're going to send to Python.
@@ -190,12 +218,14 @@ func libExtension() string {
 	return "so"
 }
 
-func setConfigValue(name string, value string) {
+func setArchConfigValue(arch, name, value string) {
+	cArch := C.CString(arch)
 	cName := C.CString(name)
 	cValue := C.CString(value)
+	defer C.free(unsafe.Pointer(cArch))
 	defer C.free(unsafe.Pointer(cName))
 	defer C.free(unsafe.Pointer(cValue))
-	C.SetConfigValue(cName, cValue)
+	C.SetConfigValue(cArch, cName, cValue)
 }
 
 func loadBuiltinRules(path string) {
@@ -245,6 +275,9 @@ func parsePackageFile(state *core.BuildState, filename string, pkg *core.Package
 	log.Debug("Parsing package file %s", filename)
 	start := time.Now()
 	initializeOnce.Do(func() { initializeInterpreter(state.Config) })
+	if pkg.Arch != "" {
+		initializeArch(state, pkg.Arch)
+	}
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
 	// TODO(pebers): It seems like we should be calling C.pypy_attach_thread here once per OS thread.
@@ -255,9 +288,11 @@ func parsePackageFile(state *core.BuildState, filename string, pkg *core.Package
 	//               multithreaded parsing without it.
 	cFilename := C.CString(filename)
 	cPackageName := C.CString(pkg.Name)
+	cArch := C.CString(pkg.Arch)
 	defer C.free(unsafe.Pointer(cFilename))
 	defer C.free(unsafe.Pointer(cPackageName))
-	ret := C.GoString(C.ParseFile(cFilename, cPackageName, sizep(pkg)))
+	defer C.free(unsafe.Pointer(cArch))
+	ret := C.GoString(C.ParseFile(cFilename, cPackageName, cArch, sizep(pkg)))
 	if ret != "" && ret != pyDeferParse {
 		panic(fmt.Sprintf("Failed to parse file %s: %s", filename, ret))
 	}
@@ -275,24 +310,24 @@ func IsValidTargetName(name *C.char) bool {
 
 //export AddTarget
 func AddTarget(pkgPtr uintptr, cName, cCmd, cTestCmd *C.char, binary, test, needsTransitiveDeps,
-	outputIsComplete, containerise, noTestOutput, testOnly, stamp bool,
-	flakiness, buildTimeout, testTimeout int, cBuildingDescription *C.char) (ret C.size_t) {
+	outputIsComplete, containerise, noTestOutput, testOnly, stamp, sandbox bool,
+	flakiness, shards, cpus, memory, buildTimeout, testTimeout int, cBuildingDescription *C.char) (ret C.size_t) {
 	buildingDescription := ""
 	if cBuildingDescription != nil {
 		buildingDescription = C.GoString(cBuildingDescription)
 	}
 	return sizet(addTarget(pkgPtr, C.GoString(cName), C.GoString(cCmd), C.GoString(cTestCmd),
 		binary, test, needsTransitiveDeps, outputIsComplete, containerise, noTestOutput,
-		testOnly, stamp, flakiness, buildTimeout, testTimeout, buildingDescription))
+		testOnly, stamp, sandbox, flakiness, shards, cpus, memory, buildTimeout, testTimeout, buildingDescription))
 }
 
 // addTarget adds a new build target to the graph.
 // Separated from AddTarget to make it possible to test (since you can't mix cgo and go test).
 func addTarget(pkgPtr uintptr, name, cmd, testCmd string, binary, test, needsTransitiveDeps,
-	outputIsComplete, containerise, noTestOutput, testOnly, stamp bool,
-	flakiness, buildTimeout, testTimeout int, buildingDescription string) *core.BuildTarget {
+	outputIsComplete, containerise, noTestOutput, testOnly, stamp, sandbox bool,
+	flakiness, shards, cpus, memory, buildTimeout, testTimeout int, buildingDescription string) *core.BuildTarget {
 	pkg := unsizep(pkgPtr)
-	target := core.NewBuildTarget(core.NewBuildLabel(pkg.Name, name))
+	target := core.NewBuildTarget(core.NewBuildLabel(pkg.Name, name).ForArch(pkg.Arch).ForConfig(pkg.Config))
 	target.IsBinary = binary
 	target.IsTest = test
 	target.NeedsTransitiveDependencies = needsTransitiveDeps
@@ -301,9 +336,13 @@ func addTarget(pkgPtr uintptr, name, cmd, testCmd string, binary, test, needsTra
 	target.NoTestOutput = noTestOutput
 	target.TestOnly = testOnly
 	target.Flakiness = flakiness
+	target.Shards = shards
+	target.Cpus = cpus
+	target.Memory = memory
 	target.BuildTimeout = time.Duration(buildTimeout) * time.Second
 	target.TestTimeout = time.Duration(testTimeout) * time.Second
 	target.Stamp = stamp
+	target.Sandbox = sandbox
 	// Automatically label containerised tests.
 	if containerise {
 		target.AddLabel("container")
@@ -327,7 +366,7 @@ func addTarget(pkgPtr uintptr, name, cmd, testCmd string, binary, test, needsTra
 		return nil
 	}
 	pkg.Targets[name] = target
-	if core.State.Graph.Package(pkg.Name) != nil {
+	if core.State.Graph.PackageByLabel(pkg.Label()) != nil {
 		// Package already added, so we're probably in a post-build function. Add target directly to graph now.
 		log.Debug("Adding new target %s directly to graph", target.Label)
 		core.State.Graph.AddTarget(target)
@@ -357,7 +396,7 @@ func AddDependency(cPackage uintptr, cTarget *C.char, cDep *C.char, exported boo
 	if err != nil {
 		return C.CString(err.Error())
 	}
-	dep, err := core.TryParseBuildLabel(C.GoString(cDep), target.Label.PackageName)
+	dep, err := core.TryParseBuildLabelFor(C.GoString(cDep), target.Label)
 	if err != nil {
 		return C.CString(err.Error())
 	}
@@ -431,7 +470,7 @@ func getTargetPost(cPackage uintptr, cTarget *C.char) (*core.BuildTarget, error)
 //export AddSource
 func AddSource(cTarget uintptr, cSource *C.char) *C.char {
 	target := unsizet(cTarget)
-	source, err := parseSource(C.GoString(cSource), target.Label.PackageName, true)
+	source, err := parseSource(C.GoString(cSource), target.Label, true)
 	if err != nil {
 		return C.CString(err.Error())
 	}
@@ -441,9 +480,11 @@ func AddSource(cTarget uintptr, cSource *C.char) *C.char {
 
 // Parses an incoming source label as either a file or a build label.
 // Identifies if the file is owned by this package and returns an error if not.
-func parseSource(src, packageName string, systemAllowed bool) (core.BuildInput, error) {
+// Build labels are built for the same platform and configuration as owner unless they specify a platform.
+func parseSource(src string, owner core.BuildLabel, systemAllowed bool) (core.BuildInput, error) {
+	packageName := owner.PackageName
 	if core.LooksLikeABuildLabel(src) {
-		return core.TryParseBuildLabel(src, packageName)
+		return core.TryParseBuildLabelFor(src, owner)
 	} else if src == "" {
 		return nil, fmt.Errorf("Empty source path (in package %s)", packageName)
 	} else if strings.Contains(src, "../") {
@@ -467,7 +508,7 @@ func parseSource(src, packageName string, systemAllowed bool) (core.BuildInput,
 //export AddNamedSource
 func AddNamedSource(cTarget uintptr, cName *C.char, cSource *C.char) *C.char {
 	target := unsizet(cTarget)
-	source, err := parseSource(C.GoString(cSource), target.Label.PackageName, false)
+	source, err := parseSource(C.GoString(cSource), target.Label, false)
 	if err != nil {
 		return C.CString(err.Error())
 	}
@@ -490,7 +531,7 @@ func AddTestCommand(cTarget uintptr, cConfig *C.char, cCommand *C.char) *C.char
 //export AddData
 func AddData(cTarget uintptr, cData *C.char) *C.char {
 	target := unsizet(cTarget)
-	data, err := parseSource(C.GoString(cData), target.Label.PackageName, false)
+	data, err := parseSource(C.GoString(cData), target.Label, false)
 	if err != nil {
 		return C.CString(err.Error())
 	}
@@ -518,7 +559,7 @@ func AddOptionalOutput(cTarget uintptr, cOutput *C.char) *C.char {
 //export AddDep
 func AddDep(cTarget uintptr, cDep *C.char) *C.char {
 	target := unsizet(cTarget)
-	dep, err := core.TryParseBuildLabel(C.GoString(cDep), target.Label.PackageName)
+	dep, err := core.TryParseBuildLabelFor(C.GoString(cDep), target.Label)
 	if err != nil {
 		return C.CString(err.Error())
 	}
@@ -529,7 +570,7 @@ func AddDep(cTarget uintptr, cDep *C.char) *C.char {
 //export AddExportedDep
 func AddExportedDep(cTarget uintptr, cDep *C.char) *C.char {
 	target := unsizet(cTarget)
-	dep, err := core.TryParseBuildLabel(C.GoString(cDep), target.Label.PackageName)
+	dep, err := core.TryParseBuildLabelFor(C.GoString(cDep), target.Label)
 	if err != nil {
 		return C.CString(err.Error())
 	}
@@ -551,7 +592,9 @@ func AddTool(cTarget uintptr, cTool *C.char) *C.char {
 			return C.CString(err.Error())
 		}
 	}
-	tool, err := parseSource(src, target.Label.PackageName, true)
+	// Tools always run on the host, so they're built for it (in the primary configuration)
+	// regardless of what the target is built for.
+	tool, err := parseSource(src, core.BuildLabel{PackageName: target.Label.PackageName}, true)
 	if err != nil {
 		return C.CString(err.Error())
 	}
@@ -615,10 +658,17 @@ func AddRequire(cTarget uintptr, cRequire *C.char) *C.char {
 	return nil
 }
 
+//export AddPassEnv
+func AddPassEnv(cTarget uintptr, cName *C.char) *C.char {
+	target := unsizet(cTarget)
+	target.PassEnv = append(target.PassEnv, C.GoString(cName))
+	return nil
+}
+
 //export AddProvide
 func AddProvide(cTarget uintptr, cLanguage *C.char, cDep *C.char) *C.char {
 	target := unsizet(cTarget)
-	label, err := core.TryParseBuildLabel(C.GoString(cDep), target.Label.PackageName)
+	label, err := core.TryParseBuildLabelFor(C.GoString(cDep), target.Label)
 	if err != nil {
 		return C.CString(err.Error())
 	}
@@ -661,11 +711,11 @@ func getSubincludeFile(pkg *core.Package, labelStr string) string {
 	if label.PackageName == pkg.Name {
 		return fmt.Sprintf("__Can't subinclude :%s in %s; can't subinclude local targets.", label.Name, pkg.Name)
 	}
-	pkgLabel := core.BuildLabel{PackageName: pkg.Name, Name: "all"}
+	pkgLabel := pkg.Label()
 	target := core.State.Graph.Target(label)
 	if target == nil {
 		// Might not have been parsed yet. Check for that first.
-		if subincludePackage := core.State.Graph.Package(label.PackageName); subincludePackage == nil {
+		if subincludePackage := core.State.Graph.PackageByLabel(label); subincludePackage == nil {
 			if deferParse(label, pkg) {
 				return pyDeferParse // Not an error, they'll just have to wait.
 			}
@@ -780,7 +830,8 @@ func GetLabels(cPackage uintptr, cTarget *C.char, cPrefix *C.char) **C.char {
 	lbl := C.GoString(cTarget)
 	prefix := C.GoString(cPrefix)
 	if core.LooksLikeABuildLabel(lbl) {
-		label, err := core.TryParseBuildLabel(lbl, unsizep(cPackage).Name)
+		pkg := unsizep(cPackage)
+		label, err := core.TryParseBuildLabelFor(lbl, pkg.Label())
 		if err != nil {
 			log.Fatalf("%s", err) // TODO(pebers): report proper errors here and below
 		}
@@ -8,9 +8,9 @@
 #include <stdlib.h>
 
 // AFAICT there isn't a way to call the function pointers directly.
-char* ParseFile(char* filename, char* package_name, size_t package);
+char* ParseFile(char* filename, char* package_name, char* arch, size_t package);
 char* ParseCode(char* filename, char* package_name, size_t package);
-void SetConfigValue(char* name, char* value);
+void SetConfigValue(char* arch, char* name, char* value);
 char* RunPreBuildFunction(size_t callback, size_t package, char* name);
 char* RunPostBuildFunction(size_t callback, size_t package, char* name, char* output);
 
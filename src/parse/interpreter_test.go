@@ -12,7 +12,7 @@ import (
 )
 
 func TestParseSourceBuildLabel(t *testing.T) {
-	src, err := parseSource("//src/parse/test_data/test_subfolder4:test_py", "src/parse", false)
+	src, err := parseSource("//src/parse/test_data/test_subfolder4:test_py", core.BuildLabel{PackageName: "src/parse"}, false)
 	assert.NoError(t, err)
 	label := src.Label()
 	assert.NotNil(t, label)
@@ -21,7 +21,7 @@ func TestParseSourceBuildLabel(t *testing.T) {
 }
 
 func TestParseSourceRelativeBuildLabel(t *testing.T) {
-	src, err := parseSource(":builtin_rules", "src/parse", false)
+	src, err := parseSource(":builtin_rules", core.BuildLabel{PackageName: "src/parse"}, false)
 	assert.NoError(t, err)
 	label := src.Label()
 	assert.NotNil(t, label)
@@ -31,7 +31,7 @@ func TestParseSourceRelativeBuildLabel(t *testing.T) {
 
 // Test parsing from a subdirectory that does not contain a build file.
 func TestParseSourceFromSubdirectory(t *testing.T) {
-	src, err := parseSource("test_subfolder3/test_py", "src/parse/test_data", false)
+	src, err := parseSource("test_subfolder3/test_py", core.BuildLabel{PackageName: "src/parse/test_data"}, false)
 	assert.NoError(t, err)
 	assert.Nil(t, src.Label())
 	paths := src.Paths(nil)
@@ -40,19 +40,19 @@ func TestParseSourceFromSubdirectory(t *testing.T) {
 }
 
 func TestParseSourceFromOwnedSubdirectory(t *testing.T) {
-	_, err := parseSource("test_subfolder4/test_py", "src/parse/test_data", false)
+	_, err := parseSource("test_subfolder4/test_py", core.BuildLabel{PackageName: "src/parse/test_data"}, false)
 	assert.Error(t, err, "Should produce an error when parsing from a subdirectory that does contain a build file")
 }
 
 func TestParseSourceWithParentPath(t *testing.T) {
-	_, err := parseSource("test_subfolder4/../test_py", "src/parse/test_data", false)
+	_, err := parseSource("test_subfolder4/../test_py", core.BuildLabel{PackageName: "src/parse/test_data"}, false)
 	assert.Error(t, err, "Should produce an error when parsing a path with ../ in it")
 }
 
 func TestParseSourceWithAbsolutePath(t *testing.T) {
-	_, err := parseSource("/test_subfolder4/test_py", "src/parse/test_data", false)
+	_, err := parseSource("/test_subfolder4/test_py", core.BuildLabel{PackageName: "src/parse/test_data"}, false)
 	assert.Error(t, err, "Should produce an error trying to parse an absolute path")
-	_, err = parseSource("/usr/bin/go", "src/parse/test_data", true)
+	_, err = parseSource("/usr/bin/go", core.BuildLabel{PackageName: "src/parse/test_data"}, true)
 	assert.NoError(t, err, "Should not produce an error trying to parse an absolute path in cases where it's allowed")
 }
 
@@ -60,7 +60,7 @@ func TestAddTarget(t *testing.T) {
 	pkg := core.NewPackage("src/parse")
 	addTargetTest1 := func(name string, binary, container, test bool, testCmd string) *core.BuildTarget {
 		return addTarget(uintptr(unsafe.Pointer(pkg)), name, "true", testCmd, binary, test,
-			false, false, container, false, false, false, 0, 0, 0, "Building...")
+			false, false, container, false, false, false, false, 0, 0, 0, 0, 0, 0, "Building...")
 	}
 	addTargetTest := func(name string, binary, container bool) *core.BuildTarget {
 		return addTargetTest1(name, binary, container, false, "")
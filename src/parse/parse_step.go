@@ -30,7 +30,7 @@ func Parse(tid int, state *core.BuildState, label, dependor core.BuildLabel, noD
 		}
 	}()
 	// First see if this package already exists; once it's in the graph it will have been parsed.
-	pkg := state.Graph.Package(label.PackageName)
+	pkg := state.Graph.PackageByLabel(label)
 	if pkg != nil {
 		// Does exist, all we need to do is toggle on this target
 		activateTarget(state, pkg, label, dependor, noDeps, include, exclude)
@@ -39,7 +39,7 @@ func Parse(tid int, state *core.BuildState, label, dependor core.BuildLabel, noD
 	// We use the name here to signal undeferring of a package. If we get that we need to retry the package regardless.
 	if dependor.Name != "_UNDEFER_" && !firstToParse(label, dependor) {
 		// Check this again to avoid a potential race
-		if pkg = state.Graph.Package(label.PackageName); pkg != nil {
+		if pkg = state.Graph.PackageByLabel(label); pkg != nil {
 			activateTarget(state, pkg, label, dependor, noDeps, include, exclude)
 		} else {
 			log.Debug("Adding pending parse for %s", label)
@@ -54,15 +54,14 @@ func Parse(tid int, state *core.BuildState, label, dependor core.BuildLabel, noD
 		return
 	}
 
-	// Now add any lurking pending targets for this package.
+	// Now add any lurking pending targets for this package (in any configuration).
 	pendingTargetMutex.Lock()
-	pending := pendingTargets[label.PackageName]                       // Must be present.
-	pendingTargets[label.PackageName] = map[string][]core.BuildLabel{} // Empty this to free memory, but leave a sentinel
-	pendingTargetMutex.Unlock()                                        // Nothing will look up this package in the map again.
-	for targetName, dependors := range pending {
+	pending := pendingTargets[primaryPackage(label)]                                // Must be present.
+	pendingTargets[primaryPackage(label)] = map[core.BuildLabel][]core.BuildLabel{} // Empty this to free memory, but leave a sentinel
+	pendingTargetMutex.Unlock()                                                     // Nothing will look up this package in the map again.
+	for lbl, dependors := range pending {
 		for _, dependor := range dependors {
-			lbl := core.BuildLabel{PackageName: label.PackageName, Name: targetName}
-			activateTarget(state, pkg, lbl, dependor, noDeps, include, exclude)
+			activateTarget(state, state.Graph.PackageByLabel(lbl), lbl, dependor, noDeps, include, exclude)
 		}
 	}
 	state.LogBuildResult(tid, label, core.PackageParsed, "Parsed")
@@ -100,26 +99,32 @@ func activateTarget(state *core.BuildState, pkg *core.Package, label, dependor c
 // Used to arbitrate single access to these maps
 var pendingTargetMutex sync.Mutex
 
-// Map of package name -> target name -> label that requested parse
-var pendingTargets = map[string]map[string][]core.BuildLabel{}
+// Map of package label (in the primary configuration) -> target label -> label that requested parse
+var pendingTargets = map[core.BuildLabel]map[core.BuildLabel][]core.BuildLabel{}
 
-// Map of package name -> target name -> package names that're waiting for it
-var deferredParses = map[string]map[string][]string{}
+// Map of package label -> target name -> package labels that're waiting for it
+var deferredParses = map[core.BuildLabel]map[string][]core.BuildLabel{}
 
 // firstToParse returns true if the caller is the first to parse a given package and hence should
 // continue parsing that file. It only returns true once for each package but stores subsequent
 // targets in the pendingTargets map.
+// A package is only parsed once for all configurations; see core.Package.ForConfig.
 func firstToParse(label, dependor core.BuildLabel) bool {
 	pendingTargetMutex.Lock()
 	defer pendingTargetMutex.Unlock()
-	if pkg, present := pendingTargets[label.PackageName]; present {
-		pkg[label.Name] = append(pkg[label.Name], dependor)
+	if pkg, present := pendingTargets[primaryPackage(label)]; present {
+		pkg[label] = append(pkg[label], dependor)
 		return false
 	}
-	pendingTargets[label.PackageName] = map[string][]core.BuildLabel{label.Name: {dependor}}
+	pendingTargets[primaryPackage(label)] = map[core.BuildLabel][]core.BuildLabel{label: {dependor}}
 	return true
 }
 
+// primaryPackage returns the label of the package containing the given label, in the primary configuration.
+func primaryPackage(label core.BuildLabel) core.BuildLabel {
+	return label.ForConfig("").PackageLabel()
+}
+
 // deferParse defers the parsing of a package until the given label has been built.
 // Returns true if it was deferred, or false if it's already built.
 func deferParse(label core.BuildLabel, pkg *core.Package) bool {
@@ -128,13 +133,13 @@ func deferParse(label core.BuildLabel, pkg *core.Package) bool {
 	if target := core.State.Graph.Target(label); target != nil && target.State() >= core.Built {
 		return false
 	}
-	log.Debug("Deferring parse of %s pending %s", pkg.Name, label)
-	if m, present := deferredParses[label.PackageName]; present {
-		m[label.Name] = append(m[label.Name], pkg.Name)
+	log.Debug("Deferring parse of %s pending %s", pkg.Label(), label)
+	if m, present := deferredParses[label.PackageLabel()]; present {
+		m[label.Name] = append(m[label.Name], pkg.Label())
 	} else {
-		deferredParses[label.PackageName] = map[string][]string{label.Name: {pkg.Name}}
+		deferredParses[label.PackageLabel()] = map[string][]core.BuildLabel{label.Name: {pkg.Label()}}
 	}
-	core.State.AddPendingParse(label, core.BuildLabel{PackageName: pkg.Name, Name: "all"}, true)
+	core.State.AddPendingParse(label, pkg.Label(), true)
 	return true
 }
 
@@ -142,13 +147,13 @@ func deferParse(label core.BuildLabel, pkg *core.Package) bool {
 func UndeferAnyParses(state *core.BuildState, target *core.BuildTarget) {
 	pendingTargetMutex.Lock()
 	defer pendingTargetMutex.Unlock()
-	if m, present := deferredParses[target.Label.PackageName]; present {
+	if m, present := deferredParses[target.Label.PackageLabel()]; present {
 		if s, present := m[target.Label.Name]; present {
-			for _, deferredPackageName := range s {
-				log.Debug("Undeferring parse of %s", deferredPackageName)
+			for _, deferredPackage := range s {
+				log.Debug("Undeferring parse of %s", deferredPackage)
 				state.AddPendingParse(
-					core.BuildLabel{PackageName: deferredPackageName, Name: getDependingTarget(deferredPackageName)},
-					core.BuildLabel{PackageName: deferredPackageName, Name: "_UNDEFER_"},
+					getDependingTarget(deferredPackage),
+					core.BuildLabel{PackageName: deferredPackage.PackageName, Name: "_UNDEFER_", Arch: deferredPackage.Arch},
 					false,
 				)
 			}
@@ -157,25 +162,27 @@ func UndeferAnyParses(state *core.BuildState, target *core.BuildTarget) {
 	}
 }
 
-// getDependingTarget returns the name of any one target in packageName that required parsing.
-func getDependingTarget(packageName string) string {
+// getDependingTarget returns the label of any one target in the given package that required parsing.
+func getDependingTarget(pkgLabel core.BuildLabel) core.BuildLabel {
 	// We need to supply a label in this package that actually needs to be built.
 	// Fortunately there must be at least one of these in the pending target map...
-	if m, present := pendingTargets[packageName]; present {
+	if m, present := pendingTargets[pkgLabel]; present {
 		for target := range m {
 			return target
 		}
 	}
 	// We shouldn't really get here, of course.
-	log.Errorf("No pending target entry for %s at deferral. Must assume :all.", packageName)
-	return "all"
+	log.Errorf("No pending target entry for %s at deferral. Must assume :all.", pkgLabel)
+	return pkgLabel
 }
 
-// parsePackage performs the initial parse of a package.
+// parsePackage performs the initial parse of a package, and adds copies of it for any other
+// configurations we're building in. It returns the package in the primary configuration.
 // It's assumed that the caller used firstToParse to ascertain that they only call this once per package.
 func parsePackage(state *core.BuildState, label, dependor core.BuildLabel) *core.Package {
 	packageName := label.PackageName
 	pkg := core.NewPackage(packageName)
+	pkg.Arch = label.Arch
 	if pkg.Filename = buildFileName(state, packageName); pkg.Filename == "" {
 		exists := core.PathExists(packageName)
 		// Handle quite a few cases to provide more obvious error messages.
@@ -192,7 +199,20 @@ func parsePackage(state *core.BuildState, label, dependor core.BuildLabel) *core
 	if parsePackageFile(state, pkg.Filename, pkg) {
 		return nil // Indicates deferral
 	}
+	addTargets(state, pkg)
+	// The copies must be in the graph before the original package is; once that's there,
+	// nobody else will wait for it to be parsed.
+	for _, config := range state.ExtraConfigs {
+		p := pkg.ForConfig(config)
+		addTargets(state, p)
+		state.Graph.AddPackage(p)
+	}
+	state.Graph.AddPackage(pkg) // Calling this means nobody else will add entries to pendingTargets for this package.
+	return pkg
+}
 
+// addTargets adds all the targets in a package to the graph, along with their dependencies.
+func addTargets(state *core.BuildState, pkg *core.Package) {
 	for _, target := range pkg.Targets {
 		state.Graph.AddTarget(target)
 		for _, out := range target.DeclaredOutputs() {
@@ -210,8 +230,6 @@ func parsePackage(state *core.BuildState, label, dependor core.BuildLabel) *core
 			state.Graph.AddDependency(target.Label, dep)
 		}
 	}
-	state.Graph.AddPackage(pkg) // Calling this means nobody else will add entries to pendingTargets for this package.
-	return pkg
 }
 
 func buildFileName(state *core.BuildState, pkgName string) string {
@@ -231,7 +249,7 @@ func buildFileName(state *core.BuildState, pkgName string) string {
 // Adds a single target to the build queue.
 func addDep(state *core.BuildState, label, dependor core.BuildLabel, rescan, forceBuild bool) {
 	// Stop at any package that's not loaded yet
-	if state.Graph.Package(label.PackageName) == nil {
+	if state.Graph.PackageByLabel(label) == nil {
 		state.AddPendingParse(label, dependor, false)
 		return
 	}
@@ -276,6 +294,10 @@ func addDep(state *core.BuildState, label, dependor core.BuildLabel, rescan, for
 		}
 		addDep(state, dep, label, false, forceBuild)
 	}
+	// Targets in other configurations wait for the primary one, whose outputs they might share.
+	if primary := label.ForConfig(""); label.Config != "" && state.Graph.Target(primary) != nil {
+		addDep(state, primary, label, false, forceBuild)
+	}
 }
 
 // RunPreBuildFunction runs a pre-build callback function registered on a build target via pre_build = <...>.
@@ -287,7 +309,7 @@ func addDep(state *core.BuildState, label, dependor core.BuildLabel, rescan, for
 func RunPreBuildFunction(tid int, state *core.BuildState, target *core.BuildTarget) error {
 	state.LogBuildResult(tid, target.Label, core.PackageParsing,
 		fmt.Sprintf("Running pre-build function for %s", target.Label))
-	pkg := state.Graph.Package(target.Label.PackageName)
+	pkg := state.Graph.PackageByLabel(target.Label)
 	pkg.BuildCallbackMutex.Lock()
 	defer pkg.BuildCallbackMutex.Unlock()
 	if err := runPreBuildFunction(pkg, target); err != nil {
@@ -308,7 +330,7 @@ func RunPreBuildFunction(tid int, state *core.BuildState, target *core.BuildTarg
 func RunPostBuildFunction(tid int, state *core.BuildState, target *core.BuildTarget, out string) error {
 	state.LogBuildResult(tid, target.Label, core.PackageParsing,
 		fmt.Sprintf("Running post-build function for %s", target.Label))
-	pkg := state.Graph.Package(target.Label.PackageName)
+	pkg := state.Graph.PackageByLabel(target.Label)
 	pkg.BuildCallbackMutex.Lock()
 	defer pkg.BuildCallbackMutex.Unlock()
 	log.Debug("Running post-build function for %s. Build output:\n%s", target.Label, out)
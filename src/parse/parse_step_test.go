@@ -109,6 +109,34 @@ func TestAddParseDepDeferred(t *testing.T) {
 	assert.Equal(t, 2, state.NumActive())
 }
 
+func TestAddDepOtherArch(t *testing.T) {
+	// Both packages are parsed for the host, but they have to be parsed again for another platform.
+	state := makeState(true, true)
+	addDep(state, buildLabel("///linux_arm64//package1:target1"), core.OriginalTarget, false, false)
+	assertPendingParses(t, state, "///linux_arm64//package1:target1")
+	assertPendingBuilds(t, state)
+}
+
+func TestAddDepOtherConfig(t *testing.T) {
+	// Targets in other configurations wait for the primary configuration's, so that gets built first.
+	state := makeState(true, true)
+	state.AddConfig("dbg")
+	pkg := state.Graph.Package("package2").ForConfig("dbg")
+	addTargets(state, pkg)
+	state.Graph.AddPackage(pkg)
+	addDep(state, buildLabel("//package2:target2").ForConfig("dbg"), core.OriginalTarget, false, false)
+	assertPendingBuilds(t, state, "//package2:target2")
+	assertPendingParses(t, state)
+}
+
+func TestFirstToParseOtherConfig(t *testing.T) {
+	// Packages are only parsed once for all configurations.
+	label := buildLabel("//package4:target1")
+	assert.True(t, firstToParse(label.ForConfig("dbg"), core.OriginalTarget))
+	assert.False(t, firstToParse(label, core.OriginalTarget))
+	assert.Equal(t, 2, len(pendingTargets[buildLabel("//package4:all")]))
+}
+
 func makeTarget(label string, deps ...string) *core.BuildTarget {
 	target := core.NewBuildTarget(core.ParseBuildLabel(label, ""))
 	for _, dep := range deps {
@@ -15,6 +15,7 @@ import (
 
 	"build"
 	"cache"
+	"cache/manage"
 	"clean"
 	"cli"
 	"core"
@@ -23,6 +24,7 @@ import (
 	"output"
 	"parse"
 	"query"
+	"remote"
 	"run"
 	"sync"
 	"test"
@@ -37,7 +39,7 @@ var config *core.Configuration
 
 var opts struct {
 	BuildFlags struct {
-		Config     string            `short:"c" long:"config" description:"Build config to use. Defaults to opt."`
+		Config     []string          `short:"c" long:"config" description:"Build config to use. Defaults to opt. Can be repeated to build in several configs at once."`
 		RepoRoot   string            `short:"r" long:"repo_root" description:"Root of repository to build."`
 		KeepGoing  bool              `short:"k" long:"keep_going" description:"Don't stop on first failed target."`
 		NumThreads int               `short:"n" long:"num_threads" description:"Number of concurrent build operations. Default is number of CPUs + 2."`
@@ -45,6 +47,7 @@ var opts struct {
 		Exclude    []string          `short:"e" long:"exclude" description:"Label of targets to exclude from automatic detection."`
 		Engine     string            `long:"engine" hidden:"true" description:"Parser engine .so / .dylib to load"`
 		Option     map[string]string `short:"o" long:"override" description:"Options to override from .plzconfig (e.g. -o please.selfupdate:false)"`
+		Arch       string            `long:"arch" description:"Architecture to build for, e.g. linux_arm64. Defaults to the host architecture."`
 	} `group:"Options controlling what to build & how to build it"`
 
 	OutputFlags struct {
@@ -56,6 +59,9 @@ var opts struct {
 		Colour            bool   `long:"colour" description:"Forces coloured output from logging & other shell output."`
 		NoColour          bool   `long:"nocolour" description:"Forces colourless output from logging & other shell output."`
 		TraceFile         string `long:"trace_file" description:"File to write Chrome tracing output into"`
+		CriticalPath      bool   `long:"critical_path" description:"Print an analysis of the build's critical path once it's finished"`
+		CriticalPathFile  string `long:"critical_path_file" description:"File to write critical path analysis into. Implies --critical_path."`
+		EventStream       string `long:"event_stream" description:"File to write a stream of build events into, as newline-delimited JSON"`
 		ShowAllOutput     bool   `long:"show_all_output" description:"Show all output live from all commands. Implies --plain_output."`
 		Version           bool   `long:"version" description:"Print the version of the tool"`
 	} `group:"Options controlling output & logging"`
@@ -73,8 +79,10 @@ var opts struct {
 	NoCacheCleaner   bool   `description:"Don't start a cleaning process for the directory cache" no-flag:"true"`
 
 	Build struct {
-		Prepare bool     `long:"prepare" description:"Prepare build directory for these targets but don't build them."`
-		Args    struct { // Inner nesting is necessary to make positional-args work :(
+		Prepare          bool     `long:"prepare" description:"Prepare build directory for these targets but don't build them."`
+		Explain          bool     `long:"explain" description:"Explain why each target needed to be rebuilt."`
+		CheckDeterminism bool     `long:"check_determinism" description:"Build each target twice and check that the outputs are identical. Implies --nocache."`
+		Args             struct { // Inner nesting is necessary to make positional-args work :(
 			Targets []core.BuildLabel `positional-arg-name:"targets" description:"Targets to build"`
 		} `positional-args:"true" required:"true"`
 	} `command:"build" description:"Builds one or more targets"`
@@ -221,7 +229,51 @@ var opts struct {
 				Files []string `positional-arg-name:"files" description:"Files to query targets responsible for"`
 			} `positional-args:"true"`
 		} `command:"whatoutputs" description:"Prints out target(s) responsible for outputting provided file(s)"`
+		Slowest struct {
+			Num int `short:"n" long:"num" default:"20" description:"Number of targets to print. 0 prints all of them."`
+		} `command:"slowest" description:"Prints the targets that have taken longest to build and test previously."`
+		Log struct {
+			Action   string `short:"a" long:"action" choice:"build" choice:"test" description:"Kind of action to print the log of. By default prints whichever ran most recently."`
+			Previous int    `short:"p" long:"previous" description:"Prints an older log instead of the latest, e.g. 1 for the one before it."`
+			Args     struct {
+				Target core.BuildLabel `positional-arg-name:"target" description:"Target to print the log of" required:"true"`
+			} `positional-args:"true" required:"true"`
+		} `command:"log" description:"Prints the log of the last time a target was built or tested."`
 	} `command:"query" description:"Queries information about the build graph"`
+
+	Cache struct {
+		Ls struct {
+			Args struct {
+				Targets []core.BuildLabel `positional-arg-name:"targets" description:"Targets to list artifacts for" required:"true"`
+			} `positional-args:"true" required:"true"`
+		} `command:"ls" description:"Lists the hashes that targets have artifacts stored under in each cache."`
+		Get struct {
+			Hash string `long:"hash" description:"Hash to retrieve artifacts for, as printed by plz cache ls. Defaults to the target's current hash."`
+			Args struct {
+				Target core.BuildLabel `positional-arg-name:"target" description:"Target to retrieve artifacts for" required:"true"`
+			} `positional-args:"true" required:"true"`
+		} `command:"get" description:"Retrieves a target's artifacts from the cache into plz-out."`
+		Evict struct {
+			Hash string `long:"hash" description:"Hash to evict artifacts for, as printed by plz cache ls. Defaults to the targets' current hashes."`
+			All  bool   `short:"a" long:"all" description:"Evict artifacts for every hash, not just one."`
+			Args struct {
+				Targets []core.BuildLabel `positional-arg-name:"targets" description:"Targets to evict artifacts for" required:"true"`
+			} `positional-args:"true" required:"true"`
+		} `command:"evict" description:"Removes targets' artifacts from all caches."`
+		Verify struct {
+			Evict bool `long:"evict" description:"Evict any artifacts that fail verification."`
+			Args  struct {
+				Targets []core.BuildLabel `positional-arg-name:"targets" description:"Targets to verify artifacts for" required:"true"`
+			} `positional-args:"true" required:"true"`
+		} `command:"verify" description:"Checks that targets' artifacts in each cache match the hashes they were stored with."`
+		Stats struct {
+		} `command:"stats" description:"Prints the number of entries in and size of each cache."`
+		Prefetch struct {
+			Args struct {
+				Targets []core.BuildLabel `positional-arg-name:"targets" description:"Targets to prefetch" required:"true"`
+			} `positional-args:"true" required:"true"`
+		} `command:"prefetch" description:"Retrieves artifacts for targets and their dependencies into the dir cache without building anything."`
+	} `command:"cache" description:"Inspects and manages the contents of the caches"`
 }
 
 // Definitions of what we do for each command.
@@ -256,10 +308,10 @@ var buildFunctions = map[string]func() bool{
 		return success || opts.Test.FailingTestsOk
 	},
 	"cover": func() bool {
-		if opts.BuildFlags.Config != "" {
+		if len(opts.BuildFlags.Config) > 0 {
 			log.Warning("Build config overridden; coverage may not be available for some languages")
 		} else {
-			opts.BuildFlags.Config = "cover"
+			opts.BuildFlags.Config = []string{"cover"}
 		}
 		os.RemoveAll(opts.Cover.TestResultsFile)
 		os.RemoveAll(opts.Cover.CoverageResultsFile)
@@ -415,6 +467,58 @@ var buildFunctions = map[string]func() bool{
 			query.WhatOutputs(state.Graph, files, opts.Query.WhatOutputs.EchoFiles)
 		})
 	},
+	"slowest": func() bool {
+		query.QuerySlowest(core.Timings, opts.Query.Slowest.Num)
+		return true
+	},
+	"log": func() bool {
+		if err := query.QueryLog(opts.Query.Log.Args.Target, opts.Query.Log.Action, opts.Query.Log.Previous); err != nil {
+			log.Error("%s", err)
+			return false
+		}
+		return true
+	},
+	"ls": func() bool {
+		return runQuery(true, opts.Cache.Ls.Args.Targets, func(state *core.BuildState) {
+			if err := manage.List(state, state.ExpandOriginalTargets()); err != nil {
+				log.Fatalf("%s", err)
+			}
+		})
+	},
+	"get": func() bool {
+		return runQuery(true, []core.BuildLabel{opts.Cache.Get.Args.Target}, func(state *core.BuildState) {
+			if err := manage.Get(state, opts.Cache.Get.Args.Target, opts.Cache.Get.Hash); err != nil {
+				log.Fatalf("%s", err)
+			}
+		})
+	},
+	"evict": func() bool {
+		return runQuery(true, opts.Cache.Evict.Args.Targets, func(state *core.BuildState) {
+			if err := manage.Evict(state, state.ExpandOriginalTargets(), opts.Cache.Evict.Hash, opts.Cache.Evict.All); err != nil {
+				log.Fatalf("%s", err)
+			}
+		})
+	},
+	"verify": func() bool {
+		success := false
+		return runQuery(true, opts.Cache.Verify.Args.Targets, func(state *core.BuildState) {
+			success = manage.Verify(state, state.ExpandOriginalTargets(), opts.Cache.Verify.Evict)
+		}) && success
+	},
+	"stats": func() bool {
+		config.Cache.DirCacheCleaner = "" // Don't need it for this and don't want it interfering.
+		c := cache.NewCache(config, false)
+		if c != nil {
+			defer (*c).Shutdown()
+		}
+		return manage.Stats(c)
+	},
+	"prefetch": func() bool {
+		success := false
+		return runQuery(true, opts.Cache.Prefetch.Args.Targets, func(state *core.BuildState) {
+			success = manage.Prefetch(state, state.ExpandOriginalTargets())
+		}) && success
+	},
 }
 
 // Used above as a convenience wrapper for query functions.
@@ -440,14 +544,21 @@ func please(tid int, state *core.BuildState, parsePackageOnly bool, include, exc
 		case core.Parse, core.SubincludeParse:
 			parse.Parse(tid, state, label, dependor, parsePackageOnly, include, exclude)
 		case core.Build, core.SubincludeBuild:
-			build.Build(tid, state, label)
+			withResources(state, label, t, func() { build.Build(tid, state, label) })
 		case core.Test:
-			test.Test(tid, state, label)
+			withResources(state, label, t, func() { test.Test(tid, state, label) })
 		}
 		state.TaskDone()
 	}
 }
 
+// withResources runs the given function while holding the resources the target needs for the given task.
+func withResources(state *core.BuildState, label core.BuildLabel, t core.TaskType, f func()) {
+	state.AcquireResources(label, t)
+	defer state.ReleaseResources(label, t)
+	f()
+}
+
 // Determines from input flags whether we should show 'pretty' output (ie. interactive).
 func prettyOutput(interactiveOutput bool, plainOutput bool, verbosity int) bool {
 	if interactiveOutput && plainOutput {
@@ -465,14 +576,25 @@ func Please(targets []core.BuildLabel, config *core.Configuration, prettyOutput,
 	if opts.NoCacheCleaner {
 		config.Cache.DirCacheCleaner = ""
 	}
-	if opts.BuildFlags.Config != "" {
-		config.Build.Config = opts.BuildFlags.Config
+	if len(opts.BuildFlags.Config) > 0 {
+		config.Build.Config = opts.BuildFlags.Config[0]
 	}
 	var c *core.Cache
-	if !opts.FeatureFlags.NoCache {
-		c = cache.NewCache(config)
+	if !opts.FeatureFlags.NoCache && !opts.Build.CheckDeterminism {
+		c = cache.NewCache(config, shouldBuild || shouldTest)
 	}
 	state := core.NewBuildState(config.Please.NumThreads, c, opts.OutputFlags.Verbosity, config)
+	if shouldBuild || shouldTest {
+		// Run this now so that if it fails the user gets one error rather than one per stamped target.
+		if _, err := state.WorkspaceStatus(); err != nil {
+			log.Errorf("%s", err)
+			if c != nil {
+				(*c).Shutdown()
+			}
+			return false, state
+		}
+	}
+	state.Executor = remote.NewExecutor(config)
 	state.VerifyHashes = !opts.FeatureFlags.NoHashVerification
 	state.NumTestRuns = opts.Test.NumRuns + opts.Cover.NumRuns            // Only one of these can be passed.
 	state.TestArgs = append(opts.Test.Args.Args, opts.Cover.Args.Args...) // Similarly here.
@@ -481,11 +603,28 @@ func Please(targets []core.BuildLabel, config *core.Configuration, prettyOutput,
 	state.NeedTests = shouldTest
 	state.NeedHashesOnly = len(opts.Hash.Args.Targets) > 0
 	state.PrepareOnly = opts.Build.Prepare
+	state.Explain = opts.Build.Explain
+	state.CheckDeterminism = opts.Build.CheckDeterminism
 	state.CleanWorkdirs = !opts.FeatureFlags.KeepWorkdirs
 	state.ForceRebuild = len(opts.Rebuild.Args.Targets) > 0
 	state.ShowTestOutput = opts.Test.ShowOutput || opts.Cover.ShowOutput
 	state.ShowAllOutput = opts.OutputFlags.ShowAllOutput
 	state.SetIncludeAndExclude(opts.BuildFlags.Include, opts.BuildFlags.Exclude)
+	for _, c := range opts.BuildFlags.Config {
+		if err := core.ValidateConfig(c); err != nil {
+			log.Fatalf("%s", err)
+		}
+		state.AddConfig(c)
+	}
+	if opts.BuildFlags.Arch != "" && opts.BuildFlags.Arch != core.HostArch {
+		if err := core.ValidateArch(opts.BuildFlags.Arch); err != nil {
+			log.Fatalf("%s", err)
+		}
+		state.Arch = opts.BuildFlags.Arch
+		archConfig := readConfigFiles(core.ArchConfigFile(state.Arch))
+		archConfig.Build.Config = config.Build.Config
+		state.SetArchConfig(state.Arch, archConfig)
+	}
 	metrics.InitFromConfig(config)
 	// Acquire the lock before we start building
 	if (shouldBuild || shouldTest) && !opts.FeatureFlags.NoLock {
@@ -513,11 +652,19 @@ func Please(targets []core.BuildLabel, config *core.Configuration, prettyOutput,
 	}()
 	// Draw stuff to the screen while there are still results coming through.
 	shouldRun := !opts.Run.Args.Target.IsEmpty()
-	success := output.MonitorState(state, config.Please.NumThreads, !prettyOutput, opts.BuildFlags.KeepGoing, shouldBuild, shouldTest, shouldRun, opts.OutputFlags.TraceFile)
+	criticalPathFile := opts.OutputFlags.CriticalPathFile
+	if criticalPathFile == "" && opts.OutputFlags.CriticalPath {
+		criticalPathFile = "-"
+	}
+	success := output.MonitorState(state, config.Please.NumThreads, !prettyOutput, opts.BuildFlags.KeepGoing, shouldBuild, shouldTest, shouldRun, opts.OutputFlags.TraceFile, criticalPathFile, opts.OutputFlags.EventStream)
+	build.SaveFileHashes()
+	core.SaveTimings()
 	metrics.Stop()
 	if c != nil {
 		(*c).Shutdown()
 	}
+	state.Executor.Shutdown()
+	build.StopWorkers()
 	return success, state
 }
 
@@ -566,9 +713,17 @@ func readConfig(forceUpdate bool) *core.Configuration {
 		log.Warning("You've disabled hash verification; this is intended to help temporarily while modifying build targets. You shouldn't use this regularly.")
 	}
 
+	config := readConfigFiles(core.ArchConfigFileName)
+	update.CheckAndUpdate(config, !opts.FeatureFlags.NoUpdate, forceUpdate, opts.Update.Force)
+	return config
+}
+
+// readConfigFiles reads the config files, using the given architecture-specific one, and
+// applies any overrides given on the command line.
+func readConfigFiles(archConfigFileName string) *core.Configuration {
 	config, err := core.ReadConfigFiles([]string{
 		path.Join(core.RepoRoot, core.ConfigFileName),
-		path.Join(core.RepoRoot, core.ArchConfigFileName),
+		path.Join(core.RepoRoot, archConfigFileName),
 		core.MachineConfigFileName,
 		path.Join(core.RepoRoot, core.LocalConfigFileName),
 	})
@@ -577,7 +732,6 @@ func readConfig(forceUpdate bool) *core.Configuration {
 	} else if err := config.ApplyOverrides(opts.BuildFlags.Option); err != nil {
 		log.Fatalf("Can't override requested config setting: %s", err)
 	}
-	update.CheckAndUpdate(config, !opts.FeatureFlags.NoUpdate, forceUpdate, opts.Update.Force)
 	return config
 }
 
@@ -609,7 +763,11 @@ func main() {
 	parser, extraArgs, flagsErr := cli.ParseFlags("Please", &opts, os.Args)
 	// Note that we must leave flagsErr for later, because it may be affected by aliases.
 	if opts.OutputFlags.Version {
-		fmt.Printf("Please version %s\n", core.PleaseVersion)
+		if core.GitCommit != "" {
+			fmt.Printf("Please version %s (git commit %s)\n", core.PleaseVersion, core.GitCommit)
+		} else {
+			fmt.Printf("Please version %s\n", core.PleaseVersion)
+		}
 		os.Exit(0) // Ignore other errors if --version was passed.
 	}
 	if opts.OutputFlags.Colour {
@@ -64,7 +64,7 @@ func queryCompletionPackages(config *core.Configuration, query, repoRoot string)
 func QueryCompletions(graph *core.BuildGraph, labels []core.BuildLabel, binary, test bool) {
 	for _, label := range labels {
 		count := 0
-		for _, target := range graph.PackageOrDie(label.PackageName).Targets {
+		for _, target := range graph.PackageOrDie(label).Targets {
 			if (binary && (!target.IsBinary || target.IsTest)) || (test && !target.IsTest) {
 				continue
 			}
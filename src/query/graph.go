@@ -92,7 +92,7 @@ func addJSONTarget(graph *core.BuildGraph, ret *JSONGraph, label core.BuildLabel
 	}
 	done[label] = struct{}{}
 	if label.IsAllTargets() {
-		pkg := graph.PackageOrDie(label.PackageName)
+		pkg := graph.PackageOrDie(label)
 		for _, target := range pkg.Targets {
 			addJSONTarget(graph, ret, target.Label, done)
 		}
@@ -0,0 +1,83 @@
+package query
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"core"
+)
+
+// QueryLog prints the log of the last action run for a target.
+// If action is empty it picks whichever of the target's build and test logs was written most recently;
+// for a sharded test the logs of all its shards are printed.
+// previous selects an older log, 1 being the one before the latest.
+func QueryLog(label core.BuildLabel, action string, previous int) error {
+	files, err := actionLogFiles(label, action, previous)
+	if err != nil {
+		return err
+	} else if len(files) == 0 {
+		if action == "" {
+			action = "build or test"
+		}
+		return fmt.Errorf("No %s log found for %s", action, label)
+	}
+	for i, file := range files {
+		contents, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if len(files) > 1 {
+			if i > 0 {
+				fmt.Printf("\n")
+			}
+			fmt.Printf("==> %s <==\n", file)
+		}
+		os.Stdout.Write(contents)
+	}
+	return nil
+}
+
+// actionLogFiles returns the log files to print for a target.
+func actionLogFiles(label core.BuildLabel, action string, previous int) ([]string, error) {
+	suffix := ".log"
+	if previous > 0 {
+		suffix += "." + strconv.Itoa(previous)
+	}
+	dir := path.Dir(core.ActionLogFile(label, "build", 0))
+	files, err := filepath.Glob(path.Join(dir, action+"*"+suffix))
+	if err != nil {
+		return nil, err
+	}
+	// Find the most recent one, and print all the logs for the same kind of action.
+	var latest os.FileInfo
+	latestKind := ""
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil && (latest == nil || info.ModTime().After(latest.ModTime())) {
+			latest = info
+			latestKind = actionKind(file, suffix)
+		}
+	}
+	ret := []string{}
+	for _, file := range files {
+		if actionKind(file, suffix) == latestKind {
+			ret = append(ret, file)
+		}
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// actionKind returns the kind of action a log file is for, i.e. the shards of a test are all "test".
+func actionKind(file, suffix string) string {
+	action := strings.TrimSuffix(path.Base(file), suffix)
+	if strings.HasPrefix(action, "test_shard") {
+		return "test"
+	}
+	return action
+}
@@ -70,6 +70,7 @@ func QueryPrint(graph *core.BuildGraph, labels []core.BuildLabel) {
 		} else {
 			pythonBool("container", target.Containerise)
 		}
+		pythonBool("sandbox", target.Sandbox)
 		pythonBool("no_test_output", target.NoTestOutput)
 		pythonBool("test_only", target.TestOnly)
 		labelList("deps", excludeLabels(target.DeclaredDependencies(), target.ExportedDependencies(), sourceLabels(target)), target)
@@ -93,6 +94,7 @@ func QueryPrint(graph *core.BuildGraph, labels []core.BuildLabel) {
 		stringList("licences", target.Licences)
 		stringList("test_outputs", target.TestOutputs)
 		stringList("requires", target.Requires)
+		stringList("pass_env", target.PassEnv)
 		if len(target.Provides) > 0 {
 			fmt.Printf("      provides = {\n")
 			for k, v := range target.Provides {
@@ -113,6 +115,15 @@ func QueryPrint(graph *core.BuildGraph, labels []core.BuildLabel) {
 		if target.TestTimeout > 0 {
 			fmt.Printf("      test_timeout = %d,\n", target.TestTimeout)
 		}
+		if target.Shards > 0 {
+			fmt.Printf("      shards = %d,\n", target.Shards)
+		}
+		if target.Cpus > 0 {
+			fmt.Printf("      cpus = %d,\n", target.Cpus)
+		}
+		if target.Memory > 0 {
+			fmt.Printf("      memory = %d,\n", target.Memory)
+		}
 		if len(target.Visibility) > 0 {
 			fmt.Printf("      visibility = [\n")
 			for _, vis := range target.Visibility {
@@ -15,6 +15,7 @@ var KnownFields = map[string]bool{
 	"Command":                     true,
 	"Commands":                    true,
 	"Containerise":                true,
+	"Cpus":                        true,
 	"ContainerSettings":           true,
 	"Data":                        true,
 	"dependencies":                true,
@@ -25,16 +26,20 @@ var KnownFields = map[string]bool{
 	"Label":                       true, // this includes the target's name
 	"Labels":                      true,
 	"Licences":                    true,
+	"Memory":                      true,
 	"NamedSources":                true,
 	"NeedsTransitiveDependencies": true,
 	"NoTestOutput":                true,
 	"OptionalOutputs":             true,
 	"OutputIsComplete":            true,
 	"outputs":                     true,
+	"PassEnv":                     true,
 	"PreBuildFunction":            true,
 	"PostBuildFunction":           true,
 	"Provides":                    true,
 	"Requires":                    true,
+	"Sandbox":                     true,
+	"Shards":                      true,
 	"Sources":                     true,
 	"Stamp":                       true,
 	"TestCommand":                 true,
@@ -47,6 +52,7 @@ var KnownFields = map[string]bool{
 
 	// These aren't part of the declaration, only used internally.
 	"state":         true,
+	"sharedWith":    true,
 	"Results":       true,
 	"PreBuildHash":  true,
 	"PostBuildHash": true,
@@ -0,0 +1,20 @@
+package query
+
+import (
+	"fmt"
+
+	"core"
+)
+
+// QuerySlowest prints the given number of targets that have historically taken longest to build and test.
+func QuerySlowest(timings *core.TimingDB, n int) {
+	slowest := timings.Slowest(n)
+	if len(slowest) == 0 {
+		fmt.Printf("No timings recorded yet; they're recorded as targets are built and tested.\n")
+		return
+	}
+	fmt.Printf("%8s %8s %8s  %s\n", "Total", "Build", "Test", "Target")
+	for _, timing := range slowest {
+		fmt.Printf("%7.1fs %7.1fs %7.1fs  %s\n", timing.Total(), timing.Build, timing.Test, timing.Label)
+	}
+}
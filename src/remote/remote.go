@@ -0,0 +1,24 @@
+// Package remote implements executing build actions on remote workers.
+package remote
+
+import (
+	"gopkg.in/op/go-logging.v1"
+
+	"core"
+)
+
+var log = logging.MustGetLogger("remote")
+
+// NewExecutor creates a new executor from the given config.
+// It returns a local executor if no remote workers are configured or none can be reached.
+func NewExecutor(config *core.Configuration) core.Executor {
+	if len(config.Remote.Workers) == 0 {
+		return &core.LocalExecutor{}
+	}
+	executor, err := newRpcExecutor(config)
+	if err != nil {
+		log.Warning("%s, will build locally", err)
+		return &core.LocalExecutor{}
+	}
+	return executor
+}
@@ -0,0 +1,464 @@
+// +build proto
+
+// Executor that sends build actions to a pool of remote workers over gRPC.
+package remote
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	"cache"
+	"core"
+	pb "remote/proto/remote_worker"
+)
+
+// chunkSize is the size of chunks that we send input files in.
+const chunkSize = 1024 * 1024
+
+// initialRecheck and maxRecheck bound how long we wait between checking whether a failed worker
+// has come back; the interval doubles each time it's still not serving.
+const initialRecheck = 5 * time.Second
+const maxRecheck = 5 * time.Minute
+
+type rpcExecutor struct {
+	workers []*remoteWorker
+	// Used for actions that we can't run remotely, or if a worker fails.
+	local   core.Executor
+	timeout time.Duration
+	// Digests of files we've already calculated, so we don't keep redoing them for
+	// inputs shared between many actions.
+	digests map[string]*fileDigest
+	mutex   sync.Mutex
+	// Closed on shutdown to stop rechecking failed workers.
+	done chan struct{}
+}
+
+// A remoteWorker represents our connection to a single worker.
+type remoteWorker struct {
+	url        string
+	connection *grpc.ClientConn
+	client     pb.RemoteWorkerClient
+	// Number of actions currently running on this worker. Protected by the executor's mutex.
+	inFlight int
+	// True if the worker has failed and is out of rotation until it's serving again.
+	// Also protected by the executor's mutex.
+	unhealthy bool
+}
+
+// A fileDigest is a digest of a file which is valid while its size and modification time are unchanged.
+type fileDigest struct {
+	modTime time.Time
+	size    int64
+	digest  []byte
+}
+
+func (e *rpcExecutor) Execute(action *core.BuildAction) ([]byte, []byte, error) {
+	if action.Target.PostBuildFunction != 0 {
+		// Post-build functions can add outputs after the action has run, which we wouldn't
+		// know to retrieve from the worker.
+		return e.local.Execute(action)
+	} else if action.Sandbox {
+		// Workers don't sandbox actions, so we can't honour that remotely.
+		return e.local.Execute(action)
+	}
+	inputs, files, err := e.digestInputs(action)
+	if err != nil {
+		log.Warning("Failed to collect inputs of %s for remote workers: %s\nWill build it locally instead.", action.Target.Label, err)
+		return e.local.Execute(action)
+	}
+	worker := e.acquire()
+	if worker == nil {
+		log.Debug("No healthy remote workers, building %s locally", action.Target.Label)
+		return e.local.Execute(action)
+	}
+	defer e.release(worker)
+	log.Debug("Building %s on remote worker %s", action.Target.Label, worker.url)
+	resp, err := e.executeInputs(worker, action, inputs, files)
+	if err != nil {
+		log.Warning("Failed to build %s on remote worker %s: %s\nWill build it locally instead.", action.Target.Label, worker.url, err)
+		e.markUnhealthy(worker)
+		if err := removeOutputs(action); err != nil {
+			return nil, nil, err
+		}
+		return e.local.Execute(action)
+	}
+	if action.ShowOutput {
+		os.Stderr.Write(resp.CombinedOutput)
+	}
+	if !resp.Success {
+		return resp.Stdout, resp.CombinedOutput, errors.New(resp.Error)
+	}
+	return resp.Stdout, resp.CombinedOutput, nil
+}
+
+func (e *rpcExecutor) Shutdown() {
+	close(e.done)
+	for _, worker := range e.workers {
+		worker.connection.Close()
+	}
+}
+
+// acquire returns the least busy healthy worker, or nil if none of them are healthy.
+func (e *rpcExecutor) acquire() *remoteWorker {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	var best *remoteWorker
+	for _, worker := range e.workers {
+		if !worker.unhealthy && (best == nil || worker.inFlight < best.inFlight) {
+			best = worker
+		}
+	}
+	if best != nil {
+		best.inFlight++
+	}
+	return best
+}
+
+// release marks an action as finished on a worker.
+func (e *rpcExecutor) release(worker *remoteWorker) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	worker.inFlight--
+}
+
+// markUnhealthy takes a worker out of rotation after it's failed, and starts checking
+// in the background for it to come back.
+func (e *rpcExecutor) markUnhealthy(worker *remoteWorker) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if !worker.unhealthy {
+		worker.unhealthy = true
+		go e.recheck(worker)
+	}
+}
+
+// recheck checks an unhealthy worker at increasing intervals until it's serving again.
+func (e *rpcExecutor) recheck(worker *remoteWorker) {
+	for interval := initialRecheck; ; interval *= 2 {
+		if interval > maxRecheck {
+			interval = maxRecheck
+		}
+		select {
+		case <-e.done:
+			return
+		case <-time.After(interval):
+		}
+		if err := checkHealth(worker.connection, e.timeout); err != nil {
+			log.Debug("Remote worker %s still unhealthy: %s", worker.url, err)
+			continue
+		}
+		log.Notice("Remote worker %s is serving again", worker.url)
+		e.mutex.Lock()
+		worker.unhealthy = false
+		e.mutex.Unlock()
+		return
+	}
+}
+
+// removeOutputs removes any outputs that a failed remote attempt may have partially written,
+// so a local build of the action doesn't start with them in place.
+func removeOutputs(action *core.BuildAction) error {
+	for _, out := range action.Outputs {
+		filename, err := core.JoinWithin(action.Dir, out)
+		if err != nil {
+			return err
+		} else if err := os.RemoveAll(filename); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// execute runs a single action on the given worker and writes its outputs into the action's
+// directory. It returns the final response from the worker.
+// Errors returned are from communicating with the worker; failure of the action itself is
+// indicated in the response.
+func (e *rpcExecutor) execute(worker *remoteWorker, action *core.BuildAction) (*pb.ExecuteResponse, error) {
+	inputs, files, err := e.digestInputs(action)
+	if err != nil {
+		return nil, err
+	}
+	return e.executeInputs(worker, action, inputs, files)
+}
+
+// executeInputs is like execute but takes the action's inputs, which have already been digested.
+func (e *rpcExecutor) executeInputs(worker *remoteWorker, action *core.BuildAction, inputs []*pb.InputFile, files map[string]string) (*pb.ExecuteResponse, error) {
+	if err := e.uploadInputs(worker, files); err != nil {
+		return nil, err
+	}
+	timeout := action.Timeout
+	if timeout == 0 {
+		timeout = time.Duration(action.DefaultTimeout)
+	}
+	// Allow a bit of leeway on top of the action's timeout for transferring files.
+	ctx, cancel := context.WithTimeout(context.Background(), timeout+e.timeout)
+	defer cancel()
+	stream, err := worker.client.Execute(ctx, &pb.ExecuteRequest{
+		Label:    action.Target.Label.String(),
+		Command:  action.Command,
+		Env:      action.Env,
+		Dir:      action.Dir,
+		RepoRoot: core.RepoRoot,
+		Inputs:   inputs,
+		Outputs:  action.Outputs,
+		Timeout:  int64(timeout),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var f *os.File
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			return nil, fmt.Errorf("Worker ended the stream without a result")
+		} else if err != nil {
+			return nil, err
+		} else if resp.Done {
+			if f != nil {
+				return nil, fmt.Errorf("Worker didn't send all of output %s", f.Name())
+			}
+			return resp, nil
+		} else if resp.Chunk == nil {
+			return nil, fmt.Errorf("Missing output chunk in response")
+		}
+		if f == nil {
+			// Don't let the worker write anything outside the action's directory.
+			filename, err := core.JoinWithin(action.Dir, resp.Chunk.Path)
+			if err != nil {
+				return nil, err
+			} else if f, err = createOutput(filename, resp.Chunk.Executable); err != nil {
+				return nil, err
+			}
+		}
+		if _, err := f.Write(resp.Chunk.Body); err != nil {
+			return nil, err
+		}
+		if resp.Chunk.Last {
+			if err := f.Close(); err != nil {
+				return nil, err
+			}
+			f = nil
+		}
+	}
+}
+
+// createOutput creates a single output file returned by a worker.
+func createOutput(filename string, executable bool) (*os.File, error) {
+	if err := os.MkdirAll(path.Dir(filename), core.DirPermissions); err != nil {
+		return nil, err
+	}
+	var mode os.FileMode = 0644
+	if executable {
+		mode = 0755
+	}
+	return os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+}
+
+// digestInputs collects all the input files of an action and calculates their digests.
+// It returns the inputs to send to the worker and a map of digests to the files they came from.
+func (e *rpcExecutor) digestInputs(action *core.BuildAction) ([]*pb.InputFile, map[string]string, error) {
+	inputs := []*pb.InputFile{}
+	files := map[string]string{}
+	add := func(src, dest string) error {
+		return walkFiles(src, func(name string, info os.FileInfo) error {
+			digest, err := e.digestFile(name, info)
+			if err != nil {
+				return err
+			}
+			inputs = append(inputs, &pb.InputFile{
+				Path:       path.Join(dest, name[len(src):]),
+				Digest:     digest,
+				Executable: info.Mode()&0100 != 0,
+			})
+			files[string(digest)] = name
+			return nil
+		})
+	}
+	for _, source := range action.Sources {
+		if err := add(source.Src, source.Tmp); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, tool := range action.Tools {
+		if err := add(tool, tool); err != nil {
+			return nil, nil, err
+		}
+	}
+	return inputs, files, nil
+}
+
+// walkFiles calls the given function for every file under the given path, which may be a
+// file or a directory. Unlike filepath.Walk, symlinks are followed.
+func walkFiles(root string, f func(name string, info os.FileInfo) error) error {
+	info, err := os.Stat(root)
+	if err != nil {
+		return err
+	} else if !info.IsDir() {
+		return f(root, info)
+	}
+	return filepath.Walk(root, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if info.Mode()&os.ModeSymlink != 0 {
+			return walkFiles(name, f)
+		} else if info.IsDir() {
+			return nil
+		}
+		return f(name, info)
+	})
+}
+
+// digestFile returns the SHA-1 digest of a single file.
+func (e *rpcExecutor) digestFile(filename string, info os.FileInfo) ([]byte, error) {
+	e.mutex.Lock()
+	d, present := e.digests[filename]
+	e.mutex.Unlock()
+	if present && d.modTime.Equal(info.ModTime()) && d.size == info.Size() {
+		return d.digest, nil
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha1.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	digest := h.Sum(nil)
+	e.mutex.Lock()
+	e.digests[filename] = &fileDigest{modTime: info.ModTime(), size: info.Size(), digest: digest}
+	e.mutex.Unlock()
+	return digest, nil
+}
+
+// uploadInputs uploads any of the given files that the worker doesn't already have.
+func (e *rpcExecutor) uploadInputs(worker *remoteWorker, files map[string]string) error {
+	req := &pb.FindMissingInputsRequest{}
+	for digest := range files {
+		req.Digests = append(req.Digests, []byte(digest))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+	defer cancel()
+	resp, err := worker.client.FindMissingInputs(ctx, req)
+	if err != nil {
+		return err
+	} else if len(resp.Digests) == 0 {
+		return nil
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := worker.client.UploadInputs(ctx)
+	if err != nil {
+		return err
+	}
+	for _, digest := range resp.Digests {
+		if err := sendInput(stream, digest, files[string(digest)]); err != nil {
+			return err
+		}
+	}
+	if resp, err := stream.CloseAndRecv(); err != nil {
+		return err
+	} else if !resp.Success {
+		return fmt.Errorf("Failed to upload inputs")
+	}
+	return nil
+}
+
+// sendInput sends the contents of a single input file on an upload stream in chunks.
+func sendInput(stream pb.RemoteWorker_UploadInputsClient, digest []byte, filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(f, buf)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return err
+		}
+		if err := stream.Send(&pb.UploadInputsRequest{Digest: digest, Body: buf[:n], Last: last}); err != nil || last {
+			return err
+		}
+	}
+}
+
+// connect connects to a single worker and checks that it's serving.
+func connect(url string, timeout time.Duration, auth grpc.DialOption) (*remoteWorker, error) {
+	connection, err := grpc.Dial(url, grpc.WithTimeout(timeout), auth)
+	if err != nil {
+		return nil, err
+	}
+	// As with the RPC cache, we need to send it a message to know that it's really there.
+	if err := checkHealth(connection, timeout); err != nil {
+		connection.Close()
+		return nil, err
+	}
+	return &remoteWorker{url: url, connection: connection, client: pb.NewRemoteWorkerClient(connection)}, nil
+}
+
+// checkHealth checks that the worker on the other end of a connection is serving.
+func checkHealth(connection *grpc.ClientConn, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	resp, err := healthpb.NewHealthClient(connection).Check(ctx, &healthpb.HealthCheckRequest{Service: "plz-remote-worker"})
+	if err != nil {
+		return err
+	} else if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("Worker says it is not serving (%d)", resp.Status)
+	}
+	return nil
+}
+
+func newRpcExecutor(config *core.Configuration) (*rpcExecutor, error) {
+	e := &rpcExecutor{
+		local:   &core.LocalExecutor{},
+		timeout: time.Duration(config.Remote.Timeout),
+		digests: map[string]*fileDigest{},
+		done:    make(chan struct{}),
+	}
+	// Workers always require TLS since they'll run whatever they're sent.
+	auth, err := cache.LoadAuth(config.Remote.CACert, config.Remote.PublicKey, config.Remote.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load remote worker credentials: %s", err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(len(config.Remote.Workers))
+	for _, url := range config.Remote.Workers {
+		go func(url string) {
+			defer wg.Done()
+			worker, err := connect(url, e.timeout, auth)
+			if err != nil {
+				log.Warning("Failed to connect to remote worker %s: %s", url, err)
+				return
+			}
+			e.mutex.Lock()
+			defer e.mutex.Unlock()
+			e.workers = append(e.workers, worker)
+		}(url)
+	}
+	wg.Wait()
+	if len(e.workers) == 0 {
+		return nil, fmt.Errorf("Couldn't connect to any remote workers")
+	}
+	log.Info("Connected to %d of %d remote workers", len(e.workers), len(config.Remote.Workers))
+	return e, nil
+}
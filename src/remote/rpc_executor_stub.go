@@ -0,0 +1,13 @@
+// Only used at initial bootstrap or when used with 'go run' so we don't have to worry
+// about proto compilation until that's sorted.
+
+package remote
+
+import (
+	"core"
+	"fmt"
+)
+
+func newRpcExecutor(config *core.Configuration) (core.Executor, error) {
+	return nil, fmt.Errorf("Config specifies remote workers but they are not compiled")
+}
@@ -0,0 +1,192 @@
+// Tests for the remote executor, against a worker running on localhost.
+package remote
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"core"
+	"remote/worker"
+)
+
+const tmpDir = "plz-out/tmp/src/remote/rpc_executor_test._build"
+
+// Certificates and keys of the worker and of a client that it allows and one that it doesn't.
+var serverCert, serverKey, clientCert, clientKey, otherCert, otherKey string
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "rpc_executor_test")
+	if err != nil {
+		panic(err)
+	}
+	w, err := worker.NewWorker(dir, 2, 0)
+	if err != nil {
+		panic(err)
+	}
+	serverCert, serverKey = writeCert(dir, "server")
+	clientCert, clientKey = writeCert(dir, "client")
+	otherCert, otherKey = writeCert(dir, "other")
+	s, lis := worker.BuildGrpcServer(7695, w, serverKey, serverCert, "", clientCert)
+	go s.Serve(lis)
+	core.RepoRoot, _ = os.Getwd()
+	os.Exit(m.Run())
+}
+
+// writeCert generates a self-signed certificate for localhost and writes it and its key into
+// the given directory, returning their filenames.
+func writeCert(dir, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		panic(err)
+	}
+	certFile := path.Join(dir, name+".pem")
+	keyFile := path.Join(dir, name+".key")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), 0644); err != nil {
+		panic(err)
+	} else if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}), 0600); err != nil {
+		panic(err)
+	}
+	return certFile, keyFile
+}
+
+func newExecutor(t *testing.T) *rpcExecutor {
+	return newExecutorWithCert(t, clientCert, clientKey)
+}
+
+func newExecutorWithCert(t *testing.T, cert, key string) *rpcExecutor {
+	config := core.DefaultConfiguration()
+	config.Remote.Workers = []string{"localhost:7695"}
+	config.Remote.CACert = serverCert
+	config.Remote.PublicKey = cert
+	config.Remote.PrivateKey = key
+	e, err := newRpcExecutor(config)
+	assert.NoError(t, err)
+	return e
+}
+
+func newAction(t *testing.T, name, command string) *core.BuildAction {
+	src := path.Join(os.TempDir(), name+".txt")
+	assert.NoError(t, ioutil.WriteFile(src, []byte("hello"), 0644))
+	dir := path.Join(tmpDir, name)
+	assert.NoError(t, os.MkdirAll(dir, core.DirPermissions))
+	return &core.BuildAction{
+		Target:         core.NewBuildTarget(core.ParseBuildLabel("//src/remote:"+name, "")),
+		Command:        command,
+		Env:            []string{"TMP_DIR=" + path.Join(core.RepoRoot, dir)},
+		Dir:            dir,
+		DefaultTimeout: core.DefaultConfiguration().Build.Timeout,
+		Sources:        []core.SourcePair{{Src: src, Tmp: path.Join(dir, "in.txt")}},
+		Outputs:        []string{"out.txt"},
+	}
+}
+
+func TestExecute(t *testing.T) {
+	e := newExecutor(t)
+	defer e.Shutdown()
+	action := newAction(t, "execute", "cat $TMP_DIR/in.txt in.txt > out.txt && echo done")
+	out, _, err := e.Execute(action)
+	assert.NoError(t, err)
+	assert.Equal(t, "done\n", string(out))
+	b, err := ioutil.ReadFile(path.Join(action.Dir, "out.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hellohello", string(b))
+}
+
+func TestExecuteRemotely(t *testing.T) {
+	// Call execute directly so we know it didn't fall back to running locally.
+	e := newExecutor(t)
+	defer e.Shutdown()
+	action := newAction(t, "execute_remotely", "cat in.txt > out.txt")
+	resp, err := e.execute(e.workers[0], action)
+	assert.NoError(t, err)
+	assert.True(t, resp.Success)
+	b, err := ioutil.ReadFile(path.Join(action.Dir, "out.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+}
+
+func TestUnknownClient(t *testing.T) {
+	e := newExecutorWithCert(t, otherCert, otherKey)
+	defer e.Shutdown()
+	action := newAction(t, "unknown_client", "cat in.txt > out.txt")
+	_, err := e.execute(e.workers[0], action)
+	assert.Error(t, err)
+	assert.False(t, core.PathExists(path.Join(action.Dir, "out.txt")))
+}
+
+func TestExecuteFailure(t *testing.T) {
+	e := newExecutor(t)
+	defer e.Shutdown()
+	action := newAction(t, "failure", "echo wibble && false")
+	_, combined, err := e.Execute(action)
+	assert.Error(t, err)
+	assert.Equal(t, "wibble\n", string(combined))
+	assert.False(t, core.PathExists(path.Join(action.Dir, "out.txt")))
+}
+
+func TestNoWorkers(t *testing.T) {
+	config := core.DefaultConfiguration()
+	config.Remote.Workers = []string{"localhost:7696"}
+	config.Remote.Timeout = core.DefaultConfiguration().Remote.Timeout / 5
+	start := time.Now()
+	e := NewExecutor(config)
+	assert.IsType(t, &core.LocalExecutor{}, e)
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+func TestUnhealthyWorker(t *testing.T) {
+	e := newExecutor(t)
+	defer e.Shutdown()
+	worker := e.workers[0]
+	e.markUnhealthy(worker)
+	assert.Nil(t, e.acquire())
+	// With no healthy workers it should build locally.
+	action := newAction(t, "unhealthy_worker", "echo done")
+	out, _, err := e.Execute(action)
+	assert.NoError(t, err)
+	assert.Equal(t, "done\n", string(out))
+	assert.Equal(t, 0, worker.inFlight)
+}
+
+func TestRemoveOutputs(t *testing.T) {
+	action := newAction(t, "remove_outputs", "")
+	filename := path.Join(action.Dir, "out.txt")
+	assert.NoError(t, ioutil.WriteFile(filename, []byte("partial"), 0644))
+	assert.NoError(t, removeOutputs(action))
+	assert.False(t, core.PathExists(filename))
+	action.Outputs = []string{"../escape.txt"}
+	assert.Error(t, removeOutputs(action))
+}
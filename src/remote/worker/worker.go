@@ -0,0 +1,340 @@
+// Package worker implements a server that runs build actions on behalf of remote clients.
+//
+// Clients upload the inputs of each action into a content-addressed store on the worker,
+// which materialises them into a fresh directory per action, runs the command there and
+// streams the outputs back.
+package worker
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"gopkg.in/op/go-logging.v1"
+
+	"cache/server"
+	"cli"
+	"core"
+	pb "remote/proto/remote_worker"
+)
+
+var log = logging.MustGetLogger("worker")
+
+// maxMsgSize is the maximum message size our gRPC server accepts.
+const maxMsgSize = 200 * 1024 * 1024
+
+// chunkSize is the size of chunks that we send output files in.
+const chunkSize = 1024 * 1024
+
+// defaultTimeout is the timeout we apply to actions if the client doesn't send one.
+const defaultTimeout = cli.Duration(10 * time.Minute)
+
+// inputDir and actionDir are the subdirectories of the worker's directory that hold the
+// input store and the working directories of actions respectively.
+const inputDir = "inputs"
+const actionDir = "actions"
+
+// A Worker implements the RemoteWorker gRPC service.
+type Worker struct {
+	dir string
+	// Certificates of clients that are allowed to use this worker.
+	allowedCerts map[string]*x509.Certificate
+	// Limits the number of actions that can run at once.
+	limiter chan struct{}
+}
+
+// NewWorker creates a new Worker storing files in the given directory, which will run
+// at most numActions actions at once. Inputs that haven't been used for maxInputAge are
+// periodically removed.
+func NewWorker(dir string, numActions int, maxInputAge time.Duration) (*Worker, error) {
+	// Anything left in the actions directory is from a previous run that didn't clean up.
+	if err := os.RemoveAll(path.Join(dir, actionDir)); err != nil {
+		return nil, err
+	}
+	for _, d := range []string{inputDir, actionDir} {
+		if err := os.MkdirAll(path.Join(dir, d), core.DirPermissions); err != nil {
+			return nil, err
+		}
+	}
+	w := &Worker{dir: dir, limiter: make(chan struct{}, numActions)}
+	if maxInputAge > 0 {
+		go func() {
+			for range time.NewTicker(maxInputAge / 10).C {
+				w.cleanInputs(maxInputAge)
+			}
+		}()
+	}
+	return w, nil
+}
+
+// FindMissingInputs implements the RemoteWorker interface.
+func (w *Worker) FindMissingInputs(ctx context.Context, req *pb.FindMissingInputsRequest) (*pb.FindMissingInputsResponse, error) {
+	if err := server.AuthenticateClient(w.allowedCerts, ctx); err != nil {
+		return nil, err
+	}
+	resp := &pb.FindMissingInputsResponse{}
+	for _, digest := range req.Digests {
+		if !core.PathExists(w.inputPath(digest)) {
+			resp.Digests = append(resp.Digests, digest)
+		}
+	}
+	return resp, nil
+}
+
+// UploadInputs implements the RemoteWorker interface.
+func (w *Worker) UploadInputs(stream pb.RemoteWorker_UploadInputsServer) error {
+	if err := server.AuthenticateClient(w.allowedCerts, stream.Context()); err != nil {
+		return err
+	}
+	var f *os.File
+	var digest []byte
+	h := sha1.New()
+	// Make sure we don't leave partial files behind if anything goes wrong.
+	defer func() {
+		if f != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(&pb.UploadInputsResponse{Success: true})
+		} else if err != nil {
+			return err
+		}
+		if f == nil {
+			if f, err = ioutil.TempFile(path.Join(w.dir, inputDir), ".tmp_"); err != nil {
+				return err
+			}
+			digest = req.Digest
+			h.Reset()
+		} else if !bytes.Equal(digest, req.Digest) {
+			return grpc.Errorf(codes.InvalidArgument, "Input %x ended without its last chunk", digest)
+		}
+		if _, err := f.Write(req.Body); err != nil {
+			return err
+		}
+		h.Write(req.Body)
+		if req.Last {
+			if err := w.storeInput(f, digest, h.Sum(nil)); err != nil {
+				return err
+			}
+			f = nil
+		}
+	}
+}
+
+// storeInput moves a completed temp file into the input store.
+func (w *Worker) storeInput(f *os.File, digest, actual []byte) error {
+	name := f.Name()
+	f.Close()
+	if !bytes.Equal(digest, actual) {
+		os.Remove(name)
+		return grpc.Errorf(codes.InvalidArgument, "Digest mismatch for input; expected %x, got %x", digest, actual)
+	}
+	dest := w.inputPath(digest)
+	if err := os.MkdirAll(path.Dir(dest), core.DirPermissions); err != nil {
+		os.Remove(name)
+		return err
+	}
+	// Inputs are never modified in place, so there's no harm in this replacing one that
+	// another client uploaded concurrently.
+	return os.Rename(name, dest)
+}
+
+// Execute implements the RemoteWorker interface.
+func (w *Worker) Execute(req *pb.ExecuteRequest, stream pb.RemoteWorker_ExecuteServer) error {
+	if err := server.AuthenticateClient(w.allowedCerts, stream.Context()); err != nil {
+		return err
+	}
+	w.limiter <- struct{}{}
+	defer func() { <-w.limiter }()
+	log.Info("Building %s", req.Label)
+	root, err := ioutil.TempDir(path.Join(w.dir, actionDir), "action_")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(root)
+	if err := w.materialise(root, req.Inputs); err != nil {
+		return err
+	}
+	dir, err := core.JoinWithin(root, req.Dir)
+	if err != nil {
+		return grpc.Errorf(codes.InvalidArgument, "Invalid directory: %s", err)
+	}
+	for _, output := range req.Outputs {
+		if _, err := core.JoinWithin(dir, output); err != nil {
+			return grpc.Errorf(codes.InvalidArgument, "Invalid output: %s", err)
+		}
+	}
+	if err := os.MkdirAll(dir, core.DirPermissions); err != nil {
+		return err
+	}
+	cmd := req.Command
+	env := req.Env
+	if req.RepoRoot != "" {
+		cmd = strings.Replace(cmd, req.RepoRoot, root, -1)
+		for i, e := range env {
+			env[i] = strings.Replace(e, req.RepoRoot, root, -1)
+		}
+	}
+	out, combined, err := core.ExecWithTimeoutShell(dir, env, time.Duration(req.Timeout), defaultTimeout, false, false, cmd)
+	if err != nil {
+		log.Info("Failed to build %s: %s", req.Label, err)
+		return stream.Send(&pb.ExecuteResponse{
+			Done:           true,
+			Stdout:         out,
+			CombinedOutput: combined,
+			Error:          err.Error(),
+		})
+	}
+	for _, output := range req.Outputs {
+		if err := sendOutput(stream, dir, output); err != nil {
+			return err
+		}
+	}
+	log.Info("Built %s", req.Label)
+	return stream.Send(&pb.ExecuteResponse{
+		Done:           true,
+		Success:        true,
+		Stdout:         out,
+		CombinedOutput: combined,
+	})
+}
+
+// materialise copies the given inputs from the store into the action's directory.
+// They're copied rather than linked so actions can't modify the store.
+func (w *Worker) materialise(root string, inputs []*pb.InputFile) error {
+	now := time.Now()
+	for _, input := range inputs {
+		src := w.inputPath(input.Digest)
+		if !core.PathExists(src) {
+			return grpc.Errorf(codes.FailedPrecondition, "Missing input %s (%x)", input.Path, input.Digest)
+		}
+		var mode os.FileMode = 0644
+		if input.Executable {
+			mode = 0755
+		}
+		dest, err := core.JoinWithin(root, input.Path)
+		if err != nil {
+			return grpc.Errorf(codes.InvalidArgument, "Invalid input: %s", err)
+		}
+		if err := core.CopyFile(src, dest, mode); err != nil {
+			return err
+		}
+		// Record when it was last used so we know when we can clean it.
+		os.Chtimes(src, now, now)
+	}
+	return nil
+}
+
+// sendOutput streams a single output (which may be a directory) back to the client.
+func sendOutput(stream pb.RemoteWorker_ExecuteServer, dir, output string) error {
+	return filepath.Walk(path.Join(dir, output), func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil // The client will notice the missing output and report it.
+			}
+			return err
+		} else if info.IsDir() {
+			return nil
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		chunk := &pb.OutputChunk{Path: name[len(dir)+1:], Executable: info.Mode()&0100 != 0}
+		buf := make([]byte, chunkSize)
+		for {
+			n, err := io.ReadFull(f, buf)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				chunk.Body = buf[:n]
+				chunk.Last = true
+				return stream.Send(&pb.ExecuteResponse{Chunk: chunk})
+			} else if err != nil {
+				return err
+			}
+			chunk.Body = buf[:n]
+			if err := stream.Send(&pb.ExecuteResponse{Chunk: chunk}); err != nil {
+				return err
+			}
+		}
+	})
+}
+
+// inputPath returns the location in the store of the input with the given digest.
+func (w *Worker) inputPath(digest []byte) string {
+	h := hex.EncodeToString(digest)
+	if len(h) < 2 {
+		return path.Join(w.dir, inputDir, "_", h)
+	}
+	return path.Join(w.dir, inputDir, h[:2], h)
+}
+
+// cleanInputs removes any inputs that haven't been used for longer than the given time.
+func (w *Worker) cleanInputs(maxAge time.Duration) {
+	threshold := time.Now().Add(-maxAge)
+	removed := 0
+	filepath.Walk(path.Join(w.dir, inputDir), func(name string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && info.ModTime().Before(threshold) {
+			if err := os.Remove(name); err == nil {
+				removed++
+			}
+		}
+		return nil
+	})
+	log.Notice("Removed %d unused inputs", removed)
+}
+
+// BuildGrpcServer creates a new, unstarted grpc.Server and returns it.
+// It also returns a net.Listener to start it on.
+// Clients must present one of the certificates in allowedCerts (a file or directory of them).
+// If keyFile and allowedCerts are empty the server is completely unauthenticated, which should
+// only ever be done for testing since anyone who can reach it can run arbitrary commands.
+func BuildGrpcServer(port int, worker *Worker, keyFile, certFile, caCertFile, allowedCerts string) (*grpc.Server, net.Listener) {
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		log.Fatalf("Failed to listen on port %d: %v", port, err)
+	}
+	opts := []grpc.ServerOption{grpc.MaxMsgSize(maxMsgSize)}
+	if keyFile != "" {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(server.ServerTLSConfig(keyFile, certFile, caCertFile))))
+	}
+	if allowedCerts != "" {
+		worker.allowedCerts = server.LoadCerts(allowedCerts)
+		if len(worker.allowedCerts) == 0 {
+			log.Fatalf("No certificates found in %s", allowedCerts)
+		}
+	}
+	s := grpc.NewServer(opts...)
+	pb.RegisterRemoteWorkerServer(s, worker)
+	healthserver := health.NewServer()
+	healthserver.SetServingStatus("plz-remote-worker", healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(s, healthserver)
+	return s, lis
+}
+
+// ServeGrpcForever constructs a new server on the given port and serves until killed.
+func ServeGrpcForever(port int, worker *Worker, keyFile, certFile, caCertFile, allowedCerts string) {
+	s, lis := BuildGrpcServer(port, worker, keyFile, certFile, caCertFile, allowedCerts)
+	log.Notice("Serving remote worker on port %d", port)
+	s.Serve(lis)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"runtime"
+	"time"
+
+	"gopkg.in/op/go-logging.v1"
+
+	"cli"
+	"remote/worker"
+)
+
+var log = logging.MustGetLogger("remote_worker")
+
+var opts struct {
+	Port        int          `short:"p" long:"port" description:"Port to serve on" default:"7679"`
+	Dir         string       `short:"d" long:"dir" description:"Directory to store inputs and run actions in" default:"plz-remote-worker"`
+	NumActions  int          `short:"n" long:"num_actions" description:"Maximum number of actions to run at once. Defaults to the number of CPUs."`
+	MaxInputAge cli.Duration `short:"m" long:"max_input_age" description:"Clean any input that's not been used in this long" default:"72h"`
+	Verbosity   int          `short:"v" long:"verbosity" description:"Verbosity of output (higher number = more output, default 2 -> notice, warnings and errors only)" default:"2"`
+	LogFile     string       `long:"log_file" description:"File to log to (in addition to stdout)"`
+
+	TLSFlags struct {
+		KeyFile      string `long:"key_file" required:"true" description:"File containing PEM-encoded private key."`
+		CertFile     string `long:"cert_file" required:"true" description:"File containing PEM-encoded certificate"`
+		CACertFile   string `long:"ca_cert_file" description:"File containing PEM-encoded CA certificate"`
+		AllowedCerts string `long:"allowed_certs" required:"true" description:"File or directory containing certificates of clients that are allowed to run actions on this worker"`
+	} `group:"Options controlling TLS communication & authentication"`
+}
+
+func main() {
+	cli.ParseFlagsOrDie("Please remote worker", "5.5.0", &opts)
+	cli.InitLogging(opts.Verbosity)
+	if opts.LogFile != "" {
+		cli.InitFileLogging(opts.LogFile, opts.Verbosity)
+	}
+	if opts.NumActions <= 0 {
+		opts.NumActions = runtime.NumCPU()
+	}
+	w, err := worker.NewWorker(opts.Dir, opts.NumActions, time.Duration(opts.MaxInputAge))
+	if err != nil {
+		log.Fatalf("Failed to initialise worker directory %s: %s", opts.Dir, err)
+	}
+	log.Notice("Starting up remote worker on port %d, running up to %d actions at once...", opts.Port, opts.NumActions)
+	worker.ServeGrpcForever(opts.Port, w, opts.TLSFlags.KeyFile, opts.TLSFlags.CertFile, opts.TLSFlags.CACertFile, opts.TLSFlags.AllowedCerts)
+}
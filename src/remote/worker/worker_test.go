@@ -0,0 +1,165 @@
+// Tests for the remote worker.
+package worker
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	pb "remote/proto/remote_worker"
+)
+
+func startWorker(t *testing.T, port int) (*grpc.Server, pb.RemoteWorkerClient) {
+	dir, err := ioutil.TempDir("", "worker_test")
+	assert.NoError(t, err)
+	w, err := NewWorker(dir, 2, 0)
+	assert.NoError(t, err)
+	s, lis := BuildGrpcServer(port, w, "", "", "", "")
+	go s.Serve(lis)
+	conn, err := grpc.Dial(fmt.Sprintf("localhost:%d", port), grpc.WithInsecure(), grpc.WithTimeout(5*time.Second))
+	assert.NoError(t, err)
+	return s, pb.NewRemoteWorkerClient(conn)
+}
+
+func ctx() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), 5*time.Second)
+}
+
+func digest(body string) []byte {
+	d := sha1.Sum([]byte(body))
+	return d[:]
+}
+
+func upload(t *testing.T, c pb.RemoteWorkerClient, bodies ...string) {
+	ctx, cancel := ctx()
+	defer cancel()
+	stream, err := c.UploadInputs(ctx)
+	assert.NoError(t, err)
+	for _, body := range bodies {
+		// Send each one in two chunks to make sure they get reassembled.
+		half := len(body) / 2
+		assert.NoError(t, stream.Send(&pb.UploadInputsRequest{Digest: digest(body), Body: []byte(body[:half])}))
+		assert.NoError(t, stream.Send(&pb.UploadInputsRequest{Digest: digest(body), Body: []byte(body[half:]), Last: true}))
+	}
+	resp, err := stream.CloseAndRecv()
+	assert.NoError(t, err)
+	assert.True(t, resp.Success)
+}
+
+// execute runs an action and returns the final response and the outputs it sent.
+func execute(t *testing.T, c pb.RemoteWorkerClient, req *pb.ExecuteRequest) (*pb.ExecuteResponse, map[string]string, error) {
+	ctx, cancel := ctx()
+	defer cancel()
+	stream, err := c.Execute(ctx, req)
+	assert.NoError(t, err)
+	outputs := map[string]string{}
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			return nil, outputs, fmt.Errorf("No final response")
+		} else if err != nil {
+			return nil, outputs, err
+		} else if resp.Done {
+			return resp, outputs, nil
+		}
+		outputs[resp.Chunk.Path] += string(resp.Chunk.Body)
+	}
+}
+
+func TestFindMissingInputs(t *testing.T) {
+	s, c := startWorker(t, 7690)
+	defer s.Stop()
+	upload(t, c, "hello")
+	ctx, cancel := ctx()
+	defer cancel()
+	resp, err := c.FindMissingInputs(ctx, &pb.FindMissingInputsRequest{
+		Digests: [][]byte{digest("hello"), digest("world")},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{digest("world")}, resp.Digests)
+}
+
+func TestUploadDigestMismatch(t *testing.T) {
+	s, c := startWorker(t, 7691)
+	defer s.Stop()
+	ctx, cancel := ctx()
+	defer cancel()
+	stream, err := c.UploadInputs(ctx)
+	assert.NoError(t, err)
+	assert.NoError(t, stream.Send(&pb.UploadInputsRequest{Digest: digest("hello"), Body: []byte("world"), Last: true}))
+	_, err = stream.CloseAndRecv()
+	assert.Error(t, err)
+}
+
+func TestExecute(t *testing.T) {
+	s, c := startWorker(t, 7692)
+	defer s.Stop()
+	upload(t, c, "hello", "world")
+	resp, outputs, err := execute(t, c, &pb.ExecuteRequest{
+		Label:    "//src/remote:test",
+		Command:  "cat $SRCS > $OUT && mkdir dir && echo 42 > dir/out2 && echo done",
+		Env:      []string{"SRCS=a.txt b.txt", "OUT=/repo/plz-out/tmp/src/remote/test._build/out.txt"},
+		Dir:      "plz-out/tmp/src/remote/test._build",
+		RepoRoot: "/repo",
+		Inputs: []*pb.InputFile{
+			{Path: "plz-out/tmp/src/remote/test._build/a.txt", Digest: digest("hello")},
+			{Path: "plz-out/tmp/src/remote/test._build/b.txt", Digest: digest("world")},
+		},
+		Outputs: []string{"out.txt", "dir"},
+		Timeout: int64(10 * time.Second),
+	})
+	assert.NoError(t, err)
+	assert.True(t, resp.Success)
+	assert.Equal(t, "done\n", string(resp.Stdout))
+	assert.Equal(t, map[string]string{"out.txt": "helloworld", "dir/out2": "42\n"}, outputs)
+}
+
+func TestExecuteFailure(t *testing.T) {
+	s, c := startWorker(t, 7693)
+	defer s.Stop()
+	resp, outputs, err := execute(t, c, &pb.ExecuteRequest{
+		Label:   "//src/remote:test",
+		Command: "echo wibble && false",
+		Outputs: []string{"out.txt"},
+	})
+	assert.NoError(t, err)
+	assert.False(t, resp.Success)
+	assert.Equal(t, "wibble\n", string(resp.CombinedOutput))
+	assert.NotEqual(t, "", resp.Error)
+	assert.Equal(t, 0, len(outputs))
+}
+
+func TestExecuteMissingInput(t *testing.T) {
+	s, c := startWorker(t, 7694)
+	defer s.Stop()
+	_, _, err := execute(t, c, &pb.ExecuteRequest{
+		Label:   "//src/remote:test",
+		Command: "true",
+		Inputs:  []*pb.InputFile{{Path: "a.txt", Digest: digest("nope")}},
+	})
+	assert.Error(t, err)
+}
+
+func TestExecuteInvalidPaths(t *testing.T) {
+	s, c := startWorker(t, 7697)
+	defer s.Stop()
+	upload(t, c, "hello")
+	for _, req := range []*pb.ExecuteRequest{
+		{Command: "true", Dir: "../escaped"},
+		{Command: "true", Dir: "/tmp"},
+		{Command: "true", Inputs: []*pb.InputFile{{Path: "a/../../escaped.txt", Digest: digest("hello")}}},
+		{Command: "true", Inputs: []*pb.InputFile{{Path: "/tmp/escaped.txt", Digest: digest("hello")}}},
+		{Command: "true", Outputs: []string{"../../../../etc/passwd"}},
+	} {
+		req.Label = "//src/remote:test"
+		_, _, err := execute(t, c, req)
+		assert.Error(t, err)
+	}
+}
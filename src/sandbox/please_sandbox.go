@@ -0,0 +1,42 @@
+// Package main implements please_sandbox, a small helper that runs a command in a sandbox.
+//
+// On Linux the command is run in new user, mount and network namespaces. It can see only
+// its working directory (read-write), an empty /tmp, a few devices and the directories it's
+// explicitly given (read-only); it has no network access other than loopback.
+// Please invokes this for targets that are marked as sandboxed; see core/sandbox.go.
+package main
+
+import (
+	"os"
+
+	"gopkg.in/op/go-logging.v1"
+
+	"cli"
+)
+
+var log = logging.MustGetLogger("please_sandbox")
+
+var opts struct {
+	Verbosity int      `short:"v" long:"verbosity" description:"Verbosity of output (higher number = more output, default 1 -> warnings and errors only)" default:"1"`
+	ReadOnly  []string `short:"r" long:"read_only" description:"Directory or file to make visible read-only within the sandbox. Can be repeated."`
+	Root      string   `long:"root" description:"Internal use only; passed when re-executing within the new namespaces."`
+	Args      struct {
+		Command []string `positional-arg-name:"command" required:"true" description:"Command to run"`
+	} `positional-args:"true" required:"true"`
+}
+
+func main() {
+	cli.ParseFlagsOrDie("Please sandbox", "5.5.0", &opts)
+	cli.InitLogging(opts.Verbosity)
+	var code int
+	var err error
+	if opts.Root == "" {
+		code, err = sandbox(opts.ReadOnly, opts.Args.Command)
+	} else {
+		code, err = enter(opts.Root, opts.ReadOnly, opts.Args.Command)
+	}
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	os.Exit(code)
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// devices are the device files that are made available within the sandbox.
+var devices = []string{"/dev/null", "/dev/zero", "/dev/random", "/dev/urandom"}
+
+// deviceLinks are symlinks we create in /dev, which commonly-used things like bash's process
+// substitution rely on.
+var deviceLinks = map[string]string{
+	"/dev/fd":     "/proc/self/fd",
+	"/dev/stdin":  "/proc/self/fd/0",
+	"/dev/stdout": "/proc/self/fd/1",
+	"/dev/stderr": "/proc/self/fd/2",
+}
+
+// lockedFlags are the mount flags that we must preserve when remounting something read-only
+// within a user namespace, mapped from the statfs flags that indicate them.
+var lockedFlags = map[int64]uintptr{
+	1:    syscall.MS_RDONLY,
+	2:    syscall.MS_NOSUID,
+	4:    syscall.MS_NODEV,
+	8:    syscall.MS_NOEXEC,
+	1024: syscall.MS_NOATIME,
+	2048: syscall.MS_NODIRATIME,
+	4096: syscall.MS_RELATIME,
+}
+
+// sandbox runs the given command in new namespaces. It does so by re-executing ourselves
+// within them to set up the filesystem, since that can't be done from outside.
+// It returns the exit code of the command.
+func sandbox(dirs, argv []string) (int, error) {
+	root, err := ioutil.TempDir("", "plz_sandbox_")
+	if err != nil {
+		return 1, err
+	}
+	// Any mounts on this are only visible within the namespace, so it's always empty by now.
+	defer os.RemoveAll(root)
+	args := []string{"--root", root}
+	for _, dir := range dirs {
+		args = append(args, "-r", dir)
+	}
+	args = append(append(args, "--"), argv...)
+	cmd := exec.Command("/proc/self/exe", args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:                 syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWNET,
+		UidMappings:                []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+		GidMappings:                []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+		GidMappingsEnableSetgroups: false,
+		Pdeathsig:                  syscall.SIGKILL,
+	}
+	// Pdeathsig is delivered when the thread that started the child exits, not the process.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	return run(cmd)
+}
+
+// enter is run within the new namespaces. It sets up the sandboxed filesystem and network,
+// then runs the command.
+func enter(root string, dirs, argv []string) (int, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return 1, err
+	}
+	if err := mountFilesystem(root, wd, dirs); err != nil {
+		return 1, err
+	} else if err := loopbackUp(); err != nil {
+		return 1, err
+	}
+	return runAsUser(argv)
+}
+
+// mountFilesystem creates the sandbox's filesystem at the given root and pivots into it.
+func mountFilesystem(root, wd string, dirs []string) error {
+	// Make sure nothing we do here propagates back to the outside world.
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("Failed to make mounts private: %s", err)
+	} else if err := syscall.Mount("tmpfs", root, "tmpfs", 0, ""); err != nil {
+		return fmt.Errorf("Failed to mount root: %s", err)
+	} else if err := os.Mkdir(path.Join(root, "tmp"), 01777); err != nil {
+		return err
+	} else if err := syscall.Mount("tmpfs", path.Join(root, "tmp"), "tmpfs", 0, ""); err != nil {
+		return fmt.Errorf("Failed to mount /tmp: %s", err)
+	}
+	// Mount parents before their children, otherwise the parent would hide the child.
+	dirs = append(dirs, wd)
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		if err := bindMount(root, dir, dir != wd); err != nil {
+			return err
+		}
+	}
+	for _, dev := range devices {
+		if err := bindMount(root, dev, false); err != nil {
+			return err
+		}
+	}
+	if err := bindMount(root, "/proc", false); err != nil {
+		return err
+	}
+	for link, target := range deviceLinks {
+		if err := os.Symlink(target, path.Join(root, link)); err != nil {
+			return err
+		}
+	}
+	// Now switch to it. pivot_root rather than chroot since the kernel won't let us create
+	// another user namespace from within a chroot.
+	old := path.Join(root, ".old")
+	if err := os.Mkdir(old, 0700); err != nil {
+		return err
+	} else if err := syscall.PivotRoot(root, old); err != nil {
+		return fmt.Errorf("Failed to pivot root: %s", err)
+	} else if err := syscall.Unmount("/.old", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("Failed to unmount old root: %s", err)
+	} else if err := os.Remove("/.old"); err != nil {
+		return err
+	}
+	return os.Chdir(wd)
+}
+
+// bindMount bind mounts the given file or directory into the sandbox at the same location.
+// Things that don't exist are silently skipped.
+func bindMount(root, src string, readOnly bool) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return nil
+	}
+	dest := path.Join(root, src)
+	if info.IsDir() {
+		if err := os.MkdirAll(dest, 0755); err != nil {
+			return err
+		}
+	} else if err := os.MkdirAll(path.Dir(dest), 0755); err != nil {
+		return err
+	} else if f, err := os.Create(dest); err != nil {
+		return err
+	} else {
+		f.Close()
+	}
+	if err := syscall.Mount(src, dest, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("Failed to mount %s: %s", src, err)
+	} else if !readOnly {
+		return nil
+	}
+	// Bind mounts can't be made read-only directly; they have to be remounted.
+	var statfs syscall.Statfs_t
+	if err := syscall.Statfs(dest, &statfs); err != nil {
+		return err
+	}
+	var flags uintptr = syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY
+	for statfsFlag, mountFlag := range lockedFlags {
+		if statfs.Flags&statfsFlag != 0 {
+			flags |= mountFlag
+		}
+	}
+	if err := syscall.Mount("", dest, "", flags, ""); err != nil {
+		return fmt.Errorf("Failed to make %s read-only: %s", src, err)
+	}
+	return nil
+}
+
+// loopbackUp brings up the loopback interface in our new network namespace, which
+// otherwise starts down.
+func loopbackUp() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	var req struct {
+		name  [syscall.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte // Pads to the size of struct ifreq.
+	}
+	copy(req.name[:], "lo")
+	req.flags = syscall.IFF_UP | syscall.IFF_RUNNING
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&req))); errno != 0 {
+		return fmt.Errorf("Failed to bring up loopback interface: %s", errno)
+	}
+	return nil
+}
+
+// runAsUser runs the command in a further user namespace which maps our root user back to
+// the original user, so the command sees the same uid & gid as it would outside.
+func runAsUser(argv []string) (int, error) {
+	uid, err := readIDMap("/proc/self/uid_map")
+	if err != nil {
+		return 1, err
+	}
+	gid, err := readIDMap("/proc/self/gid_map")
+	if err != nil {
+		return 1, err
+	}
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:                 syscall.CLONE_NEWUSER,
+		UidMappings:                []syscall.SysProcIDMap{{ContainerID: uid, HostID: 0, Size: 1}},
+		GidMappings:                []syscall.SysProcIDMap{{ContainerID: gid, HostID: 0, Size: 1}},
+		GidMappingsEnableSetgroups: false,
+		Pdeathsig:                  syscall.SIGKILL,
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	return run(cmd)
+}
+
+// readIDMap returns the outside id that our root user is mapped to from the given file.
+func readIDMap(filename string) (int, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) < 3 || fields[0] != "0" {
+		return 0, fmt.Errorf("Unexpected contents of %s: %s", filename, b)
+	}
+	return strconv.Atoi(fields[1])
+}
+
+// run runs the given command, attached to our stdin / stdout / stderr, and returns its exit code.
+func run(cmd *exec.Cmd) (int, error) {
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if exiterr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
+			if status.Signaled() {
+				return 128 + int(status.Signal()), nil
+			}
+			return status.ExitStatus(), nil
+		}
+	}
+	if err != nil {
+		return 1, err
+	}
+	return 0, nil
+}
@@ -0,0 +1,16 @@
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func sandbox(dirs, argv []string) (int, error) {
+	return 1, fmt.Errorf("Sandboxing is not supported on %s", runtime.GOOS)
+}
+
+func enter(root string, dirs, argv []string) (int, error) {
+	return sandbox(dirs, argv)
+}
@@ -0,0 +1,81 @@
+// Support for quarantining tests, so their failures are reported but don't fail the build.
+
+package test
+
+import (
+	"io/ioutil"
+	"path"
+	"strings"
+	"sync"
+
+	"core"
+)
+
+var quarantineOnce sync.Once
+var quarantinedTests map[string]bool
+
+// loadQuarantine returns the set of quarantined tests from the given config.
+// Each entry is either the name of a test case, a build label or a build label followed by
+// a colon and the name of a test case.
+func loadQuarantine(config *core.Configuration) map[string]bool {
+	quarantineOnce.Do(func() {
+		quarantinedTests = readQuarantine(config)
+	})
+	return quarantinedTests
+}
+
+func readQuarantine(config *core.Configuration) map[string]bool {
+	tests := map[string]bool{}
+	for _, test := range config.Test.Quarantine {
+		tests[test] = true
+	}
+	if config.Test.QuarantineFile != "" {
+		filename := config.Test.QuarantineFile
+		if !path.IsAbs(filename) {
+			filename = path.Join(core.RepoRoot, filename)
+		}
+		b, err := ioutil.ReadFile(filename)
+		if err != nil {
+			log.Warning("Failed to read quarantine file %s: %s", filename, err)
+		}
+		for _, line := range strings.Split(string(b), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				tests[line] = true
+			}
+		}
+	}
+	return tests
+}
+
+// isQuarantined returns true if the given test case of the given target is quarantined.
+func isQuarantined(quarantine map[string]bool, label core.BuildLabel, name string) bool {
+	return quarantine[label.String()] || quarantine[label.String()+":"+name] || quarantine[name]
+}
+
+// quarantineFailures moves any failures of quarantined tests out of the given results.
+// It returns true if that leaves no failures behind.
+func quarantineFailures(quarantine map[string]bool, label core.BuildLabel, results *core.TestResults) bool {
+	if len(quarantine) == 0 || results.Failed == 0 {
+		return false
+	}
+	failures := []core.TestFailure{}
+	quarantined := 0
+	for _, failure := range results.Failures {
+		if isQuarantined(quarantine, label, failure.Name) {
+			results.QuarantinedTests = append(results.QuarantinedTests, failure)
+			quarantined++
+		} else {
+			failures = append(failures, failure)
+		}
+	}
+	results.Failures = failures
+	if quarantine[label.String()] {
+		// The whole target is quarantined, which covers failures we don't know the names of too.
+		results.Quarantined += results.Failed
+		results.Failed = 0
+		return true
+	}
+	results.Quarantined += quarantined
+	results.Failed -= quarantined
+	return results.Failed == 0 && len(results.Failures) == 0
+}
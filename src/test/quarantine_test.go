@@ -0,0 +1,61 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"core"
+)
+
+var quarantineLabel = core.ParseBuildLabel("//src/test:quarantine_test", "")
+
+func TestIsQuarantined(t *testing.T) {
+	quarantine := map[string]bool{
+		"TestFlaky":                             true,
+		"//src/test:quarantine_test:TestWibble": true,
+		"//src/test:all_quarantined":            true,
+	}
+	assert.True(t, isQuarantined(quarantine, quarantineLabel, "TestFlaky"))
+	assert.True(t, isQuarantined(quarantine, quarantineLabel, "TestWibble"))
+	assert.False(t, isQuarantined(quarantine, quarantineLabel, "TestWobble"))
+	assert.False(t, isQuarantined(quarantine, core.ParseBuildLabel("//src/test:other_test", ""), "TestWibble"))
+	assert.True(t, isQuarantined(quarantine, core.ParseBuildLabel("//src/test:all_quarantined", ""), "TestWobble"))
+}
+
+func TestQuarantineFailures(t *testing.T) {
+	quarantine := map[string]bool{"TestFlaky": true}
+	results := &core.TestResults{
+		NumTests: 3,
+		Passed:   1,
+		Failed:   2,
+		Failures: []core.TestFailure{{Name: "TestFlaky"}, {Name: "TestBroken"}},
+	}
+	assert.False(t, quarantineFailures(quarantine, quarantineLabel, results))
+	assert.Equal(t, 1, results.Failed)
+	assert.Equal(t, 1, results.Quarantined)
+	assert.Equal(t, []core.TestFailure{{Name: "TestBroken"}}, results.Failures)
+	assert.Equal(t, []core.TestFailure{{Name: "TestFlaky"}}, results.QuarantinedTests)
+
+	results = &core.TestResults{
+		NumTests: 2,
+		Passed:   1,
+		Failed:   1,
+		Failures: []core.TestFailure{{Name: "TestFlaky"}},
+	}
+	assert.True(t, quarantineFailures(quarantine, quarantineLabel, results))
+	assert.Equal(t, 0, results.Failed)
+	assert.Equal(t, 1, results.Quarantined)
+}
+
+func TestQuarantineWholeTarget(t *testing.T) {
+	quarantine := map[string]bool{quarantineLabel.String(): true}
+	results := &core.TestResults{
+		NumTests: 1,
+		Failed:   1,
+		Failures: []core.TestFailure{{Name: "Test failed with no results"}},
+	}
+	assert.True(t, quarantineFailures(quarantine, quarantineLabel, results))
+	assert.Equal(t, 0, results.Failed)
+	assert.Equal(t, 1, results.Quarantined)
+}
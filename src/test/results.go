@@ -11,19 +11,20 @@ import (
 	"core"
 )
 
-func parseTestResults(target *core.BuildTarget, outputFile string, cached bool) (core.TestResults, error) {
+// parseTestResults parses the test results in the given file or directory and aggregates them into the given results.
+func parseTestResults(target *core.BuildTarget, into *core.TestResults, outputFile string, cached bool) (core.TestResults, error) {
 	results, err := parseTestResultsDir(target, outputFile)
 	results.Cached = cached
-	target.Results.Aggregate(results)
+	into.Aggregate(results)
 	// Ensure that the target has a failure if we encountered an error
-	if err != nil && target.Results.Failed == 0 {
-		target.Results.NumTests++
-		target.Results.Failed++
+	if err != nil && into.Failed == 0 {
+		into.NumTests++
+		into.Failed++
 	}
 	// Ensure that there is one success if the target succeeded but there are no tests.
-	if err == nil && target.Results.Failed == 0 && target.Results.NumTests == 0 {
-		target.Results.NumTests++
-		target.Results.Passed++
+	if err == nil && into.Failed == 0 && into.NumTests == 0 {
+		into.NumTests++
+		into.Passed++
 	}
 	return results, err
 }
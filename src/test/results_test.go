@@ -5,7 +5,7 @@ import "testing"
 import "core"
 
 func TestGoFailure(t *testing.T) {
-	results, err := parseTestResults(new(core.BuildTarget), "src/test/test_data/go_test_failure.txt", false)
+	results, err := parseTestResults(new(core.BuildTarget), &core.TestResults{}, "src/test/test_data/go_test_failure.txt", false)
 	if err != nil {
 		t.Errorf("Unable to parse file: %s", err)
 		return
@@ -18,7 +18,7 @@ func TestGoFailure(t *testing.T) {
 }
 
 func TestGoPassed(t *testing.T) {
-	results, err := parseTestResults(new(core.BuildTarget), "src/test/test_data/go_test_pass.txt", false)
+	results, err := parseTestResults(new(core.BuildTarget), &core.TestResults{}, "src/test/test_data/go_test_pass.txt", false)
 	if err != nil {
 		t.Errorf("Unable to parse file: %s", err)
 		return
@@ -31,7 +31,7 @@ func TestGoPassed(t *testing.T) {
 }
 
 func TestGoMultipleFailure(t *testing.T) {
-	results, err := parseTestResults(new(core.BuildTarget), "src/test/test_data/go_multiple_failure.txt", false)
+	results, err := parseTestResults(new(core.BuildTarget), &core.TestResults{}, "src/test/test_data/go_multiple_failure.txt", false)
 	if err != nil {
 		t.Errorf("Unable to parse file: %s", err)
 		return
@@ -44,7 +44,7 @@ func TestGoMultipleFailure(t *testing.T) {
 }
 
 func TestGoSkipped(t *testing.T) {
-	results, err := parseTestResults(new(core.BuildTarget), "src/test/test_data/go_test_skip.txt", false)
+	results, err := parseTestResults(new(core.BuildTarget), &core.TestResults{}, "src/test/test_data/go_test_skip.txt", false)
 	if err != nil {
 		t.Errorf("Unable to parse file: %s", err)
 		return
@@ -57,7 +57,7 @@ func TestGoSkipped(t *testing.T) {
 }
 
 func TestGoSubtests(t *testing.T) {
-	results, err := parseTestResults(new(core.BuildTarget), "src/test/test_data/go_subtests.txt", false)
+	results, err := parseTestResults(new(core.BuildTarget), &core.TestResults{}, "src/test/test_data/go_subtests.txt", false)
 	if err != nil {
 		t.Errorf("Unable to parse file: %s", err)
 		return
@@ -67,7 +67,7 @@ func TestGoSubtests(t *testing.T) {
 }
 
 func TestBuckXML(t *testing.T) {
-	results, err := parseTestResults(new(core.BuildTarget), "src/test/test_data/junit.xml", false)
+	results, err := parseTestResults(new(core.BuildTarget), &core.TestResults{}, "src/test/test_data/junit.xml", false)
 	if err != nil {
 		t.Errorf("Unable to parse file: %s", err)
 		return
@@ -80,7 +80,7 @@ func TestBuckXML(t *testing.T) {
 }
 
 func TestJUnitXML(t *testing.T) {
-	results, err := parseTestResults(new(core.BuildTarget), "src/test/test_data/xmlrunner-junit.xml", false)
+	results, err := parseTestResults(new(core.BuildTarget), &core.TestResults{}, "src/test/test_data/xmlrunner-junit.xml", false)
 	if err != nil {
 		t.Errorf("Unable to parse file: %s", err)
 		return
@@ -93,7 +93,7 @@ func TestJUnitXML(t *testing.T) {
 }
 
 func TestKarmaXML(t *testing.T) {
-	results, err := parseTestResults(new(core.BuildTarget), "src/test/test_data/karma-junit.xml", false)
+	results, err := parseTestResults(new(core.BuildTarget), &core.TestResults{}, "src/test/test_data/karma-junit.xml", false)
 	if err != nil {
 		t.Errorf("Unable to parse file: %s", err)
 		return
@@ -106,7 +106,7 @@ func TestKarmaXML(t *testing.T) {
 }
 
 func TestUnitTestXML(t *testing.T) {
-	results, err := parseTestResults(new(core.BuildTarget), "src/test/test_data/unittest.xml", false)
+	results, err := parseTestResults(new(core.BuildTarget), &core.TestResults{}, "src/test/test_data/unittest.xml", false)
 	if err != nil {
 		t.Errorf("Unable to parse file: %s", err)
 		return
@@ -119,7 +119,7 @@ func TestUnitTestXML(t *testing.T) {
 }
 
 func TestGoSuite(t *testing.T) {
-	results, err := parseTestResults(new(core.BuildTarget), "src/test/test_data/go_test_suite.txt", false)
+	results, err := parseTestResults(new(core.BuildTarget), &core.TestResults{}, "src/test/test_data/go_test_suite.txt", false)
 	if err != nil {
 		t.Errorf("Unable to parse file: %s", err)
 		return
@@ -132,7 +132,7 @@ func TestGoSuite(t *testing.T) {
 }
 
 func TestGoIgnoreUnknownOutput(t *testing.T) {
-	results, err := parseTestResults(new(core.BuildTarget), "src/test/test_data/go_test_ignore_logs.txt", false)
+	results, err := parseTestResults(new(core.BuildTarget), &core.TestResults{}, "src/test/test_data/go_test_ignore_logs.txt", false)
 	if err != nil {
 		t.Errorf("Unable to parse file: %s", err)
 		return
@@ -145,14 +145,14 @@ func TestGoIgnoreUnknownOutput(t *testing.T) {
 }
 
 func TestGoFailIfUnknownTestPasses(t *testing.T) {
-	_, err := parseTestResults(new(core.BuildTarget), "src/test/test_data/go_test_unknown_test.txt", false)
+	_, err := parseTestResults(new(core.BuildTarget), &core.TestResults{}, "src/test/test_data/go_test_unknown_test.txt", false)
 	if err == nil {
 		t.Errorf("Results should not be parsable.")
 	}
 }
 
 func TestParseGoFileWithNoTests(t *testing.T) {
-	_, err := parseTestResults(new(core.BuildTarget), "src/test/test_data/go_empty_test.txt", false)
+	_, err := parseTestResults(new(core.BuildTarget), &core.TestResults{}, "src/test/test_data/go_empty_test.txt", false)
 	if err != nil {
 		t.Errorf("Unable to parse file: %s", err)
 	}
@@ -9,6 +9,7 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"time"
 
 	"gopkg.in/op/go-logging.v1"
@@ -32,59 +33,134 @@ func Test(tid int, state *core.BuildState, label core.BuildLabel) {
 }
 
 func test(tid int, state *core.BuildState, label core.BuildLabel, target *core.BuildTarget) {
-	startTime := time.Now()
 	hash, err := build.RuntimeHash(state, target)
 	if err != nil {
 		state.LogBuildError(tid, label, core.TargetTestFailed, err, "Failed to calculate target hash")
 		return
 	}
-	// Check the cached output files if the target wasn't rebuilt.
 	hash = core.CollapseHash(hash)
+	// Each shard is run independently; they only come together again once they're all done.
+	shards := make([]*testShard, 1)
+	if target.Shards > 1 {
+		shards = make([]*testShard, target.Shards)
+	}
+	var wg sync.WaitGroup
+	wg.Add(len(shards))
+	for i := range shards {
+		shards[i] = &testShard{target: target, index: i}
+		go func(shard *testShard) {
+			defer wg.Done()
+			shard.test(tid, state, hash)
+		}(shards[i])
+	}
+	wg.Wait()
+	results, coverage, failed := mergeShards(target, shards)
+	target.Results = results
+	if !results.Cached {
+		core.Timings.RecordTest(label, time.Duration(results.Duration*float64(time.Second)))
+	}
+	if failed != nil {
+		state.LogTestResult(tid, label, core.TargetTestFailed, target.Results, coverage, failed.err, failed.msg)
+	} else {
+		logTestSuccess(state, tid, label, target.Results, coverage)
+	}
+}
+
+// A testShard represents a single process that we run for a test. Tests that aren't sharded
+// have exactly one of these.
+type testShard struct {
+	target   *core.BuildTarget
+	index    int
+	results  core.TestResults
+	coverage core.TestCoverage
+	// Set if the shard failed, along with a description of what went wrong.
+	err error
+	msg string
+}
+
+// name returns a description of this shard for progress messages, which is empty if the test isn't sharded.
+func (shard *testShard) name() string {
+	if shard.target.Shards <= 1 {
+		return ""
+	}
+	return fmt.Sprintf("shard %d of %d", shard.index+1, shard.target.Shards)
+}
+
+// title returns the shard's name for the start of a sentence.
+func (shard *testShard) title() string {
+	return fmt.Sprintf("Shard %d of %d", shard.index+1, shard.target.Shards)
+}
+
+// fileName returns the name we store one of the shard's output files under in the target's output directory.
+func (shard *testShard) fileName(name string) string {
+	if shard.target.Shards <= 1 {
+		return name
+	}
+	return fmt.Sprintf("shard%d_%s", shard.index, name)
+}
+
+// fail marks this shard as failed.
+func (shard *testShard) fail(err error, format string, args ...interface{}) {
+	if err == nil {
+		err = fmt.Errorf("Test failed")
+	}
+	shard.err = err
+	shard.msg = fmt.Sprintf(format, args...)
+}
+
+// test runs a single shard of a test, or retrieves its results from the cache.
+func (shard *testShard) test(tid int, state *core.BuildState, hash []byte) {
+	target := shard.target
+	label := target.Label
+	startTime := time.Now()
 	hashStr := base64.RawURLEncoding.EncodeToString(hash)
 	resultsFileName := fmt.Sprintf(".test_results_%s_%s", label.Name, hashStr)
 	coverageFileName := fmt.Sprintf(".test_coverage_%s_%s", label.Name, hashStr)
-	outputFile := path.Join(target.TestDir(), "test.results")
-	coverageFile := path.Join(target.TestDir(), "test.coverage")
+	if target.Shards > 1 {
+		resultsFileName = fmt.Sprintf(".test_results_%s_%d_%s", label.Name, shard.index, hashStr)
+		coverageFileName = fmt.Sprintf(".test_coverage_%s_%d_%s", label.Name, shard.index, hashStr)
+	}
+	testDir := target.ShardTestDir(shard.index)
+	outputFile := path.Join(testDir, "test.results")
+	coverageFile := path.Join(testDir, "test.coverage")
 	cachedOutputFile := path.Join(target.OutDir(), resultsFileName)
 	cachedCoverageFile := path.Join(target.OutDir(), coverageFileName)
 	needCoverage := state.NeedCoverage && !target.NoTestOutput
 
 	cachedTest := func() {
-		log.Debug("Not re-running test %s; got cached results.", label)
-		coverage := parseCoverageFile(target, cachedCoverageFile)
-		results, err := parseTestResults(target, cachedOutputFile, true)
-		target.Results.Duration = time.Since(startTime).Seconds()
-		target.Results.Cached = true
+		log.Debug("Not re-running test %s %s; got cached results.", label, shard.name())
+		shard.coverage = parseCoverageFile(target, cachedCoverageFile)
+		results, err := parseTestResults(target, &shard.results, cachedOutputFile, true)
+		shard.results.Duration = time.Since(startTime).Seconds()
+		shard.results.Cached = true
 		if err != nil {
-			state.LogBuildError(tid, label, core.TargetTestFailed, err, "Failed to parse cached test file %s", cachedOutputFile)
+			shard.fail(err, "Failed to parse cached test file %s", cachedOutputFile)
 		} else if results.Failed > 0 {
 			panic("Test results with failures shouldn't be cached.")
-		} else {
-			logTestSuccess(state, tid, label, results, coverage)
 		}
 	}
 
-	moveAndCacheOutputFiles := func(results core.TestResults, coverage core.TestCoverage) bool {
+	moveAndCacheOutputFiles := func() bool {
 		// Never cache test results when given arguments; the results may be incomplete.
 		if len(state.TestArgs) > 0 {
 			log.Debug("Not caching results for %s, we passed it arguments", label)
 			return true
 		}
 		if err := moveAndCacheOutputFile(state, target, hash, outputFile, cachedOutputFile, resultsFileName, dummyOutput); err != nil {
-			state.LogTestResult(tid, label, core.TargetTestFailed, results, coverage, err, "Failed to move test output file")
+			shard.fail(err, "Failed to move test output file")
 			return false
 		}
 		if needCoverage || core.PathExists(coverageFile) {
 			if err := moveAndCacheOutputFile(state, target, hash, coverageFile, cachedCoverageFile, coverageFileName, dummyCoverage); err != nil {
-				state.LogTestResult(tid, label, core.TargetTestFailed, results, coverage, err, "Failed to move test coverage file")
+				shard.fail(err, "Failed to move test coverage file")
 				return false
 			}
 		}
 		for _, output := range target.TestOutputs {
-			tmpFile := path.Join(target.TestDir(), output)
-			outFile := path.Join(target.OutDir(), output)
-			if err := moveAndCacheOutputFile(state, target, hash, tmpFile, outFile, output, ""); err != nil {
-				state.LogTestResult(tid, label, core.TargetTestFailed, results, coverage, err, "Failed to move test output file")
+			tmpFile := path.Join(testDir, output)
+			outFile := path.Join(target.OutDir(), shard.fileName(output))
+			if err := moveAndCacheOutputFile(state, target, hash, tmpFile, outFile, shard.fileName(output), ""); err != nil {
+				shard.fail(err, "Failed to move test output file")
 				return false
 			}
 		}
@@ -112,7 +188,7 @@ func test(tid int, state *core.BuildState, label core.BuildLabel, target *core.B
 			return true
 		}
 		for _, output := range target.TestOutputs {
-			if !cache.RetrieveExtra(target, hash, output) {
+			if !cache.RetrieveExtra(target, hash, shard.fileName(output)) {
 				return true
 			}
 		}
@@ -125,8 +201,8 @@ func test(tid int, state *core.BuildState, label core.BuildLabel, target *core.B
 		return
 	}
 	// Remove any cached test result file.
-	if err := RemoveCachedTestFiles(target); err != nil {
-		state.LogBuildError(tid, label, core.TargetTestFailed, err, "Failed to remove cached test files")
+	if err := shard.removeCachedFiles(); err != nil {
+		shard.fail(err, "Failed to remove cached test files")
 		return
 	}
 	numSucceeded := 0
@@ -134,15 +210,30 @@ func test(tid int, state *core.BuildState, label core.BuildLabel, target *core.B
 	numRuns, successesRequired := calcNumRuns(state.NumTestRuns, target.Flakiness)
 	var resultErr error
 	resultMsg := ""
-	var coverage core.TestCoverage
+	tests := state.TestArgs
+	rerunning := false
+	// True if the last run only reran some of the test cases, in which case test.results doesn't
+	// describe the whole test.
+	partialRun := false
 	for i := 0; i < numRuns && numSucceeded < successesRequired; i++ {
-		if numRuns > 1 {
+		partialRun = rerunning
+		if numRuns > 1 && target.Shards > 1 {
+			state.LogBuildResult(tid, label, core.TargetTesting, fmt.Sprintf("Testing %s (%d of %d)...", shard.name(), i+1, numRuns))
+		} else if numRuns > 1 {
 			state.LogBuildResult(tid, label, core.TargetTesting, fmt.Sprintf("Testing (%d of %d)...", i+1, numRuns))
 		}
-		out, err := prepareAndRunTest(tid, state, target)
+		out, err := prepareAndRunTest(state, target, shard.index, tests)
 		duration := time.Since(startTime).Seconds()
 		startTime = time.Now() // reset this for next time
 
+		// When rerunning only the failed test cases, their results get merged into the previous ones
+		// afterwards rather than accumulating into them.
+		run := &shard.results
+		if rerunning {
+			run = &core.TestResults{}
+		}
+		canRerun := false
+
 		// This is all pretty involved; there are lots of different possibilities of what could happen.
 		// The contract is that the test must return zero on success or non-zero on failure (Unix FTW).
 		// If it's successful, it must produce a parseable file named "test.results" in its temp folder.
@@ -150,22 +241,22 @@ func test(tid int, state *core.BuildState, label core.BuildLabel, target *core.B
 		// Tests can opt out of the file requirement individually, in which case they're judged only
 		// by their return value.
 		// But of course, we still have to consider all the alternatives here and handle them nicely.
-		target.Results.Output = string(out)
-		if err != nil && target.Results.Output == "" {
-			target.Results.Output = err.Error()
+		run.Output = string(out)
+		if err != nil && run.Output == "" {
+			run.Output = err.Error()
 		}
-		target.Results.TimedOut = err == context.DeadlineExceeded
-		coverage = parseCoverageFile(target, coverageFile)
-		target.Results.Duration += duration
+		run.TimedOut = err == context.DeadlineExceeded
+		shard.coverage = parseCoverageFile(target, coverageFile)
+		run.Duration += duration
 		if !core.PathExists(outputFile) {
 			if err == nil && target.NoTestOutput {
-				target.Results.NumTests += 1
-				target.Results.Passed += 1
+				run.NumTests += 1
+				run.Passed += 1
 				numSucceeded++
 			} else if err == nil {
-				target.Results.NumTests++
-				target.Results.Failed++
-				target.Results.Failures = append(target.Results.Failures, core.TestFailure{
+				run.NumTests++
+				run.Failed++
+				run.Failures = append(run.Failures, core.TestFailure{
 					Name:   "Missing results",
 					Stdout: string(out),
 				})
@@ -173,9 +264,9 @@ func test(tid int, state *core.BuildState, label core.BuildLabel, target *core.B
 				resultMsg = fmt.Sprintf("Test apparently succeeded but failed to produce %s. Output: %s", outputFile, string(out))
 				numFlakes++
 			} else {
-				target.Results.NumTests++
-				target.Results.Failed++
-				target.Results.Failures = append(target.Results.Failures, core.TestFailure{
+				run.NumTests++
+				run.Failed++
+				run.Failures = append(run.Failures, core.TestFailure{
 					Name:   "Test failed with no results",
 					Stdout: string(out),
 				})
@@ -184,15 +275,15 @@ func test(tid int, state *core.BuildState, label core.BuildLabel, target *core.B
 				resultMsg = fmt.Sprintf("Test failed with no results. Output: %s", string(out))
 			}
 		} else {
-			results, err2 := parseTestResults(target, outputFile, false)
+			results, err2 := parseTestResults(target, run, outputFile, false)
 			if err2 != nil {
 				resultErr = err2
 				resultMsg = fmt.Sprintf("Couldn't parse test output file: %s. Stdout: %s", err2, string(out))
 				numFlakes++
 			} else if err != nil && results.Failed == 0 {
 				// Add a failure result to the test so it shows up in the final aggregation.
-				target.Results.Failed = 1
-				target.Results.Failures = append(results.Failures, core.TestFailure{
+				run.Failed = 1
+				run.Failures = append(results.Failures, core.TestFailure{
 					Name:   "Return value",
 					Type:   fmt.Sprintf("%s", err),
 					Stdout: string(out),
@@ -208,34 +299,206 @@ func test(tid int, state *core.BuildState, label core.BuildLabel, target *core.B
 				resultErr = fmt.Errorf("Tests failed")
 				resultMsg = fmt.Sprintf("Tests failed. Stdout: %s", string(out))
 				numFlakes++
+				canRerun = true
 			} else {
 				numSucceeded++
 				if !state.ShowTestOutput {
 					// Save a bit of memory, if we're not printing results on success we will never use them again.
-					target.Results.Output = ""
+					run.Output = ""
 				}
 			}
 		}
+		if rerunning {
+			mergeRerun(&shard.results, run, canRerun || run.Failed == 0)
+			if shard.results.Failed > 0 && numSucceeded > 0 {
+				// The rerun passed but didn't tell us that all the cases that failed before now
+				// pass (most likely it didn't run them at all), so this attempt doesn't count.
+				numSucceeded--
+				numFlakes++
+				resultErr = fmt.Errorf("Rerun of failed test cases didn't report them passing")
+				resultMsg = fmt.Sprintf("Rerun of failed test cases didn't report them passing. Stdout: %s", run.Output)
+			}
+		}
+		// If the test is flaky and we know which test cases failed, just rerun those next time.
+		if tests = rerunTests(state, &shard.results, successesRequired, canRerun); tests == nil {
+			tests = state.TestArgs
+			rerunning = false
+		} else {
+			rerunning = true
+		}
 	}
 	if numSucceeded >= successesRequired {
-		target.Results.Failures = nil // Remove any failures, they don't count
-		target.Results.Failed = 0     // (they'll be picked up as flakes below)
+		shard.results.Failures = nil // Remove any failures, they don't count
+		shard.results.Failed = 0     // (they'll be picked up as flakes below)
 		if numSucceeded > 0 && numFlakes > 0 {
-			target.Results.Flakes = numFlakes
+			shard.results.Flakes = numFlakes
 		}
 		// Success, clean things up
-		if moveAndCacheOutputFiles(target.Results, coverage) {
-			logTestSuccess(state, tid, label, target.Results, coverage)
+		if partialRun {
+			// Storing these would under-report the test counts on later cache hits.
+			log.Debug("Not caching results for %s, the last run only reran some test cases", label)
+		} else {
+			moveAndCacheOutputFiles()
 		}
 		// Clean up the test directory.
 		if state.CleanWorkdirs {
-			if err := os.RemoveAll(target.TestDir()); err != nil {
+			if err := os.RemoveAll(testDir); err != nil {
 				log.Warning("Failed to remove test directory for %s: %s", target.Label, err)
 			}
 		}
+	} else if quarantineFailures(loadQuarantine(state.Config), label, &shard.results) {
+		// Only quarantined tests failed. We deliberately don't cache the results so they rerun next time.
+		log.Warning("Quarantined tests in %s failed", label)
 	} else {
-		state.LogTestResult(tid, label, core.TargetTestFailed, target.Results, coverage, resultErr, resultMsg)
+		shard.fail(resultErr, "%s", resultMsg)
+	}
+}
+
+// rerunTests returns the names of the test cases to run next time when rerunning a flaky test,
+// or nil if we should run all of them again.
+// We can only do this when the test reported which cases failed, and isn't being run repeatedly
+// deliberately (in which case each run should be a full one).
+func rerunTests(state *core.BuildState, results *core.TestResults, successesRequired int, canRerun bool) []string {
+	if !canRerun || successesRequired != 1 || len(state.TestArgs) > 0 || len(results.Failures) == 0 || results.Failed != len(results.Failures) {
+		return nil
+	}
+	tests := make([]string, len(results.Failures))
+	for i, failure := range results.Failures {
+		tests[i] = failure.Name
+	}
+	return tests
+}
+
+// mergeRerun merges the results of rerunning some failed test cases into the original results.
+// A case is only recorded as flaky if the rerun reported that it passed. If the rerun didn't
+// report results for exactly the cases we asked for (e.g. because it crashed, or the filter
+// matched nothing) then we can't tell which passed, so the original failures are kept.
+func mergeRerun(results, rerun *core.TestResults, reported bool) {
+	results.Output = rerun.Output
+	results.TimedOut = rerun.TimedOut
+	results.Duration += rerun.Duration
+	if !reported || rerun.NumTests == 0 || rerun.Failed != len(rerun.Failures) {
+		return
+	}
+	requested := make(map[string]bool, len(results.Failures))
+	for _, failure := range results.Failures {
+		requested[failure.Name] = true
+	}
+	passed := make(map[string]bool, len(rerun.Passes))
+	for _, pass := range rerun.Passes {
+		if name := rerunCaseName(pass, requested); name != "" {
+			passed[name] = true
+		} else {
+			return
+		}
+	}
+	stillFailing := make(map[string]core.TestFailure, len(rerun.Failures))
+	for _, failure := range rerun.Failures {
+		if !requested[failure.Name] {
+			return
+		}
+		stillFailing[failure.Name] = failure
+	}
+	failures := []core.TestFailure{}
+	for _, failure := range results.Failures {
+		if passed[failure.Name] {
+			results.Flaky = append(results.Flaky, failure.Name)
+			results.Passes = append(results.Passes, failure.Name)
+			results.Passed++
+			results.Failed--
+		} else if f, present := stillFailing[failure.Name]; present {
+			failures = append(failures, f)
+		} else {
+			failures = append(failures, failure) // Didn't get run at all, so it still counts.
+		}
+	}
+	results.Failures = failures
+}
+
+// rerunCaseName returns the name of the originally failed test case that a passing one from a
+// rerun corresponds to, or the empty string if it's not one of them.
+// Some formats name failures by class and passes without it, so we allow for that too.
+func rerunCaseName(pass string, requested map[string]bool) string {
+	if requested[pass] {
+		return pass
+	}
+	for name := range requested {
+		if strings.HasSuffix(name, "."+pass) {
+			return name
+		}
 	}
+	return ""
+}
+
+// removeCachedFiles removes any cached test or coverage result files for this shard.
+func (shard *testShard) removeCachedFiles() error {
+	outDir := shard.target.OutDir()
+	name := shard.target.Label.Name
+	if shard.target.Shards > 1 {
+		name = fmt.Sprintf("%s_%d_", name, shard.index)
+	}
+	if err := removeAnyFilesWithPrefix(outDir, ".test_results_"+name); err != nil {
+		return err
+	}
+	if err := removeAnyFilesWithPrefix(outDir, ".test_coverage_"+name); err != nil {
+		return err
+	}
+	for _, output := range shard.target.TestOutputs {
+		if err := os.RemoveAll(path.Join(outDir, shard.fileName(output))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeShards merges the results and coverage of all the shards of a test.
+// It also returns the first shard that failed, or nil if they all succeeded.
+func mergeShards(target *core.BuildTarget, shards []*testShard) (core.TestResults, core.TestCoverage, *testShard) {
+	if len(shards) == 1 {
+		return shards[0].results, shards[0].coverage, failedShard(shards[0])
+	}
+	results := core.TestResults{Cached: true}
+	coverage := core.NewTestCoverage()
+	var failed *testShard
+	var duration float64
+	outputs := []string{}
+	for _, shard := range shards {
+		results.Aggregate(shard.results)
+		results.Cached = results.Cached && shard.results.Cached
+		results.TimedOut = results.TimedOut || shard.results.TimedOut
+		// The shards run in parallel, so the test took as long as the slowest one.
+		if shard.results.Duration > duration {
+			duration = shard.results.Duration
+		}
+		if shard.results.Output != "" {
+			outputs = append(outputs, fmt.Sprintf("=== %s ===\n%s", shard.title(), shard.results.Output))
+		}
+		// Each shard will have covered some of the same files, so this has to merge them rather than
+		// just taking the last one as Aggregate would.
+		for filename, lines := range shard.coverage.Tests[target.Label] {
+			if coverage.Tests[target.Label] == nil {
+				coverage.Tests[target.Label] = map[string][]core.LineCoverage{}
+			}
+			coverage.Tests[target.Label][filename] = core.MergeCoverageLines(coverage.Tests[target.Label][filename], lines)
+		}
+		for filename, lines := range shard.coverage.Files {
+			coverage.Files[filename] = core.MergeCoverageLines(coverage.Files[filename], lines)
+		}
+		if failed == nil && failedShard(shard) != nil {
+			failed = &testShard{err: shard.err, msg: fmt.Sprintf("%s %s", shard.title(), shard.msg)}
+		}
+	}
+	results.Duration = duration
+	results.Output = strings.Join(outputs, "\n")
+	return results, coverage, failed
+}
+
+// failedShard returns the given shard if it failed, or nil if not.
+func failedShard(shard *testShard) *testShard {
+	if shard.err != nil {
+		return shard
+	}
+	return nil
 }
 
 func logTestSuccess(state *core.BuildState, tid int, label core.BuildLabel, results core.TestResults, coverage core.TestCoverage) {
@@ -258,14 +521,16 @@ func pluralise(word string, quantity int) string {
 	return word + "s"
 }
 
-func prepareTestDir(graph *core.BuildGraph, target *core.BuildTarget) error {
-	if err := os.RemoveAll(target.TestDir()); err != nil {
+func prepareTestDir(graph *core.BuildGraph, target *core.BuildTarget, shard int) error {
+	testDir := target.ShardTestDir(shard)
+	if err := os.RemoveAll(testDir); err != nil {
 		return err
 	}
-	if err := os.MkdirAll(target.TestDir(), core.DirPermissions); err != nil {
+	if err := os.MkdirAll(testDir, core.DirPermissions); err != nil {
 		return err
 	}
-	for out := range core.IterRuntimeFiles(graph, target, true) {
+	for out := range core.IterRuntimeFiles(graph, target, false) {
+		out.Tmp = path.Join(core.RepoRoot, testDir, out.Tmp)
 		if err := core.PrepareSourcePair(out); err != nil {
 			return err
 		}
@@ -273,26 +538,36 @@ func prepareTestDir(graph *core.BuildGraph, target *core.BuildTarget) error {
 	return nil
 }
 
-func runTest(state *core.BuildState, target *core.BuildTarget) ([]byte, error) {
+func runTest(state *core.BuildState, target *core.BuildTarget, shard int, tests []string) ([]byte, error) {
 	replacedCmd := build.ReplaceTestSequences(target, target.GetTestCommand())
-	env := core.BuildEnvironment(state, target, true)
-	if len(state.TestArgs) > 0 {
-		args := strings.Join(state.TestArgs, " ")
+	env := core.TestEnvironment(state, target, shard)
+	if len(tests) > 0 {
+		args := strings.Join(tests, " ")
 		replacedCmd += " " + args
 		env = append(env, "TESTS="+args)
 	}
 	log.Debug("Running test %s\nENVIRONMENT:\n%s\n%s", target.Label, strings.Join(env, "\n"), replacedCmd)
-	_, out, err := core.ExecWithTimeoutShell(target.TestDir(), env, target.TestTimeout, state.Config.Test.Timeout, state.ShowAllOutput, replacedCmd)
+	actionLog := core.NewActionLog(target.Label, testAction(target, shard), replacedCmd, target.ShardTestDir(shard), env)
+	_, out, err := core.ExecWithTimeoutShell(target.ShardTestDir(shard), env, target.TestTimeout, state.Config.Test.Timeout, state.ShowAllOutput, target.Sandbox, replacedCmd)
+	actionLog.Finish(state, out, err)
 	return out, err
 }
 
-// prepareAndRunTest sets up a test directory and runs the test.
-func prepareAndRunTest(tid int, state *core.BuildState, target *core.BuildTarget) (out []byte, err error) {
-	if err = prepareTestDir(state.Graph, target); err != nil {
-		state.LogBuildError(tid, target.Label, core.TargetTestFailed, err, "Failed to prepare test directory for %s: %s", target.Label, err)
-		return []byte{}, err
+// testAction returns the name of the action that runs a shard of a test, which its log is named after.
+func testAction(target *core.BuildTarget, shard int) string {
+	if target.Shards > 1 {
+		return fmt.Sprintf("test_shard%d", shard)
+	}
+	return "test"
+}
+
+// prepareAndRunTest sets up a test directory and runs a single shard of the test.
+// If tests is non-empty only the test cases it names are run.
+func prepareAndRunTest(state *core.BuildState, target *core.BuildTarget, shard int, tests []string) (out []byte, err error) {
+	if err = prepareTestDir(state.Graph, target, shard); err != nil {
+		return []byte{}, fmt.Errorf("Failed to prepare test directory for %s: %s", target.Label, err)
 	}
-	return runPossiblyContainerisedTest(state, target)
+	return runPossiblyContainerisedTest(state, target, shard, tests)
 }
 
 // Parses the coverage output for a single target.
@@ -306,14 +581,9 @@ func parseCoverageFile(target *core.BuildTarget, coverageFile string) core.TestC
 
 // RemoveCachedTestFiles removes any cached test or coverage result files for a target.
 func RemoveCachedTestFiles(target *core.BuildTarget) error {
-	if err := removeAnyFilesWithPrefix(target.OutDir(), ".test_results_"+target.Label.Name); err != nil {
-		return err
-	}
-	if err := removeAnyFilesWithPrefix(target.OutDir(), ".test_coverage_"+target.Label.Name); err != nil {
-		return err
-	}
-	for _, output := range target.TestOutputs {
-		if err := os.RemoveAll(path.Join(target.OutDir(), output)); err != nil {
+	for i := 0; i == 0 || i < target.Shards; i++ {
+		shard := &testShard{target: target, index: i}
+		if err := shard.removeCachedFiles(); err != nil {
 			return err
 		}
 	}
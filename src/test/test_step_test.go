@@ -4,6 +4,8 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+
+	"core"
 )
 
 func TestCalcNumRuns(t *testing.T) {
@@ -24,3 +26,148 @@ func TestCalcNumRuns(t *testing.T) {
 	assert.Equal(t, nr(6, 2), nr(calcNumRuns(6, 3)))
 	assert.Equal(t, nr(7, 3), nr(calcNumRuns(7, 3)))
 }
+
+func TestMergeShards(t *testing.T) {
+	target := core.NewBuildTarget(core.ParseBuildLabel("//src/test:shards", ""))
+	target.Shards = 2
+	shards := []*testShard{
+		{target: target, index: 0, results: core.TestResults{NumTests: 2, Passed: 2, Duration: 3, Cached: true}},
+		{target: target, index: 1, results: core.TestResults{NumTests: 1, Passed: 1, Duration: 5}},
+	}
+	results, _, failed := mergeShards(target, shards)
+	assert.Nil(t, failed)
+	assert.Equal(t, 3, results.NumTests)
+	assert.Equal(t, 3, results.Passed)
+	assert.Equal(t, 5.0, results.Duration) // They run in parallel so it's the longest one.
+	assert.False(t, results.Cached)
+
+	shards[1].fail(nil, "Tests failed")
+	_, _, failed = mergeShards(target, shards)
+	assert.NotNil(t, failed)
+	assert.Equal(t, "Shard 2 of 2 Tests failed", failed.msg)
+}
+
+func TestMergeRerun(t *testing.T) {
+	results := &core.TestResults{
+		NumTests: 4,
+		Passed:   2,
+		Failed:   2,
+		Failures: []core.TestFailure{{Name: "TestFlaky"}, {Name: "TestBroken"}},
+	}
+	rerun := &core.TestResults{
+		NumTests: 2,
+		Passed:   1,
+		Failed:   1,
+		Failures: []core.TestFailure{{Name: "TestBroken"}},
+		Passes:   []string{"TestFlaky"},
+	}
+	mergeRerun(results, rerun, true)
+	assert.Equal(t, 4, results.NumTests)
+	assert.Equal(t, 3, results.Passed)
+	assert.Equal(t, 1, results.Failed)
+	assert.Equal(t, []string{"TestFlaky"}, results.Flaky)
+	assert.Equal(t, []core.TestFailure{{Name: "TestBroken"}}, results.Failures)
+}
+
+func TestMergeRerunNotReported(t *testing.T) {
+	results := &core.TestResults{
+		NumTests: 2,
+		Passed:   1,
+		Failed:   1,
+		Failures: []core.TestFailure{{Name: "TestFlaky"}},
+	}
+	rerun := &core.TestResults{
+		NumTests: 1,
+		Failed:   1,
+		Failures: []core.TestFailure{{Name: "Test failed with no results"}},
+	}
+	mergeRerun(results, rerun, false)
+	assert.Equal(t, 1, results.Failed)
+	assert.Equal(t, 0, len(results.Flaky))
+	assert.Equal(t, []core.TestFailure{{Name: "TestFlaky"}}, results.Failures)
+}
+
+func TestMergeRerunMatchedNothing(t *testing.T) {
+	// The rerun's filter didn't match anything, so it ran nothing and succeeded.
+	results := &core.TestResults{
+		NumTests: 2,
+		Passed:   1,
+		Failed:   1,
+		Failures: []core.TestFailure{{Name: "TestFlaky"}},
+	}
+	mergeRerun(results, &core.TestResults{}, true)
+	assert.Equal(t, 1, results.Failed)
+	assert.Equal(t, 1, results.Passed)
+	assert.Equal(t, 0, len(results.Flaky))
+	assert.Equal(t, []core.TestFailure{{Name: "TestFlaky"}}, results.Failures)
+}
+
+func TestMergeRerunMissingCase(t *testing.T) {
+	// Only one of the two cases was reported; the other one's original failure should stand.
+	results := &core.TestResults{
+		NumTests: 3,
+		Passed:   1,
+		Failed:   2,
+		Failures: []core.TestFailure{{Name: "TestFlaky"}, {Name: "TestMissing"}},
+	}
+	rerun := &core.TestResults{
+		NumTests: 1,
+		Passed:   1,
+		Passes:   []string{"TestFlaky"},
+	}
+	mergeRerun(results, rerun, true)
+	assert.Equal(t, 1, results.Failed)
+	assert.Equal(t, []string{"TestFlaky"}, results.Flaky)
+	assert.Equal(t, []core.TestFailure{{Name: "TestMissing"}}, results.Failures)
+}
+
+func TestMergeRerunUnknownCase(t *testing.T) {
+	results := &core.TestResults{
+		NumTests: 2,
+		Passed:   1,
+		Failed:   1,
+		Failures: []core.TestFailure{{Name: "TestFlaky"}},
+	}
+	rerun := &core.TestResults{
+		NumTests: 1,
+		Passed:   1,
+		Passes:   []string{"TestSomethingElse"},
+	}
+	mergeRerun(results, rerun, true)
+	assert.Equal(t, 1, results.Failed)
+	assert.Equal(t, 0, len(results.Flaky))
+}
+
+func TestMergeRerunClassNames(t *testing.T) {
+	// JUnit results name failures by class but not passes.
+	results := &core.TestResults{
+		NumTests: 2,
+		Passed:   1,
+		Failed:   1,
+		Failures: []core.TestFailure{{Name: "FooTest.testFlaky"}},
+	}
+	rerun := &core.TestResults{
+		NumTests: 1,
+		Passed:   1,
+		Passes:   []string{"testFlaky"},
+	}
+	mergeRerun(results, rerun, true)
+	assert.Equal(t, 0, results.Failed)
+	assert.Equal(t, []string{"FooTest.testFlaky"}, results.Flaky)
+}
+
+func TestRerunTests(t *testing.T) {
+	state := core.NewBuildState(1, nil, 1, core.DefaultConfiguration())
+	results := &core.TestResults{
+		Failed:   2,
+		Failures: []core.TestFailure{{Name: "TestFlaky"}, {Name: "TestBroken"}},
+	}
+	assert.Equal(t, []string{"TestFlaky", "TestBroken"}, rerunTests(state, results, 1, true))
+	// Can't rerun individual cases if the test didn't report them properly.
+	assert.Nil(t, rerunTests(state, results, 1, false))
+	// Multiple runs were requested, so each one should be a full run.
+	assert.Nil(t, rerunTests(state, results, 3, true))
+	// Failures not attributed to a test case need a full rerun.
+	results.Failed = 3
+	assert.Nil(t, rerunTests(state, results, 1, true))
+}
@@ -93,6 +93,7 @@ type JUnitXMLTest struct {
 	Name       string           `xml:"name,attr"`
 	Failure    *JUnitXMLFailure `xml:"failure,omitempty"`
 	Error      *JUnitXMLFailure `xml:"error,omitempty"`
+	Skipped    *JUnitXMLFailure `xml:"skipped,omitempty"`
 	Time       float64          `xml:"time,attr,omitempty"`
 	Type       string           `xml:"type,attr,omitempty"`
 	Success    string           `xml:"success,attr,omitempty"`
@@ -136,6 +137,19 @@ func WriteResultsToFileOrDie(graph *core.BuildGraph, filename string) {
 					},
 				})
 			}
+			// Quarantined tests are reported as skipped so they don't fail anything reading this.
+			for _, fail := range target.Results.QuarantinedTests {
+				suite.TestCases = append(suite.TestCases, JUnitXMLTest{
+					Name:   fail.Name,
+					Stdout: fail.Stdout,
+					Stderr: fail.Stderr,
+					Skipped: &JUnitXMLFailure{
+						Message:   "Quarantined",
+						Type:      fail.Type,
+						Traceback: fail.Traceback,
+					},
+				})
+			}
 			results.TestSuites = append(results.TestSuites, suite)
 		}
 	}
@@ -75,7 +75,9 @@ func runBuild(state *core.BuildState, command string, labels []core.BuildLabel)
 		binary = "plz"
 	}
 	cmd := exec.Command(binary, command)
-	cmd.Args = append(cmd.Args, "-c", state.Config.Build.Config)
+	for _, config := range state.Configs() {
+		cmd.Args = append(cmd.Args, "-c", config)
+	}
 	for _, label := range labels {
 		cmd.Args = append(cmd.Args, label.String())
 	}
@@ -122,7 +124,7 @@ func startWatching(watcher *fsnotify.Watcher, state *core.BuildState, labels []c
 		for _, dep := range target.Dependencies() {
 			startWatch(dep)
 		}
-		pkg := state.Graph.PackageOrDie(target.Label.PackageName)
+		pkg := state.Graph.PackageOrDie(target.Label)
 		if !files.Has(pkg.Filename) {
 			log.Notice("Adding watch on %s", pkg.Filename)
 			files.Set(pkg.Filename, struct{}{})
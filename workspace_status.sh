@@ -0,0 +1,11 @@
+#!/bin/bash
+# Workspace status command used to stamp binaries built from this repo; see [build] in .plzconfig.
+
+echo "STABLE_GIT_COMMIT $(git rev-parse HEAD 2>/dev/null)"
+if git diff --quiet HEAD 2>/dev/null; then
+    echo "STABLE_GIT_DIRTY false"
+else
+    echo "STABLE_GIT_DIRTY true"
+fi
+echo "BUILD_USER $(id -un)"
+echo "BUILD_TIMESTAMP $(date +%s)"